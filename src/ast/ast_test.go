@@ -1,6 +1,7 @@
 package ast
 
 import (
+	"fmt"
 	"monkey/token"
 	"reflect"
 	"testing"
@@ -59,22 +60,45 @@ func TestStringIfExpression(t *testing.T) {
 	}
 }
 
+func TestStringHashMapLiteral(t *testing.T) {
+	key := func(value string, column int) Expression {
+		return &StringLiteral{Token: token.Token{Type: token.STRING, Literal: value, LineNumber: 1, ColumnNumber: column}, Value: value}
+	}
+	integer := func(value int64) Expression {
+		return &IntegerLiteral{Token: token.Token{Type: token.INT, Literal: fmt.Sprint(value)}, Value: value}
+	}
+
+	hml := &HashMapLiteral{KVPairs: map[Expression]Expression{
+		key("c", 1):  integer(1),
+		key("a", 9):  integer(2),
+		key("b", 17): integer(3),
+	}}
+
+	// Pairs are listed in the order in which their keys appear in the source code
+	expected := "{c: 1, a: 2, b: 3}"
+	for i := 0; i < 10; i++ {
+		if hml.String() != expected {
+			t.Fatalf("hml.String() is wrong. expected=%q, got=%q", expected, hml.String())
+		}
+	}
+}
+
 func TestModify(t *testing.T) {
 	one := func() Expression { return &IntegerLiteral{Value: 1} }
 	two := func() Expression { return &IntegerLiteral{Value: 2} }
 
-	turnOneIntoTwo := func(node Node) Node {
+	turnOneIntoTwo := func(node Node) (Node, error) {
 		integer, ok := node.(*IntegerLiteral)
 		if !ok {
-			return node
+			return node, nil
 		}
 
 		if integer.Value != 1 {
-			return node
+			return node, nil
 		}
 
 		integer.Value = 2
-		return integer
+		return integer, nil
 	}
 
 	tests := []struct {
@@ -179,10 +203,69 @@ func TestModify(t *testing.T) {
 			&IndexExpression{Left: one(), Index: one()},
 			&IndexExpression{Left: two(), Index: two()},
 		},
+		{
+			&SetLiteral{Elements: []Expression{one(), two()}},
+			&SetLiteral{Elements: []Expression{two(), two()}},
+		},
+		{
+			&CallExpression{Function: &Identifier{Value: "f"}, Arguments: []Expression{one(), one()}},
+			&CallExpression{Function: &Identifier{Value: "f"}, Arguments: []Expression{two(), two()}},
+		},
+		{
+			&ConstStatement{Name: &Identifier{Value: "x"}, Value: one()},
+			&ConstStatement{Name: &Identifier{Value: "x"}, Value: two()},
+		},
+		{
+			&AssignStatement{Name: &Identifier{Value: "x"}, Value: one()},
+			&AssignStatement{Name: &Identifier{Value: "x"}, Value: two()},
+		},
+		{
+			&WhileLoop{Condition: one(), Body: &BlockStatement{Statements: []Statement{&ExpressionStatement{Expression: one()}}}},
+			&WhileLoop{Condition: two(), Body: &BlockStatement{Statements: []Statement{&ExpressionStatement{Expression: two()}}}},
+		},
+		{
+			&ForLoop{
+				Init:         &LetStatement{Name: &Identifier{Value: "i"}, Value: one()},
+				Condition:    one(),
+				Afterthought: &AssignStatement{Name: &Identifier{Value: "i"}, Value: one()},
+				Body:         &BlockStatement{Statements: []Statement{&ExpressionStatement{Expression: one()}}},
+			},
+			&ForLoop{
+				Init:         &LetStatement{Name: &Identifier{Value: "i"}, Value: two()},
+				Condition:    two(),
+				Afterthought: &AssignStatement{Name: &Identifier{Value: "i"}, Value: two()},
+				Body:         &BlockStatement{Statements: []Statement{&ExpressionStatement{Expression: two()}}},
+			},
+		},
+		{
+			&SwitchStatement{
+				SwitchExpression: one(),
+				Cases:            []SwitchCase{{Expression: one(), Consequence: &BlockStatement{Statements: []Statement{&ExpressionStatement{Expression: one()}}}}},
+				Default:          &BlockStatement{Statements: []Statement{&ExpressionStatement{Expression: one()}}},
+			},
+			&SwitchStatement{
+				SwitchExpression: two(),
+				Cases:            []SwitchCase{{Expression: two(), Consequence: &BlockStatement{Statements: []Statement{&ExpressionStatement{Expression: two()}}}}},
+				Default:          &BlockStatement{Statements: []Statement{&ExpressionStatement{Expression: two()}}},
+			},
+		},
+		{
+			&FunctionDeclaration{
+				Name:     &Identifier{Value: "f"},
+				Function: &FunctionLiteral{Parameters: []*Identifier{}, Body: &BlockStatement{Statements: []Statement{&ReturnStatement{ReturnValue: one()}}}},
+			},
+			&FunctionDeclaration{
+				Name:     &Identifier{Value: "f"},
+				Function: &FunctionLiteral{Parameters: []*Identifier{}, Body: &BlockStatement{Statements: []Statement{&ReturnStatement{ReturnValue: two()}}}},
+			},
+		},
 	}
 
 	for _, test := range tests {
-		modified := Modify(test.input, turnOneIntoTwo)
+		modified, err := Modify(test.input, turnOneIntoTwo)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
 		equal := reflect.DeepEqual(modified, test.expected)
 		if !equal {
 			t.Errorf("not equal. expected=%#v, got=%#v", test.expected, modified)
@@ -195,7 +278,10 @@ func TestModify(t *testing.T) {
 			one(): one(),
 		},
 	}
-	Modify(hashmapLiteral, turnOneIntoTwo)
+	_, err := Modify(hashmapLiteral, turnOneIntoTwo)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
 	for key, val := range hashmapLiteral.KVPairs {
 		key, _ := key.(*IntegerLiteral)
 		if key.Value != 2 {
@@ -207,3 +293,99 @@ func TestModify(t *testing.T) {
 		}
 	}
 }
+
+func TestModifyErrors(t *testing.T) {
+	one := &IntegerLiteral{Token: token.Token{Type: token.INT, Literal: "1", LineNumber: 2, ColumnNumber: 7}, Value: 1}
+
+	tests := []struct {
+		input         Node
+		modifier      ModifierFunc
+		expectedError string
+	}{
+		{
+			&ExpressionStatement{Expression: one},
+			func(node Node) (Node, error) {
+				if _, ok := node.(*IntegerLiteral); ok {
+					return &LetStatement{Token: token.Token{Type: token.LET, Literal: "let"}, Name: &Identifier{Value: "x"}, Value: &Identifier{Value: "y"}}, nil
+				}
+				return node, nil
+			},
+			`line 2, column 7: expected expression in place of "1", got let x = y;`,
+		},
+		{
+			&BlockStatement{Statements: []Statement{&ExpressionStatement{Token: one.Token, Expression: one}}},
+			func(node Node) (Node, error) {
+				if _, ok := node.(*ExpressionStatement); ok {
+					return one, nil
+				}
+				return node, nil
+			},
+			`line 2, column 7: expected statement in place of "1", got 1`,
+		},
+		{
+			&CallExpression{Function: &Identifier{Value: "f"}, Arguments: []Expression{one}},
+			func(node Node) (Node, error) {
+				if _, ok := node.(*IntegerLiteral); ok {
+					return nil, nil
+				}
+				return node, nil
+			},
+			`line 2, column 7: expected expression in place of "1", got nothing`,
+		},
+		{
+			&ArrayLiteral{Elements: []Expression{one}},
+			func(node Node) (Node, error) {
+				if _, ok := node.(*IntegerLiteral); ok {
+					return nil, fmt.Errorf("cannot modify %s", node)
+				}
+				return node, nil
+			},
+			`cannot modify 1`,
+		},
+	}
+
+	for _, test := range tests {
+		_, err := Modify(test.input, test.modifier)
+		if err == nil {
+			t.Fatalf("expected error %q, got none", test.expectedError)
+		}
+		if err.Error() != test.expectedError {
+			t.Errorf("wrong error. expected=%q, got=%q", test.expectedError, err.Error())
+		}
+	}
+}
+
+func TestCopy(t *testing.T) {
+	original := &Program{
+		Statements: []Statement{
+			&LetStatement{
+				Token: token.Token{Type: token.LET, Literal: "let"},
+				Name:  &Identifier{Token: token.Token{Type: token.IDENT, Literal: "x"}, Value: "x"},
+				Value: &CallExpression{
+					Function:  &Identifier{Token: token.Token{Type: token.IDENT, Literal: "f"}, Value: "f"},
+					Arguments: []Expression{&IntegerLiteral{Token: token.Token{Type: token.INT, Literal: "1"}, Value: 1}},
+				},
+			},
+		},
+	}
+
+	copied := Copy(original)
+	if copied.String() != original.String() {
+		t.Fatalf("copy is not equal to original. expected=%q, got=%q", original.String(), copied.String())
+	}
+
+	_, err := Modify(copied, func(node Node) (Node, error) {
+		if integer, ok := node.(*IntegerLiteral); ok {
+			return &IntegerLiteral{Token: token.Token{Type: token.INT, Literal: "2"}, Value: integer.Value + 1}, nil
+		}
+		return node, nil
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	expected := "let x = f(1);"
+	if original.String() != expected {
+		t.Errorf("modifying the copy changed the original. expected=%q, got=%q", expected, original.String())
+	}
+}
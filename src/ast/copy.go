@@ -0,0 +1,189 @@
+package ast
+
+// Returns a deep copy of the given AST node, so that the copy can be modified (e.g. via `Modify`) without affecting
+// the original node. Tokens and type annotations, which are never modified, are shared with the original.
+func Copy(node Node) Node {
+	switch node := node.(type) {
+
+	case *Program:
+		return &Program{Statements: copyStatements(node.Statements)}
+
+	case *ExpressionStatement:
+		return &ExpressionStatement{Token: node.Token, Expression: copyExpression(node.Expression)}
+
+	case *LetStatement:
+		return &LetStatement{Token: node.Token, Name: copyIdentifier(node.Name), Type: node.Type, Value: copyExpression(node.Value)}
+
+	case *ConstStatement:
+		return &ConstStatement{Token: node.Token, Name: copyIdentifier(node.Name), Type: node.Type, Value: copyExpression(node.Value)}
+
+	case *AssignStatement:
+		return &AssignStatement{Token: node.Token, Name: copyIdentifier(node.Name), Value: copyExpression(node.Value)}
+
+	case *ReturnStatement:
+		return &ReturnStatement{Token: node.Token, ReturnValue: copyExpression(node.ReturnValue)}
+
+	case *DeferStatement:
+		return &DeferStatement{Token: node.Token, Call: copyExpression(node.Call)}
+
+	case *AssertStatement:
+		return &AssertStatement{Token: node.Token, Condition: copyExpression(node.Condition), Message: copyExpression(node.Message)}
+
+	case *BlockStatement:
+		return copyBlock(node)
+
+	case *FunctionDeclaration:
+		function, _ := Copy(node.Function).(*FunctionLiteral)
+		return &FunctionDeclaration{Token: node.Token, Name: copyIdentifier(node.Name), Function: function}
+
+	case *WhileLoop:
+		return &WhileLoop{Token: node.Token, Condition: copyExpression(node.Condition), Body: copyBlock(node.Body)}
+
+	case *ForLoop:
+		return &ForLoop{
+			Token:        node.Token,
+			Init:         copyStatement(node.Init),
+			Condition:    copyExpression(node.Condition),
+			Afterthought: copyStatement(node.Afterthought),
+			Body:         copyBlock(node.Body),
+		}
+
+	case *SwitchStatement:
+		cases := make([]SwitchCase, len(node.Cases))
+		for i, switchCase := range node.Cases {
+			cases[i] = SwitchCase{Expression: copyExpression(switchCase.Expression), Consequence: copyBlock(switchCase.Consequence)}
+		}
+		return &SwitchStatement{
+			Token:            node.Token,
+			SwitchExpression: copyExpression(node.SwitchExpression),
+			Cases:            cases,
+			Default:          copyBlock(node.Default),
+		}
+
+	case *Identifier:
+		return copyIdentifier(node)
+
+	case *IntegerLiteral:
+		return &IntegerLiteral{Token: node.Token, Value: node.Value}
+
+	case *Float:
+		return &Float{Token: node.Token, Value: node.Value}
+
+	case *Boolean:
+		return &Boolean{Token: node.Token, Value: node.Value}
+
+	case *StringLiteral:
+		return &StringLiteral{Token: node.Token, Value: node.Value}
+
+	case *PrefixExpression:
+		return &PrefixExpression{Token: node.Token, Operator: node.Operator, Right: copyExpression(node.Right)}
+
+	case *InfixExpression:
+		return &InfixExpression{
+			Token:    node.Token,
+			Left:     copyExpression(node.Left),
+			Operator: node.Operator,
+			Right:    copyExpression(node.Right),
+		}
+
+	case *IfExpression:
+		clauses := make([]ConditionalClause, len(node.Clauses))
+		for i, clause := range node.Clauses {
+			clauses[i] = ConditionalClause{Condition: copyExpression(clause.Condition), Consequence: copyBlock(clause.Consequence)}
+		}
+		return &IfExpression{Token: node.Token, Clauses: clauses, Alternative: copyBlock(node.Alternative)}
+
+	case *FunctionLiteral:
+		return &FunctionLiteral{
+			Token:          node.Token,
+			Name:           node.Name,
+			Parameters:     copyIdentifiers(node.Parameters),
+			ParameterTypes: node.ParameterTypes,
+			ReturnType:     node.ReturnType,
+			Body:           copyBlock(node.Body),
+		}
+
+	case *MacroLiteral:
+		return &MacroLiteral{Token: node.Token, Parameters: copyIdentifiers(node.Parameters), Body: copyBlock(node.Body)}
+
+	case *CallExpression:
+		return &CallExpression{Token: node.Token, Function: copyExpression(node.Function), Arguments: copyExpressions(node.Arguments)}
+
+	case *ArrayLiteral:
+		return &ArrayLiteral{Token: node.Token, Elements: copyExpressions(node.Elements)}
+
+	case *SetLiteral:
+		return &SetLiteral{Token: node.Token, Elements: copyExpressions(node.Elements)}
+
+	case *HashMapLiteral:
+		kvPairs := make(map[Expression]Expression, len(node.KVPairs))
+		for key, val := range node.KVPairs {
+			kvPairs[copyExpression(key)] = copyExpression(val)
+		}
+		return &HashMapLiteral{Token: node.Token, KVPairs: kvPairs}
+
+	case *IndexExpression:
+		return &IndexExpression{Token: node.Token, Left: copyExpression(node.Left), Index: copyExpression(node.Index)}
+
+	}
+
+	return node
+}
+
+func copyStatement(statement Statement) Statement {
+	if statement == nil {
+		return nil
+	}
+	copied, _ := Copy(statement).(Statement)
+	return copied
+}
+
+func copyStatements(statements []Statement) []Statement {
+	copied := make([]Statement, len(statements))
+	for i, statement := range statements {
+		copied[i] = copyStatement(statement)
+	}
+	return copied
+}
+
+func copyExpression(expression Expression) Expression {
+	if expression == nil {
+		return nil
+	}
+	copied, _ := Copy(expression).(Expression)
+	return copied
+}
+
+func copyExpressions(expressions []Expression) []Expression {
+	copied := make([]Expression, len(expressions))
+	for i, expression := range expressions {
+		copied[i] = copyExpression(expression)
+	}
+	return copied
+}
+
+func copyBlock(block *BlockStatement) *BlockStatement {
+	if block == nil {
+		return nil
+	}
+	return &BlockStatement{Token: block.Token, Statements: copyStatements(block.Statements)}
+}
+
+func copyIdentifier(identifier *Identifier) *Identifier {
+	if identifier == nil {
+		return nil
+	}
+	copied := &Identifier{Token: identifier.Token, Value: identifier.Value}
+	if identifier.Unquote != nil {
+		copied.Unquote = Copy(identifier.Unquote).(*CallExpression)
+	}
+	return copied
+}
+
+func copyIdentifiers(identifiers []*Identifier) []*Identifier {
+	copied := make([]*Identifier, len(identifiers))
+	for i, identifier := range identifiers {
+		copied[i] = copyIdentifier(identifier)
+	}
+	return copied
+}
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"fmt"
 	"monkey/token"
+	"sort"
 	"strings"
 )
 
@@ -50,8 +51,8 @@ func (hml *HashMapLiteral) String() string {
 	var out bytes.Buffer
 
 	pairs := []string{}
-	for k, v := range hml.KVPairs {
-		pairs = append(pairs, k.String()+": "+v.String())
+	for _, k := range hml.SortedKeys() {
+		pairs = append(pairs, k.String()+": "+hml.KVPairs[k].String())
 	}
 
 	out.WriteString("{")
@@ -61,6 +62,55 @@ func (hml *HashMapLiteral) String() string {
 	return out.String()
 }
 
+// Returns the keys of the hashmap in the order in which they appear in the source code, since the pairs of a hashmap
+// literal are stored unordered.
+func (hml *HashMapLiteral) SortedKeys() []Expression {
+	keys := make([]Expression, 0, len(hml.KVPairs))
+	for key := range hml.KVPairs {
+		keys = append(keys, key)
+	}
+
+	sort.SliceStable(keys, func(i, j int) bool {
+		a, b := TokenOf(keys[i]), TokenOf(keys[j])
+		if a.LineNumber != b.LineNumber {
+			return a.LineNumber < b.LineNumber
+		}
+		if a.ColumnNumber != b.ColumnNumber {
+			return a.ColumnNumber < b.ColumnNumber
+		}
+		return keys[i].String() < keys[j].String()
+	})
+
+	return keys
+}
+
+// Represents a set in the form #{<expression>, ...}.
+type SetLiteral struct {
+	Token    token.Token // the '#{' token
+	Elements []Expression
+}
+
+func (sl *SetLiteral) expressionNode() {}
+
+func (sl *SetLiteral) TokenLiteral() string {
+	return sl.Token.Literal
+}
+
+func (sl *SetLiteral) String() string {
+	var out bytes.Buffer
+
+	elements := []string{}
+	for _, el := range sl.Elements {
+		elements = append(elements, el.String())
+	}
+
+	out.WriteString("#{")
+	out.WriteString(strings.Join(elements, ", "))
+	out.WriteString("}")
+
+	return out.String()
+}
+
 // Represents an index expression in the form "<expression>[<expression>]".
 type IndexExpression struct {
 	Token token.Token // the '[' token
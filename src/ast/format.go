@@ -0,0 +1,330 @@
+package ast
+
+import (
+	"bytes"
+	"strings"
+)
+
+// The indentation used for each level of nesting by `Format`.
+const formatIndent = "    "
+
+// Returns the source code of the given node, pretty-printed with one statement per line and with the contents of
+// blocks indented. Unlike `String`, the output is valid Monkey code which parses back into an equivalent AST (except
+// for identifiers generated during macro expansion, which are deliberately not valid in source code).
+func Format(node Node) string {
+	f := &formatter{}
+	f.formatNode(node)
+	return strings.TrimSuffix(f.out.String(), "\n")
+}
+
+type formatter struct {
+	out   bytes.Buffer
+	depth int
+}
+
+func (f *formatter) write(strs ...string) {
+	for _, str := range strs {
+		f.out.WriteString(str)
+	}
+}
+
+func (f *formatter) newline() {
+	f.out.WriteString("\n")
+	f.out.WriteString(strings.Repeat(formatIndent, f.depth))
+}
+
+func (f *formatter) formatNode(node Node) {
+	switch node := node.(type) {
+	case *Program:
+		for i, statement := range node.Statements {
+			if i > 0 {
+				f.newline()
+			}
+			f.formatStatement(statement, nextStatement(node.Statements, i))
+		}
+	case *BlockStatement:
+		f.formatBlock(node)
+	case Statement:
+		f.formatStatement(node, nil)
+	case Expression:
+		f.formatExpression(node, false)
+	}
+}
+
+// Formats a statement, given the statement following it (if any) in the same block.
+func (f *formatter) formatStatement(statement Statement, next Statement) {
+	switch statement := statement.(type) {
+	case *ExpressionStatement:
+		f.formatExpression(statement.Expression, false)
+		if !endsWithBlock(statement.Expression) || continuesExpression(next) {
+			f.write(";")
+		}
+
+	case *FunctionDeclaration:
+		f.write("fn ", statement.Name.Value)
+		f.formatSignatureAndBody(statement.Function.Parameters, statement.Function.ParameterTypes, statement.Function.ReturnType, statement.Function.Body)
+
+	case *BlockStatement:
+		f.formatBlock(statement)
+
+	default:
+		f.formatSimpleStatement(statement)
+		f.write(";")
+	}
+}
+
+// Formats a statement which fits on a single line, without its terminating semicolon.
+func (f *formatter) formatSimpleStatement(statement Statement) {
+	switch statement := statement.(type) {
+	case *LetStatement:
+		f.formatBinding("let", statement.Name, statement.Type, statement.Value)
+	case *ConstStatement:
+		f.formatBinding("const", statement.Name, statement.Type, statement.Value)
+	case *AssignStatement:
+		f.write(statement.Name.Value, " = ")
+		f.formatExpression(statement.Value, false)
+	case *ReturnStatement:
+		f.write("return")
+		if statement.ReturnValue != nil {
+			f.write(" ")
+			f.formatExpression(statement.ReturnValue, false)
+		}
+	case *DeferStatement:
+		f.write("defer ")
+		f.formatExpression(statement.Call, false)
+	case *AssertStatement:
+		f.write("assert ")
+		f.formatExpression(statement.Condition, false)
+		if statement.Message != nil {
+			f.write(", ")
+			f.formatExpression(statement.Message, false)
+		}
+	case *ExpressionStatement:
+		f.formatExpression(statement.Expression, false)
+	default:
+		f.write(statement.String())
+	}
+}
+
+// Reports whether the expression is a compound expression ending in a block, which doesn't need to be followed by a
+// semicolon when used as a statement.
+func endsWithBlock(expression Expression) bool {
+	switch expression.(type) {
+	case *IfExpression, *WhileLoop, *ForLoop, *SwitchStatement:
+		return true
+	}
+	return false
+}
+
+// Reports whether the statement starts with a token which, following a compound expression ending in a block, would
+// be parsed as continuing that expression (as an index or call), in which case the compound expression needs to be
+// terminated with a semicolon.
+func continuesExpression(statement Statement) bool {
+	if statement == nil {
+		return false
+	}
+	formatted := Format(statement)
+	return strings.HasPrefix(formatted, "[") || strings.HasPrefix(formatted, "(")
+}
+
+func (f *formatter) formatBinding(keyword string, name *Identifier, annotation *TypeAnnotation, value Expression) {
+	f.write(keyword, " ", name.String())
+	if annotation != nil {
+		f.write(": ", annotation.String())
+	}
+	f.write(" = ")
+	f.formatExpression(value, false)
+}
+
+func (f *formatter) formatBlock(block *BlockStatement) {
+	if block == nil || len(block.Statements) == 0 {
+		f.write("{}")
+		return
+	}
+
+	f.write("{")
+	f.formatIndentedStatements(block.Statements)
+	f.newline()
+	f.write("}")
+}
+
+func (f *formatter) formatIndentedStatements(statements []Statement) {
+	f.depth++
+	for i, statement := range statements {
+		f.newline()
+		f.formatStatement(statement, nextStatement(statements, i))
+	}
+	f.depth--
+}
+
+func nextStatement(statements []Statement, i int) Statement {
+	if i+1 < len(statements) {
+		return statements[i+1]
+	}
+	return nil
+}
+
+// Formats an expression. Operator expressions nested within other operator expressions are parenthesized, so that
+// the output doesn't depend on operator precedence.
+func (f *formatter) formatExpression(expression Expression, nested bool) {
+	switch expression := expression.(type) {
+	case *StringLiteral:
+		f.write(`"`, expression.Value, `"`)
+
+	case *PrefixExpression:
+		if nested {
+			f.write("(")
+		}
+		f.write(expression.Operator)
+		f.formatExpression(expression.Right, true)
+		if nested {
+			f.write(")")
+		}
+
+	case *InfixExpression:
+		if nested {
+			f.write("(")
+		}
+		f.formatExpression(expression.Left, true)
+		f.write(" ", expression.Operator, " ")
+		f.formatExpression(expression.Right, true)
+		if nested {
+			f.write(")")
+		}
+
+	case *IfExpression:
+		for i, clause := range expression.Clauses {
+			if i > 0 {
+				f.write(" else ")
+			}
+			f.write("if (")
+			f.formatExpression(clause.Condition, false)
+			f.write(") ")
+			f.formatBlock(clause.Consequence)
+		}
+		if expression.Alternative != nil {
+			f.write(" else ")
+			f.formatBlock(expression.Alternative)
+		}
+
+	case *WhileLoop:
+		f.write("while (")
+		f.formatExpression(expression.Condition, false)
+		f.write(") ")
+		f.formatBlock(expression.Body)
+
+	case *ForLoop:
+		f.write("for (")
+		f.formatSimpleStatement(expression.Init)
+		f.write("; ")
+		f.formatExpression(expression.Condition, false)
+		f.write("; ")
+		f.formatSimpleStatement(expression.Afterthought)
+		f.write(") ")
+		f.formatBlock(expression.Body)
+
+	case *SwitchStatement:
+		f.write("switch ")
+		f.formatExpression(expression.SwitchExpression, false)
+		f.write(" {")
+		for _, switchCase := range expression.Cases {
+			f.newline()
+			f.write("case ")
+			f.formatExpression(switchCase.Expression, false)
+			f.write(":")
+			f.formatIndentedStatements(switchCase.Consequence.Statements)
+		}
+		if expression.Default != nil {
+			f.newline()
+			f.write("default:")
+			f.formatIndentedStatements(expression.Default.Statements)
+		}
+		f.newline()
+		f.write("}")
+
+	case *FunctionLiteral:
+		f.write("fn")
+		f.formatSignatureAndBody(expression.Parameters, expression.ParameterTypes, expression.ReturnType, expression.Body)
+
+	case *MacroLiteral:
+		f.write("macro")
+		f.formatSignatureAndBody(expression.Parameters, nil, nil, expression.Body)
+
+	case *CallExpression:
+		if _, ok := expression.Function.(*FunctionLiteral); ok {
+			f.write("(")
+			f.formatExpression(expression.Function, false)
+			f.write(")")
+		} else {
+			f.formatExpression(expression.Function, true)
+		}
+		f.write("(")
+		f.formatExpressionList(expression.Arguments)
+		f.write(")")
+
+	case *IndexExpression:
+		f.formatExpression(expression.Left, true)
+		f.write("[")
+		f.formatExpression(expression.Index, false)
+		f.write("]")
+
+	case *ArrayLiteral:
+		f.write("[")
+		f.formatExpressionList(expression.Elements)
+		f.write("]")
+
+	case *SetLiteral:
+		f.write("#{")
+		f.formatExpressionList(expression.Elements)
+		f.write("}")
+
+	case *HashMapLiteral:
+		f.formatHashMapLiteral(expression)
+
+	case nil:
+
+	default:
+		f.write(expression.String())
+	}
+}
+
+func (f *formatter) formatExpressionList(expressions []Expression) {
+	for i, expression := range expressions {
+		if i > 0 {
+			f.write(", ")
+		}
+		f.formatExpression(expression, false)
+	}
+}
+
+func (f *formatter) formatSignatureAndBody(params []*Identifier, paramTypes []*TypeAnnotation, returnType *TypeAnnotation, body *BlockStatement) {
+	f.write("(")
+	for i, param := range params {
+		if i > 0 {
+			f.write(", ")
+		}
+		f.write(param.String())
+		if i < len(paramTypes) && paramTypes[i] != nil {
+			f.write(": ", paramTypes[i].String())
+		}
+	}
+	f.write(")")
+	if returnType != nil {
+		f.write(": ", returnType.String())
+	}
+	f.write(" ")
+	f.formatBlock(body)
+}
+
+func (f *formatter) formatHashMapLiteral(hashmap *HashMapLiteral) {
+	f.write("{")
+	for i, key := range hashmap.SortedKeys() {
+		if i > 0 {
+			f.write(", ")
+		}
+		f.formatExpression(key, false)
+		f.write(": ")
+		f.formatExpression(hashmap.KVPairs[key], false)
+	}
+	f.write("}")
+}
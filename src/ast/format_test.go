@@ -0,0 +1,74 @@
+package ast_test
+
+import (
+	"monkey/ast"
+	"monkey/lexer"
+	"monkey/parser"
+	"testing"
+)
+
+func TestFormat(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{
+			`let x = 1 + 2 * 3; const y: int | string = -x;`,
+			"let x = 1 + (2 * 3);\nconst y: int | string = -x;",
+		},
+		{
+			`let add = fn(a: int, b): int { return a + b; }; add(1, 2)`,
+			"let add = fn(a: int, b): int {\n    return a + b;\n};\nadd(1, 2);",
+		},
+		{
+			`fn f(x) { if (x > 1) { x } else if (x < -1) { -x } else { 0 } }`,
+			"fn f(x) {\n    if (x > 1) {\n        x;\n    } else if (x < (-1)) {\n        -x;\n    } else {\n        0;\n    }\n}",
+		},
+		{
+			`let i = 0; while (i < 3) { i = i + 1; }; for (let j = 0; j < 3; j++) { puts([j], #{j}, {"j": j}[j]); }`,
+			"let i = 0;\nwhile (i < 3) {\n    i = i + 1;\n}\nfor (let j = 0; j < 3; j = j + 1) {\n    puts([j], #{j}, {\"j\": j}[j]);\n}",
+		},
+		{
+			`switch x { case 1: puts("one"); default: puts("other") }`,
+			"switch x {\ncase 1:\n    puts(\"one\");\ndefault:\n    puts(\"other\");\n}",
+		},
+		{
+			`if (x) { 1 }; [1, 2]; let m = macro(a) { quote(unquote(a)) }; fn() {}()`,
+			"if (x) {\n    1;\n};\n[1, 2];\nlet m = macro(a) {\n    quote(unquote(a));\n};\n(fn() {})();",
+		},
+		{
+			`fn f() { defer puts("done"); 1 }`,
+			"fn f() {\n    defer puts(\"done\");\n    1;\n}",
+		},
+		{
+			`assert x > 0, "positive"; assert y`,
+			"assert x > 0, \"positive\";\nassert y;",
+		},
+	}
+
+	for _, test := range tests {
+		program := parse(t, test.input)
+		formatted := ast.Format(program)
+		if formatted != test.expected {
+			t.Errorf("wrong formatted output for input %q.\nexpected=\n%s\ngot=\n%s", test.input, test.expected, formatted)
+		}
+
+		// The formatted output should parse back into an equivalent program
+		reformatted := ast.Format(parse(t, formatted))
+		if reformatted != formatted {
+			t.Errorf("formatted output doesn't parse back into an equivalent program.\nexpected=\n%s\ngot=\n%s", formatted, reformatted)
+		}
+	}
+}
+
+func parse(t *testing.T, input string) *ast.Program {
+	t.Helper()
+
+	l := lexer.NewLexer(input)
+	p := parser.NewParser(l)
+	program := p.ParseProgram()
+	if len(p.Errors()) != 0 {
+		t.Fatalf("parser errors for input %q: %v", input, p.Errors())
+	}
+	return program
+}
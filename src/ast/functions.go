@@ -9,10 +9,12 @@ import (
 
 // Represents a function literal in the form "fn <parameters> <block statement>".
 type FunctionLiteral struct {
-	Token      token.Token // the 'fn' token
-	Name       string
-	Parameters []*Identifier
-	Body       *BlockStatement
+	Token          token.Token // the 'fn' token
+	Name           string
+	Parameters     []*Identifier
+	ParameterTypes []*TypeAnnotation // parallel to Parameters, with nil entries for unannotated parameters
+	ReturnType     *TypeAnnotation   // nil if the return type isn't annotated
+	Body           *BlockStatement
 }
 
 func (fl *FunctionLiteral) expressionNode() {}
@@ -24,23 +26,58 @@ func (fl *FunctionLiteral) TokenLiteral() string {
 func (fl *FunctionLiteral) String() string {
 	var out bytes.Buffer
 
-	params := []string{}
-	for _, p := range fl.Parameters {
-		params = append(params, p.String())
-	}
-
 	out.WriteString(fl.TokenLiteral())
 	if fl.Name != "" {
 		out.WriteString(fmt.Sprintf("<%s>", fl.Name))
 	}
+	out.WriteString(fl.signatureAndBody())
+
+	return out.String()
+}
+
+// Returns the parenthesized parameters of the function, its return type annotation (if any), and its body.
+func (fl *FunctionLiteral) signatureAndBody() string {
+	var out bytes.Buffer
+
+	params := []string{}
+	for i, p := range fl.Parameters {
+		if i < len(fl.ParameterTypes) && fl.ParameterTypes[i] != nil {
+			params = append(params, p.String()+": "+fl.ParameterTypes[i].String())
+		} else {
+			params = append(params, p.String())
+		}
+	}
+
 	out.WriteString("(")
 	out.WriteString(strings.Join(params, ", "))
-	out.WriteString(") ")
+	out.WriteString(")")
+	if fl.ReturnType != nil {
+		out.WriteString(": " + fl.ReturnType.String())
+	}
+	out.WriteString(" ")
 	out.WriteString(fl.Body.String())
 
 	return out.String()
 }
 
+// Represents a named function declaration in the form "fn <identifier> <parameters> <block statement>". Function
+// declarations are hoisted to the top of the block (or program) containing them.
+type FunctionDeclaration struct {
+	Token    token.Token // the 'fn' token
+	Name     *Identifier
+	Function *FunctionLiteral
+}
+
+func (fd *FunctionDeclaration) statementNode() {}
+
+func (fd *FunctionDeclaration) TokenLiteral() string {
+	return fd.Token.Literal
+}
+
+func (fd *FunctionDeclaration) String() string {
+	return fd.TokenLiteral() + " " + fd.Name.String() + fd.Function.signatureAndBody()
+}
+
 // Represents a call expression (calling a function) in the form "<expression>(<comma-separated expressions>)".
 type CallExpression struct {
 	Token     token.Token // the '(' token
@@ -1,74 +1,380 @@
 package ast
 
-// Represents a function that optionally modifies an AST node in some way.
-type ModifierFunc func(Node) Node
+import (
+	"fmt"
+	"monkey/token"
+)
+
+// Represents a function that optionally modifies an AST node in some way, or reports an error.
+type ModifierFunc func(Node) (Node, error)
+
+// Traverses the AST rooted at the given node depth-first, replacing each node with the result of calling the
+// modifier on it (after its children have been modified). Returns an error if the modifier returns one, or if it
+// replaces a node with a node of the wrong kind, e.g. an expression with a statement.
+func Modify(node Node, modifier ModifierFunc) (Node, error) {
+	var err error
 
-func Modify(node Node, modifier ModifierFunc) Node {
 	switch node := node.(type) {
 
 	case *Program:
-		for i, statement := range node.Statements {
-			node.Statements[i], _ = Modify(statement, modifier).(Statement)
-		}
+		err = modifyStatements(node.Statements, modifier)
 
 	case *ExpressionStatement:
-		node.Expression, _ = Modify(node.Expression, modifier).(Expression)
+		node.Expression, err = modifyExpression(node.Expression, modifier)
 
 	case *PrefixExpression:
-		node.Right, _ = Modify(node.Right, modifier).(Expression)
+		node.Right, err = modifyExpression(node.Right, modifier)
 
 	case *InfixExpression:
-		node.Left, _ = Modify(node.Left, modifier).(Expression)
-		node.Right, _ = Modify(node.Right, modifier).(Expression)
+		if node.Left, err = modifyExpression(node.Left, modifier); err != nil {
+			return nil, err
+		}
+		node.Right, err = modifyExpression(node.Right, modifier)
 
 	case *LetStatement:
-		node.Value, _ = Modify(node.Value, modifier).(Expression)
+		if node.Name, err = modifyIdentifier(node.Name, modifier); err != nil {
+			return nil, err
+		}
+		node.Value, err = modifyExpression(node.Value, modifier)
+
+	case *ConstStatement:
+		if node.Name, err = modifyIdentifier(node.Name, modifier); err != nil {
+			return nil, err
+		}
+		node.Value, err = modifyExpression(node.Value, modifier)
+
+	case *AssignStatement:
+		if node.Name, err = modifyIdentifier(node.Name, modifier); err != nil {
+			return nil, err
+		}
+		node.Value, err = modifyExpression(node.Value, modifier)
 
 	case *ReturnStatement:
-		node.ReturnValue, _ = Modify(node.ReturnValue, modifier).(Expression)
+		node.ReturnValue, err = modifyExpression(node.ReturnValue, modifier)
 
-	case *BlockStatement:
-		for i, statement := range node.Statements {
-			node.Statements[i], _ = Modify(statement, modifier).(Statement)
+	case *DeferStatement:
+		node.Call, err = modifyExpression(node.Call, modifier)
+
+	case *AssertStatement:
+		if node.Condition, err = modifyExpression(node.Condition, modifier); err != nil {
+			return nil, err
 		}
+		node.Message, err = modifyExpression(node.Message, modifier)
+
+	case *BlockStatement:
+		err = modifyStatements(node.Statements, modifier)
 
 	case *IfExpression:
-		modifiedClauses := []ConditionalClause{}
-		for _, clause := range node.Clauses {
-			modifiedClauseCondition, _ := Modify(clause.Condition, modifier).(Expression)
-			modifiedClauseConsequence, _ := Modify(clause.Consequence, modifier).(*BlockStatement)
-			modifiedClauses = append(modifiedClauses, ConditionalClause{Condition: modifiedClauseCondition, Consequence: modifiedClauseConsequence})
+		for i, clause := range node.Clauses {
+			if node.Clauses[i].Condition, err = modifyExpression(clause.Condition, modifier); err != nil {
+				return nil, err
+			}
+			if node.Clauses[i].Consequence, err = modifyBlock(clause.Consequence, modifier); err != nil {
+				return nil, err
+			}
 		}
-		node.Clauses = modifiedClauses
-		if node.Alternative != nil {
-			node.Alternative, _ = Modify(node.Alternative, modifier).(*BlockStatement)
+		node.Alternative, err = modifyBlock(node.Alternative, modifier)
+
+	case *SwitchStatement:
+		if node.SwitchExpression, err = modifyExpression(node.SwitchExpression, modifier); err != nil {
+			return nil, err
+		}
+		for i, switchCase := range node.Cases {
+			if node.Cases[i].Expression, err = modifyExpression(switchCase.Expression, modifier); err != nil {
+				return nil, err
+			}
+			if node.Cases[i].Consequence, err = modifyBlock(switchCase.Consequence, modifier); err != nil {
+				return nil, err
+			}
+		}
+		node.Default, err = modifyBlock(node.Default, modifier)
+
+	case *WhileLoop:
+		if node.Condition, err = modifyExpression(node.Condition, modifier); err != nil {
+			return nil, err
 		}
+		node.Body, err = modifyBlock(node.Body, modifier)
+
+	case *ForLoop:
+		if node.Init, err = modifyStatement(node.Init, modifier); err != nil {
+			return nil, err
+		}
+		if node.Condition, err = modifyExpression(node.Condition, modifier); err != nil {
+			return nil, err
+		}
+		if node.Afterthought, err = modifyStatement(node.Afterthought, modifier); err != nil {
+			return nil, err
+		}
+		node.Body, err = modifyBlock(node.Body, modifier)
 
 	case *FunctionLiteral:
-		for i := range node.Parameters {
-			node.Parameters[i], _ = Modify(node.Parameters[i], modifier).(*Identifier)
+		if err = modifyIdentifiers(node.Parameters, modifier); err != nil {
+			return nil, err
 		}
-		node.Body, _ = Modify(node.Body, modifier).(*BlockStatement)
+		node.Body, err = modifyBlock(node.Body, modifier)
 
-	case *ArrayLiteral:
-		for i, element := range node.Elements {
-			node.Elements[i], _ = Modify(element, modifier).(Expression)
+	case *FunctionDeclaration:
+		if node.Name, err = modifyIdentifier(node.Name, modifier); err != nil {
+			return nil, err
+		}
+		var function Node
+		if function, err = Modify(node.Function, modifier); err != nil {
+			return nil, err
+		}
+		modifiedFunction, ok := function.(*FunctionLiteral)
+		if !ok {
+			return nil, wrongKindError(node.Function, function, "function literal")
+		}
+		node.Function = modifiedFunction
+
+	case *MacroLiteral:
+		if err = modifyIdentifiers(node.Parameters, modifier); err != nil {
+			return nil, err
 		}
+		node.Body, err = modifyBlock(node.Body, modifier)
+
+	case *CallExpression:
+		if node.Function, err = modifyExpression(node.Function, modifier); err != nil {
+			return nil, err
+		}
+		err = modifyExpressions(node.Arguments, modifier)
+
+	case *ArrayLiteral:
+		err = modifyExpressions(node.Elements, modifier)
+
+	case *SetLiteral:
+		err = modifyExpressions(node.Elements, modifier)
 
 	case *HashMapLiteral:
 		newKVPairs := make(map[Expression]Expression)
 		for key, val := range node.KVPairs {
-			newKey, _ := Modify(key, modifier).(Expression)
-			newVal, _ := Modify(val, modifier).(Expression)
+			newKey, err := modifyExpression(key, modifier)
+			if err != nil {
+				return nil, err
+			}
+			newVal, err := modifyExpression(val, modifier)
+			if err != nil {
+				return nil, err
+			}
 			newKVPairs[newKey] = newVal
 		}
 		node.KVPairs = newKVPairs
 
 	case *IndexExpression:
-		node.Left, _ = Modify(node.Left, modifier).(Expression)
-		node.Index, _ = Modify(node.Index, modifier).(Expression)
+		if node.Left, err = modifyExpression(node.Left, modifier); err != nil {
+			return nil, err
+		}
+		node.Index, err = modifyExpression(node.Index, modifier)
 
 	}
 
+	if err != nil {
+		return nil, err
+	}
+
 	return modifier(node)
 }
+
+func modifyStatement(statement Statement, modifier ModifierFunc) (Statement, error) {
+	if statement == nil {
+		return nil, nil
+	}
+
+	modified, err := Modify(statement, modifier)
+	if err != nil {
+		return nil, err
+	}
+
+	modifiedStatement, ok := modified.(Statement)
+	if !ok || modifiedStatement == nil {
+		return nil, wrongKindError(statement, modified, "statement")
+	}
+	return modifiedStatement, nil
+}
+
+func modifyStatements(statements []Statement, modifier ModifierFunc) error {
+	for i, statement := range statements {
+		modified, err := modifyStatement(statement, modifier)
+		if err != nil {
+			return err
+		}
+		statements[i] = modified
+	}
+	return nil
+}
+
+func modifyExpression(expression Expression, modifier ModifierFunc) (Expression, error) {
+	if expression == nil {
+		return nil, nil
+	}
+
+	modified, err := Modify(expression, modifier)
+	if err != nil {
+		return nil, err
+	}
+
+	modifiedExpression, ok := modified.(Expression)
+	if !ok || modifiedExpression == nil {
+		return nil, wrongKindError(expression, modified, "expression")
+	}
+	return modifiedExpression, nil
+}
+
+func modifyExpressions(expressions []Expression, modifier ModifierFunc) error {
+	for i, expression := range expressions {
+		modified, err := modifyExpression(expression, modifier)
+		if err != nil {
+			return err
+		}
+		expressions[i] = modified
+	}
+	return nil
+}
+
+func modifyBlock(block *BlockStatement, modifier ModifierFunc) (*BlockStatement, error) {
+	if block == nil {
+		return nil, nil
+	}
+
+	modified, err := Modify(block, modifier)
+	if err != nil {
+		return nil, err
+	}
+
+	modifiedBlock, ok := modified.(*BlockStatement)
+	if !ok || modifiedBlock == nil {
+		return nil, wrongKindError(block, modified, "block statement")
+	}
+	return modifiedBlock, nil
+}
+
+func modifyIdentifier(identifier *Identifier, modifier ModifierFunc) (*Identifier, error) {
+	if identifier == nil {
+		return nil, nil
+	}
+
+	modified, err := Modify(identifier, modifier)
+	if err != nil {
+		return nil, err
+	}
+
+	modifiedIdentifier, ok := modified.(*Identifier)
+	if !ok || modifiedIdentifier == nil {
+		return nil, wrongKindError(identifier, modified, "identifier")
+	}
+	return modifiedIdentifier, nil
+}
+
+func modifyIdentifiers(identifiers []*Identifier, modifier ModifierFunc) error {
+	for i, identifier := range identifiers {
+		modified, err := modifyIdentifier(identifier, modifier)
+		if err != nil {
+			return err
+		}
+		identifiers[i] = modified
+	}
+	return nil
+}
+
+// Reports that the original node was replaced with a node of the wrong kind, at the position of the original node.
+func wrongKindError(original Node, modified Node, expectedKind string) error {
+	got := "nothing"
+	if modified != nil {
+		got = modified.String()
+	}
+
+	tok := TokenOf(original)
+	return fmt.Errorf("line %d, column %d: expected %s in place of %q, got %s", tok.LineNumber, tok.ColumnNumber, expectedKind, original.String(), got)
+}
+
+// Returns the token at which the given node starts (or, for infix expressions, the token of the operator), which
+// gives the node's position in the source code.
+func TokenOf(node Node) token.Token {
+	switch node := node.(type) {
+	case *Program:
+		if len(node.Statements) > 0 {
+			return TokenOf(node.Statements[0])
+		}
+	case *CallExpression:
+		return TokenOf(node.Function)
+	default:
+		if tok := tokenRef(node); tok != nil {
+			return *tok
+		}
+	}
+	return token.Token{}
+}
+
+// Gives the tokens of the node and its descendants which have no position (e.g. those of nodes constructed by macros
+// rather than parsed from source code) the given position.
+func SetMissingPositions(node Node, line int, column int) error {
+	_, err := Modify(node, func(node Node) (Node, error) {
+		if tok := tokenRef(node); tok != nil && tok.LineNumber == 0 {
+			tok.LineNumber = line
+			tok.ColumnNumber = column
+		}
+		return node, nil
+	})
+	return err
+}
+
+// Returns a reference to the node's own token, or nil if it has none.
+func tokenRef(node Node) *token.Token {
+	switch node := node.(type) {
+	case *ExpressionStatement:
+		return &node.Token
+	case *LetStatement:
+		return &node.Token
+	case *ConstStatement:
+		return &node.Token
+	case *AssignStatement:
+		return &node.Token
+	case *ReturnStatement:
+		return &node.Token
+	case *DeferStatement:
+		return &node.Token
+	case *AssertStatement:
+		return &node.Token
+	case *BlockStatement:
+		return &node.Token
+	case *IfExpression:
+		return &node.Token
+	case *SwitchStatement:
+		return &node.Token
+	case *WhileLoop:
+		return &node.Token
+	case *ForLoop:
+		return &node.Token
+	case *FunctionLiteral:
+		return &node.Token
+	case *FunctionDeclaration:
+		return &node.Token
+	case *MacroLiteral:
+		return &node.Token
+	case *CallExpression:
+		return &node.Token
+	case *Identifier:
+		return &node.Token
+	case *IntegerLiteral:
+		return &node.Token
+	case *Float:
+		return &node.Token
+	case *Boolean:
+		return &node.Token
+	case *StringLiteral:
+		return &node.Token
+	case *PrefixExpression:
+		return &node.Token
+	case *InfixExpression:
+		return &node.Token
+	case *ArrayLiteral:
+		return &node.Token
+	case *SetLiteral:
+		return &node.Token
+	case *HashMapLiteral:
+		return &node.Token
+	case *IndexExpression:
+		return &node.Token
+	}
+	return nil
+}
@@ -70,8 +70,9 @@ func (sl *StringLiteral) String() string {
 
 // Represents an identifier, consisting of the IDENT token and the value (name of the identifier).
 type Identifier struct {
-	Token token.Token // the token.IDENT token
-	Value string
+	Token   token.Token // the token.IDENT token
+	Value   string
+	Unquote *CallExpression // the `unquote` call naming a binding in quoted code (e.g. `let unquote(name) = 1`), if any
 }
 
 func (i *Identifier) expressionNode() {}
@@ -81,5 +82,8 @@ func (i *Identifier) TokenLiteral() string {
 }
 
 func (i *Identifier) String() string {
+	if i.Unquote != nil {
+		return i.Unquote.String()
+	}
 	return i.Value
 }
@@ -6,10 +6,12 @@ import (
 )
 
 // Represents a let statement in the Monkey programming language, consisting of (1) the LET token, (2) the
-// name of the identifier in the binding, and (3) the expression that produces the value for the binding.
+// name of the identifier in the binding, (3) an optional type annotation, and (4) the expression that produces
+// the value for the binding.
 type LetStatement struct {
 	Token token.Token // the token.LET token
 	Name  *Identifier
+	Type  *TypeAnnotation // nil if the binding isn't annotated
 	Value Expression
 }
 
@@ -24,6 +26,9 @@ func (ls *LetStatement) String() string {
 
 	out.WriteString(ls.TokenLiteral() + " ")
 	out.WriteString(ls.Name.String())
+	if ls.Type != nil {
+		out.WriteString(": " + ls.Type.String())
+	}
 	out.WriteString(" = ")
 	if ls.Value != nil {
 		out.WriteString(ls.Value.String())
@@ -34,11 +39,12 @@ func (ls *LetStatement) String() string {
 }
 
 // Represents a const declaration statement in the Monkey programming language, consisting of (1) the CONST token,
-// (2) the name of the identifier in the binding, and (3) the expression that produces the value for the binding.
-// Variables declared as consts cannot be reassigned other values later.
+// (2) the name of the identifier in the binding, (3) an optional type annotation, and (4) the expression that
+// produces the value for the binding. Variables declared as consts cannot be reassigned other values later.
 type ConstStatement struct {
 	Token token.Token // the token.CONST token
 	Name  *Identifier
+	Type  *TypeAnnotation // nil if the binding isn't annotated
 	Value Expression
 }
 
@@ -53,6 +59,9 @@ func (cs *ConstStatement) String() string {
 
 	out.WriteString(cs.TokenLiteral() + " ")
 	out.WriteString(cs.Name.String())
+	if cs.Type != nil {
+		out.WriteString(": " + cs.Type.String())
+	}
 	out.WriteString(" = ")
 	if cs.Value != nil {
 		out.WriteString(cs.Value.String())
@@ -137,3 +146,88 @@ func (bs *BlockStatement) String() string {
 
 	return out.String()
 }
+
+// Represents a defer statement in the Monkey programming language, consisting of the DEFER token and the function
+// call being deferred. The function and its arguments are evaluated when the defer statement runs, but the call
+// itself is postponed until the surrounding function returns.
+type DeferStatement struct {
+	Token token.Token // the token.DEFER token
+	Call  Expression  // the deferred call, which is always a *CallExpression when parsed
+}
+
+func (ds *DeferStatement) statementNode() {}
+
+func (ds *DeferStatement) TokenLiteral() string {
+	return ds.Token.Literal
+}
+
+func (ds *DeferStatement) String() string {
+	var out bytes.Buffer
+
+	out.WriteString(ds.TokenLiteral() + " ")
+	if ds.Call != nil {
+		out.WriteString(ds.Call.String())
+	}
+	out.WriteString(";")
+
+	return out.String()
+}
+
+// Represents an assert statement in the Monkey programming language, consisting of (1) the ASSERT token, (2) the
+// condition being asserted, and (3) an optional expression producing a message to report if the condition is falsy.
+type AssertStatement struct {
+	Token     token.Token // the token.ASSERT token
+	Condition Expression
+	Message   Expression // nil if the assertion has no message
+}
+
+func (as *AssertStatement) statementNode() {}
+
+func (as *AssertStatement) TokenLiteral() string {
+	return as.Token.Literal
+}
+
+func (as *AssertStatement) String() string {
+	var out bytes.Buffer
+
+	out.WriteString(as.TokenLiteral() + " ")
+	if as.Condition != nil {
+		out.WriteString(as.Condition.String())
+	}
+	if as.Message != nil {
+		out.WriteString(", " + as.Message.String())
+	}
+	out.WriteString(";")
+
+	return out.String()
+}
+
+// Returns the names of the identifiers referenced by the asserted condition (other than the names of the functions it
+// calls), in the order in which they first appear, whose values are reported if the assertion fails.
+func (as *AssertStatement) ReferencedIdentifiers() []string {
+	identifiers := []*Identifier{}
+	callees := map[*Identifier]bool{}
+
+	Modify(Copy(as.Condition), func(node Node) (Node, error) {
+		switch node := node.(type) {
+		case *Identifier:
+			identifiers = append(identifiers, node)
+		case *CallExpression:
+			if callee, ok := node.Function.(*Identifier); ok {
+				callees[callee] = true
+			}
+		}
+		return node, nil
+	})
+
+	names := []string{}
+	seen := map[string]bool{}
+	for _, identifier := range identifiers {
+		if callees[identifier] || seen[identifier.Value] {
+			continue
+		}
+		seen[identifier.Value] = true
+		names = append(names, identifier.Value)
+	}
+	return names
+}
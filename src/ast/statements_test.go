@@ -0,0 +1,39 @@
+package ast_test
+
+import (
+	"monkey/ast"
+	"monkey/lexer"
+	"monkey/parser"
+	"reflect"
+	"testing"
+)
+
+func TestAssertReferencedIdentifiers(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected []string
+	}{
+		{`assert x > 0`, []string{"x"}},
+		{`assert len(xs) < limit && xs[0] == limit`, []string{"xs", "limit"}},
+		{`assert f(g)(h)`, []string{"g", "h"}},
+		{`assert 1 == 1, message`, []string{}},
+	}
+
+	for _, test := range tests {
+		p := parser.NewParser(lexer.NewLexer(test.input))
+		program := p.ParseProgram()
+		if len(p.Errors()) != 0 {
+			t.Fatalf("parser errors for input %q: %v", test.input, p.Errors())
+		}
+
+		assertStatement, ok := program.Statements[0].(*ast.AssertStatement)
+		if !ok {
+			t.Fatalf("statement is not an *ast.AssertStatement. got=%T", program.Statements[0])
+		}
+
+		identifiers := assertStatement.ReferencedIdentifiers()
+		if !reflect.DeepEqual(identifiers, test.expected) {
+			t.Errorf("wrong referenced identifiers for input %q. expected=%v, got=%v", test.input, test.expected, identifiers)
+		}
+	}
+}
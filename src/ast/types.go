@@ -0,0 +1,22 @@
+package ast
+
+import (
+	"monkey/token"
+	"strings"
+)
+
+// Represents an optional type annotation in the form "<type> | <type> | ...", attached to a let or const binding,
+// a function parameter, or a function's return value. Type annotations have no effect at runtime; they are only
+// consumed by the static type checker.
+type TypeAnnotation struct {
+	Token token.Token // the token of the first type name
+	Types []string    // the names of the types in the (possibly single-member) union
+}
+
+func (ta *TypeAnnotation) TokenLiteral() string {
+	return ta.Token.Literal
+}
+
+func (ta *TypeAnnotation) String() string {
+	return strings.Join(ta.Types, " | ")
+}
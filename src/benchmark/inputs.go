@@ -15,3 +15,15 @@ var fibonacciInput = `
 
 	fibonacci(35);
 `
+
+var loopInput = `
+	let sum = fn(n) {
+		let total = 0;
+		for (let i = 0; i < n; i++) {
+			total += i;
+		}
+		total
+	};
+
+	sum(10000000);
+`
@@ -13,6 +13,8 @@ import (
 )
 
 var engine = flag.String("engine", "vm", "use 'vm' or 'eval'")
+var noOptimizations = flag.Bool("O0", false, "disable compiler optimizations, e.g. to measure the speedup from superinstructions")
+var runs = flag.Int("runs", 1, "run each benchmark this many times, reporting the mean and the fastest of the durations")
 
 var benchmarks = []struct {
 	name           string
@@ -20,51 +22,78 @@ var benchmarks = []struct {
 	expectedResult string
 }{
 	{name: "fibonacci", input: fibonacciInput, expectedResult: "9227465"},
+	{name: "loop", input: loopInput, expectedResult: "49999995000000"},
 }
 
 func main() {
 	flag.Parse()
+	if *runs < 1 {
+		fmt.Println("-runs must be at least 1")
+		return
+	}
 
 	for _, benchmark := range benchmarks {
-		var duration time.Duration
+		var total, fastest time.Duration
 		var result object.Object
 
-		l := lexer.NewLexer(benchmark.input)
-		p := parser.NewParser(l)
-		program := p.ParseProgram()
+		for run := 0; run < *runs; run++ {
+			var duration time.Duration
+			var err error
 
-		if *engine == "vm" {
-			// Compilation
-			compiler := compiler.NewCompiler()
-			err := compiler.Compile(program)
+			result, duration, err = runBenchmark(benchmark.input)
 			if err != nil {
-				fmt.Printf("compiler error: %s", err)
+				fmt.Println(err)
 				return
 			}
 
-			// Execution on Virtual Machine (with timing/benchmarking)
-			vm := vm.NewVM(compiler.Bytecode())
-			startTime := time.Now()
-			err = vm.Run()
-			if err != nil {
-				fmt.Printf("vm error: %s", err)
+			total += duration
+			if run == 0 || duration < fastest {
+				fastest = duration
 			}
-			duration = time.Since(startTime)
-			result = vm.LastPoppedStackElem()
-		} else {
-			env := object.NewEnvironment()
-			startTime := time.Now()
-			result = evaluator.Eval(program, env)
-			duration = time.Since(startTime)
 		}
 
+		duration := total / time.Duration(*runs)
+
 		fmt.Printf(
-			"engine=%s, benchmark=%s, result=%s, expectedResult=%s, duration=%s\n",
+			"engine=%s, benchmark=%s, result=%s, expectedResult=%s, duration=%s, fastest=%s\n",
 			*engine,
 			benchmark.name,
 			result.Inspect(),
 			benchmark.expectedResult,
 			duration,
+			fastest,
 		)
 	}
 }
+
+// Runs a benchmark's program once on the selected engine, returning its result and how long it took to run.
+func runBenchmark(input string) (object.Object, time.Duration, error) {
+	l := lexer.NewLexer(input)
+	p := parser.NewParser(l)
+	program := p.ParseProgram()
+
+	if *engine == "vm" {
+		// Compilation
+		c := compiler.NewCompiler()
+		c.SetOptions(compiler.Options{NoOptimizations: *noOptimizations})
+		err := c.Compile(program)
+		if err != nil {
+			return nil, 0, fmt.Errorf("compiler error: %s", err)
+		}
+
+		// Execution on Virtual Machine (with timing/benchmarking)
+		vm := vm.NewVM(c.Bytecode())
+		startTime := time.Now()
+		err = vm.Run()
+		duration := time.Since(startTime)
+		if err != nil {
+			return nil, 0, fmt.Errorf("vm error: %s", err)
+		}
+		return vm.LastPoppedStackElem(), duration, nil
+	}
+
+	env := object.NewEnvironment()
+	startTime := time.Now()
+	result := evaluator.Eval(program, env)
+	return result, time.Since(startTime), nil
+}
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"encoding/binary"
 	"fmt"
+	"math"
 )
 
 // Represents an opcode of size 1 byte, indicating some operation with some number of operands.
@@ -17,6 +18,7 @@ const (
 
 	OpPop
 	OpJumpNotTruthy
+	OpJumpTruthy
 	OpJump
 
 	OpAdd
@@ -26,6 +28,8 @@ const (
 	OpIntegerDiv
 	OpExp
 	OpMod
+	OpUnion
+	OpIntersection
 
 	OpAnd
 	OpOr
@@ -36,6 +40,7 @@ const (
 	OpGreaterThan
 	OpLessThanOrEqualTo
 	OpGreaterThanOrEqualTo
+	OpIn
 
 	OpMinus
 	OpBang
@@ -44,9 +49,12 @@ const (
 	OpSetGlobal
 	OpGetLocal
 	OpSetLocal
+	OpSetLocalKeep
+	OpClearLocal
 
 	OpArray
 	OpHashMap
+	OpSet
 	OpIndex
 
 	OpCall
@@ -54,10 +62,34 @@ const (
 	OpReturn
 	OpGetBuiltIn
 	OpClosure
-	OpGetFreeVar
+	OpGetUpvalue
+	OpSetUpvalue
+	OpCaptureLocal
+	OpCaptureUpvalue
+	OpCaptureCurrentClosure
+	OpCloseUpvalues
 	OpCurrentClosure
+	OpDefer
+	OpAssertFail
+	OpCheckDefined
+
+	OpGetLocal0
+	OpGetLocal1
+	OpGetLocal2
+	OpGetLocal3
+	OpAddConst
+	OpSubConst
+	OpIncLocal
+	OpLessThanJump
+	OpEqualJump
+	OpCallGlobal
+
+	OpWide
 )
 
+// The width in bytes of each operand of an instruction prefixed by `OpWide`.
+const WideOperandWidth = 4
+
 // Represents a set of instructions as a slice of bytes.
 type Instructions []byte
 
@@ -66,15 +98,20 @@ func (instr Instructions) String() string {
 
 	i := 0
 	for i < len(instr) {
-		def, err := LookUp(instr[i])
+		op, operands, width, err := ReadInstruction(instr[i:])
 		if err != nil {
 			fmt.Fprintf(&out, "ERROR: %s\n", err)
-			continue
+			break
+		}
+
+		def, _ := LookUp(byte(op))
+		prefix := ""
+		if Opcode(instr[i]) == OpWide {
+			prefix = "OpWide "
 		}
 
-		operands, read := ReadOperands(def, instr[i+1:])
-		fmt.Fprintf(&out, "%04d %s\n", i, instr.fmtInstruction(def, operands))
-		i += 1 + read
+		fmt.Fprintf(&out, "%04d %s%s\n", i, prefix, instr.fmtInstruction(def, operands))
+		i += width
 	}
 
 	return out.String()
@@ -114,15 +151,18 @@ var definitions = map[Opcode]*Definition{
 
 	OpPop:           {"OpPop", []int{}},
 	OpJumpNotTruthy: {"OpJumpNotTruthy", []int{2}},
+	OpJumpTruthy:    {"OpJumpTruthy", []int{2}},
 	OpJump:          {"OpJump", []int{2}},
 
-	OpAdd:        {"OpAdd", []int{}},
-	OpSub:        {"OpSub", []int{}},
-	OpMul:        {"OpMul", []int{}},
-	OpDiv:        {"OpDiv", []int{}},
-	OpIntegerDiv: {"OpIntegerDiv", []int{}},
-	OpExp:        {"OpExp", []int{}},
-	OpMod:        {"OpMod", []int{}},
+	OpAdd:          {"OpAdd", []int{}},
+	OpSub:          {"OpSub", []int{}},
+	OpMul:          {"OpMul", []int{}},
+	OpDiv:          {"OpDiv", []int{}},
+	OpIntegerDiv:   {"OpIntegerDiv", []int{}},
+	OpExp:          {"OpExp", []int{}},
+	OpMod:          {"OpMod", []int{}},
+	OpUnion:        {"OpUnion", []int{}},
+	OpIntersection: {"OpIntersection", []int{}},
 
 	OpAnd: {"OpAnd", []int{}},
 	OpOr:  {"OpOr", []int{}},
@@ -133,26 +173,52 @@ var definitions = map[Opcode]*Definition{
 	OpGreaterThan:          {"OpGreaterThan", []int{}},
 	OpLessThanOrEqualTo:    {"OpLessThanOrEqualTo", []int{}},
 	OpGreaterThanOrEqualTo: {"OpGreaterThanOrEqualTo", []int{}},
+	OpIn:                   {"OpIn", []int{}},
 
 	OpMinus: {"OpMinus", []int{}},
 	OpBang:  {"OpBang", []int{}},
 
-	OpGetGlobal: {"OpGetGlobal", []int{2}},
-	OpSetGlobal: {"OpSetGlobal", []int{2}},
-	OpGetLocal:  {"OpGetLocal", []int{1}},
-	OpSetLocal:  {"OpSetLocal", []int{1}},
+	OpGetGlobal:    {"OpGetGlobal", []int{2}},
+	OpSetGlobal:    {"OpSetGlobal", []int{2}},
+	OpGetLocal:     {"OpGetLocal", []int{1}},
+	OpSetLocal:     {"OpSetLocal", []int{1}},
+	OpSetLocalKeep: {"OpSetLocalKeep", []int{1}}, // Stores the value on top of the stack in a local, leaving it on the stack.
+	OpClearLocal:   {"OpClearLocal", []int{1}},   // Marks a local as undeclared, so that reading it before its declaration is detected (see OpCheckDefined).
 
 	OpArray:   {"OpArray", []int{2}},
 	OpHashMap: {"OpHashMap", []int{2}},
+	OpSet:     {"OpSet", []int{2}},
 	OpIndex:   {"OpIndex", []int{}},
 
-	OpCall:           {"OpCall", []int{1}},
-	OpReturnValue:    {"OpReturnValue", []int{}},
-	OpReturn:         {"OpReturn", []int{}},
-	OpGetBuiltIn:     {"OpGetBuiltIn", []int{1}},
-	OpClosure:        {"OpClosure", []int{2, 1}}, // First operand: constant index of *object.CompiledFunction. Second operand: number of free variables in the closure.
-	OpGetFreeVar:     {"OpGetFreeVar", []int{1}},
-	OpCurrentClosure: {"OpCurrentClosure", []int{}},
+	OpCall:                  {"OpCall", []int{1}},
+	OpReturnValue:           {"OpReturnValue", []int{}},
+	OpReturn:                {"OpReturn", []int{}},
+	OpGetBuiltIn:            {"OpGetBuiltIn", []int{1}},
+	OpClosure:               {"OpClosure", []int{2, 1}}, // First operand: constant index of *object.CompiledFunction. Second operand: number of upvalues captured by the closure.
+	OpGetUpvalue:            {"OpGetUpvalue", []int{1}},
+	OpSetUpvalue:            {"OpSetUpvalue", []int{1}},
+	OpCaptureLocal:          {"OpCaptureLocal", []int{1}},   // Captures a local of the current frame as an upvalue of the closure being created.
+	OpCaptureUpvalue:        {"OpCaptureUpvalue", []int{1}}, // Shares an upvalue of the current closure with the closure being created.
+	OpCaptureCurrentClosure: {"OpCaptureCurrentClosure", []int{}},
+	OpCloseUpvalues:         {"OpCloseUpvalues", []int{1}}, // Closes the open upvalues of the current frame's locals, starting from the given local index.
+	OpCurrentClosure:        {"OpCurrentClosure", []int{}},
+	OpDefer:                 {"OpDefer", []int{1}},         // Records a call of the function below the given number of arguments on the stack, to run when the current frame returns.
+	OpAssertFail:            {"OpAssertFail", []int{2, 1}}, // First operand: constant index of the assertion's description. Second operand: number of (name, value) pairs of referenced identifiers above its message on the stack.
+	OpCheckDefined:          {"OpCheckDefined", []int{2}},  // Fails with the error message at the given constant index if the value on top of the stack is a variable read before its declaration.
+
+	// Superinstructions, which the compiler selects in place of common sequences of instructions
+	OpGetLocal0:    {"OpGetLocal0", []int{}},
+	OpGetLocal1:    {"OpGetLocal1", []int{}},
+	OpGetLocal2:    {"OpGetLocal2", []int{}},
+	OpGetLocal3:    {"OpGetLocal3", []int{}},
+	OpAddConst:     {"OpAddConst", []int{2}},      // Adds the constant at the given index to the value on top of the stack.
+	OpSubConst:     {"OpSubConst", []int{2}},      // Subtracts the constant at the given index from the value on top of the stack.
+	OpIncLocal:     {"OpIncLocal", []int{1, 2}},   // Adds the constant at the index given by the second operand to the local given by the first operand.
+	OpLessThanJump: {"OpLessThanJump", []int{2}},  // Pops two values, jumping to the given position unless the first is less than the second.
+	OpEqualJump:    {"OpEqualJump", []int{2}},     // Pops two values, jumping to the given position unless they're equal.
+	OpCallGlobal:   {"OpCallGlobal", []int{2, 1}}, // Calls the function stored in the global given by the first operand, with the given number of arguments on the stack.
+
+	OpWide: {"OpWide", []int{}}, // Prefixes an instruction whose operands don't all fit in their widths, making each of its operands 4 bytes wide instead.
 }
 
 func LookUp(op byte) (*Definition, error) {
@@ -164,35 +230,94 @@ func LookUp(op byte) (*Definition, error) {
 	return def, nil
 }
 
-func Make(op Opcode, operands ...int) []byte {
+// Encodes an instruction with the given operands. If any of the operands doesn't fit in its width, the instruction is
+// prefixed by `OpWide` and each of its operands is encoded in 4 bytes instead. An error is returned if the opcode is
+// undefined, if the wrong number of operands is given, or if an operand doesn't fit in 4 bytes either.
+func Encode(op Opcode, operands ...int) ([]byte, error) {
 	def, ok := definitions[op]
 	if !ok {
-		return []byte{}
+		return nil, fmt.Errorf("opcode %d is undefined", op)
+	}
+	if len(operands) != len(def.OperandWidths) {
+		return nil, fmt.Errorf("%s expects %d operands. got %d", def.Name, len(def.OperandWidths), len(operands))
 	}
 
-	instructionLen := 1
-	for _, w := range def.OperandWidths {
-		instructionLen += w
+	wide := false
+	for i, o := range operands {
+		if o < 0 || uint64(o) > math.MaxUint32 {
+			return nil, fmt.Errorf("operand %d of %s overflows: %d", i, def.Name, o)
+		}
+		if o >= 1<<(8*def.OperandWidths[i]) {
+			wide = true
+		}
 	}
 
-	instruction := make([]byte, instructionLen)
-	instruction[0] = byte(op)
+	instruction := []byte{}
+	if wide {
+		instruction = append(instruction, byte(OpWide))
+	}
+	instruction = append(instruction, byte(op))
 
-	offset := 1
 	for i, o := range operands {
 		width := def.OperandWidths[i]
+		if wide {
+			width = WideOperandWidth
+		}
+
 		switch width {
 		case 1:
-			instruction[offset] = byte(o)
+			instruction = append(instruction, byte(o))
 		case 2:
-			binary.BigEndian.PutUint16(instruction[offset:], uint16(o))
+			instruction = binary.BigEndian.AppendUint16(instruction, uint16(o))
+		case 4:
+			instruction = binary.BigEndian.AppendUint32(instruction, uint32(o))
 		}
-		offset += width
 	}
 
+	return instruction, nil
+}
+
+// Encodes an instruction like Encode, panicking if it can't be encoded (since that means the caller has built an
+// invalid instruction) rather than silently truncating its operands.
+func Make(op Opcode, operands ...int) []byte {
+	instruction, err := Encode(op, operands...)
+	if err != nil {
+		panic(err)
+	}
 	return instruction
 }
 
+// Reads the instruction at the start of the given instructions, returning its opcode, its operands, and the number of
+// bytes that it takes up (including any `OpWide` prefix).
+func ReadInstruction(instr Instructions) (Opcode, []int, int, error) {
+	prefixWidth := 0
+	if Opcode(instr[0]) == OpWide {
+		if len(instr) < 2 {
+			return OpWide, nil, 0, fmt.Errorf("OpWide isn't followed by an instruction")
+		}
+		prefixWidth = 1
+	}
+
+	op := Opcode(instr[prefixWidth])
+	def, err := LookUp(byte(op))
+	if err != nil {
+		return op, nil, 0, err
+	}
+
+	if prefixWidth == 0 {
+		operands, read := ReadOperands(def, instr[1:])
+		return op, operands, 1 + read, nil
+	}
+
+	operands := make([]int, len(def.OperandWidths))
+	offset := prefixWidth + 1
+	for i := range operands {
+		operands[i] = int(ReadUint32(instr[offset:]))
+		offset += WideOperandWidth
+	}
+	return op, operands, offset, nil
+}
+
 func ReadOperands(def *Definition, instr Instructions) ([]int, int) {
 	operands := make([]int, len(def.OperandWidths))
 	offset := 0
@@ -210,6 +335,10 @@ func ReadOperands(def *Definition, instr Instructions) ([]int, int) {
 	return operands, offset
 }
 
+func ReadUint32(instr Instructions) uint32 {
+	return binary.BigEndian.Uint32(instr)
+}
+
 func ReadUint16(instr Instructions) uint16 {
 	return binary.BigEndian.Uint16(instr)
 }
@@ -17,6 +17,10 @@ func TestMake(t *testing.T) {
 		{OpCall, []int{2}, []byte{byte(OpCall), 2}},
 		{OpGetLocal, []int{255}, []byte{byte(OpGetLocal), 255}},
 		{OpClosure, []int{65534, 255}, []byte{byte(OpClosure), 255, 254, 255}},
+		{OpIncLocal, []int{255, 65534}, []byte{byte(OpIncLocal), 255, 255, 254}},
+		{OpConstant, []int{65536}, []byte{byte(OpWide), byte(OpConstant), 0, 1, 0, 0}},
+		{OpGetLocal, []int{256}, []byte{byte(OpWide), byte(OpGetLocal), 0, 0, 1, 0}},
+		{OpClosure, []int{1, 300}, []byte{byte(OpWide), byte(OpClosure), 0, 0, 0, 1, 0, 0, 1, 44}},
 	}
 
 	for _, test := range tests {
@@ -43,9 +47,11 @@ func TestInstructionsString(t *testing.T) {
 		Make(OpTrue),
 		Make(OpGetLocal, 255),
 		Make(OpClosure, 65535, 255),
+		Make(OpJump, 70000),
+		Make(OpClosure, 65535, 256),
 	}
 
-	expected := "0000 OpAdd\n0001 OpConstant 1\n0004 OpConstant 2\n0007 OpConstant 65535\n0010 OpTrue\n0011 OpGetLocal 255\n0013 OpClosure 65535 255\n"
+	expected := "0000 OpAdd\n0001 OpConstant 1\n0004 OpConstant 2\n0007 OpConstant 65535\n0010 OpTrue\n0011 OpGetLocal 255\n0013 OpClosure 65535 255\n0017 OpWide OpJump 70000\n0023 OpWide OpClosure 65535 256\n"
 
 	concatted := Instructions{}
 	for _, instr := range instructions {
@@ -93,3 +99,68 @@ func TestReadOperands(t *testing.T) {
 		}
 	}
 }
+
+func TestReadInstruction(t *testing.T) {
+	tests := []struct {
+		op       Opcode
+		operands []int
+		width    int
+	}{
+		{OpConstant, []int{65535}, 3},
+		{OpTrue, []int{}, 1},
+		{OpConstant, []int{65536}, 6},
+		{OpGetLocal, []int{1000}, 6},
+		{OpClosure, []int{70000, 2}, 10},
+	}
+
+	for _, test := range tests {
+		instruction := append(Make(test.op, test.operands...), Make(OpPop)...)
+
+		op, operands, width, err := ReadInstruction(instruction)
+		if err != nil {
+			t.Fatalf("error reading instruction: %s", err)
+		}
+		if op != test.op {
+			t.Fatalf("opcode wrong. expected=%d, got=%d", test.op, op)
+		}
+		if width != test.width {
+			t.Fatalf("instruction width wrong. expected=%d, got=%d", test.width, width)
+		}
+		for i, expected := range test.operands {
+			if operands[i] != expected {
+				t.Fatalf("operand at position %d wrong. expected=%d, got=%d", i, expected, operands[i])
+			}
+		}
+	}
+}
+
+func TestEncodeErrors(t *testing.T) {
+	tests := []struct {
+		op            Opcode
+		operands      []int
+		expectedError string
+	}{
+		{OpConstant, []int{-1}, "operand 0 of OpConstant overflows: -1"},
+		{OpConstant, []int{1 << 32}, "operand 0 of OpConstant overflows: 4294967296"},
+		{OpClosure, []int{1}, "OpClosure expects 2 operands. got 1"},
+		{OpAdd, []int{1}, "OpAdd expects 0 operands. got 1"},
+		{Opcode(255), []int{}, "opcode 255 is undefined"},
+	}
+
+	for _, test := range tests {
+		_, err := Encode(test.op, test.operands...)
+		if err == nil {
+			t.Fatalf("expected an error encoding %d %v", test.op, test.operands)
+		}
+		if err.Error() != test.expectedError {
+			t.Errorf("wrong error. expected=%q, got=%q", test.expectedError, err.Error())
+		}
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Errorf("Make didn't panic on an operand overflow")
+		}
+	}()
+	Make(OpConstant, 1<<32)
+}
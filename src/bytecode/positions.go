@@ -0,0 +1,49 @@
+package bytecode
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Represents a position in the source code of a program.
+type Position struct {
+	Line   int
+	Column int
+}
+
+// Formats the position as `file:line:column`, or as `line L, column C` if the name of the file isn't known (the same
+// format as errors reported by the compiler).
+func (p Position) Format(filename string) string {
+	if filename != "" {
+		return fmt.Sprintf("%s:%d:%d", filename, p.Line, p.Column)
+	}
+	return fmt.Sprintf("line %d, column %d", p.Line, p.Column)
+}
+
+// Maps the offsets of instructions to the positions in the source code of the nodes they were compiled from. The table
+// is compact: each entry covers the instructions from its offset up to the offset of the next entry, so a series of
+// instructions compiled from the same node shares a single entry.
+type PositionTable []PositionEntry
+
+type PositionEntry struct {
+	Offset   int
+	Position Position
+}
+
+// Records that the instructions starting at the given offset were compiled from the given position, returning the
+// updated table. Offsets must be added in increasing order.
+func (pt PositionTable) Add(offset int, position Position) PositionTable {
+	if len(pt) > 0 && pt[len(pt)-1].Position == position {
+		return pt
+	}
+	return append(pt, PositionEntry{Offset: offset, Position: position})
+}
+
+// Returns the position of the instruction at (or spanning) the given offset, if it's covered by the table.
+func (pt PositionTable) Lookup(offset int) (Position, bool) {
+	i := sort.Search(len(pt), func(i int) bool { return pt[i].Offset > offset })
+	if i == 0 {
+		return Position{}, false
+	}
+	return pt[i-1].Position, true
+}
@@ -0,0 +1,50 @@
+package bytecode
+
+import "testing"
+
+func TestPositionTable(t *testing.T) {
+	table := PositionTable{}
+	table = table.Add(0, Position{Line: 1, Column: 1})
+	table = table.Add(3, Position{Line: 1, Column: 1})
+	table = table.Add(5, Position{Line: 2, Column: 9})
+	table = table.Add(9, Position{Line: 1, Column: 1})
+
+	if len(table) != 3 {
+		t.Fatalf("repeated position wasn't merged. got=%v", table)
+	}
+
+	tests := []struct {
+		offset   int
+		expected Position
+	}{
+		{0, Position{Line: 1, Column: 1}},
+		{4, Position{Line: 1, Column: 1}},
+		{5, Position{Line: 2, Column: 9}},
+		{8, Position{Line: 2, Column: 9}},
+		{100, Position{Line: 1, Column: 1}},
+	}
+
+	for _, test := range tests {
+		actual, ok := table.Lookup(test.offset)
+		if !ok {
+			t.Errorf("no position found for offset %d", test.offset)
+		} else if actual != test.expected {
+			t.Errorf("wrong position for offset %d. expected=%v, got=%v", test.offset, test.expected, actual)
+		}
+	}
+
+	if _, ok := table[1:].Lookup(0); ok {
+		t.Errorf("expected no position for an offset before the first entry")
+	}
+}
+
+func TestPositionFormat(t *testing.T) {
+	position := Position{Line: 3, Column: 14}
+
+	if actual := position.Format("main.mo"); actual != "main.mo:3:14" {
+		t.Errorf("wrong format. expected=%q, got=%q", "main.mo:3:14", actual)
+	}
+	if actual := position.Format(""); actual != "line 3, column 14" {
+		t.Errorf("wrong format. expected=%q, got=%q", "line 3, column 14", actual)
+	}
+}
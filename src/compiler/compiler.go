@@ -2,47 +2,62 @@ package compiler
 
 import (
 	"fmt"
+	"math"
 	"monkey/ast"
 	"monkey/bytecode"
+	"monkey/ir"
 	"monkey/object"
-	"sort"
 )
 
 // Represents bytecode generated and constants evaluated by the compiler.
 type Bytecode struct {
 	Instructions bytecode.Instructions
 	Constants    []object.Object
-}
+	NumLocals    int // The number of local slots used by top-level blocks, which are stored in the main frame.
+	NumGlobals   int // The number of global slots used by the program (including those of previous REPL inputs).
 
-// Represents an instruction that was emitted by the compiler.
-type EmittedInstruction struct {
-	Opcode   bytecode.Opcode
-	Position int
+	Positions bytecode.PositionTable // The positions in the source code of the program's top-level instructions.
+	Filename  string                 // The name of the file the program was compiled from (if any).
 }
 
-// Represents the scope of compilation.
+// Represents the scope of compilation: the function (or the program's top-level code) whose control-flow graph is being
+// generated.
 type CompilationScope struct {
-	instructions            bytecode.Instructions
-	lastInstruction         EmittedInstruction // The latest instruction emitted by the compiler.
-	previousLastInstruction EmittedInstruction // The second-to-latest instruction emitted by the compiler.
+	function *ir.Function
+	block    *ir.Block         // The block that instructions are currently being added to.
+	locals   map[int]*ir.Local // The local stored in each slot, as of the latest definition of a symbol in the slot.
+}
+
+// Options configuring how the compiler generates bytecode.
+type Options struct {
+	Filename        string // the name of the file being compiled (if any), used in assertion failure and runtime error messages
+	NoAsserts       bool   // strip assert statements instead of compiling them
+	NoOptimizations bool   // disable constant folding, dead-code elimination and peephole optimizations
 }
 
 // Represents a compiler for the Monkey programming language, generating bytecode instructions to execute.
 type Compiler struct {
-	constants []object.Object
+	options Options
+
+	constants       []object.Object
+	constantIndices map[interface{}]int // The indices of the interned constants, by their keys.
 
 	scopes     []CompilationScope
 	scopeIndex int
+	functions  []*ir.Function // The control-flow graphs of the functions compiled so far.
 
 	symbolTable *SymbolTable // The symbol table for the compiler to use for identifier associations (bindings).
+
+	hasState      bool            // Whether the compiler continues from the state of previous programs (e.g. in the REPL).
+	assignedNames map[string]bool // The names which are assigned to anywhere in the program being compiled.
+
+	position bytecode.Position // The position in the source code of the node being compiled.
+
+	err error // The first instruction that couldn't be encoded (e.g. because an operand overflows), if any.
 }
 
 func NewCompiler() *Compiler {
-	mainScope := CompilationScope{
-		instructions:            bytecode.Instructions{},
-		lastInstruction:         EmittedInstruction{},
-		previousLastInstruction: EmittedInstruction{},
-	}
+	mainScope := newCompilationScope("main")
 
 	symbolTable := NewSymbolTable()
 	for i, builtIn := range object.BuiltIns {
@@ -50,10 +65,12 @@ func NewCompiler() *Compiler {
 	}
 
 	return &Compiler{
-		constants: []object.Object{},
+		constants:       []object.Object{},
+		constantIndices: map[interface{}]int{},
 
 		scopes:     []CompilationScope{mainScope},
 		scopeIndex: 0,
+		functions:  []*ir.Function{},
 
 		symbolTable: symbolTable,
 	}
@@ -63,25 +80,43 @@ func NewCompilerWithState(st *SymbolTable, constants []object.Object) *Compiler
 	compiler := NewCompiler()
 	compiler.symbolTable = st
 	compiler.constants = constants
+	compiler.hasState = true
+	for i, constant := range constants {
+		if key, ok := internKey(constant); ok {
+			if _, ok := compiler.constantIndices[key]; !ok {
+				compiler.constantIndices[key] = i
+			}
+		}
+	}
 	return compiler
 }
 
+func (c *Compiler) SetOptions(options Options) {
+	c.options = options
+}
+
 func (c *Compiler) Compile(node ast.Node) error {
+	// Instructions are attributed to the innermost node with a known position (synthesized nodes, e.g. those desugared
+	// from increments, have none)
+	if tok := ast.TokenOf(node); tok.LineNumber > 0 {
+		outer := c.position
+		c.position = bytecode.Position{Line: tok.LineNumber, Column: tok.ColumnNumber}
+		defer func() { c.position = outer }()
+	}
+
 	switch node := node.(type) {
 	case *ast.Program:
-		for _, s := range node.Statements {
-			err := c.Compile(s)
-			if err != nil {
-				return err
-			}
+		c.assignedNames = assignedNames(node)
+
+		_, err := c.compileStatements(node.Statements, false)
+		if err != nil {
+			return err
 		}
 
 	case *ast.BlockStatement:
-		for _, s := range node.Statements {
-			err := c.Compile(s)
-			if err != nil {
-				return err
-			}
+		_, err := c.compileStatements(node.Statements, false)
+		if err != nil {
+			return err
 		}
 
 	case *ast.ExpressionStatement:
@@ -97,18 +132,14 @@ func (c *Compiler) Compile(node ast.Node) error {
 			return fmt.Errorf("line %d, column %d: identifier '%s' has already been declared", node.Token.LineNumber, node.Token.ColumnNumber, node.Name.Value)
 		}
 
-		symbol = c.symbolTable.Define(node.Name.Value)
-
+		// The value is compiled before the identifier is defined, so that it refers to any variable being shadowed
 		err := c.Compile(node.Value)
 		if err != nil {
 			return err
 		}
 
-		if symbol.Scope == GlobalScope {
-			c.emit(bytecode.OpSetGlobal, symbol.Index)
-		} else {
-			c.emit(bytecode.OpSetLocal, symbol.Index)
-		}
+		symbol = c.defineSymbol(node.Name.Value, false)
+		c.storeSymbol(symbol)
 
 	case *ast.ConstStatement:
 		symbol, ok := c.symbolTable.store[node.Name.Value] // Only able to declare this variable if it hasn't already been declared
@@ -116,38 +147,33 @@ func (c *Compiler) Compile(node ast.Node) error {
 			return fmt.Errorf("line %d, column %d: identifier '%s' has already been declared", node.Token.LineNumber, node.Token.ColumnNumber, node.Name.Value)
 		}
 
-		symbol = c.symbolTable.DefineConst(node.Name.Value)
-
+		// The value is compiled before the identifier is defined, so that it refers to any variable being shadowed
 		err := c.Compile(node.Value)
 		if err != nil {
 			return err
 		}
 
-		if symbol.Scope == GlobalScope {
-			c.emit(bytecode.OpSetGlobal, symbol.Index)
-		} else {
-			c.emit(bytecode.OpSetLocal, symbol.Index)
-		}
+		symbol = c.defineSymbol(node.Name.Value, true)
+		c.storeSymbol(symbol)
 
 	case *ast.AssignStatement:
-		symbol, ok := c.symbolTable.store[node.Name.Value] // Only able to reassign value if the variable was declared in the same scope we're currently in
+		symbol, ok := c.symbolTable.Resolve(node.Name.Value)
 		if !ok {
 			return fmt.Errorf("line %d, column %d: attempting to assign value to identifier '%s' prior to declaration", node.Token.LineNumber, node.Token.ColumnNumber, node.Name.Value)
 		}
 		if symbol.Const {
 			return fmt.Errorf("line %d, column %d: attempting to assign value to constant variable '%s'", node.Token.LineNumber, node.Token.ColumnNumber, node.Name.Value)
 		}
+		if symbol.Scope == BuiltInScope || symbol.Scope == FunctionScope {
+			return fmt.Errorf("line %d, column %d: attempting to assign value to function '%s'", node.Token.LineNumber, node.Token.ColumnNumber, node.Name.Value)
+		}
 
 		err := c.Compile(node.Value)
 		if err != nil {
 			return err
 		}
 
-		if symbol.Scope == GlobalScope {
-			c.emit(bytecode.OpSetGlobal, symbol.Index)
-		} else {
-			c.emit(bytecode.OpSetLocal, symbol.Index)
-		}
+		c.storeSymbol(symbol)
 
 	case *ast.Identifier:
 		symbol, ok := c.symbolTable.Resolve(node.Value)
@@ -156,8 +182,18 @@ func (c *Compiler) Compile(node ast.Node) error {
 		}
 
 		c.loadSymbol(symbol)
+		if symbol.Reserved {
+			// Hoisted functions can be called before the variables they refer to are declared
+			message := fmt.Sprintf("line %d, column %d: undefined variable: %s", node.Token.LineNumber, node.Token.ColumnNumber, node.Value)
+			c.emit(bytecode.OpCheckDefined, c.addConstant(&object.String{Value: message}))
+		}
 
 	case *ast.PrefixExpression:
+		if value, ok := c.constantValue(node); ok {
+			c.emitConstantValue(value)
+			return nil
+		}
+
 		err := c.Compile(node.Right)
 		if err != nil {
 			return err
@@ -173,6 +209,11 @@ func (c *Compiler) Compile(node ast.Node) error {
 		}
 
 	case *ast.InfixExpression:
+		if value, ok := c.constantValue(node); ok {
+			c.emitConstantValue(value)
+			return nil
+		}
+
 		err := c.Compile(node.Left)
 		if err != nil {
 			return err
@@ -198,6 +239,10 @@ func (c *Compiler) Compile(node ast.Node) error {
 			c.emit(bytecode.OpExp)
 		case "%":
 			c.emit(bytecode.OpMod)
+		case "|":
+			c.emit(bytecode.OpUnion)
+		case "&":
+			c.emit(bytecode.OpIntersection)
 
 		case "&&":
 			c.emit(bytecode.OpAnd)
@@ -216,61 +261,58 @@ func (c *Compiler) Compile(node ast.Node) error {
 			c.emit(bytecode.OpLessThanOrEqualTo)
 		case ">=":
 			c.emit(bytecode.OpGreaterThanOrEqualTo)
+		case "in":
+			c.emit(bytecode.OpIn)
 		default:
 			return fmt.Errorf("line %d, column %d: unknown operator: %s", node.Token.LineNumber, node.Token.ColumnNumber, node.Operator)
 		}
 
 	case *ast.IfExpression:
-		jumpPositions := []int{}
+		clauses, alternative, pruned := c.pruneClauses(node.Clauses, node.Alternative)
+		afterIfExpression := c.newBlock()
 
-		for _, clause := range node.Clauses {
+		for _, clause := range clauses {
 			err := c.Compile(clause.Condition)
 			if err != nil {
 				return err
 			}
 
-			// Emit an `OpJumpNotTruthy` with a bogus offset to be updated below with the position following this clause's consequence
-			jumpNotTruthyPos := c.emit(bytecode.OpJumpNotTruthy, 9999)
+			consequence, nextClause := c.newBlock(), c.newBlock()
+			c.branch(consequence, nextClause)
 
-			err = c.Compile(clause.Consequence)
+			c.startBlock(consequence)
+			err = c.compileBlockExpression(clause.Consequence)
 			if err != nil {
 				return err
 			}
-
-			if c.lastInstructionIs(bytecode.OpPop) {
-				c.removeLastPop()
+			if !c.alwaysReturns(clause.Consequence) {
+				c.jump(afterIfExpression)
 			}
 
-			// Emit an `OpJump` with a bogus offset to be updated below with the position following the end of the entire if expression
-			jumpPos := c.emit(bytecode.OpJump, 9999)
-			jumpPositions = append(jumpPositions, jumpPos)
-
-			afterClauseConsequencePos := len(c.currentInstructions())
-			c.changeOperand(jumpNotTruthyPos, afterClauseConsequencePos)
+			c.startBlock(nextClause)
 		}
 
-		if node.Alternative == nil {
+		if alternative == nil {
 			c.emit(bytecode.OpNull)
 		} else {
-			err := c.Compile(node.Alternative)
+			err := c.compileBlockExpression(alternative)
 			if err != nil {
 				return err
 			}
-
-			if c.lastInstructionIs(bytecode.OpPop) {
-				c.removeLastPop()
-			}
 		}
 
-		afterIfExpressionPos := len(c.currentInstructions())
-		for _, jumpPos := range jumpPositions {
-			c.changeOperand(jumpPos, afterIfExpressionPos)
+		err := c.compileUnreachable(pruned...)
+		if err != nil {
+			return err
 		}
 
+		c.startBlock(afterIfExpression)
+
 	case *ast.SwitchStatement:
-		jumpPositions := []int{}
+		cases, defaultCase, pruned := c.pruneCases(node)
+		afterSwitchStatement := c.newBlock()
 
-		for _, switchCase := range node.Cases {
+		for _, switchCase := range cases {
 			err := c.Compile(node.SwitchExpression)
 			if err != nil {
 				return err
@@ -283,112 +325,103 @@ func (c *Compiler) Compile(node ast.Node) error {
 
 			c.emit(bytecode.OpEqual)
 
-			// Emit an `OpJumpNotTruthy` with a bogus offset to be updated below with the position following this case's consequence
-			jumpNotTruthyPos := c.emit(bytecode.OpJumpNotTruthy, 9999)
+			consequence, nextCase := c.newBlock(), c.newBlock()
+			c.branch(consequence, nextCase)
 
-			err = c.Compile(switchCase.Consequence)
+			c.startBlock(consequence)
+			err = c.compileBlockExpression(switchCase.Consequence)
 			if err != nil {
 				return err
 			}
-
-			if c.lastInstructionIs(bytecode.OpPop) {
-				c.removeLastPop()
+			if !c.alwaysReturns(switchCase.Consequence) {
+				c.jump(afterSwitchStatement)
 			}
 
-			// Emit an `OpJump` with a bogus offset to be updated below with the position following the end of the entire switch statement
-			jumpPos := c.emit(bytecode.OpJump, 9999)
-			jumpPositions = append(jumpPositions, jumpPos)
-
-			afterCaseConsequencePos := len(c.currentInstructions())
-			c.changeOperand(jumpNotTruthyPos, afterCaseConsequencePos)
+			c.startBlock(nextCase)
 		}
 
-		if node.Default == nil {
+		if defaultCase == nil {
 			c.emit(bytecode.OpNull)
 		} else {
-			err := c.Compile(node.Default)
+			err := c.compileBlockExpression(defaultCase)
 			if err != nil {
 				return err
 			}
-
-			if c.lastInstructionIs(bytecode.OpPop) {
-				c.removeLastPop()
-			}
 		}
 
-		afterSwitchStatementPos := len(c.currentInstructions())
-		for _, jumpPos := range jumpPositions {
-			c.changeOperand(jumpPos, afterSwitchStatementPos)
+		err := c.compileUnreachable(pruned...)
+		if err != nil {
+			return err
 		}
 
+		c.startBlock(afterSwitchStatement)
+
 	case *ast.WhileLoop:
-		whileLoopStartPos := len(c.currentInstructions())
+		if c.isConstantlyFalsy(node.Condition) {
+			// The loop's body never runs, so the loop only evaluates to null
+			c.emit(bytecode.OpNull)
+			return c.compileUnreachable(node.Body)
+		}
 
+		loopCondition, loopBody, afterLoop := c.newBlock(), c.newBlock(), c.newBlock()
+
+		c.startBlock(loopCondition)
 		err := c.Compile(node.Condition)
 		if err != nil {
 			return err
 		}
+		c.branch(loopBody, afterLoop)
 
-		// Emit an `OpJumpNotTruthy` with a bogus offset to be updated below with the position following the loop body
-		jumpNotTruthyPos := c.emit(bytecode.OpJumpNotTruthy, 9999)
-
-		err = c.Compile(node.Body)
+		c.startBlock(loopBody)
+		err = c.compileBlock(node.Body)
 		if err != nil {
 			return err
 		}
+		c.jump(loopCondition) // Go back to the start of the loop
 
-		if c.lastInstructionIs(bytecode.OpPop) {
-			c.removeLastPop()
-		}
-
-		// Emit an `OpJump` to go back to the start of the loop
-		c.emit(bytecode.OpJump, whileLoopStartPos)
-
-		afterWhileLoopPos := len(c.currentInstructions())
-		c.changeOperand(jumpNotTruthyPos, afterWhileLoopPos)
+		c.startBlock(afterLoop)
 
 		// Emit an OpNull so that the OpPop emitted after this while loop is compiled doesn't change anything
 		c.emit(bytecode.OpNull)
 
 	case *ast.ForLoop:
+		// The loop's initialization statement declares bindings in a block scope surrounding the entire loop
+		c.enterBlockScope()
+		defer c.leaveBlockScope()
+
 		err := c.Compile(node.Init)
 		if err != nil {
 			return err
 		}
 
-		forLoopConditionStartPos := len(c.currentInstructions())
+		if c.isConstantlyFalsy(node.Condition) {
+			// The loop's body never runs, so the loop only evaluates to null once initialized
+			c.emit(bytecode.OpNull)
+			return c.compileUnreachable(node.Body, node.Afterthought)
+		}
+
+		loopCondition, loopBody, afterLoop := c.newBlock(), c.newBlock(), c.newBlock()
 
+		c.startBlock(loopCondition)
 		err = c.Compile(node.Condition)
 		if err != nil {
 			return err
 		}
+		c.branch(loopBody, afterLoop)
 
-		// Emit an `OpJumpNotTruthy` with a bogus offset to be updated below with the position following the loop body
-		jumpNotTruthyPos := c.emit(bytecode.OpJumpNotTruthy, 9999)
-
-		err = c.Compile(node.Body)
+		c.startBlock(loopBody)
+		err = c.compileBlock(node.Body)
 		if err != nil {
 			return err
 		}
 
-		if c.lastInstructionIs(bytecode.OpPop) {
-			c.removeLastPop()
-		}
-
 		err = c.Compile(node.Afterthought)
 		if err != nil {
 			return err
 		}
+		c.jump(loopCondition) // Go back to the start of the loop
 
-		if c.lastInstructionIs(bytecode.OpPop) {
-			c.removeLastPop()
-		}
-
-		// Emit an `OpJump` to go back to the start of the loop
-		c.emit(bytecode.OpJump, forLoopConditionStartPos)
-
-		afterForLoopPos := len(c.currentInstructions())
-		c.changeOperand(jumpNotTruthyPos, afterForLoopPos)
+		c.startBlock(afterLoop)
 
 		// Emit an OpNull so that the OpPop emitted after this for loop is compiled doesn't change anything
 		c.emit(bytecode.OpNull)
@@ -422,15 +455,7 @@ func (c *Compiler) Compile(node ast.Node) error {
 		c.emit(bytecode.OpArray, len(node.Elements))
 
 	case *ast.HashMapLiteral:
-		keys := []ast.Expression{}
-		for k := range node.KVPairs {
-			keys = append(keys, k)
-		}
-		sort.Slice(keys, func(i int, j int) bool {
-			return keys[i].String() < keys[j].String()
-		})
-
-		for _, k := range keys {
+		for _, k := range node.SortedKeys() {
 			err := c.Compile(k)
 			if err != nil {
 				return err
@@ -443,6 +468,15 @@ func (c *Compiler) Compile(node ast.Node) error {
 		}
 		c.emit(bytecode.OpHashMap, len(node.KVPairs)*2)
 
+	case *ast.SetLiteral:
+		for _, element := range node.Elements {
+			err := c.Compile(element)
+			if err != nil {
+				return err
+			}
+		}
+		c.emit(bytecode.OpSet, len(node.Elements))
+
 	case *ast.IndexExpression:
 		err := c.Compile(node.Left)
 		if err != nil {
@@ -464,164 +498,524 @@ func (c *Compiler) Compile(node ast.Node) error {
 		}
 
 		for _, p := range node.Parameters {
-			c.symbolTable.Define(p.Value)
+			c.defineSymbol(p.Value, false)
 		}
 
-		err := c.Compile(node.Body)
+		// The function returns the value of its last statement if it's an expression statement, or null otherwise
+		hasValue, err := c.compileStatements(node.Body.Statements, true)
 		if err != nil {
 			return err
 		}
 
-		if c.lastInstructionIs(bytecode.OpPop) {
-			c.replaceLastPopWithReturn()
-		}
-		if !c.lastInstructionIs(bytecode.OpReturnValue) {
-			c.emit(bytecode.OpReturn)
+		if hasValue {
+			c.terminate(&ir.Return{WithValue: true})
+		} else if !c.hasReturned() {
+			c.terminate(&ir.Return{WithValue: false})
 		}
 
 		freeSymbols := c.symbolTable.FreeSymbols
-		numLocals := c.symbolTable.numDefinitions
-		instructions := c.leaveScope()
+		numLocals := c.symbolTable.NumLocals()
+		function := c.leaveScope()
 
 		for _, fs := range freeSymbols {
-			c.loadSymbol(fs)
+			c.captureSymbol(fs)
 		}
 
+		instructions, positions := c.lower(function)
 		compiledFunction := &object.CompiledFunction{
+			Name:          node.Name,
 			Instructions:  instructions,
 			NumLocals:     numLocals,
 			NumParameters: len(node.Parameters),
+			Positions:     positions,
 		}
 		fnIndex := c.addConstant(compiledFunction)
 		c.emit(bytecode.OpClosure, fnIndex, len(freeSymbols))
 
+		function.Name = fmt.Sprintf("fn %s", node.Name)
+		if node.Name == "" {
+			function.Name = "fn"
+		}
+		function.Name += fmt.Sprintf(" (constant %d)", fnIndex)
+		c.functions = append(c.functions, function)
+
+	case *ast.FunctionDeclaration:
+		symbol, err := c.declareFunction(node)
+		if err != nil {
+			return err
+		}
+
+		err = c.defineFunction(node, symbol)
+		if err != nil {
+			return err
+		}
+
 	case *ast.ReturnStatement:
 		err := c.Compile(node.ReturnValue)
 		if err != nil {
 			return err
 		}
 
-		c.emit(bytecode.OpReturnValue)
+		c.terminate(&ir.Return{WithValue: true})
 
-	case *ast.CallExpression:
-		err := c.Compile(node.Function)
+	case *ast.DeferStatement:
+		call, ok := node.Call.(*ast.CallExpression)
+		if !ok {
+			return fmt.Errorf("line %d, column %d: expected a function call to defer. got %s instead", node.Token.LineNumber, node.Token.ColumnNumber, node.Call.String())
+		}
+
+		err := c.Compile(call.Function)
 		if err != nil {
 			return err
 		}
 
-		for _, argExp := range node.Arguments {
+		for _, argExp := range call.Arguments {
 			err = c.Compile(argExp)
 			if err != nil {
 				return err
 			}
 		}
 
-		c.emit(bytecode.OpCall, len(node.Arguments))
+		c.emit(bytecode.OpDefer, len(call.Arguments))
+
+	case *ast.AssertStatement:
+		if c.options.NoAsserts {
+			return nil
+		}
+
+		err := c.compileAssertStatement(node)
+		if err != nil {
+			return err
+		}
+
+	case *ast.CallExpression:
+		global, direct := c.directlyCallableGlobal(node.Function)
+		if !direct {
+			err := c.Compile(node.Function)
+			if err != nil {
+				return err
+			}
+		}
+
+		for _, argExp := range node.Arguments {
+			err := c.Compile(argExp)
+			if err != nil {
+				return err
+			}
+		}
+
+		if direct {
+			c.emit(bytecode.OpCallGlobal, global.Index, len(node.Arguments))
+		} else {
+			c.emit(bytecode.OpCall, len(node.Arguments))
+		}
 	}
 
-	return nil
+	// Instructions are emitted without checking for errors, so one which couldn't be encoded is reported here
+	return c.err
 }
 
 func (c *Compiler) Bytecode() *Bytecode {
+	instructions, positions := c.lower(c.currentScope().function)
 	return &Bytecode{
-		Instructions: c.currentInstructions(),
+		Instructions: instructions,
 		Constants:    c.constants,
+		NumLocals:    c.symbolTable.NumLocals(),
+		NumGlobals:   c.symbolTable.numDefinitions,
+		Positions:    positions,
+		Filename:     c.options.Filename,
 	}
 }
 
-func (c *Compiler) emit(op bytecode.Opcode, operands ...int) int {
-	instr := bytecode.Make(op, operands...)
-	pos := c.addInstruction(instr)
-
-	c.setLastInstruction(op, pos)
+// Returns the control-flow graphs generated for the program's top-level code, followed by those of the functions
+// defined in it.
+func (c *Compiler) IR() []*ir.Function {
+	return append([]*ir.Function{c.currentScope().function}, c.functions...)
+}
 
-	return pos
+// Lowers the control-flow graph of a function to bytecode, running the peephole optimizer over the instructions.
+// Returns the instructions along with the table of their positions in the source code.
+func (c *Compiler) lower(function *ir.Function) (bytecode.Instructions, bytecode.PositionTable) {
+	instructions, positions := function.Lower()
+	if c.options.NoOptimizations {
+		return instructions, positions
+	}
+	return optimizeInstructions(instructions, positions)
 }
 
-func (c *Compiler) setLastInstruction(op bytecode.Opcode, pos int) {
-	newPrevious := c.scopes[c.scopeIndex].lastInstruction
-	newLast := EmittedInstruction{Opcode: op, Position: pos}
+// Emits an instruction, recording an error if it can't be encoded (which is returned by Compile).
+func (c *Compiler) emit(op bytecode.Opcode, operands ...int) {
+	if _, err := bytecode.Encode(op, operands...); err != nil && c.err == nil {
+		c.err = fmt.Errorf("line %d, column %d: %s", c.position.Line, c.position.Column, err)
+	}
+	c.currentBlock().Emit(op, operands...).Position = c.position
+}
 
-	c.scopes[c.scopeIndex].previousLastInstruction = newPrevious
-	c.scopes[c.scopeIndex].lastInstruction = newLast
+// Emits an instruction operating on the local stored in the slot of the given symbol.
+func (c *Compiler) emitLocal(op bytecode.Opcode, symbol Symbol) {
+	local, ok := c.currentScope().locals[symbol.Index]
+	if !ok {
+		local = c.defineLocal(symbol)
+	}
+	c.currentBlock().EmitLocal(op, local).Position = c.position
 }
 
+// Adds the given object to the constant pool, returning its index. Integers, floats, strings and booleans are
+// interned, so identical values share a single constant.
 func (c *Compiler) addConstant(obj object.Object) int {
+	key, interned := internKey(obj)
+	if interned {
+		if index, ok := c.constantIndices[key]; ok {
+			return index
+		}
+	}
+
 	c.constants = append(c.constants, obj)
-	return len(c.constants) - 1
+	index := len(c.constants) - 1
+	if interned {
+		c.constantIndices[key] = index
+	}
+	return index
+}
+
+// Returns the key under which the given constant is interned, if it's a value that can be shared. The keys of
+// different types of constants never compare equal, since their dynamic types differ.
+func internKey(obj object.Object) (interface{}, bool) {
+	switch obj := obj.(type) {
+	case *object.Integer:
+		return obj.Value, true
+	case *object.Float:
+		return math.Float64bits(obj.Value), true
+	case *object.String:
+		return obj.Value, true
+	case *object.Boolean:
+		return obj.Value, true
+	}
+	return nil, false
 }
 
-func (c *Compiler) addInstruction(instr []byte) int {
-	posNewInstruction := len(c.currentInstructions())
-	updatedInstructions := append(c.currentInstructions(), instr...)
-	c.scopes[c.scopeIndex].instructions = updatedInstructions
-	return posNewInstruction
+func (c *Compiler) currentScope() *CompilationScope {
+	return &c.scopes[c.scopeIndex]
 }
 
-func (c *Compiler) replaceInstruction(pos int, newInstr []byte) {
-	instructions := c.currentInstructions()
-	for i := 0; i < len(newInstr); i++ {
-		instructions[pos+i] = newInstr[i]
+// Returns the block that instructions are being added to. Once a block is terminated, any instructions that follow
+// (e.g. statements following a `return`) are unreachable, so they're added to a new block which no other block leads to.
+func (c *Compiler) currentBlock() *ir.Block {
+	if c.currentScope().block.IsTerminated() {
+		c.startBlock(c.newBlock())
 	}
+	return c.currentScope().block
 }
 
-func (c *Compiler) replaceLastPopWithReturn() {
-	lastPos := c.scopes[c.scopeIndex].lastInstruction.Position
-	c.replaceInstruction(lastPos, bytecode.Make(bytecode.OpReturnValue))
-	c.scopes[c.scopeIndex].lastInstruction.Opcode = bytecode.OpReturnValue
+func (c *Compiler) newBlock() *ir.Block {
+	return c.currentScope().function.NewBlock()
 }
 
-func (c *Compiler) currentInstructions() bytecode.Instructions {
-	return c.scopes[c.scopeIndex].instructions
-}
+// Lays out the given block after the current block, and starts adding instructions to it. If the current block hasn't
+// been terminated, control falls through from it to the new block.
+func (c *Compiler) startBlock(block *ir.Block) {
+	scope := c.currentScope()
+	if !scope.block.IsTerminated() {
+		scope.block.Terminator = &ir.Jump{Target: block}
+	}
 
-func (c *Compiler) changeOperand(opPos int, operand int) {
-	op := bytecode.Opcode(c.currentInstructions()[opPos])
-	newInstruction := bytecode.Make(op, operand)
+	scope.function.Place(block)
+	scope.block = block
+}
 
-	c.replaceInstruction(opPos, newInstruction)
+func (c *Compiler) terminate(terminator ir.Terminator) {
+	c.currentBlock().Terminator = terminator
 }
 
-func (c *Compiler) lastInstructionIs(op bytecode.Opcode) bool {
-	if len(c.currentInstructions()) == 0 {
-		return false
-	}
+func (c *Compiler) jump(target *ir.Block) {
+	c.terminate(&ir.Jump{Target: target})
+}
 
-	return c.scopes[c.scopeIndex].lastInstruction.Opcode == op
+// Terminates the current block with a branch on the value on top of the stack.
+func (c *Compiler) branch(then *ir.Block, otherwise *ir.Block) {
+	c.terminate(&ir.Branch{Then: then, Else: otherwise})
 }
 
-func (c *Compiler) removeLastPop() {
-	last := c.scopes[c.scopeIndex].lastInstruction
-	previous := c.scopes[c.scopeIndex].previousLastInstruction
+// Reports whether the current block returns from the function, with no instructions having been emitted since.
+func (c *Compiler) hasReturned() bool {
+	_, ok := c.currentScope().block.Terminator.(*ir.Return)
+	return ok
+}
 
-	oldInstructions := c.currentInstructions()
-	newInstructions := oldInstructions[:last.Position]
+func newCompilationScope(name string) CompilationScope {
+	function := ir.NewFunction(name)
+	entry := function.NewBlock()
+	function.Place(entry)
 
-	c.scopes[c.scopeIndex].instructions = newInstructions
-	c.scopes[c.scopeIndex].lastInstruction = previous
+	return CompilationScope{
+		function: function,
+		block:    entry,
+		locals:   map[int]*ir.Local{},
+	}
 }
 
 func (c *Compiler) enterScope() {
-	newScope := CompilationScope{
-		instructions:            bytecode.Instructions{},
-		lastInstruction:         EmittedInstruction{},
-		previousLastInstruction: EmittedInstruction{},
-	}
-	c.scopes = append(c.scopes, newScope)
+	c.scopes = append(c.scopes, newCompilationScope("fn"))
 	c.scopeIndex += 1
 
 	c.symbolTable = NewEnclosedSymbolTable(c.symbolTable)
 }
 
-func (c *Compiler) leaveScope() bytecode.Instructions {
-	instructions := c.currentInstructions()
+func (c *Compiler) leaveScope() *ir.Function {
+	function := c.currentScope().function
 
 	c.scopes = c.scopes[:len(c.scopes)-1]
 	c.scopeIndex -= 1
 
 	c.symbolTable = c.symbolTable.outer
 
-	return instructions
+	return function
+}
+
+// Defines a symbol in the current symbol table. If the symbol is stored in a local slot, a new local of the current
+// function is declared for it.
+func (c *Compiler) defineSymbol(name string, isConst bool) Symbol {
+	// The local of a reserved symbol was already defined when it was reserved
+	if symbol, ok := c.symbolTable.declareReserved(name); ok {
+		return symbol
+	}
+
+	var symbol Symbol
+	if isConst {
+		symbol = c.symbolTable.DefineConst(name)
+	} else {
+		symbol = c.symbolTable.Define(name)
+	}
+
+	if symbol.Scope == LocalScope {
+		c.defineLocal(symbol)
+	}
+	return symbol
+}
+
+func (c *Compiler) defineLocal(symbol Symbol) *ir.Local {
+	scope := c.currentScope()
+	local := scope.function.NewLocal(symbol.Name, symbol.Index)
+	scope.locals[symbol.Index] = local
+	return local
+}
+
+// Compiles the statements of a program or block. Function declarations are hoisted: all of the block's functions are
+// declared and defined before any of its other statements run, so that they can be called from anywhere in the
+// block (including from each other). The variables and constants declared in the block are visible to its functions,
+// so their slots are reserved before the functions are compiled, but the block's other statements can only refer to
+// them once they've been declared.
+//
+// If keepValue is set and the last statement compiled is an expression statement, its value is left on the stack
+// instead of being popped, and true is returned.
+func (c *Compiler) compileStatements(statements []ast.Statement, keepValue bool) (bool, error) {
+	declarations := []*ast.FunctionDeclaration{}
+	symbols := []Symbol{}
+	others := []ast.Statement{}
+	for _, s := range statements {
+		if declaration, ok := s.(*ast.FunctionDeclaration); ok {
+			symbol, err := c.declareFunction(declaration)
+			if err != nil {
+				return false, err
+			}
+			declarations = append(declarations, declaration)
+			symbols = append(symbols, symbol)
+		} else {
+			others = append(others, s)
+		}
+	}
+
+	reserved := []string{}
+	if len(declarations) > 0 {
+		for _, s := range others {
+			switch s := s.(type) {
+			case *ast.LetStatement:
+				reserved = c.reserveSymbol(reserved, s.Name.Value, false)
+			case *ast.ConstStatement:
+				reserved = c.reserveSymbol(reserved, s.Name.Value, true)
+			}
+		}
+	}
+
+	for i, declaration := range declarations {
+		err := c.defineFunction(declaration, symbols[i])
+		if err != nil {
+			return false, err
+		}
+	}
+
+	for _, name := range reserved {
+		c.symbolTable.hideReserved(name)
+	}
+
+	unreachable := []ast.Node{}
+	for i, s := range others {
+		if _, ok := s.(*ast.ReturnStatement); ok && !c.options.NoOptimizations {
+			for _, statement := range others[i+1:] {
+				unreachable = append(unreachable, statement)
+			}
+			others = others[:i+1] // The remaining statements are unreachable
+			break
+		}
+	}
+
+	for i, s := range others {
+		if es, ok := s.(*ast.ExpressionStatement); ok && keepValue && i == len(others)-1 {
+			return true, c.Compile(es.Expression)
+		}
+
+		err := c.Compile(s)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	return false, c.compileUnreachable(unreachable...)
+}
+
+// Defines a symbol for a variable or constant ahead of its declaration, adding its name to the reserved names. Names
+// that are already declared in the current scope are skipped, since declaring them again is an error. A local's slot
+// may still hold a value from earlier (e.g. from the previous iteration of a loop), so it's cleared.
+func (c *Compiler) reserveSymbol(reserved []string, name string, isConst bool) []string {
+	if _, ok := c.symbolTable.store[name]; ok {
+		return reserved
+	}
+
+	symbol := c.symbolTable.reserve(name, isConst)
+	if symbol.Scope == LocalScope {
+		c.emitLocal(bytecode.OpClearLocal, symbol)
+	}
+	return append(reserved, name)
+}
+
+func (c *Compiler) declareFunction(declaration *ast.FunctionDeclaration) (Symbol, error) {
+	symbol, ok := c.symbolTable.store[declaration.Name.Value] // Only able to declare this function if its name hasn't already been declared
+	if ok && (symbol.Scope == GlobalScope || symbol.Scope == LocalScope) {
+		return Symbol{}, fmt.Errorf("line %d, column %d: identifier '%s' has already been declared", declaration.Name.Token.LineNumber, declaration.Name.Token.ColumnNumber, declaration.Name.Value)
+	}
+
+	return c.defineSymbol(declaration.Name.Value, false), nil
+}
+
+func (c *Compiler) defineFunction(declaration *ast.FunctionDeclaration, symbol Symbol) error {
+	err := c.Compile(declaration.Function)
+	if err != nil {
+		return err
+	}
+
+	c.storeSymbol(symbol)
+	return nil
+}
+
+func (c *Compiler) enterBlockScope() {
+	c.symbolTable = NewBlockSymbolTable(c.symbolTable)
+}
+
+// Leaves the current block scope. If any of the block's bindings were captured by closures, their upvalues are
+// closed, since the block's local slots may be reused once it ends (e.g. by the next iteration of a loop).
+func (c *Compiler) leaveBlockScope() {
+	if c.symbolTable.hasCaptures {
+		c.emit(bytecode.OpCloseUpvalues, c.symbolTable.blockStart)
+	}
+	c.symbolTable = c.symbolTable.outer
+}
+
+// Compiles the body of a conditional or loop in its own block scope, so that the bindings declared in the block
+// are released once it ends.
+func (c *Compiler) compileBlock(block *ast.BlockStatement) error {
+	c.enterBlockScope()
+	defer c.leaveBlockScope()
+
+	return c.Compile(block)
+}
+
+// Compiles a block whose value is used as the value of an expression (e.g. the consequence of a conditional),
+// leaving exactly one value on the stack: the value of its last expression statement, or null if the block
+// doesn't end with an expression statement. Nothing is left if the block always returns from the function.
+func (c *Compiler) compileBlockExpression(block *ast.BlockStatement) error {
+	c.enterBlockScope()
+	defer c.leaveBlockScope()
+
+	hasValue, err := c.compileStatements(block.Statements, true)
+	if err != nil {
+		return err
+	}
+
+	if !hasValue && !c.alwaysReturns(block) {
+		c.emit(bytecode.OpNull)
+	}
+
+	return nil
+}
+
+// Compiles an assert statement into a check of its condition, which skips over the failure if the condition is truthy.
+// On failure, the message and the names and values of the identifiers referenced by the condition are pushed for
+// `OpAssertFail` to report, along with the assertion's description.
+func (c *Compiler) compileAssertStatement(node *ast.AssertStatement) error {
+	err := c.Compile(node.Condition)
+	if err != nil {
+		return err
+	}
+
+	// Branch on the negated condition, so that the failure immediately follows the check
+	c.emit(bytecode.OpBang)
+	failure, afterFailure := c.newBlock(), c.newBlock()
+	c.branch(failure, afterFailure)
+
+	c.startBlock(failure)
+
+	if node.Message == nil {
+		c.emit(bytecode.OpNull)
+	} else {
+		err = c.Compile(node.Message)
+		if err != nil {
+			return err
+		}
+	}
+
+	names := node.ReferencedIdentifiers()
+	numReferenced := 0
+	for _, name := range names {
+		symbol, ok := c.symbolTable.Resolve(name)
+		if !ok || symbol.Scope == BuiltInScope {
+			continue
+		}
+
+		c.emit(bytecode.OpConstant, c.addConstant(&object.String{Value: name}))
+		c.loadSymbol(symbol)
+		numReferenced++
+	}
+
+	description := &object.String{Value: object.AssertionDescription(c.options.Filename, node)}
+	c.emit(bytecode.OpAssertFail, c.addConstant(description), numReferenced)
+
+	c.startBlock(afterFailure)
+
+	return nil
+}
+
+func (c *Compiler) storeSymbol(symbol Symbol) {
+	switch symbol.Scope {
+	case GlobalScope:
+		c.emit(bytecode.OpSetGlobal, symbol.Index)
+	case LocalScope:
+		c.emitLocal(bytecode.OpSetLocal, symbol)
+	case FreeScope:
+		c.emit(bytecode.OpSetUpvalue, symbol.Index)
+	}
+}
+
+// Emits the instruction capturing the given free symbol (as resolved from the enclosing scope) as an upvalue of the
+// closure being created.
+func (c *Compiler) captureSymbol(symbol Symbol) {
+	switch symbol.Scope {
+	case LocalScope:
+		c.emitLocal(bytecode.OpCaptureLocal, symbol)
+	case FreeScope:
+		c.emit(bytecode.OpCaptureUpvalue, symbol.Index)
+	case FunctionScope:
+		c.emit(bytecode.OpCaptureCurrentClosure)
+	}
 }
 
 func (c *Compiler) loadSymbol(symbol Symbol) {
@@ -629,9 +1023,9 @@ func (c *Compiler) loadSymbol(symbol Symbol) {
 	case GlobalScope:
 		c.emit(bytecode.OpGetGlobal, symbol.Index)
 	case LocalScope:
-		c.emit(bytecode.OpGetLocal, symbol.Index)
+		c.emitLocal(bytecode.OpGetLocal, symbol)
 	case FreeScope:
-		c.emit(bytecode.OpGetFreeVar, symbol.Index)
+		c.emit(bytecode.OpGetUpvalue, symbol.Index)
 	case FunctionScope:
 		c.emit(bytecode.OpCurrentClosure)
 	case BuiltInScope:
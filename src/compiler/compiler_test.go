@@ -8,6 +8,7 @@ import (
 	"monkey/lexer"
 	"monkey/object"
 	"monkey/parser"
+	"strings"
 	"testing"
 )
 
@@ -241,11 +242,11 @@ func TestBooleanExpressions(t *testing.T) {
 			input: "3 == 3",
 			expectedInstructions: []bytecode.Instructions{
 				bytecode.Make(bytecode.OpConstant, 0),
-				bytecode.Make(bytecode.OpConstant, 1),
+				bytecode.Make(bytecode.OpConstant, 0),
 				bytecode.Make(bytecode.OpEqual),
 				bytecode.Make(bytecode.OpPop),
 			},
-			expectedConstants: []interface{}{3, 3},
+			expectedConstants: []interface{}{3},
 		},
 		{
 			input: "3 == 7",
@@ -271,11 +272,11 @@ func TestBooleanExpressions(t *testing.T) {
 			input: "1 != 1",
 			expectedInstructions: []bytecode.Instructions{
 				bytecode.Make(bytecode.OpConstant, 0),
-				bytecode.Make(bytecode.OpConstant, 1),
+				bytecode.Make(bytecode.OpConstant, 0),
 				bytecode.Make(bytecode.OpNotEqual),
 				bytecode.Make(bytecode.OpPop),
 			},
-			expectedConstants: []interface{}{1, 1},
+			expectedConstants: []interface{}{1},
 		},
 		{
 			input: "6 < 8",
@@ -301,11 +302,11 @@ func TestBooleanExpressions(t *testing.T) {
 			input: "4 > 4",
 			expectedInstructions: []bytecode.Instructions{
 				bytecode.Make(bytecode.OpConstant, 0),
-				bytecode.Make(bytecode.OpConstant, 1),
+				bytecode.Make(bytecode.OpConstant, 0),
 				bytecode.Make(bytecode.OpGreaterThan),
 				bytecode.Make(bytecode.OpPop),
 			},
-			expectedConstants: []interface{}{4, 4},
+			expectedConstants: []interface{}{4},
 		},
 		{
 			input: "10 <= 12",
@@ -423,7 +424,7 @@ func TestConditionals(t *testing.T) {
 				bytecode.Make(bytecode.OpNull),
 				// 0021
 				bytecode.Make(bytecode.OpPop),
-				// 0022
+				// 0020
 				bytecode.Make(bytecode.OpConstant, 2),
 				// 0025
 				bytecode.Make(bytecode.OpPop),
@@ -513,13 +514,13 @@ func TestSwitchStatements(t *testing.T) {
 				// 0000
 				bytecode.Make(bytecode.OpConstant, 0),
 				// 0003
-				bytecode.Make(bytecode.OpConstant, 1),
+				bytecode.Make(bytecode.OpConstant, 0),
 				// 0006
 				bytecode.Make(bytecode.OpEqual),
 				// 0007
 				bytecode.Make(bytecode.OpJumpNotTruthy, 16),
 				// 0010
-				bytecode.Make(bytecode.OpConstant, 2),
+				bytecode.Make(bytecode.OpConstant, 1),
 				// 0013
 				bytecode.Make(bytecode.OpJump, 17),
 				// 0016
@@ -527,11 +528,11 @@ func TestSwitchStatements(t *testing.T) {
 				// 0017
 				bytecode.Make(bytecode.OpPop),
 				// 0018
-				bytecode.Make(bytecode.OpConstant, 3),
+				bytecode.Make(bytecode.OpConstant, 2),
 				// 0021
 				bytecode.Make(bytecode.OpPop),
 			},
-			expectedConstants: []interface{}{"hello", "hello", 10, 3333},
+			expectedConstants: []interface{}{"hello", 10, 3333},
 		},
 		{
 			input: `
@@ -547,25 +548,25 @@ func TestSwitchStatements(t *testing.T) {
 				// 0000
 				bytecode.Make(bytecode.OpConstant, 0),
 				// 0003
-				bytecode.Make(bytecode.OpConstant, 1),
+				bytecode.Make(bytecode.OpConstant, 0),
 				// 0006
 				bytecode.Make(bytecode.OpEqual),
 				// 0007
 				bytecode.Make(bytecode.OpJumpNotTruthy, 16),
 				// 0010
-				bytecode.Make(bytecode.OpConstant, 2),
+				bytecode.Make(bytecode.OpConstant, 1),
 				// 0013
 				bytecode.Make(bytecode.OpJump, 33),
 				// 0016
-				bytecode.Make(bytecode.OpConstant, 3),
+				bytecode.Make(bytecode.OpConstant, 0),
 				// 0019
-				bytecode.Make(bytecode.OpConstant, 4),
-				// 0022
+				bytecode.Make(bytecode.OpConstant, 2),
+				// 0020
 				bytecode.Make(bytecode.OpEqual),
 				// 0023
 				bytecode.Make(bytecode.OpJumpNotTruthy, 32),
 				// 0026
-				bytecode.Make(bytecode.OpConstant, 5),
+				bytecode.Make(bytecode.OpConstant, 3),
 				// 0029
 				bytecode.Make(bytecode.OpJump, 33),
 				// 0032
@@ -573,11 +574,11 @@ func TestSwitchStatements(t *testing.T) {
 				// 0033
 				bytecode.Make(bytecode.OpPop),
 				// 0034
-				bytecode.Make(bytecode.OpConstant, 6),
+				bytecode.Make(bytecode.OpConstant, 4),
 				// 0037
 				bytecode.Make(bytecode.OpPop),
 			},
-			expectedConstants: []interface{}{"hello", "hello", 10, "hello", "world", 20, 3333},
+			expectedConstants: []interface{}{"hello", 10, "world", 20, 3333},
 		},
 		{
 			input: `
@@ -595,37 +596,37 @@ func TestSwitchStatements(t *testing.T) {
 				// 0000
 				bytecode.Make(bytecode.OpConstant, 0),
 				// 0003
-				bytecode.Make(bytecode.OpConstant, 1),
+				bytecode.Make(bytecode.OpConstant, 0),
 				// 0006
 				bytecode.Make(bytecode.OpEqual),
 				// 0007
 				bytecode.Make(bytecode.OpJumpNotTruthy, 16),
 				// 0010
-				bytecode.Make(bytecode.OpConstant, 2),
+				bytecode.Make(bytecode.OpConstant, 1),
 				// 0013
 				bytecode.Make(bytecode.OpJump, 35),
 				// 0016
-				bytecode.Make(bytecode.OpConstant, 3),
+				bytecode.Make(bytecode.OpConstant, 0),
 				// 0019
-				bytecode.Make(bytecode.OpConstant, 4),
-				// 0022
+				bytecode.Make(bytecode.OpConstant, 2),
+				// 0020
 				bytecode.Make(bytecode.OpEqual),
 				// 0023
 				bytecode.Make(bytecode.OpJumpNotTruthy, 32),
 				// 0026
-				bytecode.Make(bytecode.OpConstant, 5),
+				bytecode.Make(bytecode.OpConstant, 3),
 				// 0029
 				bytecode.Make(bytecode.OpJump, 35),
 				// 0032
-				bytecode.Make(bytecode.OpConstant, 6),
+				bytecode.Make(bytecode.OpConstant, 4),
 				// 0035
 				bytecode.Make(bytecode.OpPop),
 				// 0036
-				bytecode.Make(bytecode.OpConstant, 7),
+				bytecode.Make(bytecode.OpConstant, 5),
 				// 0039
 				bytecode.Make(bytecode.OpPop),
 			},
-			expectedConstants: []interface{}{"hello", "hello", 10, "hello", "world", 20, 30, 3333},
+			expectedConstants: []interface{}{"hello", 10, "world", 20, 30, 3333},
 		},
 	}
 
@@ -642,18 +643,20 @@ func TestWhileLoops(t *testing.T) {
 				// 0000
 				bytecode.Make(bytecode.OpTrue),
 				// 0001
-				bytecode.Make(bytecode.OpJumpNotTruthy, 10),
+				bytecode.Make(bytecode.OpJumpNotTruthy, 11),
 				// 0004
 				bytecode.Make(bytecode.OpConstant, 0),
 				// 0007
+				bytecode.Make(bytecode.OpPop),
+				// 0008
 				bytecode.Make(bytecode.OpJump, 0),
-				// 0010
-				bytecode.Make(bytecode.OpNull),
 				// 0011
-				bytecode.Make(bytecode.OpPop),
+				bytecode.Make(bytecode.OpNull),
 				// 0012
+				bytecode.Make(bytecode.OpPop),
+				// 0013
 				bytecode.Make(bytecode.OpConstant, 1),
-				// 0015
+				// 0016
 				bytecode.Make(bytecode.OpPop),
 			},
 			expectedConstants: []interface{}{10, 3333},
@@ -679,7 +682,7 @@ func TestWhileLoops(t *testing.T) {
 				bytecode.Make(bytecode.OpGetGlobal, 0),
 				// 0019
 				bytecode.Make(bytecode.OpConstant, 2),
-				// 0022
+				// 0020
 				bytecode.Make(bytecode.OpAdd),
 				// 0023
 				bytecode.Make(bytecode.OpSetGlobal, 0),
@@ -717,7 +720,7 @@ func TestWhileLoops(t *testing.T) {
 				bytecode.Make(bytecode.OpGetGlobal, 0),
 				// 0019
 				bytecode.Make(bytecode.OpConstant, 2),
-				// 0022
+				// 0020
 				bytecode.Make(bytecode.OpAdd),
 				// 0023
 				bytecode.Make(bytecode.OpSetGlobal, 0),
@@ -755,7 +758,7 @@ func TestWhileLoops(t *testing.T) {
 				bytecode.Make(bytecode.OpGetGlobal, 0),
 				// 0019
 				bytecode.Make(bytecode.OpConstant, 2),
-				// 0022
+				// 0020
 				bytecode.Make(bytecode.OpAdd),
 				// 0023
 				bytecode.Make(bytecode.OpSetGlobal, 0),
@@ -787,39 +790,41 @@ func TestForLoops(t *testing.T) {
 				// 0000
 				bytecode.Make(bytecode.OpConstant, 0),
 				// 0003
-				bytecode.Make(bytecode.OpSetGlobal, 0),
+				bytecode.Make(bytecode.OpSetLocal, 0),
 
-				// 0006
+				// 0005
 				bytecode.Make(bytecode.OpTrue),
-				// 0007
-				bytecode.Make(bytecode.OpJumpNotTruthy, 30),
+				// 0006
+				bytecode.Make(bytecode.OpJumpNotTruthy, 27),
 
-				// 0010
+				// 0009
 				bytecode.Make(bytecode.OpGetBuiltIn, 0),
-				// 0012
-				bytecode.Make(bytecode.OpGetGlobal, 0),
-				// 0015
+				// 0011
+				bytecode.Make(bytecode.OpGetLocal, 0),
+				// 0013
 				bytecode.Make(bytecode.OpCall, 1),
+				// 0015
+				bytecode.Make(bytecode.OpPop),
 
-				// 0017
-				bytecode.Make(bytecode.OpGetGlobal, 0),
-				// 0020
+				// 0016
+				bytecode.Make(bytecode.OpGetLocal, 0),
+				// 0018
 				bytecode.Make(bytecode.OpConstant, 1),
-				// 0023
+				// 0021
 				bytecode.Make(bytecode.OpAdd),
+				// 0022
+				bytecode.Make(bytecode.OpSetLocal, 0),
 				// 0024
-				bytecode.Make(bytecode.OpSetGlobal, 0),
-				// 0027
-				bytecode.Make(bytecode.OpJump, 6),
+				bytecode.Make(bytecode.OpJump, 5),
 
-				// 0030
+				// 0027
 				bytecode.Make(bytecode.OpNull),
-				// 0031
+				// 0028
 				bytecode.Make(bytecode.OpPop),
 
-				// 0032
+				// 0029
 				bytecode.Make(bytecode.OpConstant, 2),
-				// 0035
+				// 0032
 				bytecode.Make(bytecode.OpPop),
 			},
 			expectedConstants: []interface{}{0, 1, 3333},
@@ -832,39 +837,41 @@ func TestForLoops(t *testing.T) {
 				// 0000
 				bytecode.Make(bytecode.OpConstant, 0),
 				// 0003
-				bytecode.Make(bytecode.OpSetGlobal, 0),
+				bytecode.Make(bytecode.OpSetLocal, 0),
 
-				// 0006
+				// 0005
 				bytecode.Make(bytecode.OpTrue),
-				// 0007
-				bytecode.Make(bytecode.OpJumpNotTruthy, 30),
+				// 0006
+				bytecode.Make(bytecode.OpJumpNotTruthy, 27),
 
-				// 0010
+				// 0009
 				bytecode.Make(bytecode.OpGetBuiltIn, 0),
-				// 0012
-				bytecode.Make(bytecode.OpGetGlobal, 0),
-				// 0015
+				// 0011
+				bytecode.Make(bytecode.OpGetLocal, 0),
+				// 0013
 				bytecode.Make(bytecode.OpCall, 1),
+				// 0015
+				bytecode.Make(bytecode.OpPop),
 
-				// 0017
-				bytecode.Make(bytecode.OpGetGlobal, 0),
-				// 0020
+				// 0016
+				bytecode.Make(bytecode.OpGetLocal, 0),
+				// 0018
 				bytecode.Make(bytecode.OpConstant, 1),
-				// 0023
+				// 0021
 				bytecode.Make(bytecode.OpAdd),
+				// 0022
+				bytecode.Make(bytecode.OpSetLocal, 0),
 				// 0024
-				bytecode.Make(bytecode.OpSetGlobal, 0),
-				// 0027
-				bytecode.Make(bytecode.OpJump, 6),
+				bytecode.Make(bytecode.OpJump, 5),
 
-				// 0030
+				// 0027
 				bytecode.Make(bytecode.OpNull),
-				// 0031
+				// 0028
 				bytecode.Make(bytecode.OpPop),
 
-				// 0032
+				// 0029
 				bytecode.Make(bytecode.OpConstant, 2),
-				// 0035
+				// 0032
 				bytecode.Make(bytecode.OpPop),
 			},
 			expectedConstants: []interface{}{0, 1, 3333},
@@ -888,60 +895,198 @@ func TestForLoops(t *testing.T) {
 				// 0015
 				bytecode.Make(bytecode.OpConstant, 3),
 				// 0018
-				bytecode.Make(bytecode.OpSetGlobal, 1),
+				bytecode.Make(bytecode.OpSetLocal, 0),
 
-				// 0021
-				bytecode.Make(bytecode.OpGetGlobal, 1),
-				// 0024
+				// 0020
+				bytecode.Make(bytecode.OpGetLocal, 0),
+				// 0020
 				bytecode.Make(bytecode.OpGetBuiltIn, 1),
-				// 0026
+				// 0024
 				bytecode.Make(bytecode.OpGetGlobal, 0),
-				// 0029
+				// 0027
 				bytecode.Make(bytecode.OpCall, 1),
-				// 0031
+				// 0029
 				bytecode.Make(bytecode.OpLessThan),
-				// 0032
-				bytecode.Make(bytecode.OpJumpNotTruthy, 59),
+				// 0030
+				bytecode.Make(bytecode.OpJumpNotTruthy, 55),
 
-				// 0035
+				// 0033
 				bytecode.Make(bytecode.OpGetBuiltIn, 0),
-				// 0037
+				// 0035
 				bytecode.Make(bytecode.OpGetGlobal, 0),
+				// 0038
+				bytecode.Make(bytecode.OpGetLocal, 0),
 				// 0040
-				bytecode.Make(bytecode.OpGetGlobal, 1),
-				// 0043
 				bytecode.Make(bytecode.OpIndex),
-				// 0044
+				// 0041
 				bytecode.Make(bytecode.OpCall, 1),
+				// 0043
+				bytecode.Make(bytecode.OpPop),
 
+				// 0044
+				bytecode.Make(bytecode.OpGetLocal, 0),
 				// 0046
-				bytecode.Make(bytecode.OpGetGlobal, 1),
+				bytecode.Make(bytecode.OpConstant, 0),
 				// 0049
-				bytecode.Make(bytecode.OpConstant, 4),
-				// 0052
 				bytecode.Make(bytecode.OpAdd),
-				// 0053
-				bytecode.Make(bytecode.OpSetGlobal, 1),
-				// 0056
-				bytecode.Make(bytecode.OpJump, 21),
+				// 0050
+				bytecode.Make(bytecode.OpSetLocal, 0),
+				// 0052
+				bytecode.Make(bytecode.OpJump, 20),
 
-				// 0059
+				// 0055
 				bytecode.Make(bytecode.OpNull),
+				// 0056
+				bytecode.Make(bytecode.OpPop),
+
+				// 0057
+				bytecode.Make(bytecode.OpConstant, 4),
 				// 0060
 				bytecode.Make(bytecode.OpPop),
+			},
+			expectedConstants: []interface{}{1, 2, 3, 0, 3333},
+		},
+	}
 
-				// 0061
-				bytecode.Make(bytecode.OpConstant, 5),
-				// 0064
+	runCompilerTests(t, tests)
+}
+
+func TestBlockScopeCompilation(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input: `
+			fn() {
+				if (true) { let a = 1; a } else { let b = 2; b }
+			}
+			`,
+			expectedConstants: []interface{}{
+				1,
+				2,
+				[]bytecode.Instructions{
+					// 0000
+					bytecode.Make(bytecode.OpTrue),
+					// 0001
+					bytecode.Make(bytecode.OpJumpNotTruthy, 14),
+					// 0004
+					bytecode.Make(bytecode.OpConstant, 0),
+					// 0007
+					bytecode.Make(bytecode.OpSetLocal, 0),
+					// 0009
+					bytecode.Make(bytecode.OpGetLocal, 0),
+					// 0011
+					bytecode.Make(bytecode.OpJump, 21),
+					// 0014
+					bytecode.Make(bytecode.OpConstant, 1),
+					// 0017
+					bytecode.Make(bytecode.OpSetLocal, 0),
+					// 0019
+					bytecode.Make(bytecode.OpGetLocal, 0),
+					// 0021
+					bytecode.Make(bytecode.OpReturnValue),
+				},
+			},
+			expectedInstructions: []bytecode.Instructions{
+				bytecode.Make(bytecode.OpClosure, 2, 0),
+				bytecode.Make(bytecode.OpPop),
+			},
+		},
+		{
+			input: `
+			let x = 0;
+			if (true) { let y = 1; x = y; }
+			`,
+			expectedConstants: []interface{}{0, 1},
+			expectedInstructions: []bytecode.Instructions{
+				// 0000
+				bytecode.Make(bytecode.OpConstant, 0),
+				// 0003
+				bytecode.Make(bytecode.OpSetGlobal, 0),
+				// 0006
+				bytecode.Make(bytecode.OpTrue),
+				// 0007
+				bytecode.Make(bytecode.OpJumpNotTruthy, 24),
+				// 0010
+				bytecode.Make(bytecode.OpConstant, 1),
+				// 0013
+				bytecode.Make(bytecode.OpSetLocal, 0),
+				// 0015
+				bytecode.Make(bytecode.OpGetLocal, 0),
+				// 0017
+				bytecode.Make(bytecode.OpSetGlobal, 0),
+				// 0020
+				bytecode.Make(bytecode.OpNull),
+				// 0021
+				bytecode.Make(bytecode.OpJump, 25),
+				// 0024
+				bytecode.Make(bytecode.OpNull),
+				// 0025
 				bytecode.Make(bytecode.OpPop),
 			},
-			expectedConstants: []interface{}{1, 2, 3, 0, 1, 3333},
 		},
 	}
 
 	runCompilerTests(t, tests)
 }
 
+func TestBlockScopeNumLocals(t *testing.T) {
+	tests := []struct {
+		input                 string
+		expectedMainNumLocals int
+		expectedFnNumLocals   int
+	}{
+		{
+			input:                 `fn(a) { let b = 1; while (true) { let c = 2; } for (let d = 0; d < 1; d++) { let e = 3; } }`,
+			expectedMainNumLocals: 0,
+			expectedFnNumLocals:   4,
+		},
+		{
+			input:                 `if (true) { let a = 1; let b = 2; } else { let c = 3; }; fn() { if (true) { let d = 4; } }`,
+			expectedMainNumLocals: 2,
+			expectedFnNumLocals:   1,
+		},
+	}
+
+	for _, test := range tests {
+		compiler := NewCompiler()
+		err := compiler.Compile(parse(test.input))
+		if err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		bytecode := compiler.Bytecode()
+		if bytecode.NumLocals != test.expectedMainNumLocals {
+			t.Errorf("wrong number of main frame locals. expected=%d, got=%d", test.expectedMainNumLocals, bytecode.NumLocals)
+		}
+
+		fn, ok := bytecode.Constants[len(bytecode.Constants)-1].(*object.CompiledFunction)
+		if !ok {
+			t.Fatalf("last constant is not a function: %T", bytecode.Constants[len(bytecode.Constants)-1])
+		}
+		if fn.NumLocals != test.expectedFnNumLocals {
+			t.Errorf("wrong number of function locals. expected=%d, got=%d", test.expectedFnNumLocals, fn.NumLocals)
+		}
+	}
+}
+
+func TestBlockScopeErrors(t *testing.T) {
+	tests := []compilerErrorTestCase{
+		{
+			input:         `if (true) { let x = 1; }; x;`,
+			expectedError: `line 1, column 26: undefined variable: x`,
+		},
+		{
+			input:         `for (let i = 0; i < 3; i++) { }; i;`,
+			expectedError: `line 1, column 33: undefined variable: i`,
+		},
+		{
+			input:         `while (true) { let x = 1; let x = 2; }`,
+			expectedError: `line 1, column 26: identifier 'x' has already been declared`,
+		},
+	}
+
+	runCompilerErrorTests(t, tests)
+}
+
 func TestGlobalLetStatements(t *testing.T) {
 	tests := []compilerTestCase{
 		{
@@ -1058,7 +1203,7 @@ func TestConstStatementsErrors(t *testing.T) {
 			}
 			num;
 			`,
-			expectedError: `line 4, column 4: attempting to assign value to identifier 'num' prior to declaration`,
+			expectedError: `line 4, column 4: attempting to assign value to constant variable 'num'`,
 		},
 		{
 			input: `
@@ -1160,29 +1305,26 @@ func TestAssignStatementsErrors(t *testing.T) {
 		},
 		{
 			input: `
-			let num = 10;
-			fn() {
-				num = 20;
-				num;
-			}
-			num;
+			let f = fn() {
+				f = 1;
+			};
 			`,
-			expectedError: `line 4, column 4: attempting to assign value to identifier 'num' prior to declaration`,
+			expectedError: `line 3, column 4: attempting to assign value to function 'f'`,
 		},
 		{
 			input: `
-			let num = 10;
-			let f = fn() {
-				let num = 20;
-				let g = fn() {
-					num = 30;
-					return num
-				};
-				return g()
-			};
-			num + f();
+			len = 1;
+			`,
+			expectedError: `line 2, column 3: attempting to assign value to function 'len'`,
+		},
+		{
+			input: `
+			fn() {
+				const num = 10;
+				fn() { num = 20; }
+			}
 			`,
-			expectedError: `line 6, column 5: attempting to assign value to identifier 'num' prior to declaration`,
+			expectedError: `line 4, column 11: attempting to assign value to constant variable 'num'`,
 		},
 	}
 
@@ -1339,6 +1481,62 @@ func TestHashMapLiterals(t *testing.T) {
 	runCompilerTests(t, tests)
 }
 
+func TestSetLiterals(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input: "#{}",
+			expectedInstructions: []bytecode.Instructions{
+				bytecode.Make(bytecode.OpSet, 0),
+				bytecode.Make(bytecode.OpPop),
+			},
+			expectedConstants: []interface{}{},
+		},
+		{
+			input: "#{1, 2 + 3}",
+			expectedInstructions: []bytecode.Instructions{
+				bytecode.Make(bytecode.OpConstant, 0),
+				bytecode.Make(bytecode.OpConstant, 1),
+				bytecode.Make(bytecode.OpConstant, 2),
+				bytecode.Make(bytecode.OpAdd),
+				bytecode.Make(bytecode.OpSet, 2),
+				bytecode.Make(bytecode.OpPop),
+			},
+			expectedConstants: []interface{}{1, 2, 3},
+		},
+		{
+			input: "#{1} | #{2} & #{3} - #{4}",
+			expectedInstructions: []bytecode.Instructions{
+				bytecode.Make(bytecode.OpConstant, 0),
+				bytecode.Make(bytecode.OpSet, 1),
+				bytecode.Make(bytecode.OpConstant, 1),
+				bytecode.Make(bytecode.OpSet, 1),
+				bytecode.Make(bytecode.OpConstant, 2),
+				bytecode.Make(bytecode.OpSet, 1),
+				bytecode.Make(bytecode.OpIntersection),
+				bytecode.Make(bytecode.OpUnion),
+				bytecode.Make(bytecode.OpConstant, 3),
+				bytecode.Make(bytecode.OpSet, 1),
+				bytecode.Make(bytecode.OpSub),
+				bytecode.Make(bytecode.OpPop),
+			},
+			expectedConstants: []interface{}{1, 2, 3, 4},
+		},
+		{
+			input: "1 in #{1}",
+			expectedInstructions: []bytecode.Instructions{
+				bytecode.Make(bytecode.OpConstant, 0),
+				bytecode.Make(bytecode.OpConstant, 0),
+				bytecode.Make(bytecode.OpSet, 1),
+				bytecode.Make(bytecode.OpIn),
+				bytecode.Make(bytecode.OpPop),
+			},
+			expectedConstants: []interface{}{1},
+		},
+	}
+
+	runCompilerTests(t, tests)
+}
+
 func TestIndexExpressions(t *testing.T) {
 	tests := []compilerTestCase{
 		{
@@ -1348,13 +1546,13 @@ func TestIndexExpressions(t *testing.T) {
 				bytecode.Make(bytecode.OpConstant, 1),
 				bytecode.Make(bytecode.OpConstant, 2),
 				bytecode.Make(bytecode.OpArray, 3),
-				bytecode.Make(bytecode.OpConstant, 3),
-				bytecode.Make(bytecode.OpConstant, 4),
+				bytecode.Make(bytecode.OpConstant, 0),
+				bytecode.Make(bytecode.OpConstant, 0),
 				bytecode.Make(bytecode.OpAdd),
 				bytecode.Make(bytecode.OpIndex),
 				bytecode.Make(bytecode.OpPop),
 			},
-			expectedConstants: []interface{}{1, 2, 3, 1, 1},
+			expectedConstants: []interface{}{1, 2, 3},
 		},
 		{
 			input: "{1: 2}[2 - 1]",
@@ -1362,13 +1560,13 @@ func TestIndexExpressions(t *testing.T) {
 				bytecode.Make(bytecode.OpConstant, 0),
 				bytecode.Make(bytecode.OpConstant, 1),
 				bytecode.Make(bytecode.OpHashMap, 2),
-				bytecode.Make(bytecode.OpConstant, 2),
-				bytecode.Make(bytecode.OpConstant, 3),
+				bytecode.Make(bytecode.OpConstant, 1),
+				bytecode.Make(bytecode.OpConstant, 0),
 				bytecode.Make(bytecode.OpSub),
 				bytecode.Make(bytecode.OpIndex),
 				bytecode.Make(bytecode.OpPop),
 			},
-			expectedConstants: []interface{}{1, 2, 2, 1},
+			expectedConstants: []interface{}{1, 2},
 		},
 	}
 
@@ -1391,13 +1589,12 @@ func TestCompilerScopes(t *testing.T) {
 
 	compiler.emit(bytecode.OpSub)
 
-	if len(compiler.scopes[compiler.scopeIndex].instructions) != 1 {
-		t.Errorf("length of instructions is wrong. expected=%d, got=%d", 1, len(compiler.scopes[compiler.scopeIndex].instructions))
+	instructions := compiler.currentScope().block.Instructions
+	if len(instructions) != 1 {
+		t.Errorf("length of instructions is wrong. expected=%d, got=%d", 1, len(instructions))
 	}
-
-	last := compiler.scopes[compiler.scopeIndex].lastInstruction
-	if last.Opcode != bytecode.OpSub {
-		t.Errorf("lastInstruction.Opcode is wrong. expected=%d, got=%d", bytecode.OpSub, last.Opcode)
+	if instructions[0].Opcode != bytecode.OpSub {
+		t.Errorf("last instruction's opcode is wrong. expected=%d, got=%d", bytecode.OpSub, instructions[0].Opcode)
 	}
 
 	if compiler.symbolTable.outer != globalSymbolTable {
@@ -1418,18 +1615,15 @@ func TestCompilerScopes(t *testing.T) {
 
 	compiler.emit(bytecode.OpAdd)
 
-	if len(compiler.scopes[compiler.scopeIndex].instructions) != 2 {
-		t.Errorf("length of instructions is wrong. expected=%d, got=%d", 2, len(compiler.scopes[compiler.scopeIndex].instructions))
+	instructions = compiler.currentScope().block.Instructions
+	if len(instructions) != 2 {
+		t.Errorf("length of instructions is wrong. expected=%d, got=%d", 2, len(instructions))
 	}
-
-	last = compiler.scopes[compiler.scopeIndex].lastInstruction
-	if last.Opcode != bytecode.OpAdd {
-		t.Errorf("lastInstruction.Opcode is wrong. expected=%d, got=%d", bytecode.OpAdd, last.Opcode)
+	if instructions[1].Opcode != bytecode.OpAdd {
+		t.Errorf("last instruction's opcode is wrong. expected=%d, got=%d", bytecode.OpAdd, instructions[1].Opcode)
 	}
-
-	previous := compiler.scopes[compiler.scopeIndex].previousLastInstruction
-	if previous.Opcode != bytecode.OpMul {
-		t.Errorf("lastInstruction.Opcode is wrong. expected=%d, got=%d", bytecode.OpMul, last.Opcode)
+	if instructions[0].Opcode != bytecode.OpMul {
+		t.Errorf("previous instruction's opcode is wrong. expected=%d, got=%d", bytecode.OpMul, instructions[0].Opcode)
 	}
 }
 
@@ -1664,6 +1858,34 @@ func TestLetStatementScopes(t *testing.T) {
 				},
 			},
 		},
+		{
+			// The value is compiled before the name is defined, so it refers to the variable being shadowed
+			input: `
+			let num = 55;
+			fn() {
+				let num = num + 1;
+				num
+			}
+			`,
+			expectedInstructions: []bytecode.Instructions{
+				bytecode.Make(bytecode.OpConstant, 0),
+				bytecode.Make(bytecode.OpSetGlobal, 0),
+				bytecode.Make(bytecode.OpClosure, 2, 0),
+				bytecode.Make(bytecode.OpPop),
+			},
+			expectedConstants: []interface{}{
+				55,
+				1,
+				[]bytecode.Instructions{
+					bytecode.Make(bytecode.OpGetGlobal, 0),
+					bytecode.Make(bytecode.OpConstant, 1),
+					bytecode.Make(bytecode.OpAdd),
+					bytecode.Make(bytecode.OpSetLocal, 0),
+					bytecode.Make(bytecode.OpGetLocal, 0),
+					bytecode.Make(bytecode.OpReturnValue),
+				},
+			},
+		},
 	}
 
 	runCompilerTests(t, tests)
@@ -1893,13 +2115,13 @@ func TestClosures(t *testing.T) {
 			},
 			expectedConstants: []interface{}{
 				[]bytecode.Instructions{
-					bytecode.Make(bytecode.OpGetFreeVar, 0),
+					bytecode.Make(bytecode.OpGetUpvalue, 0),
 					bytecode.Make(bytecode.OpGetLocal, 0),
 					bytecode.Make(bytecode.OpAdd),
 					bytecode.Make(bytecode.OpReturnValue),
 				},
 				[]bytecode.Instructions{
-					bytecode.Make(bytecode.OpGetLocal, 0),
+					bytecode.Make(bytecode.OpCaptureLocal, 0),
 					bytecode.Make(bytecode.OpClosure, 0, 1),
 					bytecode.Make(bytecode.OpReturnValue),
 				},
@@ -1921,21 +2143,21 @@ func TestClosures(t *testing.T) {
 			},
 			expectedConstants: []interface{}{
 				[]bytecode.Instructions{
-					bytecode.Make(bytecode.OpGetFreeVar, 0),
-					bytecode.Make(bytecode.OpGetFreeVar, 1),
+					bytecode.Make(bytecode.OpGetUpvalue, 0),
+					bytecode.Make(bytecode.OpGetUpvalue, 1),
 					bytecode.Make(bytecode.OpAdd),
 					bytecode.Make(bytecode.OpGetLocal, 0),
 					bytecode.Make(bytecode.OpAdd),
 					bytecode.Make(bytecode.OpReturnValue),
 				},
 				[]bytecode.Instructions{
-					bytecode.Make(bytecode.OpGetFreeVar, 0),
-					bytecode.Make(bytecode.OpGetLocal, 0),
+					bytecode.Make(bytecode.OpCaptureUpvalue, 0),
+					bytecode.Make(bytecode.OpCaptureLocal, 0),
 					bytecode.Make(bytecode.OpClosure, 0, 2),
 					bytecode.Make(bytecode.OpReturnValue),
 				},
 				[]bytecode.Instructions{
-					bytecode.Make(bytecode.OpGetLocal, 0),
+					bytecode.Make(bytecode.OpCaptureLocal, 0),
 					bytecode.Make(bytecode.OpClosure, 1, 1),
 					bytecode.Make(bytecode.OpReturnValue),
 				},
@@ -1974,9 +2196,9 @@ func TestClosures(t *testing.T) {
 					bytecode.Make(bytecode.OpConstant, 3),
 					bytecode.Make(bytecode.OpSetLocal, 0),
 					bytecode.Make(bytecode.OpGetGlobal, 0),
-					bytecode.Make(bytecode.OpGetFreeVar, 0),
+					bytecode.Make(bytecode.OpGetUpvalue, 0),
 					bytecode.Make(bytecode.OpAdd),
-					bytecode.Make(bytecode.OpGetFreeVar, 1),
+					bytecode.Make(bytecode.OpGetUpvalue, 1),
 					bytecode.Make(bytecode.OpAdd),
 					bytecode.Make(bytecode.OpGetLocal, 0),
 					bytecode.Make(bytecode.OpAdd),
@@ -1985,15 +2207,15 @@ func TestClosures(t *testing.T) {
 				[]bytecode.Instructions{
 					bytecode.Make(bytecode.OpConstant, 2),
 					bytecode.Make(bytecode.OpSetLocal, 0),
-					bytecode.Make(bytecode.OpGetFreeVar, 0),
-					bytecode.Make(bytecode.OpGetLocal, 0),
+					bytecode.Make(bytecode.OpCaptureUpvalue, 0),
+					bytecode.Make(bytecode.OpCaptureLocal, 0),
 					bytecode.Make(bytecode.OpClosure, 4, 2),
 					bytecode.Make(bytecode.OpReturnValue),
 				},
 				[]bytecode.Instructions{
 					bytecode.Make(bytecode.OpConstant, 1),
 					bytecode.Make(bytecode.OpSetLocal, 0),
-					bytecode.Make(bytecode.OpGetLocal, 0),
+					bytecode.Make(bytecode.OpCaptureLocal, 0),
 					bytecode.Make(bytecode.OpClosure, 5, 1),
 					bytecode.Make(bytecode.OpReturnValue),
 				},
@@ -2004,88 +2226,885 @@ func TestClosures(t *testing.T) {
 	runCompilerTests(t, tests)
 }
 
-func TestRecursiveFunctions(t *testing.T) {
+func TestUpvalueAssignments(t *testing.T) {
 	tests := []compilerTestCase{
 		{
 			input: `
-			let countDown = fn(x) { countDown(x - 1); };
-			countDown(1);
+			let num = 10;
+			fn() { num = 20; }
 			`,
+			expectedConstants: []interface{}{
+				10,
+				20,
+				[]bytecode.Instructions{
+					bytecode.Make(bytecode.OpConstant, 1),
+					bytecode.Make(bytecode.OpSetGlobal, 0),
+					bytecode.Make(bytecode.OpReturn),
+				},
+			},
 			expectedInstructions: []bytecode.Instructions{
-				bytecode.Make(bytecode.OpClosure, 1, 0),
+				bytecode.Make(bytecode.OpConstant, 0),
 				bytecode.Make(bytecode.OpSetGlobal, 0),
-				bytecode.Make(bytecode.OpGetGlobal, 0),
-				bytecode.Make(bytecode.OpConstant, 2),
-				bytecode.Make(bytecode.OpCall, 1),
+				bytecode.Make(bytecode.OpClosure, 2, 0),
 				bytecode.Make(bytecode.OpPop),
 			},
+		},
+		{
+			input: `
+			fn() {
+				let count = 0;
+				fn() { count = count + 1; }
+			}
+			`,
 			expectedConstants: []interface{}{
+				0,
 				1,
 				[]bytecode.Instructions{
-					bytecode.Make(bytecode.OpCurrentClosure),
-					bytecode.Make(bytecode.OpGetLocal, 0),
+					bytecode.Make(bytecode.OpGetUpvalue, 0),
+					bytecode.Make(bytecode.OpConstant, 1),
+					bytecode.Make(bytecode.OpAdd),
+					bytecode.Make(bytecode.OpSetUpvalue, 0),
+					bytecode.Make(bytecode.OpReturn),
+				},
+				[]bytecode.Instructions{
 					bytecode.Make(bytecode.OpConstant, 0),
-					bytecode.Make(bytecode.OpSub),
-					bytecode.Make(bytecode.OpCall, 1),
+					bytecode.Make(bytecode.OpSetLocal, 0),
+					bytecode.Make(bytecode.OpCaptureLocal, 0),
+					bytecode.Make(bytecode.OpClosure, 2, 1),
 					bytecode.Make(bytecode.OpReturnValue),
 				},
+			},
+			expectedInstructions: []bytecode.Instructions{
+				bytecode.Make(bytecode.OpClosure, 3, 0),
+				bytecode.Make(bytecode.OpPop),
+			},
+		},
+		{
+			input: `
+			while (true) {
+				let x = 1;
+				fn() { x };
+			}
+			`,
+			expectedConstants: []interface{}{
 				1,
+				[]bytecode.Instructions{
+					bytecode.Make(bytecode.OpGetUpvalue, 0),
+					bytecode.Make(bytecode.OpReturnValue),
+				},
+			},
+			expectedInstructions: []bytecode.Instructions{
+				// 0000
+				bytecode.Make(bytecode.OpTrue),
+				// 0001
+				bytecode.Make(bytecode.OpJumpNotTruthy, 21),
+				// 0004
+				bytecode.Make(bytecode.OpConstant, 0),
+				// 0007
+				bytecode.Make(bytecode.OpSetLocal, 0),
+				// 0009
+				bytecode.Make(bytecode.OpCaptureLocal, 0),
+				// 0011
+				bytecode.Make(bytecode.OpClosure, 1, 1),
+				// 0015
+				bytecode.Make(bytecode.OpPop),
+				// 0016
+				bytecode.Make(bytecode.OpCloseUpvalues, 0),
+				// 0018
+				bytecode.Make(bytecode.OpJump, 0),
+				// 0021
+				bytecode.Make(bytecode.OpNull),
+				// 0020
+				bytecode.Make(bytecode.OpPop),
 			},
 		},
+	}
+
+	runCompilerTests(t, tests)
+}
+
+func TestFunctionDeclarations(t *testing.T) {
+	tests := []compilerTestCase{
 		{
 			input: `
-			let wrapper = fn() {
-				let countDown = fn(x) { countDown(x - 1); };
-				countDown(1);
-			};
-			wrapper();
+			let one = first();
+			fn first() { 1 }
 			`,
+			expectedConstants: []interface{}{
+				1,
+				[]bytecode.Instructions{
+					bytecode.Make(bytecode.OpConstant, 0),
+					bytecode.Make(bytecode.OpReturnValue),
+				},
+			},
 			expectedInstructions: []bytecode.Instructions{
-				bytecode.Make(bytecode.OpClosure, 3, 0),
+				bytecode.Make(bytecode.OpClosure, 1, 0),
 				bytecode.Make(bytecode.OpSetGlobal, 0),
 				bytecode.Make(bytecode.OpGetGlobal, 0),
 				bytecode.Make(bytecode.OpCall, 0),
+				bytecode.Make(bytecode.OpSetGlobal, 1),
+			},
+		},
+		{
+			input: `
+			fn() {
+				fn ping() { pong() }
+				fn pong() { ping() }
+			}
+			`,
+			expectedConstants: []interface{}{
+				[]bytecode.Instructions{
+					bytecode.Make(bytecode.OpGetUpvalue, 0),
+					bytecode.Make(bytecode.OpCall, 0),
+					bytecode.Make(bytecode.OpReturnValue),
+				},
+				[]bytecode.Instructions{
+					bytecode.Make(bytecode.OpGetUpvalue, 0),
+					bytecode.Make(bytecode.OpCall, 0),
+					bytecode.Make(bytecode.OpReturnValue),
+				},
+				[]bytecode.Instructions{
+					bytecode.Make(bytecode.OpCaptureLocal, 1),
+					bytecode.Make(bytecode.OpClosure, 0, 1),
+					bytecode.Make(bytecode.OpSetLocal, 0),
+					bytecode.Make(bytecode.OpCaptureLocal, 0),
+					bytecode.Make(bytecode.OpClosure, 1, 1),
+					bytecode.Make(bytecode.OpSetLocal, 1),
+					bytecode.Make(bytecode.OpReturn),
+				},
+			},
+			expectedInstructions: []bytecode.Instructions{
+				bytecode.Make(bytecode.OpClosure, 2, 0),
 				bytecode.Make(bytecode.OpPop),
 			},
+		},
+		{
+			// The slots of the variables that the functions refer to are reserved, and their reads are checked
+			input: `
+			fn() {
+				fn f() { x }
+				let x = 1;
+			}
+			`,
 			expectedConstants: []interface{}{
-				1,
+				"line 3, column 13: undefined variable: x",
 				[]bytecode.Instructions{
-					bytecode.Make(bytecode.OpCurrentClosure),
-					bytecode.Make(bytecode.OpGetLocal, 0),
-					bytecode.Make(bytecode.OpConstant, 0),
-					bytecode.Make(bytecode.OpSub),
-					bytecode.Make(bytecode.OpCall, 1),
+					bytecode.Make(bytecode.OpGetUpvalue, 0),
+					bytecode.Make(bytecode.OpCheckDefined, 0),
 					bytecode.Make(bytecode.OpReturnValue),
 				},
 				1,
 				[]bytecode.Instructions{
-					bytecode.Make(bytecode.OpClosure, 1, 0),
+					bytecode.Make(bytecode.OpClearLocal, 1),
+					bytecode.Make(bytecode.OpCaptureLocal, 1),
+					bytecode.Make(bytecode.OpClosure, 1, 1),
 					bytecode.Make(bytecode.OpSetLocal, 0),
-					bytecode.Make(bytecode.OpGetLocal, 0),
 					bytecode.Make(bytecode.OpConstant, 2),
-					bytecode.Make(bytecode.OpCall, 1),
-					bytecode.Make(bytecode.OpReturnValue),
+					bytecode.Make(bytecode.OpSetLocal, 1),
+					bytecode.Make(bytecode.OpReturn),
 				},
 			},
+			expectedInstructions: []bytecode.Instructions{
+				bytecode.Make(bytecode.OpClosure, 3, 0),
+				bytecode.Make(bytecode.OpPop),
+			},
 		},
 	}
 
 	runCompilerTests(t, tests)
 }
 
-func parse(input string) *ast.Program {
-	l := lexer.NewLexer(input)
-	p := parser.NewParser(l)
-	return p.ParseProgram()
+func TestFunctionDeclarationErrors(t *testing.T) {
+	tests := []compilerErrorTestCase{
+		{
+			input:         `fn f() { 1 } let f = 2;`,
+			expectedError: `line 1, column 13: identifier 'f' has already been declared`,
+		},
+		{
+			input:         `fn f() { 1 } fn f() { 2 }`,
+			expectedError: `line 1, column 16: identifier 'f' has already been declared`,
+		},
+	}
+
+	runCompilerErrorTests(t, tests)
 }
 
-func runCompilerTests(t *testing.T, tests []compilerTestCase) {
+func TestDeferStatements(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input: `fn() { defer puts(1, 2); 3 }`,
+			expectedInstructions: []bytecode.Instructions{
+				bytecode.Make(bytecode.OpClosure, 3, 0),
+				bytecode.Make(bytecode.OpPop),
+			},
+			expectedConstants: []interface{}{
+				1,
+				2,
+				3,
+				[]bytecode.Instructions{
+					bytecode.Make(bytecode.OpGetBuiltIn, 0),
+					bytecode.Make(bytecode.OpConstant, 0),
+					bytecode.Make(bytecode.OpConstant, 1),
+					bytecode.Make(bytecode.OpDefer, 2),
+					bytecode.Make(bytecode.OpConstant, 2),
+					bytecode.Make(bytecode.OpReturnValue),
+				},
+			},
+		},
+		{
+			input: `let f = fn() { 1 }; defer f();`,
+			expectedInstructions: []bytecode.Instructions{
+				bytecode.Make(bytecode.OpClosure, 1, 0),
+				bytecode.Make(bytecode.OpSetGlobal, 0),
+				bytecode.Make(bytecode.OpGetGlobal, 0),
+				bytecode.Make(bytecode.OpDefer, 0),
+			},
+			expectedConstants: []interface{}{
+				1,
+				[]bytecode.Instructions{
+					bytecode.Make(bytecode.OpConstant, 0),
+					bytecode.Make(bytecode.OpReturnValue),
+				},
+			},
+		},
+		{
+			input: `fn() { defer puts(); }`,
+			expectedInstructions: []bytecode.Instructions{
+				bytecode.Make(bytecode.OpClosure, 0, 0),
+				bytecode.Make(bytecode.OpPop),
+			},
+			expectedConstants: []interface{}{
+				[]bytecode.Instructions{
+					bytecode.Make(bytecode.OpGetBuiltIn, 0),
+					bytecode.Make(bytecode.OpDefer, 0),
+					bytecode.Make(bytecode.OpReturn),
+				},
+			},
+		},
+	}
+
+	runCompilerTests(t, tests)
+}
+
+func TestAssertStatements(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input: `let x = 1; assert x > 0, "positive";`,
+			expectedInstructions: []bytecode.Instructions{
+				bytecode.Make(bytecode.OpConstant, 0),
+				bytecode.Make(bytecode.OpSetGlobal, 0),
+				// 0006
+				bytecode.Make(bytecode.OpGetGlobal, 0),
+				bytecode.Make(bytecode.OpConstant, 1),
+				bytecode.Make(bytecode.OpGreaterThan),
+				bytecode.Make(bytecode.OpBang),
+				bytecode.Make(bytecode.OpJumpNotTruthy, 30),
+				// 0017
+				bytecode.Make(bytecode.OpConstant, 2),
+				bytecode.Make(bytecode.OpConstant, 3),
+				bytecode.Make(bytecode.OpGetGlobal, 0),
+				bytecode.Make(bytecode.OpAssertFail, 4, 1),
+				// 0030
+			},
+			expectedConstants: []interface{}{1, 0, "positive", "x", "line 1, column 11: assertion failed: (x > 0)"},
+		},
+		{
+			input: `assert len([]) == 0`,
+			expectedInstructions: []bytecode.Instructions{
+				bytecode.Make(bytecode.OpGetBuiltIn, 1),
+				bytecode.Make(bytecode.OpArray, 0),
+				bytecode.Make(bytecode.OpCall, 1),
+				bytecode.Make(bytecode.OpConstant, 0),
+				bytecode.Make(bytecode.OpEqual),
+				bytecode.Make(bytecode.OpBang),
+				bytecode.Make(bytecode.OpJumpNotTruthy, 20),
+				// 0015
+				bytecode.Make(bytecode.OpNull),
+				bytecode.Make(bytecode.OpAssertFail, 1, 0),
+				// 0020
+			},
+			expectedConstants: []interface{}{0, "line 1, column 0: assertion failed: (len([]) == 0)"},
+		},
+	}
+
+	runCompilerTests(t, tests)
+}
+
+func TestWideOperands(t *testing.T) {
+	params := []string{}
+	for i := 0; i < 300; i++ {
+		params = append(params, fmt.Sprintf("p_%c%c", 'a'+i/26, 'a'+i%26))
+	}
+
+	tests := []compilerTestCase{
+		{
+			input: fmt.Sprintf("fn(%s) { %s }", strings.Join(params, ", "), params[299]),
+			expectedInstructions: []bytecode.Instructions{
+				bytecode.Make(bytecode.OpClosure, 0, 0),
+				bytecode.Make(bytecode.OpPop),
+			},
+			expectedConstants: []interface{}{
+				[]bytecode.Instructions{
+					{byte(bytecode.OpWide), byte(bytecode.OpGetLocal), 0, 0, 1, 43},
+					bytecode.Make(bytecode.OpReturnValue),
+				},
+			},
+		},
+	}
+
+	runCompilerTests(t, tests)
+}
+
+func TestUnencodableOperands(t *testing.T) {
+	// No program has enough constants (or locals, etc.) for an operand to overflow 4 bytes, so one is emitted directly
+	c := NewCompiler()
+	c.position = bytecode.Position{Line: 1, Column: 4}
+	c.emit(bytecode.OpConstant, 1<<32)
+
+	err := c.Compile(parse("1 + 2"))
+	if err == nil {
+		t.Fatalf("no error was detected in compiler for an unencodable operand")
+	}
+	expectedError := "line 1, column 4: operand 0 of OpConstant overflows: 4294967296"
+	if err.Error() != expectedError {
+		t.Errorf("compiler error: error message was not correct. expected=%q, got=%q", expectedError, err.Error())
+	}
+}
+
+func TestConstantInterning(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input: `1 + 1; 1.5 + 1.5; "a" + "a"`,
+			expectedInstructions: []bytecode.Instructions{
+				bytecode.Make(bytecode.OpConstant, 0),
+				bytecode.Make(bytecode.OpConstant, 0),
+				bytecode.Make(bytecode.OpAdd),
+				bytecode.Make(bytecode.OpPop),
+				bytecode.Make(bytecode.OpConstant, 1),
+				bytecode.Make(bytecode.OpConstant, 1),
+				bytecode.Make(bytecode.OpAdd),
+				bytecode.Make(bytecode.OpPop),
+				bytecode.Make(bytecode.OpConstant, 2),
+				bytecode.Make(bytecode.OpConstant, 2),
+				bytecode.Make(bytecode.OpAdd),
+				bytecode.Make(bytecode.OpPop),
+			},
+			expectedConstants: []interface{}{1, 1.5, "a"},
+		},
+		{
+			// Equal values of different types aren't shared
+			input: `[1, 1.0, "1"]`,
+			expectedInstructions: []bytecode.Instructions{
+				bytecode.Make(bytecode.OpConstant, 0),
+				bytecode.Make(bytecode.OpConstant, 1),
+				bytecode.Make(bytecode.OpConstant, 2),
+				bytecode.Make(bytecode.OpArray, 3),
+				bytecode.Make(bytecode.OpPop),
+			},
+			expectedConstants: []interface{}{1, 1.0, "1"},
+		},
+		{
+			// Constants are shared between functions
+			input: `fn() { 2 }; 2`,
+			expectedInstructions: []bytecode.Instructions{
+				bytecode.Make(bytecode.OpClosure, 1, 0),
+				bytecode.Make(bytecode.OpPop),
+				bytecode.Make(bytecode.OpConstant, 0),
+				bytecode.Make(bytecode.OpPop),
+			},
+			expectedConstants: []interface{}{
+				2,
+				[]bytecode.Instructions{
+					bytecode.Make(bytecode.OpConstant, 0),
+					bytecode.Make(bytecode.OpReturnValue),
+				},
+			},
+		},
+	}
+
+	runCompilerTests(t, tests)
+}
+
+func TestConstantInterningWithState(t *testing.T) {
+	first := NewCompiler()
+	first.SetOptions(Options{NoOptimizations: true})
+	err := first.Compile(parse(`let x = 10; "hello"`))
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+	constants := first.Bytecode().Constants
+
+	second := NewCompilerWithState(first.symbolTable, constants)
+	second.SetOptions(Options{NoOptimizations: true})
+	err = second.Compile(parse(`x + 10; "hello"; 20`))
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+	program := second.Bytecode()
+
+	err = testInstructions([]bytecode.Instructions{
+		bytecode.Make(bytecode.OpGetGlobal, 0),
+		bytecode.Make(bytecode.OpConstant, 0),
+		bytecode.Make(bytecode.OpAdd),
+		bytecode.Make(bytecode.OpPop),
+		bytecode.Make(bytecode.OpConstant, 1),
+		bytecode.Make(bytecode.OpPop),
+		bytecode.Make(bytecode.OpConstant, 2),
+		bytecode.Make(bytecode.OpPop),
+	}, program.Instructions)
+	if err != nil {
+		t.Fatalf("testInstructions failed: %s", err)
+	}
+
+	err = testConstants([]interface{}{10, "hello", 20}, program.Constants)
+	if err != nil {
+		t.Fatalf("testConstants failed: %s", err)
+	}
+}
+
+func TestIR(t *testing.T) {
+	program := parse(`fn(x) { let y = x; if (y) { 1 } else { 2 } }`)
+
+	compiler := NewCompiler()
+	err := compiler.Compile(program)
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	expected := []string{
+		`main
+locals: none
+b0:
+    OpClosure 2 0
+    OpPop
+`,
+		`fn (constant 2)
+locals: 0 (x), 1 (y)
+b0:
+    OpGetLocal 0 (x)
+    OpSetLocal 1 (y)
+    OpGetLocal 1 (y)
+    branch b2 else b3
+b2:
+    OpConstant 0
+    jump b1
+b3:
+    OpConstant 1
+    jump b1
+b1:
+    return value
+`,
+	}
+
+	functions := compiler.IR()
+	if len(functions) != len(expected) {
+		t.Fatalf("wrong number of functions. expected=%d, got=%d", len(expected), len(functions))
+	}
+
+	for i, function := range functions {
+		if function.String() != expected[i] {
+			t.Errorf("wrong IR for function %d.\nexpected=%q\ngot=%q", i, expected[i], function.String())
+		}
+	}
+}
+
+func TestPositions(t *testing.T) {
+	node := parse("let x = 1;\nlet f = fn(a) {\n\ta + x\n};")
+
+	compiler := NewCompiler()
+	compiler.SetOptions(Options{Filename: "main.mo", NoOptimizations: true})
+	err := compiler.Compile(node)
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	pos := func(line, column int) bytecode.Position {
+		return bytecode.Position{Line: line, Column: column}
+	}
+
+	program := compiler.Bytecode()
+	if program.Filename != "main.mo" {
+		t.Errorf("wrong filename. expected=%q, got=%q", "main.mo", program.Filename)
+	}
+
+	// OpConstant 0, OpSetGlobal 0, OpClosure 1 0, OpSetGlobal 1
+	testPositionTable(t, program.Positions, map[int]bytecode.Position{
+		0: pos(1, 8), 3: pos(1, 0), 6: pos(2, 8), 10: pos(2, 0),
+	})
+
+	// OpGetLocal 0, OpGetGlobal 0, OpAdd, OpReturnValue
+	fn := program.Constants[1].(*object.CompiledFunction)
+	testPositionTable(t, fn.Positions, map[int]bytecode.Position{
+		0: pos(3, 1), 2: pos(3, 5), 5: pos(3, 3), 6: pos(3, 3),
+	})
+}
+
+func TestFunctionNames(t *testing.T) {
+	program := parse(`let f = fn() { 1 }; fn g() { 2 }; const h = fn() { 3 }; fn() { 4 }`)
+
+	compiler := NewCompiler()
+	err := compiler.Compile(program)
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	names := []string{}
+	for _, constant := range compiler.Bytecode().Constants {
+		if fn, ok := constant.(*object.CompiledFunction); ok {
+			names = append(names, fn.Name)
+		}
+	}
+
+	expected := []string{"g", "f", "h", ""} // Function declarations are hoisted, so `g` is compiled first
+	if strings.Join(names, ",") != strings.Join(expected, ",") {
+		t.Errorf("wrong function names. expected=%q, got=%q", expected, names)
+	}
+}
+
+func testPositionTable(t *testing.T, table bytecode.PositionTable, expected map[int]bytecode.Position) {
+	t.Helper()
+
+	for offset, position := range expected {
+		actual, ok := table.Lookup(offset)
+		if !ok {
+			t.Errorf("no position for offset %d", offset)
+		} else if actual != position {
+			t.Errorf("wrong position for offset %d. expected=%v, got=%v", offset, position, actual)
+		}
+	}
+}
+
+func TestCompilerOptions(t *testing.T) {
+	program := parse(`let x = 1; assert x > 0; x`)
+
+	compiler := NewCompiler()
+	compiler.SetOptions(Options{NoAsserts: true})
+	err := compiler.Compile(program)
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	expectedInstructions := []bytecode.Instructions{
+		bytecode.Make(bytecode.OpConstant, 0),
+		bytecode.Make(bytecode.OpSetGlobal, 0),
+		bytecode.Make(bytecode.OpGetGlobal, 0),
+		bytecode.Make(bytecode.OpPop),
+	}
+	err = testInstructions(expectedInstructions, compiler.Bytecode().Instructions)
+	if err != nil {
+		t.Fatalf("testInstructions failed: %s", err)
+	}
+
+	compiler = NewCompiler()
+	compiler.SetOptions(Options{Filename: "main.mo"})
+	err = compiler.Compile(program)
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	err = testConstants([]interface{}{1, 0, "x", "main.mo:1:11: assertion failed: (x > 0)"}, compiler.Bytecode().Constants)
+	if err != nil {
+		t.Fatalf("testConstants failed: %s", err)
+	}
+}
+
+func TestConstantFolding(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input: "1 + 2 * 3",
+			expectedInstructions: []bytecode.Instructions{
+				bytecode.Make(bytecode.OpConstant, 0),
+				bytecode.Make(bytecode.OpPop),
+			},
+			expectedConstants: []interface{}{7},
+		},
+		{
+			input: `"mon" + "key"; -(10 // 3); 1 < 2; !(2 ** 3 == 8)`,
+			expectedInstructions: []bytecode.Instructions{
+				bytecode.Make(bytecode.OpConstant, 0),
+				bytecode.Make(bytecode.OpPop),
+				bytecode.Make(bytecode.OpConstant, 1),
+				bytecode.Make(bytecode.OpPop),
+				bytecode.Make(bytecode.OpTrue),
+				bytecode.Make(bytecode.OpPop),
+				bytecode.Make(bytecode.OpFalse),
+				bytecode.Make(bytecode.OpPop),
+			},
+			expectedConstants: []interface{}{"monkey", -3},
+		},
+		{
+			input: "let x = 1; x + 2 * 3",
+			expectedInstructions: []bytecode.Instructions{
+				bytecode.Make(bytecode.OpConstant, 0),
+				bytecode.Make(bytecode.OpSetGlobal, 0),
+				bytecode.Make(bytecode.OpGetGlobal, 0),
+				bytecode.Make(bytecode.OpAddConst, 1),
+				bytecode.Make(bytecode.OpPop),
+			},
+			expectedConstants: []interface{}{1, 6},
+		},
+		{
+			// Operations which fail are left for the VM to report
+			input: "1 // 0",
+			expectedInstructions: []bytecode.Instructions{
+				bytecode.Make(bytecode.OpConstant, 0),
+				bytecode.Make(bytecode.OpConstant, 1),
+				bytecode.Make(bytecode.OpIntegerDiv),
+				bytecode.Make(bytecode.OpPop),
+			},
+			expectedConstants: []interface{}{1, 0},
+		},
+	}
+
+	runOptimizedCompilerTests(t, tests)
+}
+
+func TestDeadCodeElimination(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input: "if (false) { 10 } else { 20 }; 3333;",
+			expectedInstructions: []bytecode.Instructions{
+				bytecode.Make(bytecode.OpConstant, 0),
+				bytecode.Make(bytecode.OpPop),
+				bytecode.Make(bytecode.OpConstant, 1),
+				bytecode.Make(bytecode.OpPop),
+			},
+			expectedConstants: []interface{}{20, 3333},
+		},
+		{
+			input: "let x = 1; if (x) { 10 } else if (1 > 2) { 20 } else if (true) { 30 } else { 40 };",
+			expectedInstructions: []bytecode.Instructions{
+				// 0000
+				bytecode.Make(bytecode.OpConstant, 0),
+				// 0003
+				bytecode.Make(bytecode.OpSetGlobal, 0),
+				// 0006
+				bytecode.Make(bytecode.OpGetGlobal, 0),
+				// 0009
+				bytecode.Make(bytecode.OpJumpNotTruthy, 18),
+				// 0012
+				bytecode.Make(bytecode.OpConstant, 1),
+				// 0015
+				bytecode.Make(bytecode.OpJump, 21),
+				// 0018
+				bytecode.Make(bytecode.OpConstant, 2),
+				// 0021
+				bytecode.Make(bytecode.OpPop),
+			},
+			expectedConstants: []interface{}{1, 10, 30},
+		},
+		{
+			input: `switch "b" { case "a": 10; case "b": 20; default: 30; }`,
+			expectedInstructions: []bytecode.Instructions{
+				bytecode.Make(bytecode.OpConstant, 0),
+				bytecode.Make(bytecode.OpPop),
+			},
+			expectedConstants: []interface{}{20},
+		},
+		{
+			// The peephole optimizer removes the first loop's `OpNull; OpPop`, but the last popped value is kept
+			input: "while (false) { 10 }; for (let i = 0; false; i++) { 20 };",
+			expectedInstructions: []bytecode.Instructions{
+				bytecode.Make(bytecode.OpConstant, 0),
+				bytecode.Make(bytecode.OpSetLocal, 0),
+				bytecode.Make(bytecode.OpNull),
+				bytecode.Make(bytecode.OpPop),
+			},
+			expectedConstants: []interface{}{0},
+		},
+		{
+			input: "fn(x) { if (x) { return 1; } else { return 2; }; 3 }",
+			expectedInstructions: []bytecode.Instructions{
+				bytecode.Make(bytecode.OpClosure, 3, 0),
+				bytecode.Make(bytecode.OpPop),
+			},
+			expectedConstants: []interface{}{
+				1,
+				2,
+				3,
+				[]bytecode.Instructions{
+					// 0000
+					bytecode.Make(bytecode.OpGetLocal0),
+					// 0001
+					bytecode.Make(bytecode.OpJumpNotTruthy, 8),
+					// 0004
+					bytecode.Make(bytecode.OpConstant, 0),
+					// 0007
+					bytecode.Make(bytecode.OpReturnValue),
+					// 0008
+					bytecode.Make(bytecode.OpConstant, 1),
+					// 0011
+					bytecode.Make(bytecode.OpReturnValue),
+					// 0012
+					bytecode.Make(bytecode.OpPop),
+					// 0013
+					bytecode.Make(bytecode.OpConstant, 2),
+					// 0016
+					bytecode.Make(bytecode.OpReturnValue),
+				},
+			},
+		},
+		{
+			input: "fn() { return 1; 2; 3 }",
+			expectedInstructions: []bytecode.Instructions{
+				bytecode.Make(bytecode.OpClosure, 1, 0),
+				bytecode.Make(bytecode.OpPop),
+			},
+			expectedConstants: []interface{}{
+				1,
+				[]bytecode.Instructions{
+					bytecode.Make(bytecode.OpConstant, 0),
+					bytecode.Make(bytecode.OpReturnValue),
+				},
+			},
+		},
+	}
+
+	runOptimizedCompilerTests(t, tests)
+}
+
+func TestDeadCodeErrors(t *testing.T) {
+	tests := []compilerErrorTestCase{
+		{
+			input:         `if (false) { puts(nope); }`,
+			expectedError: `line 1, column 18: undefined variable: nope`,
+		},
+		{
+			input:         `if (true) { 1 } else if (nope) { 2 } else { 3 }`,
+			expectedError: `line 1, column 25: undefined variable: nope`,
+		},
+		{
+			input:         `switch 1 { case 1: 10; case 2: nope; }`,
+			expectedError: `line 1, column 31: undefined variable: nope`,
+		},
+		{
+			input:         `while (false) { nope; }`,
+			expectedError: `line 1, column 16: undefined variable: nope`,
+		},
+		{
+			input:         `for (let i = 0; false; nope++) { }`,
+			expectedError: `line 1, column 23: attempting to assign value to identifier 'nope' prior to declaration`,
+		},
+		{
+			input:         `fn() { return 1; nope; }`,
+			expectedError: `line 1, column 17: undefined variable: nope`,
+		},
+		{
+			input:         `if (false) { const x = 1; x = 2; }`,
+			expectedError: `line 1, column 26: attempting to assign value to constant variable 'x'`,
+		},
+	}
+
+	// Code which never runs is still checked, so the errors are the same regardless of optimizations
+	for _, options := range []Options{{}, {NoOptimizations: true}} {
+		for _, test := range tests {
+			compiler := NewCompiler()
+			compiler.SetOptions(options)
+			err := compiler.Compile(parse(test.input))
+			if err == nil {
+				t.Errorf("no error compiling %q (%+v)", test.input, options)
+				continue
+			}
+			if err.Error() != test.expectedError {
+				t.Errorf("wrong error compiling %q (%+v). expected=%q, got=%q", test.input, options, test.expectedError, err.Error())
+			}
+		}
+	}
+}
+
+func TestRecursiveFunctions(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input: `
+			let countDown = fn(x) { countDown(x - 1); };
+			countDown(1);
+			`,
+			expectedInstructions: []bytecode.Instructions{
+				bytecode.Make(bytecode.OpClosure, 1, 0),
+				bytecode.Make(bytecode.OpSetGlobal, 0),
+				bytecode.Make(bytecode.OpGetGlobal, 0),
+				bytecode.Make(bytecode.OpConstant, 0),
+				bytecode.Make(bytecode.OpCall, 1),
+				bytecode.Make(bytecode.OpPop),
+			},
+			expectedConstants: []interface{}{
+				1,
+				[]bytecode.Instructions{
+					bytecode.Make(bytecode.OpCurrentClosure),
+					bytecode.Make(bytecode.OpGetLocal, 0),
+					bytecode.Make(bytecode.OpConstant, 0),
+					bytecode.Make(bytecode.OpSub),
+					bytecode.Make(bytecode.OpCall, 1),
+					bytecode.Make(bytecode.OpReturnValue),
+				},
+			},
+		},
+		{
+			input: `
+			let wrapper = fn() {
+				let countDown = fn(x) { countDown(x - 1); };
+				countDown(1);
+			};
+			wrapper();
+			`,
+			expectedInstructions: []bytecode.Instructions{
+				bytecode.Make(bytecode.OpClosure, 2, 0),
+				bytecode.Make(bytecode.OpSetGlobal, 0),
+				bytecode.Make(bytecode.OpGetGlobal, 0),
+				bytecode.Make(bytecode.OpCall, 0),
+				bytecode.Make(bytecode.OpPop),
+			},
+			expectedConstants: []interface{}{
+				1,
+				[]bytecode.Instructions{
+					bytecode.Make(bytecode.OpCurrentClosure),
+					bytecode.Make(bytecode.OpGetLocal, 0),
+					bytecode.Make(bytecode.OpConstant, 0),
+					bytecode.Make(bytecode.OpSub),
+					bytecode.Make(bytecode.OpCall, 1),
+					bytecode.Make(bytecode.OpReturnValue),
+				},
+				[]bytecode.Instructions{
+					bytecode.Make(bytecode.OpClosure, 1, 0),
+					bytecode.Make(bytecode.OpSetLocal, 0),
+					bytecode.Make(bytecode.OpGetLocal, 0),
+					bytecode.Make(bytecode.OpConstant, 0),
+					bytecode.Make(bytecode.OpCall, 1),
+					bytecode.Make(bytecode.OpReturnValue),
+				},
+			},
+		},
+	}
+
+	runCompilerTests(t, tests)
+}
+
+func parse(input string) *ast.Program {
+	l := lexer.NewLexer(input)
+	p := parser.NewParser(l)
+	return p.ParseProgram()
+}
+
+// Runs the test cases without optimizations, so that they can check the bytecode that the compiler generates for each
+// node as written.
+func runCompilerTests(t *testing.T, tests []compilerTestCase) {
+	t.Helper()
+	runCompilerTestsWithOptions(t, tests, Options{NoOptimizations: true})
+}
+
+func runOptimizedCompilerTests(t *testing.T, tests []compilerTestCase) {
+	t.Helper()
+	runCompilerTestsWithOptions(t, tests, Options{})
+}
+
+func runCompilerTestsWithOptions(t *testing.T, tests []compilerTestCase, options Options) {
 	t.Helper()
 
 	for _, test := range tests {
 		program := parse(test.input)
 
 		compiler := NewCompiler()
+		compiler.SetOptions(options)
 		err := compiler.Compile(program)
 		if err != nil {
 			t.Fatalf("compiler error: %s", err)
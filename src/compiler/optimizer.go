@@ -0,0 +1,258 @@
+package compiler
+
+import (
+	"monkey/ast"
+	"monkey/bytecode"
+	"monkey/object"
+)
+
+// The compiler optimizes programs as it compiles them (unless the NoOptimizations option is set), by folding constant
+// expressions into a single value and by not emitting code which can never run: branches of conditionals & switch
+// statements whose conditions are constant, loops whose conditions are constantly false, and statements following a
+// `return`. Such code is still compiled without being emitted (see compileUnreachable), so that its errors are reported
+// regardless of optimizations. The AST itself is left untouched, so that e.g. assertion failures still report the
+// source of conditions.
+//
+// Calls of functions stored in globals are compiled to an `OpCallGlobal` where it's safe to do so, and the peephole
+// optimizer (see peephole.go) selects the other superinstructions once functions have been lowered to bytecode.
+
+// Evaluates an expression at compile time if its value is constant, i.e. if it's made up of literals of primitive types
+// combined with operators. Operations which fail (e.g. dividing by zero) aren't folded, so that their errors are still
+// reported when the program runs.
+func (c *Compiler) constantValue(node ast.Expression) (object.Object, bool) {
+	if c.options.NoOptimizations {
+		return nil, false
+	}
+	return constantValue(node)
+}
+
+func constantValue(node ast.Expression) (object.Object, bool) {
+	switch node := node.(type) {
+	case *ast.IntegerLiteral:
+		return &object.Integer{Value: node.Value}, true
+	case *ast.Float:
+		return &object.Float{Value: node.Value}, true
+	case *ast.Boolean:
+		return object.NativeBoolToBooleanObject(node.Value), true
+	case *ast.StringLiteral:
+		return &object.String{Value: node.Value}, true
+
+	case *ast.PrefixExpression:
+		right, ok := constantValue(node.Right)
+		if !ok {
+			return nil, false
+		}
+
+		switch node.Operator {
+		case "-":
+			return foldedValue(object.Negation(right))
+		case "!":
+			return object.Not(right), true
+		}
+
+	case *ast.InfixExpression:
+		left, ok := constantValue(node.Left)
+		if !ok {
+			return nil, false
+		}
+		right, ok := constantValue(node.Right)
+		if !ok {
+			return nil, false
+		}
+
+		// Hooks are only called for user types, which are never constant, so no hook caller is needed
+		switch node.Operator {
+		case "+", "-", "*", "/", "//", "**", "%":
+			return foldedValue(object.BinaryOperation(nil, node.Operator, left, right))
+		case "&&", "||":
+			return foldedValue(object.LogicalOperation(node.Operator, left, right))
+		case "==", "!=", "<", ">", "<=", ">=":
+			return foldedValue(object.Comparison(nil, node.Operator, left, right))
+		}
+	}
+
+	return nil, false
+}
+
+// Returns the result of an operation on constants, if it succeeded and produced a value of a primitive type.
+func foldedValue(obj object.Object, err error) (object.Object, bool) {
+	if err != nil {
+		return nil, false
+	}
+
+	switch obj.(type) {
+	case *object.Integer, *object.Float, *object.Boolean, *object.String:
+		return obj, true
+	default:
+		return nil, false
+	}
+}
+
+// Emits the instruction loading a constant value computed at compile time.
+func (c *Compiler) emitConstantValue(obj object.Object) {
+	switch obj {
+	case object.TRUE:
+		c.emit(bytecode.OpTrue)
+	case object.FALSE:
+		c.emit(bytecode.OpFalse)
+	default:
+		c.emit(bytecode.OpConstant, c.addConstant(obj))
+	}
+}
+
+// Reports whether an expression is constant and falsy, so that the code which it guards can never run.
+func (c *Compiler) isConstantlyFalsy(node ast.Expression) bool {
+	value, ok := c.constantValue(node)
+	return ok && !object.IsTruthy(value)
+}
+
+// Prunes the clauses of a conditional whose conditions are constant. Clauses which are never taken are dropped, and a
+// clause which is always taken becomes the alternative, replacing all of the clauses after it. The conditions and
+// blocks which are dropped are returned as well, to be compiled as unreachable code.
+func (c *Compiler) pruneClauses(clauses []ast.ConditionalClause, alternative *ast.BlockStatement) ([]ast.ConditionalClause, *ast.BlockStatement, []ast.Node) {
+	live := []ast.ConditionalClause{}
+	pruned := []ast.Node{}
+
+	for i, clause := range clauses {
+		value, ok := c.constantValue(clause.Condition)
+		if !ok {
+			live = append(live, clause)
+		} else if object.IsTruthy(value) {
+			for _, skipped := range clauses[i+1:] {
+				pruned = append(pruned, skipped.Condition, skipped.Consequence)
+			}
+			if alternative != nil {
+				pruned = append(pruned, alternative)
+			}
+			return live, clause.Consequence, pruned
+		} else {
+			pruned = append(pruned, clause.Consequence)
+		}
+	}
+
+	return live, alternative, pruned
+}
+
+// Prunes the cases of a switch statement whose values are constant, if the switch expression is also constant. Cases
+// which never match are dropped, and a case which always matches becomes the default, replacing all of the cases after
+// it. The expressions and blocks which are dropped are returned as well, to be compiled as unreachable code.
+func (c *Compiler) pruneCases(ss *ast.SwitchStatement) ([]ast.SwitchCase, *ast.BlockStatement, []ast.Node) {
+	switchValue, ok := c.constantValue(ss.SwitchExpression)
+	if !ok {
+		return ss.Cases, ss.Default, nil
+	}
+
+	live := []ast.SwitchCase{}
+	pruned := []ast.Node{}
+
+	for i, switchCase := range ss.Cases {
+		caseValue, ok := c.constantValue(switchCase.Expression)
+		if !ok {
+			live = append(live, switchCase)
+			continue
+		}
+
+		matches, err := object.Comparison(nil, "==", switchValue, caseValue)
+		if err != nil {
+			live = append(live, switchCase) // The comparison fails when the program runs
+		} else if object.IsTruthy(matches) {
+			for _, skipped := range ss.Cases[i+1:] {
+				pruned = append(pruned, skipped.Expression, skipped.Consequence)
+			}
+			if ss.Default != nil {
+				pruned = append(pruned, ss.Default)
+			}
+			return live, switchCase.Consequence, pruned
+		} else {
+			pruned = append(pruned, switchCase.Consequence)
+		}
+	}
+
+	return live, ss.Default, pruned
+}
+
+// Compiles code which can never run (e.g. a branch of a conditional whose condition is constantly false), so that it's
+// checked like any other code (e.g. for references to undefined variables), but without emitting its instructions:
+// they're added to blocks which are discarded instead of being laid out, and the constants they add are dropped. Blocks
+// are compiled in scopes of their own.
+func (c *Compiler) compileUnreachable(nodes ...ast.Node) error {
+	if len(nodes) == 0 {
+		return nil
+	}
+
+	current, numPlaced := c.currentScope().block, len(c.currentScope().function.Blocks)
+	numConstants := len(c.constants)
+	c.currentScope().block = c.newBlock()
+
+	var err error
+	for _, node := range nodes {
+		if block, ok := node.(*ast.BlockStatement); ok {
+			err = c.compileBlock(block)
+		} else {
+			err = c.Compile(node)
+		}
+		if err != nil {
+			break
+		}
+	}
+
+	scope := c.currentScope()
+	scope.function.Blocks = scope.function.Blocks[:numPlaced]
+	scope.block = current
+
+	if len(c.constants) > numConstants {
+		for key, index := range c.constantIndices {
+			if index >= numConstants {
+				delete(c.constantIndices, key)
+			}
+		}
+		c.constants = c.constants[:numConstants]
+	}
+
+	return err
+}
+
+// Reports whether a block always returns from the function, in which case the code following it is unreachable. The
+// statements following a `return` aren't emitted, so the block returns if any of its statements is a `return`.
+func (c *Compiler) alwaysReturns(block *ast.BlockStatement) bool {
+	if c.options.NoOptimizations {
+		return false
+	}
+
+	for _, statement := range block.Statements {
+		if _, ok := statement.(*ast.ReturnStatement); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Reports whether a call of the given function can be compiled to an `OpCallGlobal`, returning the global symbol to
+// call. An `OpCallGlobal` reads the global after the call's arguments have been evaluated rather than before them, so
+// the global mustn't be reassigned in the meantime: it has to be a constant, or a variable which isn't assigned to
+// anywhere in the program. Compilers with state only call constants directly, since a later program could reassign
+// the variables called by an earlier one.
+func (c *Compiler) directlyCallableGlobal(function ast.Expression) (Symbol, bool) {
+	identifier, ok := function.(*ast.Identifier)
+	if !ok || c.options.NoOptimizations {
+		return Symbol{}, false
+	}
+
+	symbol, ok := c.symbolTable.Resolve(identifier.Value)
+	if !ok || symbol.Scope != GlobalScope {
+		return Symbol{}, false
+	}
+	return symbol, symbol.Const || (!c.hasState && !c.assignedNames[symbol.Name])
+}
+
+// Returns the names which are the targets of assignments anywhere in the program (in any scope).
+func assignedNames(program *ast.Program) map[string]bool {
+	names := map[string]bool{}
+	ast.Modify(program, func(node ast.Node) (ast.Node, error) {
+		if assignment, ok := node.(*ast.AssignStatement); ok {
+			names[assignment.Name.Value] = true
+		}
+		return node, nil
+	})
+	return names
+}
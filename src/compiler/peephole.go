@@ -0,0 +1,258 @@
+package compiler
+
+import (
+	"monkey/bytecode"
+	"sort"
+)
+
+// Once a function has been lowered to bytecode, the peephole optimizer rewrites short sequences of its instructions
+// into shorter equivalents:
+//   - a jump to an `OpJump` goes straight to the final target of the chain of jumps
+//   - `OpNull; OpPop`, which loop statements leave behind, is removed
+//   - `OpTrue; OpJumpNotTruthy` never jumps, so it's removed, while `OpFalse; OpJumpNotTruthy` becomes an `OpJump`
+//   - `OpBang; OpJumpNotTruthy` becomes an inverted jump, `OpJumpTruthy`
+//   - `OpSetLocal n; OpGetLocal n` becomes `OpSetLocalKeep n`, storing the value while leaving it on the stack
+//
+// Common sequences are also replaced by superinstructions, which do the work of several instructions at once:
+//   - `OpGetLocal n; OpConstant c; OpAdd; OpSetLocal n` (e.g. `i++` or `i += 1`) becomes `OpIncLocal n c`
+//   - `OpConstant c; OpAdd` and `OpConstant c; OpSub` become `OpAddConst c` and `OpSubConst c`
+//   - `OpLessThan; OpJumpNotTruthy` and `OpEqual; OpJumpNotTruthy` become `OpLessThanJump` and `OpEqualJump`
+//   - once no more rewrites apply, `OpGetLocal n` becomes `OpGetLocal0` to `OpGetLocal3` for the first 4 locals
+//
+// A sequence is only rewritten if no jump lands in the middle of it. The operands of jumps refer to positions in the
+// original instructions until the very end, when they're relocated to the new positions of their targets. A rewritten
+// sequence keeps the source position of the instruction in it which can fail (e.g. the `OpAdd` of an increment), so
+// that runtime errors are still reported at the right place.
+
+// Represents an instruction being optimized, along with its position in the original instructions and the position in
+// the source code that it was compiled from.
+type peepholeInstruction struct {
+	pos      int
+	op       bytecode.Opcode
+	operands []int
+	source   bytecode.Position
+}
+
+// Optimizes the instructions of a function, returning them along with the updated table of their source positions.
+func optimizeInstructions(instructions bytecode.Instructions, positions bytecode.PositionTable) (bytecode.Instructions, bytecode.PositionTable) {
+	decoded := decodeInstructions(instructions, positions)
+
+	for changed := true; changed; {
+		decoded, changed = peepholePass(decoded, len(instructions))
+	}
+
+	for i, instr := range decoded {
+		if instr.op == bytecode.OpGetLocal && instr.operands[0] < 4 {
+			decoded[i] = peepholeInstruction{pos: instr.pos, op: bytecode.OpGetLocal0 + bytecode.Opcode(instr.operands[0]), source: instr.source}
+		}
+	}
+
+	return encodeInstructions(decoded, len(instructions))
+}
+
+// Applies each of the rewrites once over the instructions, reporting whether any of them changed anything. The end of
+// the original instructions is given, since it's a valid jump target.
+func peepholePass(instrs []peepholeInstruction, end int) ([]peepholeInstruction, bool) {
+	indices := map[int]int{}
+	targets := map[int]bool{}
+	for i, instr := range instrs {
+		indices[instr.pos] = i
+		if isJump(instr.op) {
+			targets[instr.operands[0]] = true
+		}
+	}
+
+	optimized := []peepholeInstruction{}
+	changed := false
+
+	for i := 0; i < len(instrs); i++ {
+		instr := instrs[i]
+
+		// The instruction following this one, if a sequence starting with this instruction can be rewritten
+		var next *peepholeInstruction
+		if i+1 < len(instrs) && !targets[instrs[i+1].pos] {
+			next = &instrs[i+1]
+		}
+
+		switch {
+		case isJump(instr.op):
+			target := finalJumpTarget(instrs, indices, instr.operands[0])
+			if target != instr.operands[0] {
+				instr.operands = []int{target}
+				changed = true
+			}
+
+		case instr.op == bytecode.OpNull && next != nil && next.op == bytecode.OpPop && i+2 < len(instrs):
+			// A trailing `OpNull; OpPop` is kept, so that the last popped value of a program doesn't change
+			i++
+			changed = true
+			continue
+
+		case instr.op == bytecode.OpTrue && next != nil && next.op == bytecode.OpJumpNotTruthy:
+			i++
+			changed = true
+			continue
+
+		case instr.op == bytecode.OpFalse && next != nil && next.op == bytecode.OpJumpNotTruthy:
+			instr = peepholeInstruction{pos: instr.pos, op: bytecode.OpJump, operands: next.operands, source: instr.source}
+			i++
+			changed = true
+
+		case instr.op == bytecode.OpBang && next != nil && next.op == bytecode.OpJumpNotTruthy:
+			instr = peepholeInstruction{pos: instr.pos, op: bytecode.OpJumpTruthy, operands: next.operands, source: instr.source}
+			i++
+			changed = true
+
+		case instr.op == bytecode.OpSetLocal && next != nil && next.op == bytecode.OpGetLocal && next.operands[0] == instr.operands[0]:
+			instr = peepholeInstruction{pos: instr.pos, op: bytecode.OpSetLocalKeep, operands: instr.operands, source: instr.source}
+			i++
+			changed = true
+
+		case startsSequence(instrs, targets, i, bytecode.OpGetLocal, bytecode.OpConstant, bytecode.OpAdd, bytecode.OpSetLocal) && instrs[i+3].operands[0] == instr.operands[0]:
+			instr = peepholeInstruction{pos: instr.pos, op: bytecode.OpIncLocal, operands: []int{instr.operands[0], instrs[i+1].operands[0]}, source: instrs[i+2].source}
+			i += 3
+			changed = true
+
+		case instr.op == bytecode.OpConstant && next != nil && next.op == bytecode.OpAdd:
+			instr = peepholeInstruction{pos: instr.pos, op: bytecode.OpAddConst, operands: instr.operands, source: next.source}
+			i++
+			changed = true
+
+		case instr.op == bytecode.OpConstant && next != nil && next.op == bytecode.OpSub:
+			instr = peepholeInstruction{pos: instr.pos, op: bytecode.OpSubConst, operands: instr.operands, source: next.source}
+			i++
+			changed = true
+
+		case instr.op == bytecode.OpLessThan && next != nil && next.op == bytecode.OpJumpNotTruthy:
+			instr = peepholeInstruction{pos: instr.pos, op: bytecode.OpLessThanJump, operands: next.operands, source: instr.source}
+			i++
+			changed = true
+
+		case instr.op == bytecode.OpEqual && next != nil && next.op == bytecode.OpJumpNotTruthy:
+			instr = peepholeInstruction{pos: instr.pos, op: bytecode.OpEqualJump, operands: next.operands, source: instr.source}
+			i++
+			changed = true
+		}
+
+		optimized = append(optimized, instr)
+	}
+
+	// Jumps to removed instructions land on the instruction following them instead
+	for i, instr := range optimized {
+		if isJump(instr.op) {
+			optimized[i].operands = []int{nextRemainingPosition(optimized, instr.operands[0], end)}
+		}
+	}
+
+	return optimized, changed
+}
+
+// Reports whether the instructions starting at the given index have the given opcodes, with no jump landing in the
+// middle of them.
+func startsSequence(instrs []peepholeInstruction, targets map[int]bool, i int, ops ...bytecode.Opcode) bool {
+	if i+len(ops) > len(instrs) {
+		return false
+	}
+
+	for j, op := range ops {
+		if instrs[i+j].op != op || (j > 0 && targets[instrs[i+j].pos]) {
+			return false
+		}
+	}
+	return true
+}
+
+func isJump(op bytecode.Opcode) bool {
+	switch op {
+	case bytecode.OpJump, bytecode.OpJumpNotTruthy, bytecode.OpJumpTruthy, bytecode.OpLessThanJump, bytecode.OpEqualJump:
+		return true
+	}
+	return false
+}
+
+// Follows a chain of unconditional jumps starting at the given position, returning the position where it ends. Cycles
+// of jumps (i.e. infinite loops) are left alone.
+func finalJumpTarget(instrs []peepholeInstruction, indices map[int]int, pos int) int {
+	visited := map[int]bool{}
+	for !visited[pos] {
+		visited[pos] = true
+
+		i, ok := indices[pos]
+		if !ok || instrs[i].op != bytecode.OpJump {
+			return pos
+		}
+		pos = instrs[i].operands[0]
+	}
+	return pos
+}
+
+// Returns the position of the first remaining instruction at or after the given position, or the end of the
+// instructions if there isn't one.
+func nextRemainingPosition(instrs []peepholeInstruction, pos int, end int) int {
+	i := sort.Search(len(instrs), func(i int) bool { return instrs[i].pos >= pos })
+	if i == len(instrs) {
+		return end
+	}
+	return instrs[i].pos
+}
+
+func decodeInstructions(instructions bytecode.Instructions, positions bytecode.PositionTable) []peepholeInstruction {
+	decoded := []peepholeInstruction{}
+
+	for pos := 0; pos < len(instructions); {
+		op, operands, width, err := bytecode.ReadInstruction(instructions[pos:])
+		if err != nil {
+			panic(err) // The compiler only emits valid instructions
+		}
+
+		source, _ := positions.Lookup(pos)
+		decoded = append(decoded, peepholeInstruction{pos: pos, op: op, operands: operands, source: source})
+		pos += width
+	}
+
+	return decoded
+}
+
+// Encodes the optimized instructions, relocating the operands of jumps from positions in the original instructions
+// (ending at the given position) to positions in the optimized instructions, and builds the table of their source
+// positions.
+func encodeInstructions(instrs []peepholeInstruction, end int) (bytecode.Instructions, bytecode.PositionTable) {
+	// The width of a jump depends on its new target position, so the new positions are computed starting with every
+	// position at 0, and then again until none of them move (as when lowering the IR)
+	newPositions := map[int]int{}
+	for moved := true; moved; {
+		moved = false
+
+		newPos := 0
+		for _, instr := range instrs {
+			if newPositions[instr.pos] != newPos {
+				newPositions[instr.pos] = newPos
+				moved = true
+			}
+			newPos += len(relocatedInstruction(instr, newPositions))
+		}
+		if newPositions[end] != newPos {
+			newPositions[end] = newPos
+			moved = true
+		}
+	}
+
+	instructions := bytecode.Instructions{}
+	table := bytecode.PositionTable{}
+	for _, instr := range instrs {
+		if instr.source != (bytecode.Position{}) {
+			table = table.Add(len(instructions), instr.source)
+		}
+		instructions = append(instructions, relocatedInstruction(instr, newPositions)...)
+	}
+
+	return instructions, table
+}
+
+// Encodes an instruction, relocating the operand of a jump to the new position of its target.
+func relocatedInstruction(instr peepholeInstruction, newPositions map[int]int) []byte {
+	if isJump(instr.op) {
+		return bytecode.Make(instr.op, newPositions[instr.operands[0]])
+	}
+	return bytecode.Make(instr.op, instr.operands...)
+}
@@ -0,0 +1,478 @@
+package compiler
+
+import (
+	"monkey/bytecode"
+	"testing"
+)
+
+func TestOptimizeInstructions(t *testing.T) {
+	tests := []struct {
+		input    []bytecode.Instructions
+		expected []bytecode.Instructions
+	}{
+		{
+			// Chains of jumps
+			input: []bytecode.Instructions{
+				bytecode.Make(bytecode.OpJumpNotTruthy, 3),
+				bytecode.Make(bytecode.OpJump, 6),
+				bytecode.Make(bytecode.OpJump, 9),
+				bytecode.Make(bytecode.OpNull),
+			},
+			expected: []bytecode.Instructions{
+				bytecode.Make(bytecode.OpJumpNotTruthy, 9),
+				bytecode.Make(bytecode.OpJump, 9),
+				bytecode.Make(bytecode.OpJump, 9),
+				bytecode.Make(bytecode.OpNull),
+			},
+		},
+		{
+			// Cycles of jumps are left alone
+			input: []bytecode.Instructions{
+				bytecode.Make(bytecode.OpJump, 3),
+				bytecode.Make(bytecode.OpJump, 0),
+			},
+			expected: []bytecode.Instructions{
+				bytecode.Make(bytecode.OpJump, 3),
+				bytecode.Make(bytecode.OpJump, 0),
+			},
+		},
+		{
+			// `OpNull; OpPop` is removed, unless it ends the instructions
+			input: []bytecode.Instructions{
+				bytecode.Make(bytecode.OpNull),
+				bytecode.Make(bytecode.OpPop),
+				bytecode.Make(bytecode.OpConstant, 0),
+				bytecode.Make(bytecode.OpPop),
+				bytecode.Make(bytecode.OpNull),
+				bytecode.Make(bytecode.OpPop),
+			},
+			expected: []bytecode.Instructions{
+				bytecode.Make(bytecode.OpConstant, 0),
+				bytecode.Make(bytecode.OpPop),
+				bytecode.Make(bytecode.OpNull),
+				bytecode.Make(bytecode.OpPop),
+			},
+		},
+		{
+			// A jump to a removed instruction lands on the instruction following it
+			input: []bytecode.Instructions{
+				// 0000
+				bytecode.Make(bytecode.OpTrue),
+				// 0001
+				bytecode.Make(bytecode.OpJumpNotTruthy, 8),
+				// 0004
+				bytecode.Make(bytecode.OpConstant, 0),
+				// 0007
+				bytecode.Make(bytecode.OpPop),
+				// 0008
+				bytecode.Make(bytecode.OpJump, 0),
+			},
+			expected: []bytecode.Instructions{
+				// 0000
+				bytecode.Make(bytecode.OpConstant, 0),
+				// 0003
+				bytecode.Make(bytecode.OpPop),
+				// 0004
+				bytecode.Make(bytecode.OpJump, 0),
+			},
+		},
+		{
+			input: []bytecode.Instructions{
+				// 0000
+				bytecode.Make(bytecode.OpFalse),
+				// 0001
+				bytecode.Make(bytecode.OpJumpNotTruthy, 6),
+				// 0004
+				bytecode.Make(bytecode.OpTrue),
+				// 0005
+				bytecode.Make(bytecode.OpPop),
+				// 0006
+				bytecode.Make(bytecode.OpFalse),
+				// 0007
+				bytecode.Make(bytecode.OpPop),
+			},
+			expected: []bytecode.Instructions{
+				// 0000
+				bytecode.Make(bytecode.OpJump, 5),
+				// 0003
+				bytecode.Make(bytecode.OpTrue),
+				// 0004
+				bytecode.Make(bytecode.OpPop),
+				// 0005
+				bytecode.Make(bytecode.OpFalse),
+				// 0006
+				bytecode.Make(bytecode.OpPop),
+			},
+		},
+		{
+			input: []bytecode.Instructions{
+				// 0000
+				bytecode.Make(bytecode.OpGetLocal, 0),
+				// 0002
+				bytecode.Make(bytecode.OpBang),
+				// 0003
+				bytecode.Make(bytecode.OpJumpNotTruthy, 9),
+				// 0006
+				bytecode.Make(bytecode.OpConstant, 0),
+				// 0009
+				bytecode.Make(bytecode.OpNull),
+			},
+			expected: []bytecode.Instructions{
+				// 0000
+				bytecode.Make(bytecode.OpGetLocal0),
+				// 0001
+				bytecode.Make(bytecode.OpJumpTruthy, 7),
+				// 0004
+				bytecode.Make(bytecode.OpConstant, 0),
+				// 0007
+				bytecode.Make(bytecode.OpNull),
+			},
+		},
+		{
+			input: []bytecode.Instructions{
+				bytecode.Make(bytecode.OpSetLocal, 1),
+				bytecode.Make(bytecode.OpGetLocal, 1),
+				bytecode.Make(bytecode.OpSetLocal, 1),
+				bytecode.Make(bytecode.OpGetLocal, 0),
+				bytecode.Make(bytecode.OpReturnValue),
+			},
+			expected: []bytecode.Instructions{
+				bytecode.Make(bytecode.OpSetLocalKeep, 1),
+				bytecode.Make(bytecode.OpSetLocal, 1),
+				bytecode.Make(bytecode.OpGetLocal0),
+				bytecode.Make(bytecode.OpReturnValue),
+			},
+		},
+		{
+			// Sequences that a jump lands in the middle of aren't rewritten
+			input: []bytecode.Instructions{
+				// 0000
+				bytecode.Make(bytecode.OpSetLocal, 0),
+				// 0002
+				bytecode.Make(bytecode.OpGetLocal, 0),
+				// 0004
+				bytecode.Make(bytecode.OpNull),
+				// 0005
+				bytecode.Make(bytecode.OpPop),
+				// 0006
+				bytecode.Make(bytecode.OpJumpNotTruthy, 2),
+				// 0009
+				bytecode.Make(bytecode.OpJump, 5),
+			},
+			expected: []bytecode.Instructions{
+				// 0000
+				bytecode.Make(bytecode.OpSetLocal, 0),
+				// 0002
+				bytecode.Make(bytecode.OpGetLocal0),
+				// 0003
+				bytecode.Make(bytecode.OpNull),
+				// 0004
+				bytecode.Make(bytecode.OpPop),
+				// 0005
+				bytecode.Make(bytecode.OpJumpNotTruthy, 2),
+				// 0008
+				bytecode.Make(bytecode.OpJump, 4),
+			},
+		},
+		{
+			input: []bytecode.Instructions{
+				bytecode.Make(bytecode.OpGetLocal, 1),
+				bytecode.Make(bytecode.OpConstant, 0),
+				bytecode.Make(bytecode.OpAdd),
+				bytecode.Make(bytecode.OpSetLocal, 1),
+				bytecode.Make(bytecode.OpGetLocal, 2),
+				bytecode.Make(bytecode.OpConstant, 0),
+				bytecode.Make(bytecode.OpAdd),
+				bytecode.Make(bytecode.OpSetLocal, 1),
+			},
+			expected: []bytecode.Instructions{
+				bytecode.Make(bytecode.OpIncLocal, 1, 0),
+				bytecode.Make(bytecode.OpGetLocal2),
+				bytecode.Make(bytecode.OpAddConst, 0),
+				bytecode.Make(bytecode.OpSetLocal, 1),
+			},
+		},
+		{
+			input: []bytecode.Instructions{
+				bytecode.Make(bytecode.OpGetLocal, 0),
+				bytecode.Make(bytecode.OpConstant, 0),
+				bytecode.Make(bytecode.OpSub),
+				bytecode.Make(bytecode.OpGetLocal, 3),
+				bytecode.Make(bytecode.OpConstant, 1),
+				bytecode.Make(bytecode.OpAdd),
+				bytecode.Make(bytecode.OpAdd),
+				bytecode.Make(bytecode.OpReturnValue),
+			},
+			expected: []bytecode.Instructions{
+				bytecode.Make(bytecode.OpGetLocal0),
+				bytecode.Make(bytecode.OpSubConst, 0),
+				bytecode.Make(bytecode.OpGetLocal3),
+				bytecode.Make(bytecode.OpAddConst, 1),
+				bytecode.Make(bytecode.OpAdd),
+				bytecode.Make(bytecode.OpReturnValue),
+			},
+		},
+		{
+			input: []bytecode.Instructions{
+				// 0000
+				bytecode.Make(bytecode.OpGetLocal, 4),
+				// 0002
+				bytecode.Make(bytecode.OpConstant, 0),
+				// 0005
+				bytecode.Make(bytecode.OpLessThan),
+				// 0006
+				bytecode.Make(bytecode.OpJumpNotTruthy, 18),
+				// 0009
+				bytecode.Make(bytecode.OpGetLocal, 4),
+				// 0011
+				bytecode.Make(bytecode.OpConstant, 1),
+				// 0014
+				bytecode.Make(bytecode.OpEqual),
+				// 0015
+				bytecode.Make(bytecode.OpJumpNotTruthy, 0),
+				// 0018
+				bytecode.Make(bytecode.OpNull),
+			},
+			expected: []bytecode.Instructions{
+				// 0000
+				bytecode.Make(bytecode.OpGetLocal, 4),
+				// 0002
+				bytecode.Make(bytecode.OpConstant, 0),
+				// 0005
+				bytecode.Make(bytecode.OpLessThanJump, 16),
+				// 0008
+				bytecode.Make(bytecode.OpGetLocal, 4),
+				// 0010
+				bytecode.Make(bytecode.OpConstant, 1),
+				// 0013
+				bytecode.Make(bytecode.OpEqualJump, 0),
+				// 0016
+				bytecode.Make(bytecode.OpNull),
+			},
+		},
+		{
+			// A jump landing in the middle of an increment prevents it from becoming an `OpIncLocal`
+			input: []bytecode.Instructions{
+				// 0000
+				bytecode.Make(bytecode.OpGetLocal, 0),
+				// 0002
+				bytecode.Make(bytecode.OpConstant, 0),
+				// 0005
+				bytecode.Make(bytecode.OpAdd),
+				// 0006
+				bytecode.Make(bytecode.OpSetLocal, 0),
+				// 0008
+				bytecode.Make(bytecode.OpJump, 5),
+			},
+			expected: []bytecode.Instructions{
+				// 0000
+				bytecode.Make(bytecode.OpGetLocal0),
+				// 0001
+				bytecode.Make(bytecode.OpConstant, 0),
+				// 0004
+				bytecode.Make(bytecode.OpAdd),
+				// 0005
+				bytecode.Make(bytecode.OpSetLocal, 0),
+				// 0007
+				bytecode.Make(bytecode.OpJump, 4),
+			},
+		},
+	}
+
+	for _, test := range tests {
+		input := bytecode.Instructions{}
+		for _, instr := range test.input {
+			input = append(input, instr...)
+		}
+
+		optimized, _ := optimizeInstructions(input, nil)
+		err := testInstructions(test.expected, optimized)
+		if err != nil {
+			t.Errorf("testInstructions failed: %s", err)
+		}
+	}
+}
+
+func TestPeepholePositions(t *testing.T) {
+	pos := func(column int) bytecode.Position {
+		return bytecode.Position{Line: 1, Column: column}
+	}
+
+	input := bytecode.Instructions{}
+	positions := bytecode.PositionTable{}
+	for _, instr := range []struct {
+		instruction bytecode.Instructions
+		position    bytecode.Position
+	}{
+		{bytecode.Make(bytecode.OpGetLocal, 0), pos(1)},
+		{bytecode.Make(bytecode.OpConstant, 0), pos(5)},
+		{bytecode.Make(bytecode.OpAdd), pos(3)},
+		{bytecode.Make(bytecode.OpSetLocal, 0), pos(0)},
+		{bytecode.Make(bytecode.OpGetLocal, 0), pos(8)},
+		{bytecode.Make(bytecode.OpConstant, 1), pos(12)},
+		{bytecode.Make(bytecode.OpLessThan), pos(10)},
+		{bytecode.Make(bytecode.OpJumpNotTruthy, 0), pos(10)},
+	} {
+		positions = positions.Add(len(input), instr.position)
+		input = append(input, instr.instruction...)
+	}
+
+	// OpIncLocal 0 0, OpGetLocal0, OpConstant 1, OpLessThanJump 0
+	expected := bytecode.PositionTable{
+		{Offset: 0, Position: pos(3)},
+		{Offset: 4, Position: pos(8)},
+		{Offset: 5, Position: pos(12)},
+		{Offset: 8, Position: pos(10)},
+	}
+
+	_, actual := optimizeInstructions(input, positions)
+	if len(actual) != len(expected) {
+		t.Fatalf("wrong position table length.\nexpected=%v\ngot=%v", expected, actual)
+	}
+	for i, entry := range expected {
+		if actual[i] != entry {
+			t.Errorf("wrong position table entry %d.\nexpected=%v\ngot=%v", i, entry, actual[i])
+		}
+	}
+}
+
+func TestPeepholeOptimizations(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input: "fn(x) { let y = x * 2; y }",
+			expectedInstructions: []bytecode.Instructions{
+				bytecode.Make(bytecode.OpClosure, 1, 0),
+				bytecode.Make(bytecode.OpPop),
+			},
+			expectedConstants: []interface{}{
+				2,
+				[]bytecode.Instructions{
+					bytecode.Make(bytecode.OpGetLocal0),
+					bytecode.Make(bytecode.OpConstant, 0),
+					bytecode.Make(bytecode.OpMul),
+					bytecode.Make(bytecode.OpSetLocalKeep, 1),
+					bytecode.Make(bytecode.OpReturnValue),
+				},
+			},
+		},
+		{
+			input: "fn(x) { if (!x) { if (x) { 1 } else { 2 } } else { 3 } }",
+			expectedInstructions: []bytecode.Instructions{
+				bytecode.Make(bytecode.OpClosure, 3, 0),
+				bytecode.Make(bytecode.OpPop),
+			},
+			expectedConstants: []interface{}{
+				1,
+				2,
+				3,
+				[]bytecode.Instructions{
+					// 0000
+					bytecode.Make(bytecode.OpGetLocal0),
+					// 0001
+					bytecode.Make(bytecode.OpJumpTruthy, 20),
+					// 0004
+					bytecode.Make(bytecode.OpGetLocal0),
+					// 0005
+					bytecode.Make(bytecode.OpJumpNotTruthy, 14),
+					// 0008
+					bytecode.Make(bytecode.OpConstant, 0),
+					// 0011
+					bytecode.Make(bytecode.OpJump, 23),
+					// 0014
+					bytecode.Make(bytecode.OpConstant, 1),
+					// 0017
+					bytecode.Make(bytecode.OpJump, 23),
+					// 0020
+					bytecode.Make(bytecode.OpConstant, 2),
+					// 0023
+					bytecode.Make(bytecode.OpReturnValue),
+				},
+			},
+		},
+	}
+
+	runOptimizedCompilerTests(t, tests)
+}
+
+func TestDirectGlobalCalls(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input: "let f = fn(x) { x }; f(1);",
+			expectedInstructions: []bytecode.Instructions{
+				bytecode.Make(bytecode.OpClosure, 0, 0),
+				bytecode.Make(bytecode.OpSetGlobal, 0),
+				bytecode.Make(bytecode.OpConstant, 1),
+				bytecode.Make(bytecode.OpCallGlobal, 0, 1),
+				bytecode.Make(bytecode.OpPop),
+			},
+			expectedConstants: []interface{}{
+				[]bytecode.Instructions{
+					bytecode.Make(bytecode.OpGetLocal0),
+					bytecode.Make(bytecode.OpReturnValue),
+				},
+				1,
+			},
+		},
+		{
+			// A variable which is assigned to could be reassigned while the arguments are evaluated
+			input: "let f = fn() { 1 }; let g = fn() { f = fn() { 2 }; 3 }; f(g());",
+			expectedInstructions: []bytecode.Instructions{
+				bytecode.Make(bytecode.OpClosure, 1, 0),
+				bytecode.Make(bytecode.OpSetGlobal, 0),
+				bytecode.Make(bytecode.OpClosure, 5, 0),
+				bytecode.Make(bytecode.OpSetGlobal, 1),
+				bytecode.Make(bytecode.OpGetGlobal, 0),
+				bytecode.Make(bytecode.OpCallGlobal, 1, 0),
+				bytecode.Make(bytecode.OpCall, 1),
+				bytecode.Make(bytecode.OpPop),
+			},
+			expectedConstants: []interface{}{
+				1,
+				[]bytecode.Instructions{
+					bytecode.Make(bytecode.OpConstant, 0),
+					bytecode.Make(bytecode.OpReturnValue),
+				},
+				2,
+				[]bytecode.Instructions{
+					bytecode.Make(bytecode.OpConstant, 2),
+					bytecode.Make(bytecode.OpReturnValue),
+				},
+				3,
+				[]bytecode.Instructions{
+					bytecode.Make(bytecode.OpClosure, 3, 0),
+					bytecode.Make(bytecode.OpSetGlobal, 0),
+					bytecode.Make(bytecode.OpConstant, 4),
+					bytecode.Make(bytecode.OpReturnValue),
+				},
+			},
+		},
+	}
+
+	runOptimizedCompilerTests(t, tests)
+}
+
+func TestDirectGlobalCallsWithState(t *testing.T) {
+	first := NewCompiler()
+	err := first.Compile(parse("const f = fn() { 1 }; let g = fn() { 2 };"))
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	// Only constants are called directly, since a later program could reassign variables
+	second := NewCompilerWithState(first.symbolTable, first.Bytecode().Constants)
+	err = second.Compile(parse("f(); g();"))
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	err = testInstructions([]bytecode.Instructions{
+		bytecode.Make(bytecode.OpCallGlobal, 0, 0),
+		bytecode.Make(bytecode.OpPop),
+		bytecode.Make(bytecode.OpGetGlobal, 1),
+		bytecode.Make(bytecode.OpCall, 0),
+		bytecode.Make(bytecode.OpPop),
+	}, second.Bytecode().Instructions)
+	if err != nil {
+		t.Fatalf("testInstructions failed: %s", err)
+	}
+}
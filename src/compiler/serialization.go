@@ -0,0 +1,344 @@
+package compiler
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"math"
+	"monkey/bytecode"
+	"monkey/object"
+)
+
+// Serialization of compiled programs, so that they can be run without being lexed, parsed and compiled again. A
+// serialized program consists of a header followed by its body:
+//
+//	magic     4 bytes    "\x7fMOC"
+//	version   uint16     the version of the format (`BytecodeVersion`)
+//	checksum  uint32     the CRC-32 (IEEE) checksum of the body
+//	body                 the number of locals & globals, the filename, the top-level instructions & their positions,
+//	                     and the constant pool
+//
+// Integers in the header are big-endian (like instruction operands), whereas those in the body are varints. Each
+// constant is a tag followed by its value: integers are varints, floats are their IEEE 754 bits, strings are prefixed
+// by their length, and compiled functions hold their name, number of locals & parameters, instructions and positions.
+// A position table is stored as its number of entries, each of which holds the distance from the previous entry's
+// offset, followed by its line & column.
+
+// The version of the serialized bytecode format. It must be bumped whenever the format or the instruction set (including
+// the order of the built-in functions) changes, since programs serialized by older versions wouldn't run correctly.
+const BytecodeVersion = 2
+
+var bytecodeMagic = []byte("\x7fMOC")
+
+const bytecodeHeaderSize = 10 // magic (4 bytes), version (2 bytes), checksum (4 bytes)
+
+// The tags identifying the types of serialized constants.
+const (
+	integerTag byte = iota + 1
+	floatTag
+	stringTag
+	booleanTag
+	compiledFunctionTag
+)
+
+var errUnexpectedEnd = errors.New("unexpected end of data")
+
+// Reports whether the given data starts like a serialized program.
+func IsSerializedBytecode(data []byte) bool {
+	return bytes.HasPrefix(data, bytecodeMagic)
+}
+
+// Serializes the compiled program. An error is returned if its constant pool holds a type of object which can't be
+// serialized.
+func (b *Bytecode) Serialize() ([]byte, error) {
+	body := []byte{}
+	body = binary.AppendUvarint(body, uint64(b.NumLocals))
+	body = binary.AppendUvarint(body, uint64(b.NumGlobals))
+	body = appendString(body, b.Filename)
+	body = appendBytes(body, b.Instructions)
+	body = appendPositions(body, b.Positions)
+
+	body = binary.AppendUvarint(body, uint64(len(b.Constants)))
+	for i, constant := range b.Constants {
+		var err error
+		body, err = appendConstant(body, constant)
+		if err != nil {
+			return nil, fmt.Errorf("constant %d: %s", i, err)
+		}
+	}
+
+	data := append([]byte{}, bytecodeMagic...)
+	data = binary.BigEndian.AppendUint16(data, BytecodeVersion)
+	data = binary.BigEndian.AppendUint32(data, crc32.ChecksumIEEE(body))
+	return append(data, body...), nil
+}
+
+// Deserializes a compiled program, checking that it was serialized by the current version of the format and that it
+// hasn't been corrupted.
+func DeserializeBytecode(data []byte) (*Bytecode, error) {
+	if !IsSerializedBytecode(data) {
+		return nil, fmt.Errorf("not a Monkey bytecode file")
+	}
+	if len(data) < bytecodeHeaderSize {
+		return nil, fmt.Errorf("corrupt bytecode file: %s", errUnexpectedEnd)
+	}
+
+	version := binary.BigEndian.Uint16(data[4:])
+	if version != BytecodeVersion {
+		return nil, fmt.Errorf("unsupported bytecode version %d (expected version %d); rebuild the program from its source", version, BytecodeVersion)
+	}
+
+	body := data[bytecodeHeaderSize:]
+	if crc32.ChecksumIEEE(body) != binary.BigEndian.Uint32(data[6:]) {
+		return nil, fmt.Errorf("corrupt bytecode file: checksum mismatch")
+	}
+
+	b, err := decodeBytecode(&decoder{data: body})
+	if err != nil {
+		return nil, fmt.Errorf("corrupt bytecode file: %s", err)
+	}
+	return b, nil
+}
+
+func decodeBytecode(d *decoder) (*Bytecode, error) {
+	b := &Bytecode{
+		NumLocals:    d.int(),
+		NumGlobals:   d.int(),
+		Filename:     d.string(),
+		Instructions: d.instructions(),
+		Positions:    d.positions(),
+	}
+
+	numConstants := d.length()
+	b.Constants = make([]object.Object, 0, numConstants)
+	for i := 0; i < numConstants && d.err == nil; i++ {
+		b.Constants = append(b.Constants, d.constant())
+	}
+
+	if d.err == nil && d.pos != len(d.data) {
+		d.fail(fmt.Errorf("%d bytes of trailing data", len(d.data)-d.pos))
+	}
+	return b, d.err
+}
+
+func appendConstant(data []byte, constant object.Object) ([]byte, error) {
+	switch constant := constant.(type) {
+	case *object.Integer:
+		data = append(data, integerTag)
+		return binary.AppendVarint(data, constant.Value), nil
+	case *object.Float:
+		data = append(data, floatTag)
+		return binary.BigEndian.AppendUint64(data, math.Float64bits(constant.Value)), nil
+	case *object.String:
+		data = append(data, stringTag)
+		return appendString(data, constant.Value), nil
+	case *object.Boolean:
+		data = append(data, booleanTag)
+		if constant.Value {
+			return append(data, 1), nil
+		}
+		return append(data, 0), nil
+	case *object.CompiledFunction:
+		data = append(data, compiledFunctionTag)
+		data = appendString(data, constant.Name)
+		data = binary.AppendUvarint(data, uint64(constant.NumLocals))
+		data = binary.AppendUvarint(data, uint64(constant.NumParameters))
+		data = appendBytes(data, constant.Instructions)
+		return appendPositions(data, constant.Positions), nil
+	default:
+		return nil, fmt.Errorf("unable to serialize constant of type %s", constant.Type())
+	}
+}
+
+func appendString(data []byte, s string) []byte {
+	data = binary.AppendUvarint(data, uint64(len(s)))
+	return append(data, s...)
+}
+
+func appendBytes(data []byte, b []byte) []byte {
+	data = binary.AppendUvarint(data, uint64(len(b)))
+	return append(data, b...)
+}
+
+func appendPositions(data []byte, positions bytecode.PositionTable) []byte {
+	data = binary.AppendUvarint(data, uint64(len(positions)))
+	previous := 0
+	for _, entry := range positions {
+		data = binary.AppendUvarint(data, uint64(entry.Offset-previous))
+		data = binary.AppendUvarint(data, uint64(entry.Position.Line))
+		data = binary.AppendUvarint(data, uint64(entry.Position.Column))
+		previous = entry.Offset
+	}
+	return data
+}
+
+// Reads the values of a serialized program in order. Once an error occurs, it's kept and every subsequent read returns
+// a zero value, so that the error only needs to be checked once the program has been read.
+type decoder struct {
+	data []byte
+	pos  int
+	err  error
+}
+
+func (d *decoder) fail(err error) {
+	if d.err == nil {
+		d.err = err
+	}
+}
+
+func (d *decoder) uvarint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	value, n := binary.Uvarint(d.data[d.pos:])
+	if n <= 0 {
+		d.fail(errUnexpectedEnd)
+		return 0
+	}
+	d.pos += n
+	return value
+}
+
+// Reads a non-negative integer which fits in an `int` on every platform.
+func (d *decoder) int() int {
+	value := d.uvarint()
+	if value > math.MaxInt32 {
+		d.fail(fmt.Errorf("value out of range: %d", value))
+		return 0
+	}
+	return int(value)
+}
+
+// Reads the length of a series of values, each of which takes up at least one byte.
+func (d *decoder) length() int {
+	length := d.uvarint()
+	if length > uint64(len(d.data)-d.pos) {
+		d.fail(errUnexpectedEnd)
+		return 0
+	}
+	return int(length)
+}
+
+func (d *decoder) bytes() []byte {
+	length := d.length()
+	if d.err != nil {
+		return nil
+	}
+	b := append([]byte{}, d.data[d.pos:d.pos+length]...)
+	d.pos += length
+	return b
+}
+
+func (d *decoder) string() string {
+	return string(d.bytes())
+}
+
+// Reads instructions, checking that each of them is defined and complete.
+func (d *decoder) instructions() bytecode.Instructions {
+	instructions := bytecode.Instructions(d.bytes())
+
+	for offset := 0; offset < len(instructions) && d.err == nil; {
+		width, err := instructionWidth(instructions[offset:])
+		if err != nil {
+			d.fail(fmt.Errorf("invalid instruction at offset %d: %s", offset, err))
+		}
+		offset += width
+	}
+
+	return instructions
+}
+
+// Returns the number of bytes taken up by the instruction at the start of the given instructions, or an error if it's
+// undefined or truncated.
+func instructionWidth(instructions bytecode.Instructions) (int, error) {
+	prefixWidth := 0
+	if bytecode.Opcode(instructions[0]) == bytecode.OpWide {
+		prefixWidth = 1
+		if len(instructions) < 2 {
+			return 0, errUnexpectedEnd
+		}
+	}
+
+	def, err := bytecode.LookUp(instructions[prefixWidth])
+	if err != nil {
+		return 0, err
+	}
+
+	width := prefixWidth + 1
+	for _, operandWidth := range def.OperandWidths {
+		if prefixWidth > 0 {
+			operandWidth = bytecode.WideOperandWidth
+		}
+		width += operandWidth
+	}
+
+	if width > len(instructions) {
+		return 0, errUnexpectedEnd
+	}
+	return width, nil
+}
+
+func (d *decoder) positions() bytecode.PositionTable {
+	length := d.length()
+	positions := make(bytecode.PositionTable, 0, length)
+
+	offset := 0
+	for i := 0; i < length && d.err == nil; i++ {
+		offset += d.int()
+		position := bytecode.Position{Line: d.int(), Column: d.int()}
+		positions = append(positions, bytecode.PositionEntry{Offset: offset, Position: position})
+	}
+
+	return positions
+}
+
+func (d *decoder) constant() object.Object {
+	if d.pos >= len(d.data) {
+		d.fail(errUnexpectedEnd)
+		return nil
+	}
+	tag := d.data[d.pos]
+	d.pos++
+
+	switch tag {
+	case integerTag:
+		value, n := binary.Varint(d.data[d.pos:])
+		if n <= 0 {
+			d.fail(errUnexpectedEnd)
+			return nil
+		}
+		d.pos += n
+		return &object.Integer{Value: value}
+	case floatTag:
+		if len(d.data)-d.pos < 8 {
+			d.fail(errUnexpectedEnd)
+			return nil
+		}
+		bits := binary.BigEndian.Uint64(d.data[d.pos:])
+		d.pos += 8
+		return &object.Float{Value: math.Float64frombits(bits)}
+	case stringTag:
+		return &object.String{Value: d.string()}
+	case booleanTag:
+		if d.pos >= len(d.data) {
+			d.fail(errUnexpectedEnd)
+			return nil
+		}
+		value := d.data[d.pos]
+		d.pos++
+		return object.NativeBoolToBooleanObject(value != 0)
+	case compiledFunctionTag:
+		return &object.CompiledFunction{
+			Name:          d.string(),
+			NumLocals:     d.int(),
+			NumParameters: d.int(),
+			Instructions:  d.instructions(),
+			Positions:     d.positions(),
+		}
+	default:
+		d.fail(fmt.Errorf("unknown constant tag %d", tag))
+		return nil
+	}
+}
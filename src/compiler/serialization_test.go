@@ -0,0 +1,145 @@
+package compiler
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"monkey/bytecode"
+	"monkey/object"
+	"testing"
+)
+
+func TestSerializeBytecode(t *testing.T) {
+	input := `
+	let x = 1;
+	let y = -2.5;
+	fn greet(name) {
+		let greeting = fn(punctuation) { "hello, " + name + punctuation };
+		greeting("!")
+	}
+	assert x > 0, "x must be positive";
+	greet("monkey") + " " + "é"
+	`
+
+	compiler := NewCompiler()
+	compiler.SetOptions(Options{Filename: "main.mo"})
+	err := compiler.Compile(parse(input))
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+	expected := compiler.Bytecode()
+
+	data, err := expected.Serialize()
+	if err != nil {
+		t.Fatalf("serialization error: %s", err)
+	}
+	if !IsSerializedBytecode(data) {
+		t.Fatalf("serialized bytecode isn't recognized")
+	}
+
+	actual, err := DeserializeBytecode(data)
+	if err != nil {
+		t.Fatalf("deserialization error: %s", err)
+	}
+
+	if actual.NumLocals != expected.NumLocals || actual.NumGlobals != expected.NumGlobals || actual.Filename != expected.Filename {
+		t.Errorf("wrong header values. expected=(%d, %d, %q), got=(%d, %d, %q)", expected.NumLocals, expected.NumGlobals,
+			expected.Filename, actual.NumLocals, actual.NumGlobals, actual.Filename)
+	}
+	if actual.Instructions.String() != expected.Instructions.String() {
+		t.Errorf("wrong instructions.\nexpected=%q\ngot=%q", expected.Instructions, actual.Instructions)
+	}
+	testPositionTablesEqual(t, expected.Positions, actual.Positions)
+
+	if len(actual.Constants) != len(expected.Constants) {
+		t.Fatalf("wrong number of constants. expected=%d, got=%d", len(expected.Constants), len(actual.Constants))
+	}
+	for i, constant := range expected.Constants {
+		switch constant := constant.(type) {
+		case *object.CompiledFunction:
+			fn, ok := actual.Constants[i].(*object.CompiledFunction)
+			if !ok {
+				t.Fatalf("constant %d is not a function. got=%T", i, actual.Constants[i])
+			}
+			if fn.Name != constant.Name || fn.NumLocals != constant.NumLocals || fn.NumParameters != constant.NumParameters {
+				t.Errorf("wrong function %d. expected=%+v, got=%+v", i, constant, fn)
+			}
+			if fn.Instructions.String() != constant.Instructions.String() {
+				t.Errorf("wrong instructions for function %d.\nexpected=%q\ngot=%q", i, constant.Instructions, fn.Instructions)
+			}
+			testPositionTablesEqual(t, constant.Positions, fn.Positions)
+		default:
+			if actual.Constants[i].Type() != constant.Type() || actual.Constants[i].Inspect() != constant.Inspect() {
+				t.Errorf("wrong constant %d. expected=%s, got=%s", i, constant.Inspect(), actual.Constants[i].Inspect())
+			}
+		}
+	}
+}
+
+func TestSerializeUnsupportedConstant(t *testing.T) {
+	program := &Bytecode{Constants: []object.Object{&object.Array{}}}
+
+	_, err := program.Serialize()
+	if err == nil || err.Error() != "constant 0: unable to serialize constant of type ARRAY" {
+		t.Errorf("wrong error. got=%v", err)
+	}
+}
+
+func TestDeserializeBytecodeErrors(t *testing.T) {
+	program := &Bytecode{
+		Instructions: bytecode.Instructions(bytecode.Make(bytecode.OpConstant, 0)),
+		Constants:    []object.Object{&object.Integer{Value: 5}},
+	}
+	valid, err := program.Serialize()
+	if err != nil {
+		t.Fatalf("serialization error: %s", err)
+	}
+
+	// Builds serialized bytecode with the given body and a valid header, so that the body itself is decoded
+	withBody := func(body []byte) []byte {
+		data := append([]byte{}, bytecodeMagic...)
+		data = binary.BigEndian.AppendUint16(data, BytecodeVersion)
+		data = binary.BigEndian.AppendUint32(data, crc32.ChecksumIEEE(body))
+		return append(data, body...)
+	}
+	body := valid[bytecodeHeaderSize:]
+
+	tests := []struct {
+		data          []byte
+		expectedError string
+	}{
+		{[]byte("puts(1)"), "not a Monkey bytecode file"},
+		{valid[:6], "corrupt bytecode file: unexpected end of data"},
+		{
+			append(append(append([]byte{}, valid[:4]...), 0, 99), valid[6:]...),
+			"unsupported bytecode version 99 (expected version 2); rebuild the program from its source",
+		},
+		{append(append([]byte{}, valid[:len(valid)-1]...), valid[len(valid)-1]^1), "corrupt bytecode file: checksum mismatch"},
+		{withBody(body[:len(body)-1]), "corrupt bytecode file: unexpected end of data"},
+		{withBody(append(append([]byte{}, body...), 0)), "corrupt bytecode file: 1 bytes of trailing data"},
+		{withBody([]byte{0, 0, 0, 1, 255, 0, 0}), "corrupt bytecode file: invalid instruction at offset 0: opcode 255 is undefined"},
+		{withBody([]byte{0, 0, 0, 2, byte(bytecode.OpConstant), 0, 0, 0}), "corrupt bytecode file: invalid instruction at offset 0: unexpected end of data"},
+		{withBody([]byte{0, 0, 0, 0, 0, 1, 99}), "corrupt bytecode file: unknown constant tag 99"},
+	}
+
+	for _, test := range tests {
+		_, err := DeserializeBytecode(test.data)
+		if err == nil {
+			t.Errorf("expected an error deserializing %q", test.data)
+		} else if err.Error() != test.expectedError {
+			t.Errorf("wrong error. expected=%q, got=%q", test.expectedError, err.Error())
+		}
+	}
+}
+
+func testPositionTablesEqual(t *testing.T, expected bytecode.PositionTable, actual bytecode.PositionTable) {
+	t.Helper()
+
+	if len(actual) != len(expected) {
+		t.Fatalf("wrong position table length.\nexpected=%v\ngot=%v", expected, actual)
+	}
+	for i, entry := range expected {
+		if actual[i] != entry {
+			t.Errorf("wrong position table entry %d. expected=%v, got=%v", i, entry, actual[i])
+		}
+	}
+}
@@ -13,19 +13,33 @@ const (
 
 // Represents a symbol stored in the symbol table, associated with some scope.
 type Symbol struct {
-	Name  string
-	Scope SymbolScope
-	Index int
-	Const bool
+	Name     string
+	Scope    SymbolScope
+	Index    int
+	Const    bool
+	Reserved bool // Whether the symbol is referred to ahead of its declaration (by a hoisted function), so reads of it are checked at runtime.
 }
 
 // Represents a symbol table associating Monkey identifiers with information.
+//
+// Symbol tables are either enclosing (the global symbol table, or the symbol table of a function) or block symbol
+// tables, which hold the bindings declared in the body of a conditional or loop. Block symbol tables don't have
+// their own frame at runtime; instead, their symbols are stored in local slots of the enclosing function's frame (or
+// of the main frame, at the top level). These slots are released when the block ends, so that they can be reused by
+// subsequent blocks.
 type SymbolTable struct {
 	outer *SymbolTable
 
 	store          map[string]Symbol
 	numDefinitions int
 
+	isBlock     bool
+	blockStart  int  // The first local slot available to the symbols defined in this block symbol table.
+	maxLocals   int  // The maximum number of local slots in use at once by symbols of this table's blocks.
+	hasCaptures bool // Whether any symbol defined in this block symbol table is captured by a closure.
+
+	reserved map[string]Symbol // Symbols defined ahead of their declarations, which can't be resolved until declared.
+
 	FreeSymbols []Symbol
 }
 
@@ -44,22 +58,34 @@ func NewEnclosedSymbolTable(outer *SymbolTable) *SymbolTable {
 	return st
 }
 
-func (st *SymbolTable) Define(name string) Symbol {
-	sym := Symbol{Name: name, Index: st.numDefinitions}
-	if st.outer == nil {
-		sym.Scope = GlobalScope
-	} else {
-		sym.Scope = LocalScope
+func NewBlockSymbolTable(outer *SymbolTable) *SymbolTable {
+	st := NewEnclosedSymbolTable(outer)
+	st.isBlock = true
+	if outer.isBlock {
+		st.blockStart = outer.blockStart + outer.numDefinitions
+	} else if outer.outer != nil {
+		st.blockStart = outer.numDefinitions
 	}
+	return st
+}
 
-	st.store[name] = sym
-	st.numDefinitions += 1
-	return sym
+func (st *SymbolTable) Define(name string) Symbol {
+	return st.define(name, false)
 }
 
 func (st *SymbolTable) DefineConst(name string) Symbol {
-	sym := Symbol{Name: name, Index: st.numDefinitions, Const: true}
-	if st.outer == nil {
+	return st.define(name, true)
+}
+
+func (st *SymbolTable) define(name string, isConst bool) Symbol {
+	sym := Symbol{Name: name, Index: st.numDefinitions, Const: isConst}
+	if st.isBlock {
+		sym.Scope = LocalScope
+		sym.Index += st.blockStart
+
+		enclosing := st.enclosingTable()
+		enclosing.maxLocals = max(enclosing.maxLocals, sym.Index+1)
+	} else if st.outer == nil {
 		sym.Scope = GlobalScope
 	} else {
 		sym.Scope = LocalScope
@@ -70,6 +96,34 @@ func (st *SymbolTable) DefineConst(name string) Symbol {
 	return sym
 }
 
+// Defines a symbol ahead of its declaration, which can be resolved until it's hidden with hideReserved.
+func (st *SymbolTable) reserve(name string, isConst bool) Symbol {
+	sym := st.define(name, isConst)
+	sym.Reserved = true
+	st.store[name] = sym
+	return sym
+}
+
+// Hides the reserved symbol with the given name until it's declared with declareReserved, keeping its slot for it.
+func (st *SymbolTable) hideReserved(name string) {
+	if st.reserved == nil {
+		st.reserved = map[string]Symbol{}
+	}
+	st.reserved[name] = st.store[name]
+	delete(st.store, name)
+}
+
+// Declares the symbol with the given name in the slot reserved for it, if there is one.
+func (st *SymbolTable) declareReserved(name string) (Symbol, bool) {
+	sym, ok := st.reserved[name]
+	if ok {
+		delete(st.reserved, name)
+		sym.Reserved = false
+		st.store[name] = sym
+	}
+	return sym, ok
+}
+
 func (st *SymbolTable) DefineFunctionName(name string) Symbol {
 	sym := Symbol{Name: name, Scope: FunctionScope, Index: 0}
 	st.store[name] = sym
@@ -84,11 +138,29 @@ func (st *SymbolTable) DefineBuiltIn(index int, name string) Symbol {
 
 func (st *SymbolTable) defineFreeVar(original Symbol) Symbol {
 	st.FreeSymbols = append(st.FreeSymbols, original)
-	symbol := Symbol{Name: original.Name, Scope: FreeScope, Index: len(st.FreeSymbols) - 1}
+	symbol := Symbol{Name: original.Name, Scope: FreeScope, Index: len(st.FreeSymbols) - 1, Const: original.Const, Reserved: original.Reserved}
 	st.store[original.Name] = symbol
+
+	if original.Scope == LocalScope {
+		st.outer.markCaptured(original.Name)
+	}
+
 	return symbol
 }
 
+// Records that the local with the given name, resolved starting from this symbol table, has been captured by a
+// closure. Blocks whose locals are captured need to close their upvalues when they end.
+func (st *SymbolTable) markCaptured(name string) {
+	for table := st; table != nil; table = table.outer {
+		if _, ok := table.store[name]; ok {
+			if table.isBlock {
+				table.hasCaptures = true
+			}
+			return
+		}
+	}
+}
+
 func (st *SymbolTable) Resolve(name string) (Symbol, bool) {
 	sym, ok := st.store[name]
 	if !ok && st.outer != nil {
@@ -97,7 +169,8 @@ func (st *SymbolTable) Resolve(name string) (Symbol, bool) {
 			return sym, ok
 		}
 
-		if sym.Scope == GlobalScope || sym.Scope == BuiltInScope {
+		// Symbols of enclosing blocks live in the same frame, so they aren't free variables
+		if st.isBlock || sym.Scope == GlobalScope || sym.Scope == BuiltInScope {
 			return sym, ok
 		}
 
@@ -106,3 +179,20 @@ func (st *SymbolTable) Resolve(name string) (Symbol, bool) {
 	}
 	return sym, ok
 }
+
+// Returns the number of local slots needed by the frame of this (enclosing) symbol table, including those used by
+// the symbols of its blocks.
+func (st *SymbolTable) NumLocals() int {
+	if st.outer == nil {
+		return st.maxLocals
+	}
+	return max(st.numDefinitions, st.maxLocals)
+}
+
+// Returns the nearest symbol table, starting from this one, that isn't a block symbol table.
+func (st *SymbolTable) enclosingTable() *SymbolTable {
+	if st.isBlock {
+		return st.outer.enclosingTable()
+	}
+	return st
+}
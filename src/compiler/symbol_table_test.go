@@ -332,3 +332,97 @@ func TestDefineAndResolveFunctionName(t *testing.T) {
 		t.Errorf("expected %s to resolve to %+v, got=%+v", expected.Name, expected, result)
 	}
 }
+
+func TestBlockScopes(t *testing.T) {
+	global := NewSymbolTable()
+	global.Define("a")
+
+	globalBlock := NewBlockSymbolTable(global)
+	b := globalBlock.Define("b")
+	expectedB := Symbol{Name: "b", Scope: LocalScope, Index: 0}
+	if b != expectedB {
+		t.Errorf("expected b=%+v, got=%+v", expectedB, b)
+	}
+
+	local := NewEnclosedSymbolTable(globalBlock)
+	local.Define("c")
+
+	firstBlock := NewBlockSymbolTable(local)
+	firstBlock.Define("d")
+	nestedBlock := NewBlockSymbolTable(firstBlock)
+	nestedBlock.Define("e")
+
+	expected := []Symbol{
+		{Name: "a", Scope: GlobalScope, Index: 0},
+		{Name: "b", Scope: FreeScope, Index: 0},
+		{Name: "c", Scope: LocalScope, Index: 0},
+		{Name: "d", Scope: LocalScope, Index: 1},
+		{Name: "e", Scope: LocalScope, Index: 2},
+	}
+
+	for _, sym := range expected {
+		result, ok := nestedBlock.Resolve(sym.Name)
+		if !ok {
+			t.Errorf("name %s is not resolvable", sym.Name)
+			continue
+		}
+		if result != sym {
+			t.Errorf("expected %s to resolve to %+v, got=%+v", sym.Name, sym, result)
+		}
+	}
+
+	// Slots used by blocks that have ended are reused by subsequent blocks
+	secondBlock := NewBlockSymbolTable(local)
+	f := secondBlock.Define("f")
+	expectedF := Symbol{Name: "f", Scope: LocalScope, Index: 1}
+	if f != expectedF {
+		t.Errorf("expected f=%+v, got=%+v", expectedF, f)
+	}
+
+	if _, ok := secondBlock.Resolve("d"); ok {
+		t.Errorf("name d should not be resolvable outside of its block")
+	}
+
+	if local.NumLocals() != 3 {
+		t.Errorf("wrong number of locals. expected=%d, got=%d", 3, local.NumLocals())
+	}
+
+	if global.NumLocals() != 1 {
+		t.Errorf("wrong number of main frame locals. expected=%d, got=%d", 1, global.NumLocals())
+	}
+}
+
+func TestCapturedBlockSymbols(t *testing.T) {
+	global := NewSymbolTable()
+	local := NewEnclosedSymbolTable(global)
+	local.Define("a")
+
+	outerBlock := NewBlockSymbolTable(local)
+	outerBlock.Define("b")
+	innerBlock := NewBlockSymbolTable(outerBlock)
+	innerBlock.Define("c")
+
+	closure := NewEnclosedSymbolTable(innerBlock)
+
+	expected := []Symbol{
+		{Name: "b", Scope: FreeScope, Index: 0},
+		{Name: "a", Scope: FreeScope, Index: 1},
+	}
+	for _, sym := range expected {
+		result, ok := closure.Resolve(sym.Name)
+		if !ok {
+			t.Errorf("name %s is not resolvable", sym.Name)
+			continue
+		}
+		if result != sym {
+			t.Errorf("expected %s to resolve to %+v, got=%+v", sym.Name, sym, result)
+		}
+	}
+
+	if !outerBlock.hasCaptures {
+		t.Errorf("expected the block defining b to have captured symbols")
+	}
+	if innerBlock.hasCaptures {
+		t.Errorf("expected the block defining c not to have captured symbols")
+	}
+}
@@ -0,0 +1,219 @@
+// Package difftest runs Monkey programs through both engines (the interpreter/evaluator and the compiler & VM) and
+// reports any differences in their behavior.
+package difftest
+
+import (
+	"bytes"
+	"fmt"
+	"monkey/ast"
+	"monkey/compiler"
+	"monkey/evaluator"
+	"monkey/lexer"
+	"monkey/object"
+	"monkey/parser"
+	"monkey/vm"
+	"strings"
+)
+
+// Represents the observable behavior of a program run by one of the engines.
+type Outcome struct {
+	Output string // everything printed by the program
+	Result string // the value of the program's final expression statement, or "" if it doesn't end with one
+	Error  string // the error that stopped the program, or "" if it ran to completion
+}
+
+func (o Outcome) String() string {
+	var out bytes.Buffer
+
+	fmt.Fprintf(&out, "output: %q\n", o.Output)
+	fmt.Fprintf(&out, "result: %s\n", o.Result)
+	fmt.Fprintf(&out, "error: %s", o.Error)
+
+	return out.String()
+}
+
+// Represents a program for which the two engines behave differently.
+type Divergence struct {
+	Input     string
+	Evaluator Outcome
+	VM        Outcome
+	Optimized bool // whether the program was compiled with optimizations for the VM
+}
+
+func (d *Divergence) String() string {
+	var out bytes.Buffer
+
+	out.WriteString("program:\n" + d.Input + "\n")
+	out.WriteString("evaluator:\n" + d.Evaluator.String() + "\n")
+	if d.Optimized {
+		out.WriteString("vm:\n" + d.VM.String())
+	} else {
+		out.WriteString("vm (-O0):\n" + d.VM.String())
+	}
+
+	return out.String()
+}
+
+// Runs the program through both engines, returning the divergence between them if they behave differently. The program
+// is run by the VM both with and without compiler optimizations.
+//
+// When compilation fails, only the errors are compared. The compiler rejects some errors (e.g. undefined variables)
+// before the program runs, while the evaluator only reports them once it reaches the offending code, so the evaluator
+// may have printed some output first.
+func Compare(input string) *Divergence {
+	return CompareFile("", input)
+}
+
+// Like Compare, but runs the program as if it were read from the given file (as with the `-filename` flag), whose name
+// the engines include in the errors they report.
+func CompareFile(filename string, input string) *Divergence {
+	evaluated := runEvaluator(input, filename)
+
+	for _, optimized := range []bool{true, false} {
+		executed, compileErr := runVM(input, compiler.Options{Filename: filename, NoOptimizations: !optimized})
+
+		agree := evaluated == executed
+		if compileErr {
+			agree = evaluated.Error == executed.Error
+		}
+
+		if !agree {
+			return &Divergence{Input: input, Evaluator: evaluated, VM: executed, Optimized: optimized}
+		}
+	}
+
+	return nil
+}
+
+// Runs the program with the evaluator.
+func RunEvaluator(input string) Outcome {
+	return runEvaluator(input, "")
+}
+
+// Runs the program with the evaluator, as if it were read from the given file (if any).
+func runEvaluator(input string, filename string) Outcome {
+	program, errs := parse(input)
+	if errs != "" {
+		return Outcome{Error: errs}
+	}
+
+	macroEnv := object.NewEnvironment()
+	evaluator.DefineMacros(program, macroEnv)
+	expanded, err := evaluator.ExpandMacros(program, macroEnv)
+	if err != nil {
+		return Outcome{Error: err.Error()}
+	}
+
+	var out bytes.Buffer
+	env := object.NewEnvironment()
+	env.SetOutput(&out)
+	env.SetFilename(filename)
+	result := evaluator.Eval(expanded, env)
+	output := out.String()
+
+	if errObj, ok := result.(*object.Error); ok {
+		runtimeErr := errObj.RuntimeError()
+		runtimeErr.Filename = filename
+		return Outcome{Output: output, Error: runtimeErr.Error()}
+	}
+	if !endsWithExpression(expanded) {
+		return Outcome{Output: output}
+	}
+	return Outcome{Output: output, Result: describe(result)}
+}
+
+// Runs the program with the compiler & VM.
+func RunVM(input string) Outcome {
+	outcome, _ := runVM(input, compiler.Options{})
+	return outcome
+}
+
+// Runs the program with the compiler & VM, also reporting whether it failed to compile.
+func runVM(input string, options compiler.Options) (Outcome, bool) {
+	program, errs := parse(input)
+	if errs != "" {
+		return Outcome{Error: errs}, false
+	}
+
+	macroEnv := object.NewEnvironment()
+	evaluator.DefineMacros(program, macroEnv)
+	expanded, err := evaluator.ExpandMacros(program, macroEnv)
+	if err != nil {
+		return Outcome{Error: err.Error()}, false
+	}
+
+	comp := compiler.NewCompiler()
+	comp.SetOptions(options)
+	err = comp.Compile(expanded)
+	if err != nil {
+		return Outcome{Error: err.Error()}, true
+	}
+
+	var out bytes.Buffer
+	machine := vm.NewVM(comp.Bytecode())
+	machine.SetOutput(&out)
+	err = machine.Run()
+	output := out.String()
+
+	if err != nil {
+		return Outcome{Output: output, Error: err.Error()}, false
+	}
+	if !endsWithExpression(expanded) {
+		return Outcome{Output: output}, false
+	}
+	return Outcome{Output: output, Result: describe(machine.LastPoppedStackElem())}, false
+}
+
+func parse(input string) (*ast.Program, string) {
+	l := lexer.NewLexer(input)
+	p := parser.NewParser(l)
+	program := p.ParseProgram()
+	return program, strings.Join(p.Errors(), "\n")
+}
+
+// Reports whether the last statement of the program that runs (i.e. other than a function declaration, since those
+// are hoisted) is an expression statement, in which case its value is the value of the program.
+func endsWithExpression(program *ast.Program) bool {
+	for i := len(program.Statements) - 1; i >= 0; i-- {
+		switch program.Statements[i].(type) {
+		case *ast.FunctionDeclaration:
+			continue
+		case *ast.ExpressionStatement:
+			return true
+		default:
+			return false
+		}
+	}
+	return false
+}
+
+// Describes a value in the same way regardless of the engine which produced it. Functions are represented differently
+// by the two engines, so they're only described as functions.
+func describe(obj object.Object) string {
+	switch obj := obj.(type) {
+	case nil:
+		return "<none>"
+	case *object.Function, *object.Closure:
+		return "<function>"
+	case *object.Array:
+		elements := make([]string, len(obj.Elements))
+		for i, element := range obj.Elements {
+			elements[i] = describe(element)
+		}
+		return "[" + strings.Join(elements, ", ") + "]"
+	case *object.HashMap:
+		pairs := []string{}
+		for _, pair := range obj.SortedPairs() {
+			pairs = append(pairs, describe(pair.Key)+": "+describe(pair.Value))
+		}
+		return "{" + strings.Join(pairs, ", ") + "}"
+	case *object.Set:
+		elements := []string{}
+		for _, element := range obj.SortedElements() {
+			elements = append(elements, describe(element))
+		}
+		return "#{" + strings.Join(elements, ", ") + "}"
+	default:
+		return obj.Inspect()
+	}
+}
@@ -0,0 +1,144 @@
+package difftest
+
+import (
+	"flag"
+	"monkey/ast"
+	"monkey/compiler"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "update the golden files of the programs in testdata")
+var benchmarks = flag.Bool("benchmarks", false, "also run the example programs which are long-running benchmarks")
+
+// The example programs in monkey_files which are benchmarks, and so are only run with the `-benchmarks` flag.
+var benchmarkPrograms = map[string]bool{
+	"fibonacci.mo": true,
+}
+
+// Runs the programs in testdata through both engines, checking that they agree with each other and with the expected
+// outcome recorded in the program's golden file.
+func TestGoldenPrograms(t *testing.T) {
+	files, err := filepath.Glob("testdata/*.mo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) == 0 {
+		t.Fatal("no programs found in testdata")
+	}
+
+	for _, file := range files {
+		t.Run(filepath.Base(file), func(t *testing.T) {
+			input := readFile(t, file)
+
+			if divergence := Compare(input); divergence != nil {
+				t.Fatalf("the engines diverge:\n%s", divergence)
+			}
+
+			actual := RunVM(input).String() + "\n"
+			golden := strings.TrimSuffix(file, ".mo") + ".golden"
+			if *update {
+				if err := os.WriteFile(golden, []byte(actual), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			expected := readFile(t, golden)
+			if actual != expected {
+				t.Errorf("wrong outcome.\nexpected:\n%s\ngot:\n%s", expected, actual)
+			}
+		})
+	}
+}
+
+// Runs programs as if they were read from a file, checking that both engines include its name in the errors they
+// report (failed assertions and runtime errors) in the same way.
+func TestProgramsRunFromFiles(t *testing.T) {
+	tests := []struct {
+		input         string
+		expectedError string
+	}{
+		{"assert false", "main.mo:1:0: assertion failed: false"},
+		{
+			"let withdraw = fn(balance, amount) {\n    assert amount <= balance, \"insufficient funds\";\n    balance - amount;\n};\nwithdraw(10, 25);",
+			"main.mo:2:4: assertion failed: (amount <= balance): insufficient funds (where amount = 25, balance = 10)",
+		},
+		{"let half = fn(x) { x / 0 };\nputs(half(4));", "main.mo:1:21: division by zero"},
+	}
+
+	for _, tt := range tests {
+		if divergence := CompareFile("main.mo", tt.input); divergence != nil {
+			t.Errorf("the engines diverge:\n%s", divergence)
+			continue
+		}
+
+		outcome, _ := runVM(tt.input, compiler.Options{Filename: "main.mo"})
+		if outcome.Error != tt.expectedError {
+			t.Errorf("wrong error for %q. expected=%q, got=%q", tt.input, tt.expectedError, outcome.Error)
+		}
+	}
+}
+
+// Runs the example programs in monkey_files through both engines, checking that they agree. The benchmarks among them
+// are skipped unless the `-benchmarks` flag is given.
+func TestExamplePrograms(t *testing.T) {
+	files, err := filepath.Glob("../../monkey_files/*.mo")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, file := range files {
+		t.Run(filepath.Base(file), func(t *testing.T) {
+			if benchmarkPrograms[filepath.Base(file)] && !*benchmarks {
+				t.Skip("long-running benchmark (run with -benchmarks)")
+			}
+
+			if divergence := Compare(readFile(t, file)); divergence != nil {
+				t.Fatalf("the engines diverge:\n%s", divergence)
+			}
+		})
+	}
+}
+
+func TestRandomPrograms(t *testing.T) {
+	numPrograms := int64(1000)
+	if testing.Short() {
+		numPrograms = 100
+	}
+
+	for seed := int64(0); seed < numPrograms; seed++ {
+		checkGeneratedProgram(t, seed)
+	}
+}
+
+// Fuzzes the engines with random programs, e.g. `go test ./difftest -fuzz FuzzEngines`.
+func FuzzEngines(f *testing.F) {
+	for seed := int64(0); seed < 10; seed++ {
+		f.Add(seed)
+	}
+
+	f.Fuzz(checkGeneratedProgram)
+}
+
+func checkGeneratedProgram(t *testing.T, seed int64) {
+	input := ast.Format(NewGenerator(seed).Program())
+
+	if _, compileErr := runVM(input, compiler.Options{}); compileErr {
+		t.Fatalf("generated program (seed %d) doesn't compile: %s\n%s", seed, RunVM(input).Error, input)
+	}
+	if divergence := Compare(input); divergence != nil {
+		t.Fatalf("the engines diverge on the generated program (seed %d):\n%s", seed, divergence)
+	}
+}
+
+func readFile(t *testing.T, path string) string {
+	t.Helper()
+
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(contents)
+}
@@ -0,0 +1,618 @@
+package difftest
+
+import (
+	"math/rand"
+	"monkey/ast"
+	"monkey/token"
+	"strconv"
+)
+
+// The kinds of values which the generator keeps track of, so that it can mostly generate well-typed expressions.
+type valueKind int
+
+const (
+	intKind   valueKind = iota
+	floatKind           // floats are only produced by arithmetic, so that variables don't change kinds when reassigned
+	boolKind
+	stringKind
+	arrayKind   // arrays of integers
+	hashMapKind // hashmaps from strings to integers
+	setKind     // sets of integers
+)
+
+var valueKinds = []valueKind{intKind, floatKind, boolKind, stringKind, arrayKind, hashMapKind, setKind}
+
+// The limits on the size of generated programs.
+const (
+	maxExpressionDepth = 3
+	maxBlockDepth      = 3
+	maxStatements      = 12
+	maxBlockStatements = 4
+	maxLoopIterations  = 4
+	maxParameters      = 3
+)
+
+type variable struct {
+	name       string
+	kind       valueKind
+	assignable bool // loop counters aren't assignable, so that the loops always terminate
+}
+
+type function struct {
+	name          string
+	numParameters int
+	hoisted       bool // whether the function is a function declaration, rather than a function literal bound with `let`
+}
+
+type scope struct {
+	variables []variable
+	functions []function
+	declared  map[string]bool
+}
+
+// Generates random Monkey programs from the AST types, for comparing the behavior of the two engines. The programs
+// only reference bindings that are in scope and never reassign constants or functions, so that they're accepted by the
+// compiler, and all of their loops are bounded, so that they terminate. They may still fail at runtime, though (e.g.
+// by dividing by zero, or by occasionally combining values of the wrong types).
+type Generator struct {
+	rand   *rand.Rand
+	scopes []*scope
+	names  int // The number of fresh names generated so far.
+
+	blockDepth int
+	function   *function // The function whose body is being generated, if any.
+	floor      int       // The index of the outermost scope visible from the function whose body is being generated.
+}
+
+func NewGenerator(seed int64) *Generator {
+	return &Generator{rand: rand.New(rand.NewSource(seed))}
+}
+
+// Generates a program, which ends with an expression statement so that its value can be compared.
+func (g *Generator) Program() *ast.Program {
+	g.scopes = []*scope{newScope()}
+	g.blockDepth = 0
+	g.function = nil
+	g.floor = 0
+
+	program := &ast.Program{}
+	for i := g.rand.Intn(maxStatements) + 1; i > 0; i-- {
+		program.Statements = append(program.Statements, g.topLevelStatement())
+	}
+	program.Statements = append(program.Statements, expressionStatement(g.expression(g.randomKind(), 0)))
+
+	return program
+}
+
+func newScope() *scope {
+	return &scope{declared: map[string]bool{}}
+}
+
+func (g *Generator) enterScope() {
+	g.scopes = append(g.scopes, newScope())
+}
+
+func (g *Generator) leaveScope() {
+	g.scopes = g.scopes[:len(g.scopes)-1]
+}
+
+func (g *Generator) currentScope() *scope {
+	return g.scopes[len(g.scopes)-1]
+}
+
+// Generates a name which hasn't been used yet. Identifiers can't contain digits, so the names are numbered with
+// letters instead (e.g. "v_a", "v_b", ..., "v_z", "v_ba", ...). The underscore keeps them from spelling keywords.
+func (g *Generator) freshName(prefix string) string {
+	suffix := ""
+	for n := g.names; ; n /= 26 {
+		suffix = string(rune('a'+n%26)) + suffix
+		if n < 26 {
+			break
+		}
+	}
+	g.names++
+	return prefix + "_" + suffix
+}
+
+func (g *Generator) chance(percent int) bool {
+	return g.rand.Intn(100) < percent
+}
+
+func (g *Generator) randomKind() valueKind {
+	return valueKinds[g.rand.Intn(len(valueKinds))]
+}
+
+// Returns the variables that are visible from the current scope, with shadowed variables excluded.
+func (g *Generator) visibleVariables() []variable {
+	visible := []variable{}
+	seen := map[string]bool{}
+	for i := len(g.scopes) - 1; i >= g.floor; i-- {
+		for _, v := range g.scopes[i].variables {
+			if !seen[v.name] {
+				seen[v.name] = true
+				visible = append(visible, v)
+			}
+		}
+		for _, f := range g.scopes[i].functions {
+			seen[f.name] = true
+		}
+	}
+	return visible
+}
+
+func (g *Generator) variablesOfKind(kind valueKind) []variable {
+	matching := []variable{}
+	for _, v := range g.visibleVariables() {
+		if v.kind == kind {
+			matching = append(matching, v)
+		}
+	}
+	return matching
+}
+
+// Returns the functions that can be called from the current scope. The bodies of function declarations are compiled
+// before the rest of their block, so they can only call other function declarations.
+func (g *Generator) callableFunctions() []function {
+	callable := []function{}
+	for i := len(g.scopes) - 1; i >= 0; i-- {
+		for _, f := range g.scopes[i].functions {
+			if f.hoisted || (g.function == nil || !g.function.hoisted) && i >= g.floor {
+				callable = append(callable, f)
+			}
+		}
+	}
+	return callable
+}
+
+func (g *Generator) topLevelStatement() ast.Statement {
+	if g.chance(15) {
+		return g.functionDeclaration()
+	}
+	return g.statement()
+}
+
+func (g *Generator) statement() ast.Statement {
+	nested := g.blockDepth < maxBlockDepth
+
+	switch n := g.rand.Intn(100); {
+	case n < 20:
+		return g.declaration()
+	case n < 35:
+		if assignment := g.assignment(); assignment != nil {
+			return assignment
+		}
+		return g.declaration()
+	case n < 50:
+		return g.putsStatement()
+	case n < 58 && nested:
+		return expressionStatement(g.ifExpression(g.randomKind(), 0))
+	case n < 64 && nested:
+		return g.forLoop()
+	case n < 70 && nested:
+		return g.whileLoop()
+	case n < 75 && nested:
+		return expressionStatement(g.switchStatement())
+	case n < 80 && g.function == nil:
+		return g.functionLiteralDeclaration()
+	case n < 84 && g.function != nil:
+		return &ast.DeferStatement{Token: newToken(token.DEFER, "defer"), Call: g.putsCall()}
+	case n < 88 && g.function != nil:
+		return &ast.ReturnStatement{Token: newToken(token.RETURN, "return"), ReturnValue: g.expression(intKind, 0)}
+	case n < 90:
+		return &ast.AssertStatement{Token: newToken(token.ASSERT, "assert"), Condition: g.expression(boolKind, 1)}
+	default:
+		return expressionStatement(g.expression(g.randomKind(), 0))
+	}
+}
+
+// Generates a let or const statement declaring a new variable, which occasionally shadows a variable of an enclosing
+// scope. Loop counters are never shadowed, since the loops' afterthoughts would then increment the wrong variable.
+func (g *Generator) declaration() ast.Statement {
+	kind := g.randomKind()
+	value := g.expression(kind, 0)
+
+	name := g.freshName("v")
+	if len(g.scopes) > 1 && g.chance(20) {
+		for _, v := range g.visibleVariables() {
+			if v.assignable && !g.currentScope().declared[v.name] {
+				name = v.name
+				break
+			}
+		}
+	}
+
+	isConst := g.chance(25)
+	g.declare(variable{name: name, kind: kind, assignable: !isConst})
+
+	if isConst {
+		return &ast.ConstStatement{Token: newToken(token.CONST, "const"), Name: newIdentifier(name), Value: value}
+	}
+	return &ast.LetStatement{Token: newToken(token.LET, "let"), Name: newIdentifier(name), Value: value}
+}
+
+func (g *Generator) declare(v variable) {
+	s := g.currentScope()
+	s.variables = append(s.variables, v)
+	s.declared[v.name] = true
+}
+
+// Generates an assignment to a variable in scope, or returns nil if no variable can be assigned.
+func (g *Generator) assignment() ast.Statement {
+	assignable := []variable{}
+	for _, v := range g.visibleVariables() {
+		if v.assignable {
+			assignable = append(assignable, v)
+		}
+	}
+	if len(assignable) == 0 {
+		return nil
+	}
+
+	v := assignable[g.rand.Intn(len(assignable))]
+	value := g.expression(v.kind, 0)
+	if v.kind == intKind && g.chance(50) {
+		// The equivalent of `+=`, `-=`, `++`, etc.
+		value = infix(newIdentifier(v.name), []string{"+", "-", "*"}[g.rand.Intn(3)], value)
+	}
+
+	return &ast.AssignStatement{Token: newToken(token.IDENT, v.name), Name: newIdentifier(v.name), Value: value}
+}
+
+func (g *Generator) putsStatement() ast.Statement {
+	return expressionStatement(g.putsCall())
+}
+
+func (g *Generator) putsCall() *ast.CallExpression {
+	args := []ast.Expression{}
+	for i := g.rand.Intn(3) + 1; i > 0; i-- {
+		args = append(args, g.expression(g.randomKind(), 1))
+	}
+	return call(newIdentifier("puts"), args)
+}
+
+func (g *Generator) block(statements func() []ast.Statement) *ast.BlockStatement {
+	g.enterScope()
+	g.blockDepth++
+	defer func() {
+		g.blockDepth--
+		g.leaveScope()
+	}()
+
+	return &ast.BlockStatement{Token: newToken(token.LBRACE, "{"), Statements: statements()}
+}
+
+// Generates a block of random statements, ending with an expression of the given kind (if any).
+func (g *Generator) randomBlock(valueKind *valueKind) *ast.BlockStatement {
+	return g.block(func() []ast.Statement {
+		statements := []ast.Statement{}
+		for i := g.rand.Intn(maxBlockStatements); i > 0; i-- {
+			statements = append(statements, g.statement())
+		}
+		if valueKind != nil {
+			statements = append(statements, expressionStatement(g.expression(*valueKind, 1)))
+		}
+		return statements
+	})
+}
+
+func (g *Generator) ifExpression(kind valueKind, depth int) *ast.IfExpression {
+	ie := &ast.IfExpression{Token: newToken(token.IF, "if")}
+	for i := g.rand.Intn(2) + 1; i > 0; i-- {
+		ie.Clauses = append(ie.Clauses, ast.ConditionalClause{
+			Condition:   g.expression(boolKind, depth+1),
+			Consequence: g.randomBlock(&kind),
+		})
+	}
+	if g.chance(70) {
+		ie.Alternative = g.randomBlock(&kind)
+	}
+	return ie
+}
+
+func (g *Generator) switchStatement() *ast.SwitchStatement {
+	kind := g.randomKind()
+	ss := &ast.SwitchStatement{Token: newToken(token.SWITCH, "switch"), SwitchExpression: g.expression(intKind, 1)}
+	for i := g.rand.Intn(3) + 1; i > 0; i-- {
+		ss.Cases = append(ss.Cases, ast.SwitchCase{Expression: g.expression(intKind, 2), Consequence: g.randomBlock(&kind)})
+	}
+	if g.chance(50) {
+		ss.Default = g.randomBlock(&kind)
+	}
+	return ss
+}
+
+// Generates a for loop with a counter which isn't assignable in the body, so that the loop is bounded.
+func (g *Generator) forLoop() ast.Statement {
+	counter := g.freshName("i")
+	bound := integerLiteral(int64(g.rand.Intn(maxLoopIterations + 1)))
+
+	g.enterScope()
+	defer g.leaveScope()
+	g.declare(variable{name: counter, kind: intKind})
+
+	return expressionStatement(&ast.ForLoop{
+		Token:        newToken(token.FOR, "for"),
+		Init:         &ast.LetStatement{Token: newToken(token.LET, "let"), Name: newIdentifier(counter), Value: integerLiteral(0)},
+		Condition:    infix(newIdentifier(counter), "<", bound),
+		Afterthought: increment(counter),
+		Body:         g.randomBlock(nil),
+	})
+}
+
+// Generates a while loop incrementing a counter (declared just before the loop) at the end of its body. The counter
+// isn't assignable anywhere else, so that the loop is bounded.
+func (g *Generator) whileLoop() ast.Statement {
+	counter := g.freshName("w")
+	bound := integerLiteral(int64(g.rand.Intn(maxLoopIterations + 1)))
+
+	g.enterScope()
+	defer g.leaveScope()
+	g.declare(variable{name: counter, kind: intKind})
+
+	body := g.randomBlock(nil)
+	body.Statements = append(body.Statements, increment(counter))
+
+	// The counter is declared by a statement preceding the loop, so the two are wrapped in an `if (true)` block
+	return expressionStatement(&ast.IfExpression{
+		Token: newToken(token.IF, "if"),
+		Clauses: []ast.ConditionalClause{{
+			Condition: &ast.Boolean{Token: newToken(token.TRUE, "true"), Value: true},
+			Consequence: &ast.BlockStatement{Token: newToken(token.LBRACE, "{"), Statements: []ast.Statement{
+				&ast.LetStatement{Token: newToken(token.LET, "let"), Name: newIdentifier(counter), Value: integerLiteral(0)},
+				expressionStatement(&ast.WhileLoop{
+					Token:     newToken(token.WHILE, "while"),
+					Condition: infix(newIdentifier(counter), "<", bound),
+					Body:      body,
+				}),
+			}},
+		}},
+	})
+}
+
+// Generates a function declaration. Since function declarations are hoisted, their bodies can only reference their own
+// parameters and locals, and call other function declarations.
+func (g *Generator) functionDeclaration() ast.Statement {
+	name := g.freshName("f")
+	fn := function{name: name, numParameters: g.rand.Intn(maxParameters + 1), hoisted: true}
+
+	literal := g.functionLiteral(fn, len(g.scopes))
+	g.currentScope().functions = append(g.currentScope().functions, fn)
+	g.currentScope().declared[name] = true
+
+	return &ast.FunctionDeclaration{Token: newToken(token.FUNCTION, "fn"), Name: newIdentifier(name), Function: literal}
+}
+
+// Generates a function literal bound with `let`, whose body can reference any of the variables in scope.
+func (g *Generator) functionLiteralDeclaration() ast.Statement {
+	name := g.freshName("f")
+	fn := function{name: name, numParameters: g.rand.Intn(maxParameters + 1)}
+
+	literal := g.functionLiteral(fn, g.floor)
+	g.currentScope().functions = append(g.currentScope().functions, fn)
+	g.currentScope().declared[name] = true
+
+	return &ast.LetStatement{Token: newToken(token.LET, "let"), Name: newIdentifier(name), Value: literal}
+}
+
+// Generates the literal of the function, whose body can see the scopes from the given index onwards. Its parameters
+// are integers, and it returns an integer.
+func (g *Generator) functionLiteral(fn function, floor int) *ast.FunctionLiteral {
+	outerFunction, outerFloor, outerBlockDepth := g.function, g.floor, g.blockDepth
+	g.function, g.floor, g.blockDepth = &fn, floor, 0
+	defer func() {
+		g.function, g.floor, g.blockDepth = outerFunction, outerFloor, outerBlockDepth
+	}()
+
+	g.enterScope()
+	defer g.leaveScope()
+
+	params := []*ast.Identifier{}
+	for i := 0; i < fn.numParameters; i++ {
+		param := g.freshName("p")
+		params = append(params, newIdentifier(param))
+		g.declare(variable{name: param, kind: intKind, assignable: true})
+	}
+
+	statements := []ast.Statement{}
+	for i := g.rand.Intn(maxBlockStatements); i > 0; i-- {
+		statements = append(statements, g.statement())
+	}
+	statements = append(statements, expressionStatement(g.expression(intKind, 0)))
+
+	return &ast.FunctionLiteral{
+		Token:      newToken(token.FUNCTION, "fn"),
+		Name:       fn.name,
+		Parameters: params,
+		Body:       &ast.BlockStatement{Token: newToken(token.LBRACE, "{"), Statements: statements},
+	}
+}
+
+// Generates an expression which produces a value of the given kind (except for the occasional deliberate mistake).
+func (g *Generator) expression(kind valueKind, depth int) ast.Expression {
+	if g.chance(3) {
+		kind = g.randomKind()
+	}
+
+	if depth >= maxExpressionDepth || g.chance(30) {
+		return g.leaf(kind)
+	}
+
+	switch kind {
+	case intKind:
+		return g.intExpression(depth)
+	case floatKind:
+		return g.floatExpression(depth)
+	case boolKind:
+		return g.boolExpression(depth)
+	case stringKind:
+		return infix(g.expression(stringKind, depth+1), "+", g.expression(stringKind, depth+1))
+	case arrayKind:
+		if g.chance(50) {
+			return infix(g.expression(arrayKind, depth+1), "+", g.expression(arrayKind, depth+1))
+		}
+		return g.leaf(arrayKind)
+	case hashMapKind:
+		return g.leaf(hashMapKind)
+	default:
+		operator := []string{"|", "&", "-"}[g.rand.Intn(3)]
+		return infix(g.expression(setKind, depth+1), operator, g.expression(setKind, depth+1))
+	}
+}
+
+func (g *Generator) intExpression(depth int) ast.Expression {
+	switch n := g.rand.Intn(100); {
+	case n < 40:
+		operator := []string{"+", "-", "*", "//", "%"}[g.rand.Intn(5)]
+		return infix(g.expression(intKind, depth+1), operator, g.expression(intKind, depth+1))
+	case n < 50:
+		return prefix("-", g.expression(intKind, depth+1))
+	case n < 60:
+		// The argument is always an array literal, since builtins report errors differently in the two engines
+		elements := []ast.Expression{}
+		for i := g.rand.Intn(4); i > 0; i-- {
+			elements = append(elements, g.expression(g.randomKind(), depth+1))
+		}
+		return call(newIdentifier("len"), []ast.Expression{&ast.ArrayLiteral{Token: newToken(token.LBRACKET, "["), Elements: elements}})
+	case n < 70:
+		return &ast.IndexExpression{Token: newToken(token.LBRACKET, "["), Left: g.expression(arrayKind, depth+1), Index: g.expression(intKind, depth+1)}
+	case n < 75:
+		return &ast.IndexExpression{Token: newToken(token.LBRACKET, "["), Left: g.expression(hashMapKind, depth+1), Index: g.expression(stringKind, depth+1)}
+	case n < 90:
+		if fn := g.functionCall(depth); fn != nil {
+			return fn
+		}
+		return g.leaf(intKind)
+	default:
+		return g.ifExpression(intKind, depth)
+	}
+}
+
+func (g *Generator) floatExpression(depth int) ast.Expression {
+	operator := []string{"+", "-", "*", "/", "**"}[g.rand.Intn(5)]
+	left := g.expression([]valueKind{intKind, floatKind}[g.rand.Intn(2)], depth+1)
+	right := g.expression([]valueKind{intKind, floatKind}[g.rand.Intn(2)], depth+1)
+	return infix(left, operator, right)
+}
+
+func (g *Generator) boolExpression(depth int) ast.Expression {
+	switch n := g.rand.Intn(100); {
+	case n < 40:
+		operator := []string{"==", "!=", "<", ">", "<=", ">="}[g.rand.Intn(6)]
+		kind := []valueKind{intKind, floatKind}[g.rand.Intn(2)]
+		return infix(g.expression(kind, depth+1), operator, g.expression(kind, depth+1))
+	case n < 50:
+		operator := []string{"==", "!="}[g.rand.Intn(2)]
+		kind := []valueKind{boolKind, stringKind}[g.rand.Intn(2)]
+		return infix(g.expression(kind, depth+1), operator, g.expression(kind, depth+1))
+	case n < 70:
+		operator := []string{"&&", "||"}[g.rand.Intn(2)]
+		return infix(g.expression(boolKind, depth+1), operator, g.expression(boolKind, depth+1))
+	case n < 80:
+		return prefix("!", g.expression(g.randomKind(), depth+1))
+	case n < 90:
+		return infix(g.expression(intKind, depth+1), "in", g.expression(setKind, depth+1))
+	default:
+		return infix(g.expression(stringKind, depth+1), "in", g.expression(hashMapKind, depth+1))
+	}
+}
+
+// Generates a call to one of the functions in scope, or returns nil if there aren't any. The call occasionally passes
+// the wrong number of arguments.
+func (g *Generator) functionCall(depth int) ast.Expression {
+	functions := g.callableFunctions()
+	if len(functions) == 0 {
+		return nil
+	}
+
+	fn := functions[g.rand.Intn(len(functions))]
+	numArgs := fn.numParameters
+	if g.chance(3) {
+		numArgs = g.rand.Intn(maxParameters + 1)
+	}
+
+	args := []ast.Expression{}
+	for i := 0; i < numArgs; i++ {
+		args = append(args, g.expression(intKind, depth+1))
+	}
+	return call(newIdentifier(fn.name), args)
+}
+
+// Generates a literal or a variable of the given kind.
+func (g *Generator) leaf(kind valueKind) ast.Expression {
+	if variables := g.variablesOfKind(kind); len(variables) > 0 && g.chance(60) {
+		return newIdentifier(variables[g.rand.Intn(len(variables))].name)
+	}
+
+	switch kind {
+	case intKind:
+		return integerLiteral(int64(g.rand.Intn(10)))
+	case floatKind:
+		value := float64(g.rand.Intn(40))/4 + 0.25
+		return &ast.Float{Token: newToken(token.FLOAT, strconv.FormatFloat(value, 'f', -1, 64)), Value: value}
+	case boolKind:
+		if g.chance(50) {
+			return &ast.Boolean{Token: newToken(token.TRUE, "true"), Value: true}
+		}
+		return &ast.Boolean{Token: newToken(token.FALSE, "false"), Value: false}
+	case stringKind:
+		return stringLiteral(g.randomString())
+	case arrayKind:
+		return &ast.ArrayLiteral{Token: newToken(token.LBRACKET, "["), Elements: g.integerLiterals()}
+	case hashMapKind:
+		hashmap := &ast.HashMapLiteral{Token: newToken(token.LBRACE, "{"), KVPairs: map[ast.Expression]ast.Expression{}}
+		for i := g.rand.Intn(4); i > 0; i-- {
+			hashmap.KVPairs[stringLiteral(g.randomString())] = integerLiteral(int64(g.rand.Intn(10)))
+		}
+		return hashmap
+	default:
+		return &ast.SetLiteral{Token: newToken(token.LSET, "#{"), Elements: g.integerLiterals()}
+	}
+}
+
+func (g *Generator) integerLiterals() []ast.Expression {
+	elements := []ast.Expression{}
+	for i := g.rand.Intn(5); i > 0; i-- {
+		elements = append(elements, integerLiteral(int64(g.rand.Intn(10))))
+	}
+	return elements
+}
+
+func (g *Generator) randomString() string {
+	return []string{"", "a", "b", "ab", "monkey", "Hello, World!"}[g.rand.Intn(6)]
+}
+
+func newToken(tokenType token.TokenType, literal string) token.Token {
+	return token.Token{Type: tokenType, Literal: literal}
+}
+
+func newIdentifier(name string) *ast.Identifier {
+	return &ast.Identifier{Token: newToken(token.IDENT, name), Value: name}
+}
+
+func integerLiteral(value int64) *ast.IntegerLiteral {
+	return &ast.IntegerLiteral{Token: newToken(token.INT, strconv.FormatInt(value, 10)), Value: value}
+}
+
+func stringLiteral(value string) *ast.StringLiteral {
+	return &ast.StringLiteral{Token: newToken(token.STRING, value), Value: value}
+}
+
+func expressionStatement(expression ast.Expression) *ast.ExpressionStatement {
+	return &ast.ExpressionStatement{Token: newToken(token.ILLEGAL, expression.TokenLiteral()), Expression: expression}
+}
+
+func prefix(operator string, right ast.Expression) *ast.PrefixExpression {
+	return &ast.PrefixExpression{Token: newToken(token.TokenType(operator), operator), Operator: operator, Right: right}
+}
+
+func infix(left ast.Expression, operator string, right ast.Expression) *ast.InfixExpression {
+	return &ast.InfixExpression{Token: newToken(token.TokenType(operator), operator), Left: left, Operator: operator, Right: right}
+}
+
+func increment(name string) *ast.AssignStatement {
+	return &ast.AssignStatement{Token: newToken(token.IDENT, name), Name: newIdentifier(name), Value: infix(newIdentifier(name), "+", integerLiteral(1))}
+}
+
+func call(function ast.Expression, args []ast.Expression) *ast.CallExpression {
+	return &ast.CallExpression{Token: newToken(token.LPAREN, "("), Function: function, Arguments: args}
+}
@@ -0,0 +1,605 @@
+package evaluator
+
+import (
+	"monkey/ast"
+	"monkey/lexer"
+	"monkey/object"
+	"monkey/parser"
+	"monkey/token"
+	"slices"
+	"strconv"
+)
+
+// Constructs an identifier with the given name (a string or an identifier).
+func astIdent(args ...object.Object) object.Object {
+	if len(args) != 1 {
+		return newError("wrong number of arguments. expected=1, got=%d", len(args))
+	}
+
+	identifier, err := toIdentifier("ast_ident", args[0])
+	if err != nil {
+		return err
+	}
+	return &object.Quote{Node: identifier}
+}
+
+// Constructs a literal for the given integer, float, boolean, or string.
+func astLiteral(args ...object.Object) object.Object {
+	if len(args) != 1 {
+		return newError("wrong number of arguments. expected=1, got=%d", len(args))
+	}
+
+	literal := newLiteral(args[0])
+	if literal == nil {
+		return newError("argument to `ast_literal` is not supported, got %s", args[0].Type())
+	}
+	return &object.Quote{Node: literal}
+}
+
+// Constructs a prefix expression from an operator (a string) and an operand.
+func astPrefix(args ...object.Object) object.Object {
+	if len(args) != 2 {
+		return newError("wrong number of arguments. expected=2, got=%d", len(args))
+	}
+
+	operator, err := toOperator("ast_prefix", "a prefix operator", args[0], parser.PrefixOperators)
+	if err != nil {
+		return err
+	}
+	right, err := toExpression("ast_prefix", args[1])
+	if err != nil {
+		return err
+	}
+
+	return &object.Quote{Node: &ast.PrefixExpression{Token: operator, Operator: operator.Literal, Right: right}}
+}
+
+// Constructs an infix expression from an operator (a string) and its left & right operands.
+func astInfix(args ...object.Object) object.Object {
+	if len(args) != 3 {
+		return newError("wrong number of arguments. expected=3, got=%d", len(args))
+	}
+
+	operator, err := toOperator("ast_infix", "an infix operator", args[0], parser.InfixOperators)
+	if err != nil {
+		return err
+	}
+	left, err := toExpression("ast_infix", args[1])
+	if err != nil {
+		return err
+	}
+	right, err := toExpression("ast_infix", args[2])
+	if err != nil {
+		return err
+	}
+
+	return &object.Quote{Node: &ast.InfixExpression{Token: operator, Left: left, Operator: operator.Literal, Right: right}}
+}
+
+// Constructs a call of a function (an expression, or a string naming the function) with an array of arguments.
+func astCall(args ...object.Object) object.Object {
+	if len(args) != 2 {
+		return newError("wrong number of arguments. expected=2, got=%d", len(args))
+	}
+
+	var function ast.Expression
+	if name, ok := args[0].(*object.String); ok {
+		function = newIdentifier(name.Value)
+	} else {
+		var err *object.Error
+		function, err = toExpression("ast_call", args[0])
+		if err != nil {
+			return err
+		}
+	}
+
+	arguments, err := toExpressions("ast_call", args[1])
+	if err != nil {
+		return err
+	}
+
+	return &object.Quote{Node: &ast.CallExpression{
+		Token:     token.Token{Type: token.LPAREN, Literal: "("},
+		Function:  function,
+		Arguments: arguments,
+	}}
+}
+
+// Constructs an index expression from the indexed expression and the index.
+func astIndex(args ...object.Object) object.Object {
+	if len(args) != 2 {
+		return newError("wrong number of arguments. expected=2, got=%d", len(args))
+	}
+
+	left, err := toExpression("ast_index", args[0])
+	if err != nil {
+		return err
+	}
+	index, err := toExpression("ast_index", args[1])
+	if err != nil {
+		return err
+	}
+
+	return &object.Quote{Node: &ast.IndexExpression{Token: token.Token{Type: token.LBRACKET, Literal: "["}, Left: left, Index: index}}
+}
+
+// Constructs an array literal from an array of elements.
+func astArray(args ...object.Object) object.Object {
+	if len(args) != 1 {
+		return newError("wrong number of arguments. expected=1, got=%d", len(args))
+	}
+
+	elements, err := toExpressions("ast_array", args[0])
+	if err != nil {
+		return err
+	}
+	return &object.Quote{Node: &ast.ArrayLiteral{Token: token.Token{Type: token.LBRACKET, Literal: "["}, Elements: elements}}
+}
+
+// Constructs a hashmap literal from an array of [key, value] pairs.
+func astHashMap(args ...object.Object) object.Object {
+	if len(args) != 1 {
+		return newError("wrong number of arguments. expected=1, got=%d", len(args))
+	}
+
+	pairs, ok := args[0].(*object.Array)
+	if !ok {
+		return newError("argument to `ast_hashmap` must be ARRAY, got %s", args[0].Type())
+	}
+
+	kvPairs := make(map[ast.Expression]ast.Expression)
+	for _, pair := range pairs.Elements {
+		pairArray, ok := pair.(*object.Array)
+		if !ok || len(pairArray.Elements) != 2 {
+			return newError("argument to `ast_hashmap` must be an array of [key, value] pairs, got %s", pair.Inspect())
+		}
+
+		key, err := toExpression("ast_hashmap", pairArray.Elements[0])
+		if err != nil {
+			return err
+		}
+		value, err := toExpression("ast_hashmap", pairArray.Elements[1])
+		if err != nil {
+			return err
+		}
+		kvPairs[key] = value
+	}
+
+	return &object.Quote{Node: &ast.HashMapLiteral{Token: token.Token{Type: token.LBRACE, Literal: "{"}, KVPairs: kvPairs}}
+}
+
+// Constructs a conditional from a condition, a consequence block, and optionally an alternative block.
+func astIf(args ...object.Object) object.Object {
+	if len(args) != 2 && len(args) != 3 {
+		return newError("wrong number of arguments. expected=2 or 3, got=%d", len(args))
+	}
+
+	condition, err := toExpression("ast_if", args[0])
+	if err != nil {
+		return err
+	}
+	consequence, err := toBlock("ast_if", args[1])
+	if err != nil {
+		return err
+	}
+
+	ifExpression := &ast.IfExpression{
+		Token:   token.Token{Type: token.IF, Literal: "if"},
+		Clauses: []ast.ConditionalClause{{Condition: condition, Consequence: consequence}},
+	}
+	if len(args) == 3 {
+		ifExpression.Alternative, err = toBlock("ast_if", args[2])
+		if err != nil {
+			return err
+		}
+	}
+
+	return &object.Quote{Node: ifExpression}
+}
+
+// Constructs a function literal from an array of parameters (strings or identifiers) and a body block.
+func astFn(args ...object.Object) object.Object {
+	if len(args) != 2 {
+		return newError("wrong number of arguments. expected=2, got=%d", len(args))
+	}
+
+	paramsArray, ok := args[0].(*object.Array)
+	if !ok {
+		return newError("first argument to `ast_fn` must be ARRAY, got %s", args[0].Type())
+	}
+
+	params := []*ast.Identifier{}
+	for _, param := range paramsArray.Elements {
+		identifier, err := toIdentifier("ast_fn", param)
+		if err != nil {
+			return err
+		}
+		params = append(params, identifier)
+	}
+
+	body, err := toBlock("ast_fn", args[1])
+	if err != nil {
+		return err
+	}
+
+	return &object.Quote{Node: &ast.FunctionLiteral{
+		Token:      token.Token{Type: token.FUNCTION, Literal: "fn"},
+		Parameters: params,
+		Body:       body,
+	}}
+}
+
+// Constructs a let statement binding a name (a string or an identifier) to a value.
+func astLet(args ...object.Object) object.Object {
+	if len(args) != 2 {
+		return newError("wrong number of arguments. expected=2, got=%d", len(args))
+	}
+
+	name, err := toIdentifier("ast_let", args[0])
+	if err != nil {
+		return err
+	}
+	value, err := toExpression("ast_let", args[1])
+	if err != nil {
+		return err
+	}
+
+	return &object.Quote{Node: &ast.LetStatement{Token: token.Token{Type: token.LET, Literal: "let"}, Name: name, Value: value}}
+}
+
+// Constructs an assign statement assigning a value to a name (a string or an identifier).
+func astAssign(args ...object.Object) object.Object {
+	if len(args) != 2 {
+		return newError("wrong number of arguments. expected=2, got=%d", len(args))
+	}
+
+	name, err := toIdentifier("ast_assign", args[0])
+	if err != nil {
+		return err
+	}
+	value, err := toExpression("ast_assign", args[1])
+	if err != nil {
+		return err
+	}
+
+	return &object.Quote{Node: &ast.AssignStatement{Token: name.Token, Name: name, Value: value}}
+}
+
+// Constructs a return statement returning the given value.
+func astReturn(args ...object.Object) object.Object {
+	if len(args) != 1 {
+		return newError("wrong number of arguments. expected=1, got=%d", len(args))
+	}
+
+	value, err := toExpression("ast_return", args[0])
+	if err != nil {
+		return err
+	}
+
+	return &object.Quote{Node: &ast.ReturnStatement{Token: token.Token{Type: token.RETURN, Literal: "return"}, ReturnValue: value}}
+}
+
+// Returns the kind of the node as a string, e.g. "identifier" or "call".
+func astKind(args ...object.Object) object.Object {
+	if len(args) != 1 {
+		return newError("wrong number of arguments. expected=1, got=%d", len(args))
+	}
+
+	quote, ok := args[0].(*object.Quote)
+	if !ok {
+		return newError("argument to `ast_kind` must be QUOTE, got %s", args[0].Type())
+	}
+
+	return &object.String{Value: nodeKind(quote.Node)}
+}
+
+// Returns the child nodes of the node as an array, in the order in which they appear in the source code.
+func astChildren(args ...object.Object) object.Object {
+	if len(args) != 1 {
+		return newError("wrong number of arguments. expected=1, got=%d", len(args))
+	}
+
+	quote, ok := args[0].(*object.Quote)
+	if !ok {
+		return newError("argument to `ast_children` must be QUOTE, got %s", args[0].Type())
+	}
+
+	elements := []object.Object{}
+	for _, child := range nodeChildren(quote.Node) {
+		elements = append(elements, &object.Quote{Node: child})
+	}
+	return &object.Array{Elements: elements}
+}
+
+// Returns the value of a literal, the name of an identifier, or the operator of a prefix or infix expression.
+func astValue(args ...object.Object) object.Object {
+	if len(args) != 1 {
+		return newError("wrong number of arguments. expected=1, got=%d", len(args))
+	}
+
+	quote, ok := args[0].(*object.Quote)
+	if !ok {
+		return newError("argument to `ast_value` must be QUOTE, got %s", args[0].Type())
+	}
+
+	switch node := quote.Node.(type) {
+	case *ast.IntegerLiteral:
+		return &object.Integer{Value: node.Value}
+	case *ast.Float:
+		return &object.Float{Value: node.Value}
+	case *ast.Boolean:
+		return object.NativeBoolToBooleanObject(node.Value)
+	case *ast.StringLiteral:
+		return &object.String{Value: node.Value}
+	case *ast.Identifier:
+		return &object.String{Value: node.Value}
+	case *ast.PrefixExpression:
+		return &object.String{Value: node.Operator}
+	case *ast.InfixExpression:
+		return &object.String{Value: node.Operator}
+	default:
+		return newError("argument to `ast_value` has no value, got %s node", nodeKind(quote.Node))
+	}
+}
+
+func nodeKind(node ast.Node) string {
+	switch node.(type) {
+	case *ast.Program:
+		return "program"
+	case *ast.ExpressionStatement:
+		return "expression_statement"
+	case *ast.LetStatement:
+		return "let"
+	case *ast.ConstStatement:
+		return "const"
+	case *ast.AssignStatement:
+		return "assign"
+	case *ast.ReturnStatement:
+		return "return"
+	case *ast.DeferStatement:
+		return "defer"
+	case *ast.AssertStatement:
+		return "assert"
+	case *ast.BlockStatement:
+		return "block"
+	case *ast.FunctionDeclaration:
+		return "function_declaration"
+	case *ast.Identifier:
+		return "identifier"
+	case *ast.IntegerLiteral:
+		return "integer"
+	case *ast.Float:
+		return "float"
+	case *ast.Boolean:
+		return "boolean"
+	case *ast.StringLiteral:
+		return "string"
+	case *ast.PrefixExpression:
+		return "prefix"
+	case *ast.InfixExpression:
+		return "infix"
+	case *ast.IfExpression:
+		return "if"
+	case *ast.SwitchStatement:
+		return "switch"
+	case *ast.WhileLoop:
+		return "while"
+	case *ast.ForLoop:
+		return "for"
+	case *ast.FunctionLiteral:
+		return "function"
+	case *ast.MacroLiteral:
+		return "macro"
+	case *ast.CallExpression:
+		return "call"
+	case *ast.IndexExpression:
+		return "index"
+	case *ast.ArrayLiteral:
+		return "array"
+	case *ast.HashMapLiteral:
+		return "hashmap"
+	case *ast.SetLiteral:
+		return "set"
+	default:
+		return "unknown"
+	}
+}
+
+func nodeChildren(node ast.Node) []ast.Node {
+	children := []ast.Node{}
+	add := func(nodes ...ast.Node) {
+		children = append(children, nodes...)
+	}
+
+	switch node := node.(type) {
+	case *ast.Program:
+		for _, statement := range node.Statements {
+			add(statement)
+		}
+	case *ast.ExpressionStatement:
+		add(node.Expression)
+	case *ast.LetStatement:
+		add(node.Name, node.Value)
+	case *ast.ConstStatement:
+		add(node.Name, node.Value)
+	case *ast.AssignStatement:
+		add(node.Name, node.Value)
+	case *ast.ReturnStatement:
+		if node.ReturnValue != nil {
+			add(node.ReturnValue)
+		}
+	case *ast.DeferStatement:
+		add(node.Call)
+	case *ast.AssertStatement:
+		add(node.Condition)
+		if node.Message != nil {
+			add(node.Message)
+		}
+	case *ast.BlockStatement:
+		for _, statement := range node.Statements {
+			add(statement)
+		}
+	case *ast.FunctionDeclaration:
+		add(node.Name, node.Function)
+	case *ast.PrefixExpression:
+		add(node.Right)
+	case *ast.InfixExpression:
+		add(node.Left, node.Right)
+	case *ast.IfExpression:
+		for _, clause := range node.Clauses {
+			add(clause.Condition, clause.Consequence)
+		}
+		if node.Alternative != nil {
+			add(node.Alternative)
+		}
+	case *ast.SwitchStatement:
+		add(node.SwitchExpression)
+		for _, switchCase := range node.Cases {
+			add(switchCase.Expression, switchCase.Consequence)
+		}
+		if node.Default != nil {
+			add(node.Default)
+		}
+	case *ast.WhileLoop:
+		add(node.Condition, node.Body)
+	case *ast.ForLoop:
+		add(node.Init, node.Condition, node.Afterthought, node.Body)
+	case *ast.FunctionLiteral:
+		for _, param := range node.Parameters {
+			add(param)
+		}
+		add(node.Body)
+	case *ast.MacroLiteral:
+		for _, param := range node.Parameters {
+			add(param)
+		}
+		add(node.Body)
+	case *ast.CallExpression:
+		add(node.Function)
+		for _, arg := range node.Arguments {
+			add(arg)
+		}
+	case *ast.IndexExpression:
+		add(node.Left, node.Index)
+	case *ast.ArrayLiteral:
+		for _, element := range node.Elements {
+			add(element)
+		}
+	case *ast.SetLiteral:
+		for _, element := range node.Elements {
+			add(element)
+		}
+	case *ast.HashMapLiteral:
+		for _, key := range node.SortedKeys() {
+			add(key, node.KVPairs[key])
+		}
+	}
+
+	return children
+}
+
+func newIdentifier(name string) *ast.Identifier {
+	return &ast.Identifier{Token: token.Token{Type: token.IDENT, Literal: name}, Value: name}
+}
+
+// Returns a literal node for an integer, float, boolean, or string, or nil for any other object.
+func newLiteral(obj object.Object) ast.Expression {
+	switch obj := obj.(type) {
+	case *object.Integer:
+		return &ast.IntegerLiteral{Token: token.Token{Type: token.INT, Literal: obj.Inspect()}, Value: obj.Value}
+	case *object.Float:
+		literal := strconv.FormatFloat(obj.Value, 'f', -1, 64)
+		return &ast.Float{Token: token.Token{Type: token.FLOAT, Literal: literal}, Value: obj.Value}
+	case *object.Boolean:
+		node, _ := convertObjectToASTNode(obj).(*ast.Boolean)
+		return node
+	case *object.String:
+		return &ast.StringLiteral{Token: token.Token{Type: token.STRING, Literal: obj.Value}, Value: obj.Value}
+	default:
+		return nil
+	}
+}
+
+// Returns the token of an operator given as a string, checking that it's one of the given operators.
+func toOperator(builtin string, expected string, obj object.Object, operators []token.TokenType) (token.Token, *object.Error) {
+	str, ok := obj.(*object.String)
+	if !ok {
+		return token.Token{}, newError("first argument to `%s` must be STRING, got %s", builtin, obj.Type())
+	}
+
+	l := lexer.NewLexer(str.Value)
+	tok := l.NextToken()
+	if tok.Literal == str.Value && l.NextToken().Type == token.EOF && slices.Contains(operators, tok.Type) {
+		return token.Token{Type: tok.Type, Literal: tok.Literal}, nil
+	}
+	return token.Token{}, newError("first argument to `%s` must be %s, got %q", builtin, expected, str.Value)
+}
+
+func toIdentifier(builtin string, obj object.Object) (*ast.Identifier, *object.Error) {
+	switch obj := obj.(type) {
+	case *object.String:
+		return newIdentifier(obj.Value), nil
+	case *object.Quote:
+		if identifier, ok := obj.Node.(*ast.Identifier); ok {
+			return identifier, nil
+		}
+		return nil, newError("argument to `%s` must be an identifier, got %s node", builtin, nodeKind(obj.Node))
+	default:
+		return nil, newError("argument to `%s` must be an identifier or STRING, got %s", builtin, obj.Type())
+	}
+}
+
+func toExpression(builtin string, obj object.Object) (ast.Expression, *object.Error) {
+	if quote, ok := obj.(*object.Quote); ok {
+		if expression, ok := quote.Node.(ast.Expression); ok {
+			return expression, nil
+		}
+		return nil, newError("argument to `%s` must be an expression, got %s node", builtin, nodeKind(quote.Node))
+	}
+
+	if literal := newLiteral(obj); literal != nil {
+		return literal, nil
+	}
+	return nil, newError("argument to `%s` must be QUOTE or a literal value, got %s", builtin, obj.Type())
+}
+
+func toExpressions(builtin string, obj object.Object) ([]ast.Expression, *object.Error) {
+	array, ok := obj.(*object.Array)
+	if !ok {
+		return nil, newError("argument to `%s` must be ARRAY, got %s", builtin, obj.Type())
+	}
+
+	expressions := []ast.Expression{}
+	for _, element := range array.Elements {
+		expression, err := toExpression(builtin, element)
+		if err != nil {
+			return nil, err
+		}
+		expressions = append(expressions, expression)
+	}
+	return expressions, nil
+}
+
+func toBlock(builtin string, obj object.Object) (*ast.BlockStatement, *object.Error) {
+	array, ok := obj.(*object.Array)
+	if !ok {
+		return nil, newError("argument to `%s` must be ARRAY, got %s", builtin, obj.Type())
+	}
+
+	block := &ast.BlockStatement{Token: token.Token{Type: token.LBRACE, Literal: "{"}}
+	for _, element := range array.Elements {
+		if quote, ok := element.(*object.Quote); ok {
+			if statement, ok := quote.Node.(ast.Statement); ok {
+				block.Statements = append(block.Statements, statement)
+				continue
+			}
+		}
+
+		expression, err := toExpression(builtin, element)
+		if err != nil {
+			return nil, err
+		}
+		block.Statements = append(block.Statements, &ast.ExpressionStatement{Token: ast.TokenOf(expression), Expression: expression})
+	}
+	return block, nil
+}
@@ -0,0 +1,175 @@
+package evaluator
+
+import (
+	"monkey/ast"
+	"monkey/object"
+	"testing"
+)
+
+func TestASTConstructionBuiltIns(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{`ast_ident("x")`, `x`},
+		{`ast_ident(quote(y))`, `y`},
+		{`ast_literal(5)`, `5`},
+		{`ast_literal(true)`, `true`},
+		{`ast_literal("five")`, `"five"`},
+		{`ast_prefix("-", 5)`, `-5`},
+		{`ast_infix("+", ast_ident("a"), 2)`, `a + 2`},
+		{`ast_infix("in", 1, quote(xs))`, `1 in xs`},
+		{`ast_call("f", [1, quote(b)])`, `f(1, b)`},
+		{`ast_call(quote(g(1)), [])`, `g(1)()`},
+		{`ast_index(quote(xs), 0)`, `xs[0]`},
+		{`ast_array([1, 2])`, `[1, 2]`},
+		{`ast_hashmap([["a", 1]])`, `{"a": 1}`},
+		{`ast_if(quote(x > 1), [1], [quote(y), 2])`, "if (x > 1) {\n    1;\n} else {\n    y;\n    2;\n}"},
+		{`ast_fn(["a", quote(b)], [ast_let("c", quote(a + b)), ast_return(quote(c))])`, "fn(a, b) {\n    let c = a + b;\n    return c;\n}"},
+		{`ast_assign("x", 3)`, `x = 3;`},
+	}
+
+	for _, test := range tests {
+		evaluated := testEval(test.input)
+		quote, ok := evaluated.(*object.Quote)
+		if !ok {
+			t.Fatalf("expected *object.Quote for input %q. got=%T (%+v)", test.input, evaluated, evaluated)
+		}
+
+		if ast.Format(quote.Node) != test.expected {
+			t.Errorf("constructed node is wrong for input %q. expected=%q, got=%q", test.input, test.expected, ast.Format(quote.Node))
+		}
+	}
+}
+
+func TestASTInspectionBuiltIns(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected interface{}
+	}{
+		{`ast_kind(quote(x))`, "identifier"},
+		{`ast_kind(quote(f(x)))`, "call"},
+		{`ast_kind(quote(1 + 2))`, "infix"},
+		{`ast_kind(quote(fn(x) { x }))`, "function"},
+		{`ast_kind(ast_let("x", 1))`, "let"},
+		{`ast_value(quote(x))`, "x"},
+		{`ast_value(quote(1 + 2))`, "+"},
+		{`ast_value(quote(42))`, 42},
+		{`ast_value(quote("hi"))`, "hi"},
+		{`len(ast_children(quote(f(1, 2, 3))))`, 4},
+		{`ast_value(first(ast_children(quote(f(1, 2, 3)))))`, "f"},
+		{`ast_value(last(ast_children(quote({"a": 1, "b": 2}))))`, 2},
+		{`ast_kind(last(ast_children(quote(fn(x) { x }))))`, "block"},
+		{`len(ast_children(quote(x)))`, 0},
+		{`ast_kind(5)`, "argument to `ast_kind` must be QUOTE, got INTEGER"},
+		{`ast_value(quote(f(x)))`, "argument to `ast_value` has no value, got call node"},
+		{`ast_ident(5)`, "argument to `ast_ident` must be an identifier or STRING, got INTEGER"},
+		{`ast_call("f", [fn(x) { x }])`, "argument to `ast_call` must be QUOTE or a literal value, got FUNCTION"},
+		{`ast_infix("+", ast_let("x", 1), 2)`, "argument to `ast_infix` must be an expression, got let node"},
+		{`ast_prefix("~", 1)`, "first argument to `ast_prefix` must be a prefix operator, got \"~\""},
+		{`ast_prefix("+", 1)`, "first argument to `ast_prefix` must be a prefix operator, got \"+\""},
+		{`ast_infix("=", 1, 2)`, "first argument to `ast_infix` must be an infix operator, got \"=\""},
+		{`ast_infix("|>", 1, 2)`, "first argument to `ast_infix` must be an infix operator, got \"|>\""},
+		{`ast_infix("+ 1 +", 1, 2)`, "first argument to `ast_infix` must be an infix operator, got \"+ 1 +\""},
+		{`ast_hashmap([1])`, "argument to `ast_hashmap` must be an array of [key, value] pairs, got 1"},
+	}
+
+	for _, test := range tests {
+		evaluated := testEval(test.input)
+
+		switch expected := test.expected.(type) {
+		case int:
+			testIntegerObject(t, evaluated, int64(expected))
+		case string:
+			if errorObj, ok := evaluated.(*object.Error); ok {
+				if errorObj.Message != expected {
+					t.Errorf("wrong error message for input %q. expected=%q, got=%q", test.input, expected, errorObj.Message)
+				}
+				continue
+			}
+
+			str, ok := evaluated.(*object.String)
+			if !ok {
+				t.Errorf("object is not a String for input %q. got=%T (%+v)", test.input, evaluated, evaluated)
+				continue
+			}
+			if str.Value != expected {
+				t.Errorf("wrong string for input %q. expected=%q, got=%q", test.input, expected, str.Value)
+			}
+		}
+	}
+}
+
+func TestConstructedNodePositions(t *testing.T) {
+	input := `let m = macro(x) { ast_let("y", ast_infix("*", ast_prefix("-", x), 2)) };
+let x = 1;
+  m(x);`
+
+	program := testParseProgram(input)
+	macroEnv := object.NewEnvironment()
+	DefineMacros(program, macroEnv)
+	expanded, err := ExpandMacros(program, macroEnv)
+	if err != nil {
+		t.Fatalf("macro expansion error: %s", err)
+	}
+
+	letStatement, ok := expanded.Statements[1].(*ast.LetStatement)
+	if !ok {
+		t.Fatalf("expected *ast.LetStatement. got=%T", expanded.Statements[1])
+	}
+	infix := letStatement.Value.(*ast.InfixExpression)
+	prefix := infix.Left.(*ast.PrefixExpression)
+
+	// The constructed nodes take the position of the macro call, while the argument keeps its own position
+	nodes := []struct {
+		node         ast.Node
+		line, column int
+	}{
+		{letStatement, 3, 2},
+		{letStatement.Name, 3, 2},
+		{infix, 3, 2},
+		{infix.Right, 3, 2},
+		{prefix, 3, 2},
+		{prefix.Right, 3, 4},
+	}
+	for _, n := range nodes {
+		tok := ast.TokenOf(n.node)
+		if tok.LineNumber != n.line || tok.ColumnNumber != n.column {
+			t.Errorf("wrong position for %q. expected=%d:%d, got=%d:%d", n.node.String(), n.line, n.column, tok.LineNumber, tok.ColumnNumber)
+		}
+	}
+}
+
+func TestProceduralMacros(t *testing.T) {
+	// Derives a function extracting the fields listed in a schema hashmap from a hashmap
+	input := `
+	let extractor = macro(schema) {
+		let lookUps = fn(acc, children) {
+			if (len(children) == 0) { return acc; }
+			lookUps(append(acc, ast_index(ast_ident("obj"), first(children))), rest(rest(children)))
+		};
+		ast_fn(["obj"], [ast_array(lookUps([], ast_children(schema)))])
+	};
+	let extract = extractor({"b": "int", "a": "int"});
+	extract({"a": 1, "b": 2, "c": 3})
+	`
+
+	program := testParseProgram(input)
+	macroEnv := object.NewEnvironment()
+	DefineMacros(program, macroEnv)
+	expanded, err := ExpandMacros(program, macroEnv)
+	if err != nil {
+		t.Fatalf("macro expansion error: %s", err)
+	}
+
+	evaluated := Eval(expanded, object.NewEnvironment())
+	array, ok := evaluated.(*object.Array)
+	if !ok {
+		t.Fatalf("object is not an Array. got=%T (%+v)", evaluated, evaluated)
+	}
+	if len(array.Elements) != 2 {
+		t.Fatalf("wrong number of elements. expected=2, got=%d", len(array.Elements))
+	}
+	testIntegerObject(t, array.Elements[0], 2)
+	testIntegerObject(t, array.Elements[1], 1)
+}
@@ -14,4 +14,29 @@ var builtins = map[string]*object.BuiltIn{
 	"join":   object.GetBuiltInByName("join"),
 	"split":  object.GetBuiltInByName("split"),
 	"sum":    object.GetBuiltInByName("sum"),
+
+	"union":        object.GetBuiltInByName("union"),
+	"intersection": object.GetBuiltInByName("intersection"),
+	"difference":   object.GetBuiltInByName("difference"),
+
+	// Constructing & inspecting AST nodes (as quoted code), so that macros can generate code procedurally rather than
+	// only through `quote` templates. Wherever a node is expected, an integer, float, boolean, or string is accepted as
+	// well, standing for the corresponding literal. Wherever a block is expected, an array of nodes is accepted, each
+	// of which becomes a statement of the block.
+	"ast_ident":    {Fn: astIdent},
+	"ast_literal":  {Fn: astLiteral},
+	"ast_prefix":   {Fn: astPrefix},
+	"ast_infix":    {Fn: astInfix},
+	"ast_call":     {Fn: astCall},
+	"ast_index":    {Fn: astIndex},
+	"ast_array":    {Fn: astArray},
+	"ast_hashmap":  {Fn: astHashMap},
+	"ast_if":       {Fn: astIf},
+	"ast_fn":       {Fn: astFn},
+	"ast_let":      {Fn: astLet},
+	"ast_assign":   {Fn: astAssign},
+	"ast_return":   {Fn: astReturn},
+	"ast_kind":     {Fn: astKind},
+	"ast_children": {Fn: astChildren},
+	"ast_value":    {Fn: astValue},
 }
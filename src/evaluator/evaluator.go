@@ -1,19 +1,32 @@
 package evaluator
 
 import (
+	"errors"
 	"fmt"
+	"io"
 	"monkey/ast"
+	"monkey/bytecode"
 	"monkey/object"
 	"monkey/token"
 )
 
 var (
-	NULL  = &object.Null{}
-	TRUE  = &object.Boolean{Value: true}
-	FALSE = &object.Boolean{Value: false}
+	NULL  = object.NULL
+	TRUE  = object.TRUE
+	FALSE = object.FALSE
 )
 
+// Evaluates the given node in the given environment. An error propagating out of the node records the node's position
+// in its stack trace (see `locateError`).
 func Eval(node ast.Node, env *object.Environment) object.Object {
+	result := evalNode(node, env)
+	if err, ok := result.(*object.Error); ok {
+		locateError(err, node)
+	}
+	return result
+}
+
+func evalNode(node ast.Node, env *object.Environment) object.Object {
 	switch node := node.(type) {
 	// Statements
 	case *ast.Program:
@@ -23,35 +36,49 @@ func Eval(node ast.Node, env *object.Environment) object.Object {
 	case *ast.BlockStatement:
 		return evalBlockStatement(node, env)
 	case *ast.LetStatement:
-		val := Eval(node.Value, env)
-		if isError(val) {
-			return val
-		}
-		env.Set(node.Name.Value, val)
+		return evalDeclaration(node.Token, node.Name, node.Value, object.VariableBinding, env)
+	case *ast.ConstStatement:
+		return evalDeclaration(node.Token, node.Name, node.Value, object.ConstantBinding, env)
+	case *ast.AssignStatement:
+		return evalAssignStatement(node, env)
+	case *ast.FunctionDeclaration:
+		return evalFunctionDeclaration(node, env)
 	case *ast.ReturnStatement:
 		val := Eval(node.ReturnValue, env)
-		if isError(val) {
+		if isReturnValueOrError(val) {
 			return val
 		}
 		return &object.ReturnValue{Value: val}
+	case *ast.DeferStatement:
+		return evalDeferStatement(node, env)
+	case *ast.AssertStatement:
+		return evalAssertStatement(node, env)
 
 	// Primitive Expressions
 	case *ast.IntegerLiteral:
 		return &object.Integer{Value: node.Value}
+	case *ast.Float:
+		return &object.Float{Value: node.Value}
 	case *ast.Boolean:
-		return nativeBoolToBooleanObject(node.Value)
+		return object.NativeBoolToBooleanObject(node.Value)
 	case *ast.StringLiteral:
 		return &object.String{Value: node.Value}
 
 	// Other Data Types
 	case *ast.ArrayLiteral:
 		elements := evalExpressions(node.Elements, env)
-		if len(elements) == 1 && isError(elements[0]) {
+		if len(elements) == 1 && isReturnValueOrError(elements[0]) {
 			return elements[0]
 		}
 		return &object.Array{Elements: elements}
 	case *ast.HashMapLiteral:
 		return evalHashMapLiteral(node, env)
+	case *ast.SetLiteral:
+		elements := evalExpressions(node.Elements, env)
+		if len(elements) == 1 && isReturnValueOrError(elements[0]) {
+			return elements[0]
+		}
+		return toObject(object.NewSetOf(hookCaller{env.Output()}, elements))
 
 	// Identifiers
 	case *ast.Identifier:
@@ -60,42 +87,50 @@ func Eval(node ast.Node, env *object.Environment) object.Object {
 	// Prefix Expressions
 	case *ast.PrefixExpression:
 		right := Eval(node.Right, env)
-		if isError(right) {
+		if isReturnValueOrError(right) {
 			return right
 		}
-		return evalPrefixExpression(node.Operator, right)
+		return evalPrefixExpression(node, right)
 
 	// Infix Expressions
 	case *ast.InfixExpression:
 		left := Eval(node.Left, env)
-		if isError(left) {
+		if isReturnValueOrError(left) {
 			return left
 		}
 		right := Eval(node.Right, env)
-		if isError(right) {
+		if isReturnValueOrError(right) {
 			return right
 		}
-		return evalInfixExpression(node.Operator, left, right)
+		return evalInfixExpression(node, left, right, env)
 
-	// If Expressions
+	// Conditionals
 	case *ast.IfExpression:
 		return evalIfExpression(node, env)
+	case *ast.SwitchStatement:
+		return evalSwitchStatement(node, env)
+
+	// Loops
+	case *ast.WhileLoop:
+		return evalWhileLoop(node, env)
+	case *ast.ForLoop:
+		return evalForLoop(node, env)
 
 	// Other Expressions
 	case *ast.IndexExpression:
 		left := Eval(node.Left, env)
-		if isError(left) {
+		if isReturnValueOrError(left) {
 			return left
 		}
 		index := Eval(node.Index, env)
-		if isError(index) {
+		if isReturnValueOrError(index) {
 			return index
 		}
-		return evalIndexExpression(left, index)
+		return toObject(object.Index(hookCaller{env.Output()}, left, index))
 
 	// Functions
 	case *ast.FunctionLiteral:
-		return &object.Function{Parameters: node.Parameters, Body: node.Body, Env: env}
+		return &object.Function{Name: node.Name, Parameters: node.Parameters, Body: node.Body, Env: env}
 	case *ast.CallExpression:
 		if node.Function.TokenLiteral() == "quote" {
 			return quote(node.Arguments, env)
@@ -110,146 +145,144 @@ func Eval(node ast.Node, env *object.Environment) object.Object {
 func evalProgram(statements []ast.Statement, env *object.Environment) object.Object {
 	var result object.Object
 
+	if err := hoistFunctionDeclarations(statements, env); err != nil {
+		return err
+	}
+
 	for _, statement := range statements {
+		if _, ok := statement.(*ast.FunctionDeclaration); ok {
+			continue
+		}
+
 		result = Eval(statement, env)
 
-		switch result := result.(type) {
-		case *object.ReturnValue:
-			return result.Value
-		case *object.Error:
-			return result
+		if returnValue, ok := result.(*object.ReturnValue); ok {
+			result = returnValue.Value
+			break
+		}
+		if isReturnValueOrError(result) {
+			break
 		}
 	}
 
-	return result
+	return runDeferredCalls(env, result)
 }
 
+// Evaluates the statements of a block, producing the value of its last statement if that's an expression statement,
+// or null otherwise (the same as the value that the compiler leaves on the stack for the block).
 func evalBlockStatement(blockStatement *ast.BlockStatement, env *object.Environment) object.Object {
-	var result object.Object
+	var result object.Object = NULL
+
+	if err := hoistFunctionDeclarations(blockStatement.Statements, env); err != nil {
+		return err
+	}
 
 	for _, statement := range blockStatement.Statements {
-		result = Eval(statement, env)
+		if _, ok := statement.(*ast.FunctionDeclaration); ok {
+			continue
+		}
 
-		if result != nil {
-			rt := result.Type()
+		evaluated := Eval(statement, env)
+
+		if evaluated != nil {
+			rt := evaluated.Type()
 			if rt == object.RETURN_VALUE_OBJ || rt == object.ERROR_OBJ {
-				return result
+				return evaluated
 			}
 		}
+
+		result = NULL
+		if _, ok := statement.(*ast.ExpressionStatement); ok && evaluated != nil {
+			result = evaluated
+		}
 	}
 
 	return result
 }
 
-func nativeBoolToBooleanObject(input bool) *object.Boolean {
-	if input {
-		return TRUE
-	} else {
-		return FALSE
+// Defines all of the function declarations among the provided statements before any of the statements are evaluated,
+// so that the declared functions can be called from anywhere in their block (including from each other).
+func hoistFunctionDeclarations(statements []ast.Statement, env *object.Environment) *object.Error {
+	for _, statement := range statements {
+		if declaration, ok := statement.(*ast.FunctionDeclaration); ok {
+			if err, ok := evalFunctionDeclaration(declaration, env).(*object.Error); ok {
+				return err
+			}
+		}
 	}
+	return nil
 }
 
-func evalPrefixExpression(operator string, right object.Object) object.Object {
-	switch operator {
-	case token.BANG:
-		return evalBangOperatorExpression(right)
-	case token.MINUS:
-		return evalMinusPrefixOperatorExpression(right)
-	default:
-		return newError("unknown operator: %s%s", operator, right.Type())
+func evalFunctionDeclaration(fd *ast.FunctionDeclaration, env *object.Environment) object.Object {
+	if env.IsDeclared(fd.Name.Value) {
+		return newErrorAt(fd.Name.Token, "identifier '%s' has already been declared", fd.Name.Value)
 	}
+
+	env.Set(fd.Name.Value, &object.Function{Name: fd.Function.Name, Parameters: fd.Function.Parameters, Body: fd.Function.Body, Env: env})
+	return nil
 }
 
-func evalBangOperatorExpression(right object.Object) object.Object {
-	switch right {
-	case TRUE:
-		return FALSE
-	case FALSE:
-		return TRUE
-	case NULL:
-		return TRUE
-	default:
-		return FALSE
+// Evaluates a let or const statement, declaring a binding of the given kind.
+func evalDeclaration(tok token.Token, name *ast.Identifier, value ast.Expression, kind object.BindingKind, env *object.Environment) object.Object {
+	if env.IsDeclared(name.Value) { // Only able to declare this variable if it hasn't already been declared
+		return newErrorAt(tok, "identifier '%s' has already been declared", name.Value)
 	}
-}
 
-func evalMinusPrefixOperatorExpression(right object.Object) object.Object {
-	if right.Type() != object.INTEGER_OBJ {
-		return newError("unknown operator: %s%s", token.MINUS, right.Type())
+	val := Eval(value, env)
+	if isReturnValueOrError(val) {
+		return val
 	}
 
-	value := right.(*object.Integer).Value
-	return &object.Integer{Value: -value}
+	env.SetBinding(name.Value, val, kind)
+	return nil
 }
 
-func evalInfixExpression(operator string, left object.Object, right object.Object) object.Object {
+func evalAssignStatement(as *ast.AssignStatement, env *object.Environment) object.Object {
+	name := as.Name.Value
+	kind, declared := env.Kind(name)
+	_, isBuiltIn := builtins[name]
+
 	switch {
-	case left.Type() == object.INTEGER_OBJ && right.Type() == object.INTEGER_OBJ:
-		return evalIntegerInfixExpression(operator, left, right)
-	case left.Type() == object.BOOLEAN_OBJ && right.Type() == object.BOOLEAN_OBJ:
-		return evalBooleanInfixExpression(operator, left, right)
-	case left.Type() == object.STRING_OBJ && right.Type() == object.STRING_OBJ:
-		return evalStringInfixExpression(operator, left, right)
-	case left.Type() != right.Type():
-		return newError("type mismatch: %s %s %s", left.Type(), operator, right.Type())
-	default:
-		return newError("unknown operator: %s %s %s", left.Type(), operator, right.Type())
+	case !declared && !isBuiltIn:
+		return newErrorAt(as.Token, "attempting to assign value to identifier '%s' prior to declaration", name)
+	case declared && kind == object.ConstantBinding:
+		return newErrorAt(as.Token, "attempting to assign value to constant variable '%s'", name)
+	case !declared || kind == object.FunctionNameBinding:
+		return newErrorAt(as.Token, "attempting to assign value to function '%s'", name)
 	}
-}
-
-func evalIntegerInfixExpression(operator string, left object.Object, right object.Object) object.Object {
-	leftVal := left.(*object.Integer).Value
-	rightVal := right.(*object.Integer).Value
 
-	switch operator {
-	case token.PLUS:
-		return &object.Integer{Value: leftVal + rightVal}
-	case token.MINUS:
-		return &object.Integer{Value: leftVal - rightVal}
-	case token.MUL:
-		return &object.Integer{Value: leftVal * rightVal}
-	case token.DIV:
-		return &object.Integer{Value: leftVal / rightVal}
-	case token.EQ:
-		return nativeBoolToBooleanObject(leftVal == rightVal)
-	case token.NOT_EQ:
-		return nativeBoolToBooleanObject(leftVal != rightVal)
-	case token.LT:
-		return nativeBoolToBooleanObject(leftVal < rightVal)
-	case token.GT:
-		return nativeBoolToBooleanObject(leftVal > rightVal)
-	default:
-		return newError("unknown operator: %s %s %s", left.Type(), operator, right.Type())
+	val := Eval(as.Value, env)
+	if isReturnValueOrError(val) {
+		return val
 	}
-}
 
-func evalBooleanInfixExpression(operator string, left object.Object, right object.Object) object.Object {
-	leftVal := left.(*object.Boolean).Value
-	rightVal := right.(*object.Boolean).Value
+	env.Assign(name, val)
+	return nil
+}
 
-	switch operator {
-	case token.EQ:
-		return nativeBoolToBooleanObject(leftVal == rightVal)
-	case token.NOT_EQ:
-		return nativeBoolToBooleanObject(leftVal != rightVal)
+func evalPrefixExpression(pe *ast.PrefixExpression, right object.Object) object.Object {
+	switch pe.Operator {
+	case token.BANG:
+		return object.Not(right)
+	case token.MINUS:
+		return toObject(object.Negation(right))
 	default:
-		return newError("unknown operator: %s %s %s", left.Type(), operator, right.Type())
+		return newErrorAt(pe.Token, "unknown operator: %s", pe.Operator)
 	}
 }
 
-func evalStringInfixExpression(operator string, left object.Object, right object.Object) object.Object {
-	leftVal := left.(*object.String).Value
-	rightVal := right.(*object.String).Value
-
-	switch operator {
-	case token.PLUS:
-		return &object.String{Value: leftVal + rightVal}
-	case token.EQ:
-		return &object.Boolean{Value: leftVal == rightVal}
-	case token.NOT_EQ:
-		return &object.Boolean{Value: leftVal != rightVal}
+func evalInfixExpression(ie *ast.InfixExpression, left object.Object, right object.Object, env *object.Environment) object.Object {
+	switch ie.Operator {
+	case "+", "-", "*", "/", "//", "**", "%", "|", "&":
+		return toObject(object.BinaryOperation(hookCaller{env.Output()}, ie.Operator, left, right))
+	case "&&", "||":
+		return toObject(object.LogicalOperation(ie.Operator, left, right))
+	case "==", "!=", "<", ">", "<=", ">=":
+		return toObject(object.Comparison(hookCaller{env.Output()}, ie.Operator, left, right))
+	case "in":
+		return toObject(object.Membership(hookCaller{env.Output()}, left, right))
 	default:
-		return newError("unknown operator: %s %s %s", left.Type(), operator, right.Type())
+		return newErrorAt(ie.Token, "unknown operator: %s", ie.Operator)
 	}
 }
 
@@ -262,100 +295,218 @@ func evalIdentifier(i *ast.Identifier, env *object.Environment) object.Object {
 		return builtin
 	}
 
-	return newError("identifier not found: %s", i.Value)
+	return newErrorAt(i.Token, "undefined variable: %s", i.Value)
 }
 
 func evalIfExpression(ie *ast.IfExpression, env *object.Environment) object.Object {
 	for _, clause := range ie.Clauses {
 		condition := Eval(clause.Condition, env)
-		if isError(condition) {
+		if isReturnValueOrError(condition) {
 			return condition
 		}
 
-		if isTruthy(condition) {
-			return Eval(clause.Consequence, env)
+		if object.IsTruthy(condition) {
+			return Eval(clause.Consequence, object.NewBlockEnvironment(env))
 		}
 	}
 
 	if ie.Alternative != nil {
-		return Eval(ie.Alternative, env)
+		return Eval(ie.Alternative, object.NewBlockEnvironment(env))
 	} else {
 		return NULL
 	}
 }
 
-func evalHashMapLiteral(hml *ast.HashMapLiteral, env *object.Environment) object.Object {
-	kvPairs := make(map[object.HashKey]object.HashMapPair)
-	for keyExp, valExp := range hml.KVPairs {
-		key := Eval(keyExp, env)
-		if isError(key) {
-			return key
+// Evaluates a switch statement by comparing the switch expression to each case in turn. Like the compiled code, the
+// switch expression is evaluated again for each case that's compared.
+func evalSwitchStatement(ss *ast.SwitchStatement, env *object.Environment) object.Object {
+	for _, switchCase := range ss.Cases {
+		value := Eval(ss.SwitchExpression, env)
+		if isReturnValueOrError(value) {
+			return value
 		}
 
-		hashKey, ok := key.(object.Hashable)
-		if !ok {
-			return newError("key is unusable as hash key: %s", key.Type())
+		caseValue := Eval(switchCase.Expression, env)
+		if isReturnValueOrError(caseValue) {
+			return caseValue
 		}
 
-		val := Eval(valExp, env)
-		if isError(val) {
-			return val
+		matches := toObject(object.Comparison(hookCaller{env.Output()}, "==", value, caseValue))
+		if isReturnValueOrError(matches) {
+			return matches
 		}
 
-		hashed := hashKey.HashKey()
-		kvPairs[hashed] = object.HashMapPair{Key: key, Value: val}
+		if object.IsTruthy(matches) {
+			return Eval(switchCase.Consequence, object.NewBlockEnvironment(env))
+		}
 	}
 
-	return &object.HashMap{KVPairs: kvPairs}
+	if ss.Default != nil {
+		return Eval(ss.Default, object.NewBlockEnvironment(env))
+	} else {
+		return NULL
+	}
 }
 
-func evalIndexExpression(left object.Object, index object.Object) object.Object {
-	switch {
-	case left.Type() == object.ARRAY_OBJ && index.Type() == object.INTEGER_OBJ:
-		return evalArrayIndexExpression(left, index)
-	case left.Type() == object.HASHMAP_OBJ && isHashable(index):
-		return evalHashMapIndexExpression(left, index)
-	default:
-		return newError("index operator not supported: %s[%s]", left.Type(), index.Type())
+// Evaluates a while loop, running its body in a new block environment on each iteration. The loop itself evaluates to
+// null.
+func evalWhileLoop(wl *ast.WhileLoop, env *object.Environment) object.Object {
+	for {
+		condition := Eval(wl.Condition, env)
+		if isReturnValueOrError(condition) {
+			return condition
+		}
+		if !object.IsTruthy(condition) {
+			return NULL
+		}
+
+		result := Eval(wl.Body, object.NewBlockEnvironment(env))
+		if isReturnValueOrError(result) {
+			return result
+		}
 	}
 }
 
-func evalArrayIndexExpression(array object.Object, index object.Object) object.Object {
-	arrayObject := array.(*object.Array)
-	i := index.(*object.Integer)
+// Evaluates a for loop. The loop's initialization statement declares bindings in a block environment surrounding the
+// entire loop, while the body runs in a new block environment on each iteration. The loop itself evaluates to null.
+func evalForLoop(fl *ast.ForLoop, env *object.Environment) object.Object {
+	loopEnv := object.NewBlockEnvironment(env)
 
-	if i.Value < 0 || i.Value >= int64(len(arrayObject.Elements)) {
-		return newError("index is out-of-bounds for array")
+	init := Eval(fl.Init, loopEnv)
+	if isReturnValueOrError(init) {
+		return init
 	}
 
-	return arrayObject.Elements[i.Value]
+	for {
+		condition := Eval(fl.Condition, loopEnv)
+		if isReturnValueOrError(condition) {
+			return condition
+		}
+		if !object.IsTruthy(condition) {
+			return NULL
+		}
+
+		result := Eval(fl.Body, object.NewBlockEnvironment(loopEnv))
+		if isReturnValueOrError(result) {
+			return result
+		}
+
+		afterthought := Eval(fl.Afterthought, loopEnv)
+		if isReturnValueOrError(afterthought) {
+			return afterthought
+		}
+	}
 }
 
-func evalHashMapIndexExpression(hashmap object.Object, index object.Object) object.Object {
-	hashmapObject := hashmap.(*object.HashMap)
-	i := index.(object.Hashable)
+// Evaluates a hashmap literal, evaluating its keys (each followed by its value) in the same order as the compiler.
+func evalHashMapLiteral(hml *ast.HashMapLiteral, env *object.Environment) object.Object {
+	keys := []object.Object{}
+	values := []object.Object{}
+	for _, keyExp := range hml.SortedKeys() {
+		key := Eval(keyExp, env)
+		if isReturnValueOrError(key) {
+			return key
+		}
+
+		val := Eval(hml.KVPairs[keyExp], env)
+		if isReturnValueOrError(val) {
+			return val
+		}
 
-	hashed := i.HashKey()
-	val, ok := hashmapObject.KVPairs[hashed]
-	if !ok {
-		return newError("key not found in hashmap")
+		keys = append(keys, key)
+		values = append(values, val)
 	}
 
-	return val.Value
+	return toObject(object.NewHashMap(hookCaller{env.Output()}, keys, values))
 }
 
 func evalCallExpression(ce *ast.CallExpression, env *object.Environment) object.Object {
 	function := Eval(ce.Function, env)
-	if isError(function) {
+	if isReturnValueOrError(function) {
 		return function
 	}
 
 	args := evalExpressions(ce.Arguments, env)
-	if len(args) == 1 && isError(args[0]) {
+	if len(args) == 1 && isReturnValueOrError(args[0]) {
 		return args[0]
 	}
 
-	return applyFunction(function, args)
+	return applyFunction(function, args, env.Output())
+}
+
+func evalDeferStatement(ds *ast.DeferStatement, env *object.Environment) object.Object {
+	call, ok := ds.Call.(*ast.CallExpression)
+	if !ok {
+		return newErrorAt(ds.Token, "expected a function call to defer. got %s instead", ds.Call.String())
+	}
+
+	function := Eval(call.Function, env)
+	if isReturnValueOrError(function) {
+		return function
+	}
+
+	args := evalExpressions(call.Arguments, env)
+	if len(args) == 1 && isReturnValueOrError(args[0]) {
+		return args[0]
+	}
+
+	env.Defer(&object.DeferredCall{Fn: function, Args: args})
+	return nil
+}
+
+func evalAssertStatement(as *ast.AssertStatement, env *object.Environment) object.Object {
+	if env.AssertsDisabled() {
+		return nil
+	}
+
+	condition := Eval(as.Condition, env)
+	if isReturnValueOrError(condition) {
+		return condition
+	}
+	if object.IsTruthy(condition) {
+		return nil
+	}
+
+	var message object.Object
+	if as.Message != nil {
+		message = Eval(as.Message, env)
+		if isReturnValueOrError(message) {
+			return message
+		}
+		if message == NULL {
+			message = nil
+		}
+	}
+
+	names := []string{}
+	values := []object.Object{}
+	for _, name := range as.ReferencedIdentifiers() {
+		if value, ok := env.Get(name); ok {
+			names = append(names, name)
+			values = append(values, value)
+		}
+	}
+
+	// The description of the assertion already starts with its location
+	description := object.AssertionDescription(env.Filename(), as)
+	return &object.Error{
+		Message: object.FormatAssertionFailure(hookCaller{env.Output()}, description, message, names, values),
+		Located: true,
+	}
+}
+
+// Runs the calls deferred in the environment of a function (or program) that has finished with the given result, in
+// the reverse of the order in which they were deferred. The deferred calls run even if the function failed, in which
+// case its error is returned; otherwise, the first error from a deferred call (if any) is returned in place of the
+// result.
+func runDeferredCalls(env *object.Environment, result object.Object) object.Object {
+	for _, call := range env.TakeDeferred() {
+		evaluated := applyFunction(call.Fn, call.Args, env.Output())
+		if isError(evaluated) && !isError(result) {
+			result = evaluated
+		}
+	}
+	return result
 }
 
 func evalExpressions(exps []ast.Expression, env *object.Environment) []object.Object {
@@ -363,7 +514,7 @@ func evalExpressions(exps []ast.Expression, env *object.Environment) []object.Ob
 
 	for _, exp := range exps {
 		evaluated := Eval(exp, env)
-		if isError(evaluated) {
+		if isReturnValueOrError(evaluated) {
 			return []object.Object{evaluated}
 		}
 		result = append(result, evaluated)
@@ -372,28 +523,96 @@ func evalExpressions(exps []ast.Expression, env *object.Environment) []object.Ob
 	return result
 }
 
-func applyFunction(fn object.Object, args []object.Object) object.Object {
+func applyFunction(fn object.Object, args []object.Object, out io.Writer) object.Object {
 	switch function := fn.(type) {
 	case *object.Function:
 		if len(args) != len(function.Parameters) {
-			return newError("wrong number of arguments provided to function. expected=%d, received=%d", len(function.Parameters), len(args))
+			return newError("wrong number of arguments: expected=%d, got=%d", len(function.Parameters), len(args))
 		}
 
 		extendedEnv := extendFunctionEnv(function, args)
 		evaluated := Eval(function.Body, extendedEnv)
-		return unwrapReturnValue(evaluated)
+		result := runDeferredCalls(extendedEnv, unwrapReturnValue(evaluated))
+		if err, ok := result.(*object.Error); ok {
+			unwindFrame(err, function.Name)
+		}
+		return result
 	case *object.BuiltIn:
-		if result := function.Fn(args...); result != nil {
+		if result := function.Call(hookCaller{out}, args...); result != nil {
 			return result
 		}
 		return NULL
 	default:
-		return newError("not a function: %s", function.Type())
+		return newError("attempted to call non-closure and non-builtin")
+	}
+}
+
+// Returns the string representation of the object like `Inspect`, except that the `__str__` hooks of user types are
+// used to represent them (see `object.InspectWithHooks`). The hooks are run with the output of the environment.
+func Inspect(obj object.Object, env *object.Environment) (string, error) {
+	return object.InspectWithHooks(hookCaller{env.Output()}, obj)
+}
+
+// Calls the hooks of user types on behalf of built-in functions (e.g. `__len__` for `len`).
+type hookCaller struct {
+	out io.Writer // The writer to which the hooks (and built-in functions) print.
+}
+
+func (hc hookCaller) CallHook(hook object.Object, args ...object.Object) (object.Object, error) {
+	result := applyFunction(hook, args, hc.out)
+	if errObj, ok := result.(*object.Error); ok {
+		return nil, errorObject{errObj}
+	}
+	return result, nil
+}
+
+func (hc hookCaller) Output() io.Writer {
+	return hc.out
+}
+
+// Carries an error object (along with its stack trace) through the operations shared with the VM, which report errors
+// as Go errors.
+type errorObject struct {
+	obj *object.Error
+}
+
+func (eo errorObject) Error() string {
+	return eo.obj.Message
+}
+
+// Records the position of a node that an error is propagating out of in the error's stack trace, as the position being
+// run in the frame currently being unwound. Only the innermost node with a known position is recorded.
+func locateError(err *object.Error, node ast.Node) {
+	if len(err.Trace) == 0 {
+		err.Trace = []object.StackFrame{{Function: object.MainFunctionName}}
+	}
+
+	frame := &err.Trace[len(err.Trace)-1]
+	if frame.Position != (bytecode.Position{}) {
+		return
+	}
+	if tok := ast.TokenOf(node); tok.LineNumber > 0 {
+		frame.Position = bytecode.Position{Line: tok.LineNumber, Column: tok.ColumnNumber}
+	}
+}
+
+// Records that an error has propagated out of a call to the function with the given name, naming the frame being
+// unwound and starting the frame of its caller (which is the top-level code until it's found to be a function too).
+func unwindFrame(err *object.Error, name string) {
+	if len(err.Trace) == 0 {
+		err.Trace = []object.StackFrame{{}}
 	}
+	err.Trace[len(err.Trace)-1].Function = name
+	err.Trace = append(err.Trace, object.StackFrame{Function: object.MainFunctionName})
 }
 
+// Creates the environment in which a function's body is evaluated, binding its parameters to the provided arguments.
+// A named function is also bound to its own name, so that it can call itself.
 func extendFunctionEnv(function *object.Function, args []object.Object) *object.Environment {
 	env := object.NewEnclosedEnvironment(function.Env)
+	if function.Name != "" {
+		env.SetBinding(function.Name, function, object.FunctionNameBinding)
+	}
 	for i, param := range function.Parameters {
 		env.Set(param.Value, args[i])
 	}
@@ -407,22 +626,24 @@ func unwrapReturnValue(obj object.Object) object.Object {
 	return obj
 }
 
-func isTruthy(obj object.Object) bool {
-	switch obj {
-	case NULL:
-		return false
-	case TRUE:
-		return true
-	case FALSE:
-		return false
-	default:
-		return true
+// Converts the result of one of the operations shared with the VM into an object, turning an error into an error object.
+func toObject(obj object.Object, err error) object.Object {
+	if err != nil {
+		var hookErr errorObject
+		if errors.As(err, &hookErr) {
+			return hookErr.obj
+		}
+		return newError("%s", err.Error())
 	}
+	return obj
 }
 
-func isHashable(obj object.Object) bool {
-	_, ok := obj.(object.Hashable)
-	return ok
+func isReturnValueOrError(obj object.Object) bool {
+	if obj != nil {
+		rt := obj.Type()
+		return rt == object.RETURN_VALUE_OBJ || rt == object.ERROR_OBJ
+	}
+	return false
 }
 
 func isError(obj object.Object) bool {
@@ -435,3 +656,10 @@ func isError(obj object.Object) bool {
 func newError(format string, a ...interface{}) *object.Error {
 	return &object.Error{Message: fmt.Sprintf(format, a...)}
 }
+
+// Creates an error whose message starts with the location of the given token, in the same format as the compiler's
+// errors. The position recorded in the error's stack trace isn't added to the message again when it's reported.
+func newErrorAt(tok token.Token, format string, a ...interface{}) *object.Error {
+	location := fmt.Sprintf("line %d, column %d: ", tok.LineNumber, tok.ColumnNumber)
+	return &object.Error{Message: location + fmt.Sprintf(format, a...), Located: true}
+}
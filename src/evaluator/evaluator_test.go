@@ -1,6 +1,9 @@
 package evaluator
 
 import (
+	"fmt"
+	"math"
+	"monkey/bytecode"
 	"monkey/lexer"
 	"monkey/object"
 	"monkey/parser"
@@ -173,6 +176,11 @@ func TestReturnStatements(t *testing.T) {
 			return 1;
 		}
 		`, 10},
+		{"let f = fn() { (if (true) { return 1; } else { 2 }) * 3 }; f();", 1},
+		{"let f = fn() { let x = if (true) { return 1; }; 5 }; f();", 1},
+		{"let f = fn() { puts(if (true) { return 1; }); 5 }; f();", 1},
+		{"let f = fn() { [2, -(if (true) { return 1; })] }; f();", 1},
+		{"let f = fn() { switch (if (true) { return 4; }) { case 1: 3; }; 5 }; f();", 4},
 	}
 
 	for _, test := range tests {
@@ -181,6 +189,47 @@ func TestReturnStatements(t *testing.T) {
 	}
 }
 
+func TestReturnsNestedInExpressions(t *testing.T) {
+	// A return statement within an expression returns from the enclosing function, without evaluating the rest of the
+	// expression
+	tests := []struct {
+		description string
+		input       string
+	}{
+		{"prefix operand", "let f = fn() { -(if (true) { return 1; }); 5 }; f()"},
+		{"left infix operand", "let f = fn() { (if (true) { return 1; }) + 2; 5 }; f()"},
+		{"right infix operand", "let f = fn() { 2 + (if (true) { return 1; }); 5 }; f()"},
+		{"indexed expression", "let f = fn() { (if (true) { return 1; })[0]; 5 }; f()"},
+		{"index", "let f = fn() { [5][if (true) { return 1; }]; 5 }; f()"},
+		{"array element", "let f = fn() { [2, if (true) { return 1; }]; 5 }; f()"},
+		{"set element", "let f = fn() { #{2, if (true) { return 1; }}; 5 }; f()"},
+		{"hashmap key", "let f = fn() { {(if (true) { return 1; }): 2}; 5 }; f()"},
+		{"hashmap value", "let f = fn() { {2: if (true) { return 1; }}; 5 }; f()"},
+		{"called function", "let f = fn() { (if (true) { return 1; })(); 5 }; f()"},
+		{"call argument", "let f = fn() { len(if (true) { return 1; }); 5 }; f()"},
+		{"let value", "let f = fn() { let x = if (true) { return 1; }; 5 }; f()"},
+		{"assigned value", "let f = fn() { let x = 0; x = if (true) { return 1; }; 5 }; f()"},
+		{"if condition", "let f = fn() { if (if (true) { return 1; }) { 2 }; 5 }; f()"},
+		{"switch value", "let f = fn() { switch (if (true) { return 1; }) { case 1: 2; }; 5 }; f()"},
+		{"switch case", "let f = fn() { switch (3) { case if (true) { return 1; }: 2; }; 5 }; f()"},
+		{"while condition", "let f = fn() { while (if (true) { return 1; }) { return 2; }; 5 }; f()"},
+		{"for initialization", "let f = fn() { for (let i = if (true) { return 1; }; i < 2; i++) { 2 }; 5 }; f()"},
+		{"for condition", "let f = fn() { for (let i = 0; if (true) { return 1; }; i++) { return 2; }; 5 }; f()"},
+		{"for afterthought", "let f = fn() { for (let i = 0; i < 2; i = if (true) { return 1; }) { 2 }; 5 }; f()"},
+		{"deferred function", "let f = fn() { defer (if (true) { return 1; })(); 5 }; f()"},
+		{"deferred call argument", "let f = fn() { defer len(if (true) { return 1; }); 5 }; f()"},
+		{"assert condition", "let f = fn() { assert if (true) { return 1; }; 5 }; f()"},
+		{"assert message", "let f = fn() { assert false, if (true) { return 1; }; 5 }; f()"},
+	}
+
+	for _, test := range tests {
+		evaluated := testEval(test.input)
+		if integer, ok := evaluated.(*object.Integer); !ok || integer.Value != 1 {
+			t.Errorf("wrong result for return nested in %s (%q). expected=1, got=%T (%+v)", test.description, test.input, evaluated, evaluated)
+		}
+	}
+}
+
 func TestErrorHandling(t *testing.T) {
 	tests := []struct {
 		input           string
@@ -188,51 +237,51 @@ func TestErrorHandling(t *testing.T) {
 	}{
 		{
 			"5 + true;",
-			"type mismatch: INTEGER + BOOLEAN",
+			"unsupported types for binary operation: INTEGER BOOLEAN",
 		},
 		{
 			"5 + true; 5;",
-			"type mismatch: INTEGER + BOOLEAN",
+			"unsupported types for binary operation: INTEGER BOOLEAN",
 		},
 		{
 			"-true;",
-			"unknown operator: -BOOLEAN",
+			"unsupported type for negation: BOOLEAN",
 		},
 		{
 			"true + false;",
-			"unknown operator: BOOLEAN + BOOLEAN",
+			"unsupported types for binary operation: BOOLEAN BOOLEAN",
 		},
 		{
 			"5; true + false; 5",
-			"unknown operator: BOOLEAN + BOOLEAN",
+			"unsupported types for binary operation: BOOLEAN BOOLEAN",
 		},
 		{
 			"if (10 > 1) { true + false; }",
-			"unknown operator: BOOLEAN + BOOLEAN",
+			"unsupported types for binary operation: BOOLEAN BOOLEAN",
 		},
 		{
 			"foobar;",
-			"identifier not found: foobar",
+			"line 1, column 0: undefined variable: foobar",
 		},
 		{
 			"let a = 5; let b = a + 7; c;",
-			"identifier not found: c",
+			"line 1, column 26: undefined variable: c",
 		},
 		{
 			"fn(x, y) { return 10 * x + y - 3; }(10, 6, 7)",
-			"wrong number of arguments provided to function. expected=2, received=3",
+			"wrong number of arguments: expected=2, got=3",
 		},
 		{
 			"fn(x, y, z) { return 10 * x + y - 3; }(10, 6)",
-			"wrong number of arguments provided to function. expected=3, received=2",
+			"wrong number of arguments: expected=3, got=2",
 		},
 		{
 			`5; "true" + "false"; "true" + 5;`,
-			"type mismatch: STRING + INTEGER",
+			"unsupported types for binary operation: STRING INTEGER",
 		},
 		{
 			`"hello" - "there";`,
-			"unknown operator: STRING - STRING",
+			"unknown binary string operator: -",
 		},
 	}
 
@@ -258,6 +307,95 @@ func TestLetStatements(t *testing.T) {
 	}
 }
 
+func TestShadowingDeclarations(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected int64
+	}{
+		// The value of a declaration refers to the variable being shadowed, not to the one being declared
+		{"let x = 1; if (true) { let x = x + 1; x }", 2},
+		{"let x = 1; let f = fn() { let x = x * 10; x }; f() + x", 11},
+		{"const c = 2; let f = fn() { const c = c + 1; c }; f() + c", 5},
+		{"let x = 3; let f = fn() { let g = fn() { let x = x - 1; x }; g() }; f()", 2},
+	}
+
+	for _, test := range tests {
+		testIntegerObject(t, testEval(test.input), test.expected)
+	}
+}
+
+func TestBlockScopes(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected interface{}
+	}{
+		{"let x = 1; if (true) { let y = x + 1; y }", 2},
+		{"let x = 1; if (true) { let x = 2; x }", 2},
+		{"let x = 1; if (true) { let x = 2; }; x", 1},
+		{"let x = 1; if (false) { 0 } else { let x = 3; }; x", 1},
+		{"if (true) { let y = 2; }; y", "line 1, column 26: undefined variable: y"},
+	}
+
+	for _, test := range tests {
+		evaluated := testEval(test.input)
+		switch expected := test.expected.(type) {
+		case int:
+			testIntegerObject(t, evaluated, int64(expected))
+		case string:
+			errObj, ok := evaluated.(*object.Error)
+			if !ok {
+				t.Errorf("no error object returned. got=%T (%+v)", evaluated, evaluated)
+				continue
+			}
+			if errObj.Message != expected {
+				t.Errorf("wrong error message. expected=%q, got=%q", expected, errObj.Message)
+			}
+		}
+	}
+}
+
+func TestFunctionDeclarations(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected interface{}
+	}{
+		{"fn add(a, b) { a + b } add(1, 2)", 3},
+		{"let result = double(21); fn double(x) { x * 2 } result", 42},
+		{"fn fact(n) { if (n < 2) { return 1; } n * fact(n - 1) } fact(5)", 120},
+		{
+			`
+			let parity = fn(n) {
+				let result = isEven(n);
+				fn isEven(n) { if (n == 0) { return 1; } isOdd(n - 1) }
+				fn isOdd(n) { if (n == 0) { return 0; } isEven(n - 1) }
+				result
+			};
+			parity(10) + parity(7);
+			`,
+			1,
+		},
+		{"if (true) { let y = triple(3); fn triple(n) { n * 3 } y }", 9},
+		{"if (true) { fn hidden() { 1 } }; hidden()", "line 1, column 33: undefined variable: hidden"},
+	}
+
+	for _, test := range tests {
+		evaluated := testEval(test.input)
+		switch expected := test.expected.(type) {
+		case int:
+			testIntegerObject(t, evaluated, int64(expected))
+		case string:
+			errObj, ok := evaluated.(*object.Error)
+			if !ok {
+				t.Errorf("no error object returned. got=%T (%+v)", evaluated, evaluated)
+				continue
+			}
+			if errObj.Message != expected {
+				t.Errorf("wrong error message. expected=%q, got=%q", expected, errObj.Message)
+			}
+		}
+	}
+}
+
 func TestFunctionObject(t *testing.T) {
 	input := "fn(x) { x + 2; }"
 	evaluated := testEval(input)
@@ -312,6 +450,138 @@ func TestClosures(t *testing.T) {
 	testIntegerObject(t, testEval(input), 4)
 }
 
+func TestDeferStatements(t *testing.T) {
+	tests := []struct {
+		input          string
+		expected       interface{}
+		expectedRecord []int64
+	}{
+		{
+			"let f = fn() { defer record(1); defer record(2); record(0); 10 }; f()",
+			10,
+			[]int64{0, 2, 1},
+		},
+		{
+			"let f = fn(n) { defer record(n); if (n > 0) { return n * 10; } record(0); 0 }; f(5) + f(0)",
+			50,
+			[]int64{5, 0, 0},
+		},
+		{
+			"let inner = fn() { defer record(1); 1 }; let outer = fn() { defer record(2); inner() + 1 }; outer()",
+			2,
+			[]int64{1, 2},
+		},
+		{
+			"defer record(1); record(0); 3",
+			3,
+			[]int64{0, 1},
+		},
+		{
+			"let f = fn() { defer record(1); defer record(2); 1 + true }; f()",
+			"unsupported types for binary operation: INTEGER BOOLEAN",
+			[]int64{2, 1},
+		},
+		{
+			"let inner = fn() { defer record(1); -true }; let outer = fn() { defer record(2); inner() }; defer record(3); outer()",
+			"unsupported type for negation: BOOLEAN",
+			[]int64{1, 2, 3},
+		},
+		{
+			"let f = fn() { defer record(1); defer fn() { 1 + true }(); defer record(2); 5 }; f()",
+			"unsupported types for binary operation: INTEGER BOOLEAN",
+			[]int64{2, 1},
+		},
+		{
+			"let f = fn() { defer fn() { -true }(); 1 + true }; f()",
+			"unsupported types for binary operation: INTEGER BOOLEAN",
+			[]int64{},
+		},
+	}
+
+	for _, test := range tests {
+		recorded := []int64{}
+		env := object.NewEnvironment()
+		env.Set("record", &object.BuiltIn{Fn: func(args ...object.Object) object.Object {
+			recorded = append(recorded, args[0].(*object.Integer).Value)
+			return nil
+		}})
+
+		evaluated := Eval(testParseProgram(test.input), env)
+
+		switch expected := test.expected.(type) {
+		case int:
+			testIntegerObject(t, evaluated, int64(expected))
+		case string:
+			testErrorObject(t, evaluated, expected)
+		}
+
+		if len(recorded) != len(test.expectedRecord) {
+			t.Errorf("wrong deferred calls for input %q. expected=%v, got=%v", test.input, test.expectedRecord, recorded)
+			continue
+		}
+		for i, value := range test.expectedRecord {
+			if recorded[i] != value {
+				t.Errorf("wrong deferred calls for input %q. expected=%v, got=%v", test.input, test.expectedRecord, recorded)
+				break
+			}
+		}
+	}
+}
+
+func TestAssertStatements(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected interface{}
+	}{
+		{`let x = 5; assert x > 0; x`, 5},
+		{`let f = fn(x) { assert x > 0, "x must be positive"; x * 2 }; f(3)`, 6},
+		{`assert false`, "line 1, column 0: assertion failed: false"},
+		{
+			`let x = -1; assert x > 0, "x must be positive";`,
+			"line 1, column 12: assertion failed: (x > 0): x must be positive (where x = -1)",
+		},
+		{
+			`let xs = [1, 2]; let check = fn(limit) { assert len(xs) < limit, "limit " + "exceeded"; }; check(2)`,
+			"line 1, column 41: assertion failed: (len(xs) < limit): limit exceeded (where xs = [1, 2], limit = 2)",
+		},
+		{`assert 1 + true`, "unsupported types for binary operation: INTEGER BOOLEAN"},
+	}
+
+	for _, test := range tests {
+		evaluated := testEval(test.input)
+		switch expected := test.expected.(type) {
+		case int:
+			testIntegerObject(t, evaluated, int64(expected))
+		case string:
+			testErrorObject(t, evaluated, expected)
+		default:
+			testNullObject(t, evaluated)
+		}
+	}
+}
+
+func TestDisabledAssertStatements(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected int64
+	}{
+		{`assert false; 1`, 1},
+		{`let x = -1; assert x > 0, "x must be positive"; x`, -1},
+		{`let f = fn(x) { assert x > 0; x * 2 }; f(-3)`, -6},
+		{`let f = fn() { fn() { assert false; 4 } }; f()()`, 4},
+		// The condition isn't evaluated either
+		{`let x = 0; assert fn() { x = 1; false }(); x`, 0},
+	}
+
+	for _, test := range tests {
+		program := parser.NewParser(lexer.NewLexer(test.input)).ParseProgram()
+		env := object.NewEnvironment()
+		env.DisableAsserts()
+
+		testIntegerObject(t, Eval(program, env), test.expected)
+	}
+}
+
 func TestBuiltInFunctions(t *testing.T) {
 	tests := []struct {
 		input    string
@@ -331,6 +601,8 @@ func TestBuiltInFunctions(t *testing.T) {
 
 		{`len(1)`, "argument to `len` is not supported, got INTEGER"},
 		{`len("one", "two")`, "wrong number of arguments. expected=1, got=2"},
+		{`len({"__len__": fn(self) { 3 }})`, 3},
+		{`len({"__len__": fn(self) { "three" }})`, "__len__ must return an integer, got STRING"},
 
 		{`first([])`, "array is empty; no first element"},
 		{`first([3])`, 3},
@@ -439,23 +711,23 @@ func TestArrayIndexExpressions(t *testing.T) {
 		},
 		{
 			"3[3]",
-			"index operator not supported: INTEGER[INTEGER]",
+			"index operator not supported: INTEGER",
 		},
 		{
 			`[1, 2, 3][fn(x) { 2 * x }]`,
-			"index operator not supported: ARRAY[FUNCTION]",
+			"index operator not supported: ARRAY",
 		},
 		{
 			`let a = "s"; [1, 2, 3][a]`,
-			"index operator not supported: ARRAY[STRING]",
+			"index operator not supported: ARRAY",
 		},
 		{
 			"[1, 2, 3][3]",
-			"index is out-of-bounds for array",
+			nil,
 		},
 		{
 			"[1, 2, 3][-1]",
-			"index is out-of-bounds for array",
+			nil,
 		},
 	}
 
@@ -512,6 +784,30 @@ func TestHashMapLiterals(t *testing.T) {
 	}
 }
 
+func TestHashMapLiteralOrder(t *testing.T) {
+	// Keys & values are evaluated in the order in which they appear in the source code
+	recorded := []int64{}
+	env := object.NewEnvironment()
+	env.Set("record", &object.BuiltIn{Fn: func(args ...object.Object) object.Object {
+		recorded = append(recorded, args[0].(*object.Integer).Value)
+		return args[0]
+	}})
+
+	evaluated := Eval(testParseProgram(`{record(3): record(4), record(1): record(2), record(5): record(6)}`), env)
+	if _, ok := evaluated.(*object.HashMap); !ok {
+		t.Fatalf("eval didn't return HashMap. got=%T (%+v)", evaluated, evaluated)
+	}
+
+	expected := []int64{3, 4, 1, 2, 5, 6}
+	if fmt.Sprint(recorded) != fmt.Sprint(expected) {
+		t.Errorf("wrong evaluation order. expected=%v, got=%v", expected, recorded)
+	}
+
+	// The last of several equal keys wins
+	testIntegerObject(t, testEval(`let h = {"a": 1, "b": 2, "a": 3}; h["a"]`), 3)
+	testIntegerObject(t, testEval(`let h = {1: "x", 2: "y", 1: 5}; h[1]`), 5)
+}
+
 func TestHashMapIndexExpressions(t *testing.T) {
 	tests := []struct {
 		input    string
@@ -537,6 +833,18 @@ func TestHashMapIndexExpressions(t *testing.T) {
 			`{-4: 4}[-4]`,
 			4,
 		},
+		{
+			`{}["foo"]`,
+			nil,
+		},
+		{
+			`{1: "one", "two": 2, true: 3}[0]`,
+			nil,
+		},
+		{
+			`{1: "one", "two": 2, true: 3}[false]`,
+			nil,
+		},
 	}
 
 	for _, test := range tests {
@@ -549,6 +857,8 @@ func TestHashMapIndexExpressions(t *testing.T) {
 			testStringObject(t, evaluated, expected)
 		case bool:
 			testBooleanObject(t, evaluated, expected)
+		default:
+			testNullObject(t, evaluated)
 		}
 	}
 }
@@ -560,29 +870,400 @@ func TestHashMapIndexExpressionErrors(t *testing.T) {
 	}{
 		{
 			`{fn(x) { x }: "Monkey"}[true]`,
-			"key is unusable as hash key: FUNCTION",
+			"unusable as hash key: FUNCTION",
 		},
 		{
 			`{"name": "Monkey"}[fn(x) { x }]`,
-			"index operator not supported: HASHMAP[FUNCTION]",
+			"unusable as hash key: FUNCTION",
 		},
 		{
-			`{}["foo"]`,
-			"key not found in hashmap",
+			`[1, 2][{}]`,
+			"index operator not supported: ARRAY",
+		},
+	}
+
+	for _, test := range tests {
+		evaluated := testEval(test.input)
+		testErrorObject(t, evaluated, test.expected)
+	}
+}
+
+func TestEvalFloatExpression(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected interface{}
+	}{
+		{"1.49", 1.49},
+		{"-7801.23189123", -7801.23189123},
+		{"22 / 7", 3.1428571429},
+		{"21 / 7", 3},
+		{"7 * 8.4178923", 58.9252461},
+		{"6.84 - 10 * 9.8 + 42.17987", -48.98013},
+		{"5 * (6.87 - 10.892137) / 4.21 + (10 - 7) * 11.6", 30.0231152019},
+		{"1.5 == 1.5", true},
+		{"1.0 == 1", true},
+		{"2.5 > 2", true},
+	}
+
+	for _, test := range tests {
+		testExpectedObject(t, testEval(test.input), test.expected)
+	}
+}
+
+func TestEvalOperators(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected interface{}
+	}{
+		{"22 // 7", 3},
+		{"6.182 // 2.498", 2},
+		{"3 // 0.74", 4},
+		{"2 ** 3", 8},
+		{"-1**3", -1},
+		{"2.6**3", 17.576},
+		{"7 % 4", 3},
+		{"-9 % 4", -1},
+		{"3 * -(2 + 10) + 4 % 3", -35},
+		{"1 <= 2", true},
+		{"2 <= 2", true},
+		{"3 <= 2", false},
+		{"2 >= 2", true},
+		{"1 >= 2", false},
+		{"true && true", true},
+		{"true && false", false},
+		{"false || true", true},
+		{"false || false", false},
+		{"1 < 2 && 2 < 3", true},
+		{"len([1] + [2, 3])", 3},
+		{"([1] + [2, 3])[2]", 3},
+		{"1 in #{1, 2}", true},
+		{"3 in #{1, 2}", false},
+		{`"k" in {"k": 1}`, true},
+		{`"v" in {"k": "v"}`, false},
+	}
+
+	for _, test := range tests {
+		testExpectedObject(t, testEval(test.input), test.expected)
+	}
+}
+
+func TestSetLiterals(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"#{}", "#{}"},
+		{"#{3, 1, 2}", "#{1, 2, 3}"},
+		{"#{1, 1, 1 + 1}", "#{1, 2}"},
+		{"#{1, 2} | #{2, 3}", "#{1, 2, 3}"},
+		{"#{1, 2} & #{2, 3}", "#{2}"},
+		{"#{1, 2} - #{2, 3}", "#{1}"},
+	}
+
+	for _, test := range tests {
+		evaluated := testEval(test.input)
+		set, ok := evaluated.(*object.Set)
+		if !ok {
+			t.Errorf("object is not a Set. got=%T (%+v)", evaluated, evaluated)
+			continue
+		}
+		if set.Inspect() != test.expected {
+			t.Errorf("set has wrong elements. expected=%q, got=%q", test.expected, set.Inspect())
+		}
+	}
+}
+
+func TestElseIfExpressions(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected interface{}
+	}{
+		{"let x = 5; if (x < 3) { 1 } else if (x < 6) { 2 } else { 3 }", 2},
+		{"let x = 9; if (x < 3) { 1 } else if (x < 6) { 2 } else { 3 }", 3},
+		{"let x = 9; if (x < 3) { 1 } else if (x < 6) { 2 }", nil},
+		{"if (true) { let x = 1; }", nil},
+	}
+
+	for _, test := range tests {
+		testExpectedObject(t, testEval(test.input), test.expected)
+	}
+}
+
+func TestSwitchStatements(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected interface{}
+	}{
+		{`switch "hello" { case "hello": 10; }`, 10},
+		{`switch "world" { case "hello": 10; case "world": 20; default: 30; }`, 20},
+		{`switch "other" { case "hello": 10; case "world": 20; default: 30; }`, 30},
+		{`switch "other" { case "hello": 10; }`, nil},
+		{`let x = 2; switch x * 2 { case 1 + 1: "two"; case 4: let y = "four"; y; }`, "four"},
+		{`switch 1 { case "1": 10; }`, "unsupported types for binary comparison: INTEGER STRING"},
+	}
+
+	for _, test := range tests {
+		evaluated := testEval(test.input)
+		if errObj, ok := evaluated.(*object.Error); ok {
+			testErrorObject(t, errObj, test.expected.(string))
+			continue
+		}
+		testExpectedObject(t, evaluated, test.expected)
+	}
+}
+
+func TestWhileLoops(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected interface{}
+	}{
+		{"let x = 0; while (false) { x = x + 1; }; x;", 0},
+		{"let x = 0; while (x < 10) { x = x + 1; }; x;", 10},
+		{"let x = 0; while (x < 10) { x++ }; x;", 10},
+		{"let x = 0; while (x < 10) { x++; };", nil},
+		{"let arr = [1, 2, 3]; let i = len(arr) - 1; while (i >= 0) { i--; }; i;", -1},
+		{"let n = 0; while (n < 3) { let step = 1; n += step; }; n", 3},
+		{"let f = fn() { let i = 0; while (true) { if (i == 4) { return i; } i++; } }; f()", 4},
+	}
+
+	for _, test := range tests {
+		testExpectedObject(t, testEval(test.input), test.expected)
+	}
+}
+
+func TestForLoops(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected interface{}
+	}{
+		{"let x = 0; for (let i = 0; i < 10; i = i + 1) { x = i; }; x;", 9},
+		{"let x = 0; for (let i = 0; i < 10; i++) { x = i; }; x;", 9},
+		{"let arr = [1, 2, 3]; let sum = 0; for (let i = 0; i < len(arr); i++) { sum += arr[i]; }; sum;", 6},
+		{"let sum = 0; for (let i = 0; i < 3; i++) { sum += i; }; for (let i = 0; i < 3; i++) { sum += i; }; sum", 6},
+		{"for (let i = 0; i < 3; i++) { }", nil},
+		{
+			`
+			let makers = [];
+			for (let i = 0; i < 3; i++) {
+				let captured = i * 10;
+				makers = append(makers, fn() { captured });
+			};
+			makers[0]() + makers[1]() + makers[2]()
+			`,
+			30,
 		},
+	}
+
+	for _, test := range tests {
+		testExpectedObject(t, testEval(test.input), test.expected)
+	}
+}
+
+func TestConstStatements(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected interface{}
+	}{
+		{"const one = 1; one", 1},
+		{"const one = 1; const three = one + one + 1; one + three;", 4},
+		{"const num = 10; let f = fn() { const num = 20; num }; f() + num", 30},
+		{"const num = 10; let f = fn() { let f = 20; return f; }; f();", 20},
+	}
+
+	for _, test := range tests {
+		testExpectedObject(t, testEval(test.input), test.expected)
+	}
+}
+
+func TestAssignStatements(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected interface{}
+	}{
+		{"let one = 1; one = one + 1; one;", 2},
+		{"let one = 1; let two = one + 1; one = 3; one + two;", 5},
+		{"let f = fn() { 4; }; f = 20; f;", 20},
+		{"let num = 10; let f = fn() { num = 20; }; f(); num", 20},
+		{"let num = 10; let f = fn() { let num = 20; num }; num + f();", 30},
+		{"let num = 0; num++; num;", 1},
+		{"let num = 0; num--; num;", -1},
+		{"let one = 1; one += 1; one;", 2},
+		{"let i = 0; while (i < 14) { i += 1; } i *= 2; i -= 3; i //= 2; i;", 12},
+		{"let x = 2; x *= 3; x -= 1; x", 5},
+		{"let x = 1; x /= 2; x", 0.5},
+	}
+
+	for _, test := range tests {
+		testExpectedObject(t, testEval(test.input), test.expected)
+	}
+}
+
+// The evaluator reports the same errors as the compiler for declarations and assignments, although only when the
+// offending statement is reached.
+func TestDeclarationAndAssignmentErrors(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
 		{
-			`{1: "one", "two": 2, true: 3}[0]`,
-			"key not found in hashmap",
+			"const num = 10;\nnum = 20;",
+			"line 2, column 0: attempting to assign value to constant variable 'num'",
 		},
 		{
-			`{1: "one", "two": 2, true: 3}[false]`,
-			"key not found in hashmap",
+			"const num = 10;\nlet f = fn() { num = 20; };\nf();",
+			"line 2, column 15: attempting to assign value to constant variable 'num'",
+		},
+		{
+			"const num = 10;\nlet num = 20;",
+			"line 2, column 0: identifier 'num' has already been declared",
+		},
+		{
+			"let num = 10;\nconst num = 20;",
+			"line 2, column 0: identifier 'num' has already been declared",
+		},
+		{
+			"let f = fn(a) { let a = 1; };\nf(1);",
+			"line 1, column 16: identifier 'a' has already been declared",
+		},
+		{
+			"let x = 1;\nfn x() { 2 }",
+			"line 1, column 0: identifier 'x' has already been declared",
+		},
+		{
+			"fn f() { 1 }\nfn f() { 2 }",
+			"line 2, column 3: identifier 'f' has already been declared",
+		},
+		{
+			"while (true) { let x = 1; let x = 2; }",
+			"line 1, column 26: identifier 'x' has already been declared",
+		},
+		{
+			"one = 1;",
+			"line 1, column 0: attempting to assign value to identifier 'one' prior to declaration",
+		},
+		{
+			"one += 1;",
+			"line 1, column 0: attempting to assign value to identifier 'one' prior to declaration",
+		},
+		{
+			"let f = fn() {\n  f = 1;\n};\nf();",
+			"line 2, column 2: attempting to assign value to function 'f'",
+		},
+		{
+			"len = 1;",
+			"line 1, column 0: attempting to assign value to function 'len'",
+		},
+		{
+			"for (let i = 0; i < 3; i++) { }; i;",
+			"line 1, column 33: undefined variable: i",
+		},
+		{
+			"1 % 0",
+			"division by zero",
+		},
+		{
+			"1.5 % 1",
+			"modulus operation not supported for float values",
+		},
+		{
+			"1 && true",
+			"unsupported types for logical operation: INTEGER BOOLEAN",
+		},
+		{
+			`"a" < "b"`,
+			"unknown binary string comparison operator: <",
+		},
+		{
+			"1 in [1]",
+			"unsupported type for membership test: ARRAY",
+		},
+		{
+			"#{[1]}",
+			"unusable as set element: ARRAY",
+		},
+		{
+			"5(1)",
+			"attempted to call non-closure and non-builtin",
 		},
 	}
 
 	for _, test := range tests {
-		evaluated := testEval(test.input)
-		testErrorObject(t, evaluated, test.expected)
+		testErrorObject(t, testEval(test.input), test.expected)
+	}
+}
+
+func TestStackTraces(t *testing.T) {
+	frame := func(function string, line, column int) object.StackFrame {
+		return object.StackFrame{Function: function, Position: bytecode.Position{Line: line, Column: column}}
+	}
+
+	tests := []struct {
+		input    string
+		expected []object.StackFrame
+	}{
+		{"1 / 0", []object.StackFrame{frame(object.MainFunctionName, 1, 2)}},
+		{
+			"let f = fn(x) {\n  x / 0\n};\nlet g = fn(y) {\n  1 + f(y)\n};\ng(3);",
+			[]object.StackFrame{frame("f", 2, 4), frame("g", 5, 6), frame(object.MainFunctionName, 7, 0)},
+		},
+		{
+			"fn r(n) { if (n == 0) { -true } else { r(n - 1) } }\nr(2)",
+			[]object.StackFrame{frame("r", 1, 24), frame("r", 1, 39), frame("r", 1, 39), frame(object.MainFunctionName, 2, 0)},
+		},
+		{
+			"let t = {\"__add__\": fn(a, b) { -a }};\nlet h = fn() { t + t };\nh()",
+			[]object.StackFrame{frame("", 1, 31), frame("h", 2, 17), frame(object.MainFunctionName, 3, 0)},
+		},
+		{"fn f(a) { a }\nf(1, 2)", []object.StackFrame{frame(object.MainFunctionName, 2, 0)}},
+	}
+
+	for _, test := range tests {
+		errObj, ok := testEval(test.input).(*object.Error)
+		if !ok {
+			t.Fatalf("expected an error for input %q", test.input)
+		}
+
+		trace := errObj.RuntimeError().Trace
+		if len(trace) != len(test.expected) {
+			t.Fatalf("wrong stack trace for input %q.\nexpected=%v\ngot=%v", test.input, test.expected, trace)
+		}
+		for i, frame := range test.expected {
+			if trace[i] != frame {
+				t.Errorf("wrong frame %d for input %q. expected=%v, got=%v", i, test.input, frame, trace[i])
+			}
+		}
+	}
+}
+
+func TestRuntimeErrorPositions(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"1 / 0", "main.mo:1:2: division by zero"},
+		{"let f = fn(x) {\n  x / 0\n};\nf(3);", "main.mo:2:4: division by zero"},
+		{`len(1)`, "main.mo:1:0: argument to `len` is not supported, got INTEGER"},
+		// Errors whose messages already include their locations aren't prefixed again
+		{"fn() { y }()", "line 1, column 7: undefined variable: y"},
+		{"assert 1 > 2", "main.mo:1:0: assertion failed: (1 > 2)"},
+	}
+
+	for _, test := range tests {
+		l := lexer.NewLexer(test.input)
+		p := parser.NewParser(l)
+		env := object.NewEnvironment()
+		env.SetFilename("main.mo")
+
+		errObj, ok := Eval(p.ParseProgram(), env).(*object.Error)
+		if !ok {
+			t.Fatalf("expected an error for input %q", test.input)
+		}
+
+		runtimeErr := errObj.RuntimeError()
+		runtimeErr.Filename = env.Filename()
+		if runtimeErr.Error() != test.expected {
+			t.Errorf("wrong error for input %q. expected=%q, got=%q", test.input, test.expected, runtimeErr.Error())
+		}
 	}
 }
 
@@ -603,6 +1284,21 @@ func testNullObject(t *testing.T, obj object.Object) bool {
 	return true
 }
 
+func testExpectedObject(t *testing.T, obj object.Object, expected interface{}) bool {
+	switch expected := expected.(type) {
+	case int:
+		return testIntegerObject(t, obj, int64(expected))
+	case float64:
+		return testFloatObject(t, obj, expected)
+	case bool:
+		return testBooleanObject(t, obj, expected)
+	case string:
+		return testStringObject(t, obj, expected)
+	default:
+		return testNullObject(t, obj)
+	}
+}
+
 func testIntegerObject(t *testing.T, obj object.Object, expected int64) bool {
 	result, ok := obj.(*object.Integer)
 	if !ok {
@@ -618,6 +1314,21 @@ func testIntegerObject(t *testing.T, obj object.Object, expected int64) bool {
 	return true
 }
 
+func testFloatObject(t *testing.T, obj object.Object, expected float64) bool {
+	result, ok := obj.(*object.Float)
+	if !ok {
+		t.Errorf("object is not a Float. got=%T (%+v)", obj, obj)
+		return false
+	}
+
+	if math.Abs(result.Value-expected) > 1e-9 {
+		t.Errorf("object has wrong value. expected=%f, got=%f", expected, result.Value)
+		return false
+	}
+
+	return true
+}
+
 func testBooleanObject(t *testing.T, obj object.Object, expected bool) bool {
 	result, ok := obj.(*object.Boolean)
 	if !ok {
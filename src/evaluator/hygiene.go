@@ -0,0 +1,110 @@
+package evaluator
+
+import (
+	"fmt"
+	"monkey/ast"
+	"monkey/object"
+	"monkey/token"
+)
+
+// Returns a new identifier name based on the given prefix, which is unique among the names generated by the expander.
+// Generated names contain digits, which identifiers in Monkey source code can't, so they never collide with the names
+// in user code.
+func (me *MacroExpander) newSymbol(prefix string) string {
+	me.symbols++
+	return fmt.Sprintf("%s__%d", prefix, me.symbols)
+}
+
+// Returns the `gensym` builtin, available to macros, which returns a quoted identifier with a new, unique name. An
+// optional string argument gives the prefix of the name.
+func (me *MacroExpander) gensym() *object.BuiltIn {
+	return &object.BuiltIn{Fn: func(args ...object.Object) object.Object {
+		if len(args) > 1 {
+			return newError("wrong number of arguments. expected=0 or 1, got=%d", len(args))
+		}
+
+		prefix := "gensym"
+		if len(args) == 1 {
+			str, ok := args[0].(*object.String)
+			if !ok {
+				return newError("argument to `gensym` must be STRING, got %s", args[0].Type())
+			}
+			prefix = str.Value
+		}
+
+		name := me.newSymbol(prefix)
+		return &object.Quote{Node: &ast.Identifier{Token: token.Token{Type: token.IDENT, Literal: name}, Value: name}}
+	}}
+}
+
+// Makes the code produced by a macro hygienic: the bindings that the macro itself introduces (as opposed to those in
+// the code passed to it as arguments) are renamed to new, unique names. This way, the macro's bindings can't capture
+// the variables used in its arguments, and they don't leak into or clobber the bindings of the code calling it.
+func (me *MacroExpander) makeHygienic(node ast.Node, args []ast.Expression) (ast.Node, error) {
+	fromArgs := map[ast.Node]bool{}
+	for _, arg := range args {
+		_, err := ast.Modify(arg, func(node ast.Node) (ast.Node, error) {
+			fromArgs[node] = true
+			return node, nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	renames := map[string]string{}
+	rename := func(identifier *ast.Identifier) {
+		if identifier == nil || fromArgs[identifier] {
+			return
+		}
+		if _, ok := renames[identifier.Value]; !ok {
+			renames[identifier.Value] = me.newSymbol(identifier.Value)
+		}
+	}
+
+	_, err := ast.Modify(node, func(node ast.Node) (ast.Node, error) {
+		if fromArgs[node] {
+			return node, nil
+		}
+
+		switch node := node.(type) {
+		case *ast.LetStatement:
+			rename(node.Name)
+		case *ast.ConstStatement:
+			rename(node.Name)
+		case *ast.FunctionDeclaration:
+			rename(node.Name)
+		case *ast.FunctionLiteral:
+			for _, param := range node.Parameters {
+				rename(param)
+			}
+		}
+		return node, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(renames) == 0 {
+		return node, nil
+	}
+
+	return ast.Modify(node, func(node ast.Node) (ast.Node, error) {
+		if fromArgs[node] {
+			return node, nil
+		}
+
+		switch node := node.(type) {
+		case *ast.Identifier:
+			if newName, ok := renames[node.Value]; ok {
+				node.Value = newName
+				node.Token.Literal = newName
+			}
+		case *ast.FunctionLiteral:
+			if newName, ok := renames[node.Name]; ok {
+				node.Name = newName
+			}
+		}
+		return node, nil
+	})
+}
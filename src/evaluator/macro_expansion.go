@@ -25,8 +25,78 @@ func DefineMacros(program *ast.Program, env *object.Environment) {
 	}
 }
 
-func ExpandMacros(program *ast.Program, env *object.Environment) ast.Node {
-	return ast.Modify(program, func(node ast.Node) ast.Node { return macroExpansionModifier(node, env) })
+// The maximum number of expansion steps before macro expansion is aborted, e.g. because a macro expands to a call of
+// itself.
+const maxMacroExpansionSteps = 100
+
+// Expands the calls of the macros defined in an environment. It holds the state of the expansion (the number of
+// symbols generated so far, see `newSymbol`), so that the same code always expands in the same way and separate
+// expansions (e.g. running concurrently) don't interfere with each other. An expander can be reused across programs
+// sharing the same macros (e.g. the inputs of a REPL), so that the symbols it generates are unique among all of them.
+type MacroExpander struct {
+	env     *object.Environment
+	symbols int
+}
+
+func NewMacroExpander(env *object.Environment) *MacroExpander {
+	return &MacroExpander{env: env}
+}
+
+// Replaces the calls of macros defined in the environment with the code they produce, repeatedly, until no macro
+// calls remain (including those in code produced by macros). Errors in expansion, such as a macro returning
+// something other than quoted code, are reported with the position of the offending macro call.
+func ExpandMacros(program *ast.Program, env *object.Environment) (*ast.Program, error) {
+	return NewMacroExpander(env).Expand(program)
+}
+
+// Performs a single step of macro expansion (see `MacroExpander.ExpandOnce`).
+func ExpandMacrosOnce(program *ast.Program, env *object.Environment) (*ast.Program, bool, error) {
+	return NewMacroExpander(env).ExpandOnce(program)
+}
+
+// Expands the macro calls in the program repeatedly, until none remain (see `ExpandMacros`).
+func (me *MacroExpander) Expand(program *ast.Program) (*ast.Program, error) {
+	for step := 0; step < maxMacroExpansionSteps; step++ {
+		expanded, changed, err := me.ExpandOnce(program)
+		if err != nil {
+			return nil, err
+		}
+		if !changed {
+			return expanded, nil
+		}
+		program = expanded
+	}
+
+	return nil, fmt.Errorf("macro expansion did not terminate after %d steps", maxMacroExpansionSteps)
+}
+
+// Performs a single step of macro expansion: the outermost macro calls in the program are replaced with the code they
+// produce, but macro calls passed to them as arguments, or within the produced code, are left unexpanded. A macro call
+// making up a whole expression statement is replaced along with the statement, so that the macro can produce a
+// statement (e.g. a `let` statement) rather than an expression. Reports whether any macro calls were expanded.
+func (me *MacroExpander) ExpandOnce(program *ast.Program) (*ast.Program, bool, error) {
+	calls, err := me.findCalls(program)
+	if err != nil {
+		return nil, false, err
+	}
+
+	changed := false
+	expanded, err := ast.Modify(program, func(node ast.Node) (ast.Node, error) {
+		modified, err := me.expandNode(node, calls)
+		if modified != node {
+			changed = true
+		}
+		return modified, err
+	})
+	if err != nil {
+		return nil, false, err
+	}
+
+	expandedProgram, ok := expanded.(*ast.Program)
+	if !ok {
+		return nil, false, fmt.Errorf("macro expansion produced %T in place of the program", expanded)
+	}
+	return expandedProgram, changed, nil
 }
 
 func isMacroDefinition(node ast.Statement) bool {
@@ -52,28 +122,102 @@ func addMacro(node ast.Statement, env *object.Environment) {
 	env.Set(letStatement.Name.Value, macro)
 }
 
-func macroExpansionModifier(node ast.Node, env *object.Environment) ast.Node {
-	callExpression, ok := node.(*ast.CallExpression)
-	if !ok {
-		return node
+// The macro calls found in a program before a step of expansion.
+type macroCalls struct {
+	nested     map[*ast.CallExpression]bool // the calls within the arguments of other macro calls
+	statements map[*ast.CallExpression]bool // the calls making up a whole expression statement
+}
+
+func (me *MacroExpander) findCalls(program *ast.Program) (macroCalls, error) {
+	calls := macroCalls{nested: map[*ast.CallExpression]bool{}, statements: map[*ast.CallExpression]bool{}}
+	markNested := func(node ast.Node) (ast.Node, error) {
+		if callExpression, ok := node.(*ast.CallExpression); ok {
+			calls.nested[callExpression] = true
+		}
+		return node, nil
+	}
+
+	_, err := ast.Modify(program, func(node ast.Node) (ast.Node, error) {
+		switch node := node.(type) {
+		case *ast.CallExpression:
+			if _, ok := isMacroCall(node, me.env); ok {
+				for _, arg := range node.Arguments {
+					if _, err := ast.Modify(arg, markNested); err != nil {
+						return nil, err
+					}
+				}
+			}
+		case *ast.ExpressionStatement:
+			if callExpression, ok := node.Expression.(*ast.CallExpression); ok {
+				calls.statements[callExpression] = true
+			}
+		}
+		return node, nil
+	})
+	return calls, err
+}
+
+// Expands the node if it's an outermost macro call. Macro calls making up a whole expression statement are expanded
+// along with the statement instead, in which case the statement is replaced with the produced statement, or keeps the
+// produced expression.
+func (me *MacroExpander) expandNode(node ast.Node, calls macroCalls) (ast.Node, error) {
+	switch node := node.(type) {
+	case *ast.CallExpression:
+		if calls.nested[node] || calls.statements[node] {
+			return node, nil
+		}
+		return me.expandCall(node)
+	case *ast.ExpressionStatement:
+		callExpression, ok := node.Expression.(*ast.CallExpression)
+		if !ok || calls.nested[callExpression] {
+			return node, nil
+		}
+
+		expanded, err := me.expandCall(callExpression)
+		if err != nil || expanded == ast.Node(callExpression) {
+			return node, err
+		}
+		if expression, ok := expanded.(ast.Expression); ok {
+			return &ast.ExpressionStatement{Token: node.Token, Expression: expression}, nil
+		}
+		return expanded, nil
+	default:
+		return node, nil
 	}
+}
 
-	macro, ok := isMacroCall(callExpression, env)
+// Replaces the call with the code produced by the macro it calls, or leaves it as it is if it isn't a macro call.
+func (me *MacroExpander) expandCall(callExpression *ast.CallExpression) (ast.Node, error) {
+	macro, ok := isMacroCall(callExpression, me.env)
 	if !ok {
-		return node
+		return callExpression, nil
 	}
 
+	tok := ast.TokenOf(callExpression)
+	name := callExpression.Function.String()
+
 	args := quoteArgs(callExpression)
-	evalEnv := extendMacroEnv(macro, args)
+	if len(args) != len(macro.Parameters) {
+		return nil, fmt.Errorf("line %d, column %d: wrong number of arguments provided to macro '%s'. expected=%d, got=%d", tok.LineNumber, tok.ColumnNumber, name, len(macro.Parameters), len(args))
+	}
+	evalEnv := me.extendMacroEnv(macro, args)
 
-	evaluated := Eval(macro.Body, evalEnv)
+	evaluated := unwrapReturnValue(Eval(macro.Body, evalEnv))
+	if isError(evaluated) {
+		return nil, fmt.Errorf("line %d, column %d: error expanding macro '%s': %s", tok.LineNumber, tok.ColumnNumber, name, evaluated.(*object.Error).Message)
+	}
 
 	quote, ok := evaluated.(*object.Quote)
 	if !ok {
-		panic("we only support returning AST-nodes from macros")
+		return nil, fmt.Errorf("line %d, column %d: macro '%s' must return quoted code, got %s", tok.LineNumber, tok.ColumnNumber, name, typeName(evaluated))
+	}
+
+	// Code constructed by the macro (rather than quoted from its body or arguments) is attributed to the macro call
+	if err := ast.SetMissingPositions(quote.Node, tok.LineNumber, tok.ColumnNumber); err != nil {
+		return nil, err
 	}
 
-	return quote.Node
+	return me.makeHygienic(quote.Node, callExpression.Arguments)
 }
 
 func isMacroCall(exp *ast.CallExpression, env *object.Environment) (*object.Macro, bool) {
@@ -103,14 +247,20 @@ func quoteArgs(exp *ast.CallExpression) []*object.Quote {
 	return args
 }
 
-func extendMacroEnv(macro *object.Macro, args []*object.Quote) *object.Environment {
-	if len(args) != len(macro.Parameters) {
-		panic(fmt.Sprintf("wrong number of arguments provided to macro. expected=%d, received=%d", len(macro.Parameters), len(args)))
-	}
-
+// Returns the environment in which the macro's body is evaluated, which binds its parameters to the quoted arguments,
+// along with the builtins which are only available within macros.
+func (me *MacroExpander) extendMacroEnv(macro *object.Macro, args []*object.Quote) *object.Environment {
 	env := object.NewEnclosedEnvironment(macro.Env)
+	env.Set("gensym", me.gensym())
 	for i, param := range macro.Parameters {
 		env.Set(param.Value, args[i])
 	}
 	return env
 }
+
+func typeName(obj object.Object) string {
+	if obj == nil {
+		return "nothing"
+	}
+	return string(obj.Type())
+}
@@ -5,6 +5,7 @@ import (
 	"monkey/lexer"
 	"monkey/object"
 	"monkey/parser"
+	"strings"
 	"testing"
 )
 
@@ -89,19 +90,250 @@ func TestExpandMacros(t *testing.T) {
 			`,
 			`if (!(10 > 5)) { puts("not greater") } else { puts("greater") }`,
 		},
+		{
+			`
+			let double = macro(x) { quote(unquote(x) * 2); };
+			double(1);
+			double(a + b);
+			`,
+			`(1 * 2); ((a + b) * 2)`,
+		},
 	}
 	for _, test := range tests {
 		expected := testParseProgram(test.expected)
 		program := testParseProgram(test.input)
 		env := object.NewEnvironment()
 		DefineMacros(program, env)
-		expanded := ExpandMacros(program, env)
+		expanded, err := ExpandMacros(program, env)
+		if err != nil {
+			t.Fatalf("macro expansion error: %s", err)
+		}
 		if expanded.String() != expected.String() {
 			t.Errorf("expanded macro not equal to expected output. expected=%q, got=%q", expected.String(), expanded.String())
 		}
 	}
 }
 
+func TestExpandMacrosToStatements(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+		result   int64
+	}{
+		{
+			`let defconst = macro(n, v) { ast_let(n, v) };
+			defconst(z, 5);
+			z`,
+			"let z = 5;z",
+			5,
+		},
+		{
+			`let defconst = macro(n, v) { ast_let(n, v) };
+			let f = fn() { defconst(z, 2); z * 3 };
+			f()`,
+			"let f = fn<f>() let z = 2;(z * 3);f()",
+			6,
+		},
+		// A macro call making up a statement can still produce an expression
+		{
+			`let double = macro(x) { quote(unquote(x) * 2) };
+			double(4);`,
+			"(4 * 2)",
+			8,
+		},
+	}
+
+	for _, test := range tests {
+		program := testParseProgram(test.input)
+		env := object.NewEnvironment()
+		DefineMacros(program, env)
+		expanded, err := ExpandMacros(program, env)
+		if err != nil {
+			t.Fatalf("macro expansion error: %s", err)
+		}
+		if expanded.String() != test.expected {
+			t.Errorf("wrong expansion. expected=%q, got=%q", test.expected, expanded.String())
+		}
+
+		evaluated := Eval(expanded, object.NewEnvironment())
+		testIntegerObject(t, evaluated, test.result)
+	}
+
+	// A statement can't be produced where an expression is expected
+	program := testParseProgram(`let defconst = macro(n, v) { ast_let(n, v) };
+let x = defconst(z, 5);`)
+	env := object.NewEnvironment()
+	DefineMacros(program, env)
+	_, err := ExpandMacros(program, env)
+	if err == nil || !strings.HasPrefix(err.Error(), "line 2, column 8: expected expression in place of") {
+		t.Errorf("expected error for statement in place of expression, got=%v", err)
+	}
+}
+
+func TestExpandMacrosErrors(t *testing.T) {
+	tests := []struct {
+		input         string
+		expectedError string
+	}{
+		{
+			`let m = macro(a, b) { quote(unquote(a) + unquote(b)) };
+m(1);`,
+			"line 2, column 0: wrong number of arguments provided to macro 'm'. expected=2, got=1",
+		},
+		{
+			`let m = macro() { 5 };
+let x = m();`,
+			"line 2, column 8: macro 'm' must return quoted code, got INTEGER",
+		},
+		{
+			`let m = macro() { undefined };
+m();`,
+			"line 2, column 0: error expanding macro 'm': line 1, column 18: undefined variable: undefined",
+		},
+		{
+			`let m = macro(x) { quote(unquote("x") + 1) };
+1 + m(2);`,
+			`line 2, column 4: error expanding macro 'm': line 1, column 25: cannot unquote value of type STRING`,
+		},
+		{
+			`let m = macro() { "code" };
+while (true) { [m()] };`,
+			"line 2, column 16: macro 'm' must return quoted code, got STRING",
+		},
+	}
+
+	for _, test := range tests {
+		program := testParseProgram(test.input)
+		env := object.NewEnvironment()
+		DefineMacros(program, env)
+		_, err := ExpandMacros(program, env)
+		if err == nil {
+			t.Fatalf("expected macro expansion error for input %q, got none", test.input)
+		}
+		if err.Error() != test.expectedError {
+			t.Errorf("wrong macro expansion error. expected=%q, got=%q", test.expectedError, err.Error())
+		}
+	}
+}
+
+func TestExpandMacrosOnce(t *testing.T) {
+	input := `
+	let double = macro(x) { quote(unquote(x) * 2) };
+	let quadruple = macro(x) { quote(double(double(unquote(x)))) };
+	quadruple(y);
+	`
+
+	program := testParseProgram(input)
+	env := object.NewEnvironment()
+	DefineMacros(program, env)
+
+	expanded, changed, err := ExpandMacrosOnce(program, env)
+	if err != nil {
+		t.Fatalf("macro expansion error: %s", err)
+	}
+	if !changed {
+		t.Fatalf("expected a macro call to be expanded")
+	}
+	if expanded.String() != "double(double(y))" {
+		t.Errorf("wrong single-step expansion. expected=%q, got=%q", "double(double(y))", expanded.String())
+	}
+
+	expanded, err = ExpandMacros(expanded, env)
+	if err != nil {
+		t.Fatalf("macro expansion error: %s", err)
+	}
+	if expanded.String() != "((y * 2) * 2)" {
+		t.Errorf("wrong full expansion. expected=%q, got=%q", "((y * 2) * 2)", expanded.String())
+	}
+
+	_, changed, err = ExpandMacrosOnce(expanded, env)
+	if err != nil {
+		t.Fatalf("macro expansion error: %s", err)
+	}
+	if changed {
+		t.Errorf("expected no macro calls to be left to expand")
+	}
+
+	// Only the outermost macro calls are expanded in a single step, not those passed to them as arguments
+	program = testParseProgram(`let dbl = macro(x) { quote(unquote(x) * 2) }; dbl(dbl(1)); [dbl(2), dbl(dbl(3))];`)
+	DefineMacros(program, env)
+
+	expected := "(dbl(1) * 2)[(2 * 2), (dbl(3) * 2)]"
+	expanded, _, err = ExpandMacrosOnce(program, env)
+	if err != nil {
+		t.Fatalf("macro expansion error: %s", err)
+	}
+	if expanded.String() != expected {
+		t.Errorf("wrong single-step expansion of nested calls. expected=%q, got=%q", expected, expanded.String())
+	}
+
+	expected = "((1 * 2) * 2)[(2 * 2), ((3 * 2) * 2)]"
+	expanded, _, err = ExpandMacrosOnce(expanded, env)
+	if err != nil {
+		t.Fatalf("macro expansion error: %s", err)
+	}
+	if expanded.String() != expected {
+		t.Errorf("wrong second-step expansion of nested calls. expected=%q, got=%q", expected, expanded.String())
+	}
+
+	program = testParseProgram(`let forever = macro() { quote(forever()) }; forever();`)
+	DefineMacros(program, env)
+	_, err = ExpandMacros(program, env)
+	if err == nil || err.Error() != "macro expansion did not terminate after 100 steps" {
+		t.Errorf("expected non-terminating expansion error, got=%v", err)
+	}
+}
+
+func TestHygienicMacros(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected int64
+	}{
+		// The macro's `tmp` doesn't capture the caller's `tmp`
+		{
+			`let add_one = macro(x) { quote(fn() { let tmp = 1; tmp + unquote(x) }()) };
+			let tmp = 10;
+			add_one(tmp)`,
+			11,
+		},
+		// The macro's bindings don't clobber the caller's bindings of the same name
+		{
+			`let set_tmp = macro(x) { quote(fn() { let tmp = unquote(x); tmp }()) };
+			let tmp = 5;
+			set_tmp(tmp * 2) + tmp`,
+			15,
+		},
+		// Function parameters introduced by the macro are renamed as well
+		{
+			`let apply_twice = macro(f, x) { quote(fn(n) { unquote(f)(unquote(f)(n)) }(unquote(x))) };
+			let n = 3;
+			let inc = fn(x) { x + n };
+			apply_twice(inc, n)`,
+			9,
+		},
+		// Splicing a variable number of expressions into a block
+		{
+			`let block = macro(statements) { quote(fn() { unquote_splice(statements) }()) };
+			let a = 2;
+			block([a * 3, a + 3])`,
+			5,
+		},
+	}
+
+	for _, test := range tests {
+		program := testParseProgram(test.input)
+		macroEnv := object.NewEnvironment()
+		DefineMacros(program, macroEnv)
+		expanded, err := ExpandMacros(program, macroEnv)
+		if err != nil {
+			t.Fatalf("macro expansion error: %s", err)
+		}
+
+		evaluated := Eval(expanded, object.NewEnvironment())
+		testIntegerObject(t, evaluated, test.expected)
+	}
+}
+
 func testParseProgram(input string) *ast.Program {
 	l := lexer.NewLexer(input)
 	p := parser.NewParser(l)
@@ -1,6 +1,8 @@
 package evaluator
 
 import (
+	"errors"
+	"fmt"
 	"monkey/ast"
 	"monkey/object"
 )
@@ -10,26 +12,66 @@ func quote(args []ast.Expression, env *object.Environment) object.Object {
 		return newError("wrong number of arguments provided to 'quote'. expected=1, got=%d", len(args))
 	}
 
-	node := evalUnquoteCalls(args[0], env)
+	// The quoted code is copied so that unquoting doesn't modify the original code, e.g. the body of a macro which may
+	// be called again
+	node, err := evalUnquoteCalls(ast.Copy(args[0]), env)
+	if err != nil {
+		return quoteError(err)
+	}
+
+	err = checkNoUnquoteSpliceCalls(node)
+	if err != nil {
+		return quoteError(err)
+	}
+
 	return &object.Quote{Node: node}
 }
 
-func evalUnquoteCalls(node ast.Node, env *object.Environment) ast.Node {
-	return ast.Modify(node, func(node ast.Node) ast.Node { return unquoteEvalModifier(node, env) })
+// Returns the error object for an error quoting code. Errors from evaluating the unquoted expressions are passed on as
+// they are, while the others already start with their location.
+func quoteError(err error) *object.Error {
+	var errObj errorObject
+	if errors.As(err, &errObj) {
+		return errObj.obj
+	}
+	return &object.Error{Message: err.Error(), Located: true}
+}
+
+func evalUnquoteCalls(node ast.Node, env *object.Environment) (ast.Node, error) {
+	return ast.Modify(node, func(node ast.Node) (ast.Node, error) { return unquoteEvalModifier(node, env) })
 }
 
-func unquoteEvalModifier(node ast.Node, env *object.Environment) ast.Node {
+func unquoteEvalModifier(node ast.Node, env *object.Environment) (ast.Node, error) {
+	err := evalUnquoteSpliceCalls(node, env)
+	if err != nil {
+		return nil, err
+	}
+
+	// The name of a binding given by an `unquote` call is replaced by the identifier it evaluates to
+	if identifier, ok := node.(*ast.Identifier); ok && identifier.Unquote != nil {
+		return unquoteEvalModifier(identifier.Unquote, env)
+	}
+
 	if !isUnquoteCall(node) {
-		return node
+		return node, nil
 	}
 
 	unquoteCall, _ := node.(*ast.CallExpression)
 	if len(unquoteCall.Arguments) != 1 {
-		return node
+		return node, nil
 	}
 
 	unquoteEval := Eval(unquoteCall.Arguments[0], env)
-	return convertObjectToASTNode(unquoteEval)
+	if isError(unquoteEval) {
+		return nil, errorObject{unquoteEval.(*object.Error)}
+	}
+
+	converted := convertObjectToASTNode(unquoteEval)
+	if converted == nil {
+		tok := ast.TokenOf(unquoteCall)
+		return nil, fmt.Errorf("line %d, column %d: cannot unquote value of type %s", tok.LineNumber, tok.ColumnNumber, unquoteEval.Type())
+	}
+	return converted, nil
 }
 
 func isUnquoteCall(node ast.Node) bool {
@@ -40,3 +82,136 @@ func isUnquoteCall(node ast.Node) bool {
 
 	return callExpression.Function.TokenLiteral() == "unquote"
 }
+
+// Replaces the `unquote_splice` calls among the statements of a block, the elements of an array or set literal, or the
+// arguments of a call with the list of nodes that each of them evaluates to.
+func evalUnquoteSpliceCalls(node ast.Node, env *object.Environment) error {
+	var err error
+
+	switch node := node.(type) {
+	case *ast.BlockStatement:
+		node.Statements, err = spliceStatements(node.Statements, env)
+	case *ast.ArrayLiteral:
+		node.Elements, err = spliceExpressions(node.Elements, env)
+	case *ast.SetLiteral:
+		node.Elements, err = spliceExpressions(node.Elements, env)
+	case *ast.CallExpression:
+		node.Arguments, err = spliceExpressions(node.Arguments, env)
+	}
+
+	return err
+}
+
+func spliceStatements(statements []ast.Statement, env *object.Environment) ([]ast.Statement, error) {
+	spliced := []ast.Statement{}
+	for _, statement := range statements {
+		expressionStatement, ok := statement.(*ast.ExpressionStatement)
+		if !ok || !isUnquoteSpliceCall(expressionStatement.Expression) {
+			spliced = append(spliced, statement)
+			continue
+		}
+
+		nodes, err := evalUnquoteSplice(expressionStatement.Expression.(*ast.CallExpression), env)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, node := range nodes {
+			switch node := node.(type) {
+			case ast.Statement:
+				spliced = append(spliced, node)
+			case ast.Expression:
+				spliced = append(spliced, &ast.ExpressionStatement{Token: ast.TokenOf(node), Expression: node})
+			}
+		}
+	}
+	return spliced, nil
+}
+
+func spliceExpressions(expressions []ast.Expression, env *object.Environment) ([]ast.Expression, error) {
+	spliced := []ast.Expression{}
+	for _, expression := range expressions {
+		if !isUnquoteSpliceCall(expression) {
+			spliced = append(spliced, expression)
+			continue
+		}
+
+		spliceCall := expression.(*ast.CallExpression)
+		nodes, err := evalUnquoteSplice(spliceCall, env)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, node := range nodes {
+			splicedExpression, ok := node.(ast.Expression)
+			if !ok {
+				tok := ast.TokenOf(spliceCall)
+				return nil, fmt.Errorf("line %d, column %d: cannot splice statement %q in place of an expression", tok.LineNumber, tok.ColumnNumber, node.String())
+			}
+			spliced = append(spliced, splicedExpression)
+		}
+	}
+	return spliced, nil
+}
+
+// Evaluates the argument of an `unquote_splice` call, which must be either an array of values that can be unquoted or
+// a quoted array literal, and returns the nodes to be spliced in its place.
+func evalUnquoteSplice(spliceCall *ast.CallExpression, env *object.Environment) ([]ast.Node, error) {
+	tok := ast.TokenOf(spliceCall)
+
+	if len(spliceCall.Arguments) != 1 {
+		return nil, fmt.Errorf("line %d, column %d: wrong number of arguments provided to 'unquote_splice'. expected=1, got=%d", tok.LineNumber, tok.ColumnNumber, len(spliceCall.Arguments))
+	}
+
+	evaluated := Eval(spliceCall.Arguments[0], env)
+	if isError(evaluated) {
+		return nil, errorObject{evaluated.(*object.Error)}
+	}
+
+	nodes := []ast.Node{}
+	switch evaluated := evaluated.(type) {
+	case *object.Array:
+		for _, element := range evaluated.Elements {
+			node := convertObjectToASTNode(element)
+			if node == nil {
+				return nil, fmt.Errorf("line %d, column %d: cannot unquote value of type %s", tok.LineNumber, tok.ColumnNumber, element.Type())
+			}
+			nodes = append(nodes, node)
+		}
+
+	case *object.Quote:
+		arrayLiteral, ok := evaluated.Node.(*ast.ArrayLiteral)
+		if !ok {
+			return nil, fmt.Errorf("line %d, column %d: cannot splice quoted %q, expected an array literal", tok.LineNumber, tok.ColumnNumber, evaluated.Node.String())
+		}
+		for _, element := range arrayLiteral.Elements {
+			nodes = append(nodes, element)
+		}
+
+	default:
+		return nil, fmt.Errorf("line %d, column %d: cannot splice value of type %s, expected an array", tok.LineNumber, tok.ColumnNumber, typeName(evaluated))
+	}
+
+	return nodes, nil
+}
+
+// Reports an error for any `unquote_splice` call left over in a position that can't hold a list of nodes.
+func checkNoUnquoteSpliceCalls(node ast.Node) error {
+	_, err := ast.Modify(node, func(node ast.Node) (ast.Node, error) {
+		if isUnquoteSpliceCall(node) {
+			tok := ast.TokenOf(node)
+			return nil, fmt.Errorf("line %d, column %d: unquote_splice can only be used among the statements of a block, the elements of an array or set, or the arguments of a call", tok.LineNumber, tok.ColumnNumber)
+		}
+		return node, nil
+	})
+	return err
+}
+
+func isUnquoteSpliceCall(node ast.Node) bool {
+	callExpression, ok := node.(*ast.CallExpression)
+	if !ok {
+		return false
+	}
+
+	return callExpression.Function.TokenLiteral() == "unquote_splice"
+}
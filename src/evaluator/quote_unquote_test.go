@@ -136,3 +136,175 @@ func TestQuoteUnquote(t *testing.T) {
 		}
 	}
 }
+
+func TestUnquoteSplice(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{
+			`quote(f(1, unquote_splice([2, 3]), 4))`,
+			`f(1, 2, 3, 4)`,
+		},
+		{
+			`quote([unquote_splice([]), 1])`,
+			`[1]`,
+		},
+		{
+			`let args = quote([a, b + c]); quote(f(unquote_splice(args)))`,
+			`f(a, (b + c))`,
+		},
+		{
+			`quote(#{unquote_splice([true, 1 == 2])})`,
+			`#{true, false}`,
+		},
+		{
+			`let body = [quote(puts(1)), quote(puts(2))];
+			quote(if (x) { unquote_splice(body); x })`,
+			`if (x) { puts(1)puts(2)x } `,
+		},
+	}
+
+	for _, test := range tests {
+		evaluated := testEval(test.input)
+		quote, ok := evaluated.(*object.Quote)
+		if !ok {
+			t.Fatalf("expected *object.Quote. got=%T (%+v)", evaluated, evaluated)
+		}
+
+		if quote.Node.String() != test.expected {
+			t.Errorf("quoted node string is wrong. got=%q, want=%q", quote.Node.String(), test.expected)
+		}
+	}
+}
+
+func TestUnquoteSpliceErrors(t *testing.T) {
+	tests := []struct {
+		input         string
+		expectedError string
+	}{
+		{
+			`quote(1 + unquote_splice([2]))`,
+			"line 1, column 10: unquote_splice can only be used among the statements of a block, the elements of an array or set, or the arguments of a call",
+		},
+		{
+			`quote(f(unquote_splice(5)))`,
+			"line 1, column 8: cannot splice value of type INTEGER, expected an array",
+		},
+		{
+			`quote(f(unquote_splice(quote(a + b))))`,
+			`line 1, column 8: cannot splice quoted "(a + b)", expected an array literal`,
+		},
+		{
+			`quote(f(unquote_splice(["a"])))`,
+			"line 1, column 8: cannot unquote value of type STRING",
+		},
+	}
+
+	for _, test := range tests {
+		evaluated := testEval(test.input)
+		testErrorObject(t, evaluated, test.expectedError)
+	}
+}
+
+func TestUnquotedBindingNames(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{
+			`let name = quote(x); quote(fn() { let unquote(name) = 1; x })`,
+			`fn() let x = 1;x`,
+		},
+		{
+			`let name = quote(c); quote(fn() { const unquote(name) = 2; c })`,
+			`fn() const c = 2;c`,
+		},
+		{
+			`let a = quote(a); let b = quote(b); quote(fn(unquote(a), unquote(b)) { a + b })`,
+			`fn(a, b) (a + b)`,
+		},
+	}
+
+	for _, test := range tests {
+		evaluated := testEval(test.input)
+		quote, ok := evaluated.(*object.Quote)
+		if !ok {
+			t.Fatalf("expected *object.Quote. got=%T (%+v)", evaluated, evaluated)
+		}
+
+		if quote.Node.String() != test.expected {
+			t.Errorf("quoted node string is wrong. got=%q, want=%q", quote.Node.String(), test.expected)
+		}
+	}
+
+	testErrorObject(t, testEval(`quote(fn(unquote(1)) { 1 })`), `line 1, column 9: expected identifier in place of "unquote(1)", got 1`)
+}
+
+func TestGensym(t *testing.T) {
+	input := `
+	let m = macro() { ast_array([gensym(), gensym("tmp")]) };
+	m();
+	m();
+	`
+
+	expand := func() string {
+		program := testParseProgram(input)
+		env := object.NewEnvironment()
+		DefineMacros(program, env)
+		expanded, err := ExpandMacros(program, env)
+		if err != nil {
+			t.Fatalf("macro expansion error: %s", err)
+		}
+		return expanded.String()
+	}
+
+	expected := "[gensym__1, tmp__2][gensym__3, tmp__4]"
+	if expanded := expand(); expanded != expected {
+		t.Errorf("wrong generated symbols. expected=%q, got=%q", expected, expanded)
+	}
+	// Each expansion generates the same symbols
+	if expanded := expand(); expanded != expected {
+		t.Errorf("wrong generated symbols on second expansion. expected=%q, got=%q", expected, expanded)
+	}
+
+	program := testParseProgram(`let m = macro() { gensym(1) }; m();`)
+	env := object.NewEnvironment()
+	DefineMacros(program, env)
+	_, err := ExpandMacros(program, env)
+	expectedError := "line 1, column 31: error expanding macro 'm': argument to `gensym` must be STRING, got INTEGER"
+	if err == nil || err.Error() != expectedError {
+		t.Errorf("wrong gensym error. expected=%q, got=%v", expectedError, err)
+	}
+
+	// `gensym` is only available within macros
+	testErrorObject(t, testEval(`gensym()`), "line 1, column 0: undefined variable: gensym")
+}
+
+func TestGensymBindings(t *testing.T) {
+	input := `
+	let square = macro(e) {
+		let v = gensym("v");
+		quote(fn() { let unquote(v) = unquote(e); unquote(v) * unquote(v) }())
+	};
+	let adder = macro(n) { let p = gensym(); quote(fn(unquote(p)) { unquote(p) + unquote(n) }) };
+	let v = 4;
+	[square(v + 1), adder(v)(10)]
+	`
+
+	program := testParseProgram(input)
+	env := object.NewEnvironment()
+	DefineMacros(program, env)
+	expanded, err := ExpandMacros(program, env)
+	if err != nil {
+		t.Fatalf("macro expansion error: %s", err)
+	}
+
+	evaluated := Eval(expanded, object.NewEnvironment())
+	array, ok := evaluated.(*object.Array)
+	if !ok || len(array.Elements) != 2 {
+		t.Fatalf("expected an array of 2 elements. got=%T (%+v)", evaluated, evaluated)
+	}
+	testIntegerObject(t, array.Elements[0], 25)
+	testIntegerObject(t, array.Elements[1], 14)
+}
@@ -0,0 +1,258 @@
+package ir
+
+import (
+	"bytes"
+	"fmt"
+	"monkey/bytecode"
+	"strings"
+)
+
+// The intermediate representation (IR) sits between the AST and bytecode. The compiler generates a control-flow graph
+// for the program and for each function, made up of basic blocks: straight-line sequences of instructions, each ending
+// in a terminator which transfers control to other blocks (or out of the function). The graph is then lowered to a flat
+// series of bytecode instructions, with the jumps between blocks resolved to offsets.
+
+// Represents a local variable of a function (or of a block at the top level of the program), which is stored in the
+// given slot of the frame at runtime. Each binding is a separate local, even if its slot is reused by other bindings
+// once the block declaring it ends.
+type Local struct {
+	Name string
+	Slot int
+}
+
+func (l *Local) String() string {
+	return fmt.Sprintf("%d (%s)", l.Slot, l.Name)
+}
+
+// Represents a single bytecode instruction within a basic block. Instructions which read, write or capture a local
+// refer to it explicitly; their slot operand is only filled in when the IR is lowered.
+type Instruction struct {
+	Opcode   bytecode.Opcode
+	Operands []int
+	Local    *Local
+	Position bytecode.Position // The position of the node the instruction was compiled from, if known.
+}
+
+func (instr *Instruction) operands() []int {
+	if instr.Local != nil {
+		return []int{instr.Local.Slot}
+	}
+	return instr.Operands
+}
+
+func (instr *Instruction) String() string {
+	def, err := bytecode.LookUp(byte(instr.Opcode))
+	if err != nil {
+		return fmt.Sprintf("ERROR: %s", err)
+	}
+
+	if instr.Local != nil {
+		return fmt.Sprintf("%s %s", def.Name, instr.Local)
+	}
+
+	out := def.Name
+	for _, operand := range instr.Operands {
+		out += fmt.Sprintf(" %d", operand)
+	}
+	return out
+}
+
+// Represents the instruction(s) ending a basic block, which determine the block(s) that control flows to next.
+type Terminator interface {
+	String() string
+	Successors() []*Block
+}
+
+// Unconditionally transfers control to the target block.
+type Jump struct {
+	Target *Block
+}
+
+func (j *Jump) String() string       { return fmt.Sprintf("jump %s", j.Target.Label()) }
+func (j *Jump) Successors() []*Block { return []*Block{j.Target} }
+
+// Pops the value on top of the stack, transferring control to the Then block if it's truthy, or to the Else block if
+// it isn't.
+type Branch struct {
+	Then *Block
+	Else *Block
+}
+
+func (b *Branch) String() string {
+	return fmt.Sprintf("branch %s else %s", b.Then.Label(), b.Else.Label())
+}
+func (b *Branch) Successors() []*Block { return []*Block{b.Then, b.Else} }
+
+// Returns from the function, with the value on top of the stack if WithValue is set (or with null otherwise).
+type Return struct {
+	WithValue bool
+}
+
+func (r *Return) String() string {
+	if r.WithValue {
+		return "return value"
+	}
+	return "return"
+}
+func (r *Return) Successors() []*Block { return nil }
+
+// Represents a basic block: a series of instructions which always run in order, followed by a terminator. A block
+// without a terminator falls off the end of the function, ending the program.
+type Block struct {
+	ID           int
+	Instructions []*Instruction
+	Terminator   Terminator
+}
+
+func (b *Block) Label() string {
+	return fmt.Sprintf("b%d", b.ID)
+}
+
+func (b *Block) Emit(op bytecode.Opcode, operands ...int) *Instruction {
+	instr := &Instruction{Opcode: op, Operands: operands}
+	b.Instructions = append(b.Instructions, instr)
+	return instr
+}
+
+// Emits an instruction operating on the slot of the given local.
+func (b *Block) EmitLocal(op bytecode.Opcode, local *Local) *Instruction {
+	instr := &Instruction{Opcode: op, Local: local}
+	b.Instructions = append(b.Instructions, instr)
+	return instr
+}
+
+// Reports whether the block has been terminated, after which no more instructions can be added to it.
+func (b *Block) IsTerminated() bool {
+	return b.Terminator != nil
+}
+
+// Represents the control-flow graph of a function (or of the program's top-level code).
+type Function struct {
+	Name   string
+	Locals []*Local
+	Blocks []*Block // The blocks of the function, in the order in which they're laid out in bytecode.
+
+	numBlocks int
+}
+
+func NewFunction(name string) *Function {
+	return &Function{Name: name, Locals: []*Local{}, Blocks: []*Block{}}
+}
+
+// Creates a new block in the function. The block is only laid out once it's placed.
+func (f *Function) NewBlock() *Block {
+	block := &Block{ID: f.numBlocks, Instructions: []*Instruction{}}
+	f.numBlocks += 1
+	return block
+}
+
+// Lays out the given block after the blocks placed so far.
+func (f *Function) Place(block *Block) {
+	f.Blocks = append(f.Blocks, block)
+}
+
+func (f *Function) NewLocal(name string, slot int) *Local {
+	local := &Local{Name: name, Slot: slot}
+	f.Locals = append(f.Locals, local)
+	return local
+}
+
+func (f *Function) String() string {
+	var out bytes.Buffer
+
+	locals := []string{}
+	for _, local := range f.Locals {
+		locals = append(locals, local.String())
+	}
+	if len(locals) == 0 {
+		locals = append(locals, "none")
+	}
+	fmt.Fprintf(&out, "%s\nlocals: %s\n", f.Name, strings.Join(locals, ", "))
+
+	for _, block := range f.Blocks {
+		fmt.Fprintf(&out, "%s:\n", block.Label())
+		for _, instr := range block.Instructions {
+			fmt.Fprintf(&out, "    %s\n", instr)
+		}
+		if block.Terminator != nil {
+			fmt.Fprintf(&out, "    %s\n", block.Terminator)
+		}
+	}
+
+	return out.String()
+}
+
+// Lowers the function to bytecode instructions, along with the table of their positions in the source code. Blocks are
+// emitted in the order in which they're laid out, so jumps to the block immediately following are left out, with
+// control falling through to it instead. The instructions implementing terminators share the position of the
+// instruction preceding them.
+func (f *Function) Lower() (bytecode.Instructions, bytecode.PositionTable) {
+	sizes := make([]int, len(f.Blocks))
+	for i, block := range f.Blocks {
+		for _, instr := range block.Instructions {
+			sizes[i] += len(bytecode.Make(instr.Opcode, instr.operands()...))
+		}
+	}
+
+	// Jumps to positions that don't fit in 2 bytes are wider, which may in turn move the blocks following them. The
+	// blocks are laid out starting with every position at 0, and then again until none of their positions move.
+	positions := make(map[*Block]int, len(f.Blocks))
+	for moved := true; moved; {
+		moved = false
+
+		pos := 0
+		for i, block := range f.Blocks {
+			if positions[block] != pos {
+				positions[block] = pos
+				moved = true
+			}
+			pos += sizes[i] + len(f.lowerTerminator(i, positions))
+		}
+	}
+
+	instructions := bytecode.Instructions{}
+	table := bytecode.PositionTable{}
+	for i, block := range f.Blocks {
+		for _, instr := range block.Instructions {
+			if instr.Position != (bytecode.Position{}) {
+				table = table.Add(len(instructions), instr.Position)
+			}
+			instructions = append(instructions, bytecode.Make(instr.Opcode, instr.operands()...)...)
+		}
+		instructions = append(instructions, f.lowerTerminator(i, positions)...)
+	}
+
+	return instructions, table
+}
+
+// Returns the instructions implementing the terminator of the block at the given index in the layout, jumping to the
+// given positions of its successors.
+func (f *Function) lowerTerminator(index int, positions map[*Block]int) []byte {
+	var next *Block
+	if index+1 < len(f.Blocks) {
+		next = f.Blocks[index+1]
+	}
+
+	switch terminator := f.Blocks[index].Terminator.(type) {
+	case *Jump:
+		if terminator.Target == next {
+			return []byte{}
+		}
+		return bytecode.Make(bytecode.OpJump, positions[terminator.Target])
+
+	case *Branch:
+		instructions := bytecode.Make(bytecode.OpJumpNotTruthy, positions[terminator.Else])
+		if terminator.Then != next {
+			instructions = append(instructions, bytecode.Make(bytecode.OpJump, positions[terminator.Then])...)
+		}
+		return instructions
+
+	case *Return:
+		if terminator.WithValue {
+			return bytecode.Make(bytecode.OpReturnValue)
+		}
+		return bytecode.Make(bytecode.OpReturn)
+	}
+
+	return []byte{}
+}
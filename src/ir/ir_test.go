@@ -0,0 +1,150 @@
+package ir
+
+import (
+	"monkey/bytecode"
+	"testing"
+)
+
+// Builds the control-flow graph of `while (n) { n = n - 1 }; return n`, with the loop's body laid out after its exit
+// so that the branch into it needs an additional jump.
+func buildLoop() *Function {
+	f := NewFunction("loop")
+	n := f.NewLocal("n", 0)
+
+	entry, condition, body, exit := f.NewBlock(), f.NewBlock(), f.NewBlock(), f.NewBlock()
+	f.Place(entry)
+	f.Place(condition)
+	f.Place(exit)
+	f.Place(body)
+
+	entry.Terminator = &Jump{Target: condition}
+
+	condition.EmitLocal(bytecode.OpGetLocal, n)
+	condition.Terminator = &Branch{Then: body, Else: exit}
+
+	body.EmitLocal(bytecode.OpGetLocal, n)
+	body.Emit(bytecode.OpConstant, 0)
+	body.Emit(bytecode.OpSub)
+	body.EmitLocal(bytecode.OpSetLocal, n)
+	body.Terminator = &Jump{Target: condition}
+
+	exit.EmitLocal(bytecode.OpGetLocal, n)
+	exit.Terminator = &Return{WithValue: true}
+
+	return f
+}
+
+func TestLower(t *testing.T) {
+	expected := []bytecode.Instructions{
+		// 0000
+		bytecode.Make(bytecode.OpGetLocal, 0),
+		// 0002
+		bytecode.Make(bytecode.OpJumpNotTruthy, 8),
+		// 0005
+		bytecode.Make(bytecode.OpJump, 11),
+		// 0008
+		bytecode.Make(bytecode.OpGetLocal, 0),
+		// 0010
+		bytecode.Make(bytecode.OpReturnValue),
+		// 0011
+		bytecode.Make(bytecode.OpGetLocal, 0),
+		// 0013
+		bytecode.Make(bytecode.OpConstant, 0),
+		// 0016
+		bytecode.Make(bytecode.OpSub),
+		// 0017
+		bytecode.Make(bytecode.OpSetLocal, 0),
+		// 0019
+		bytecode.Make(bytecode.OpJump, 0),
+	}
+
+	instructions, _ := buildLoop().Lower()
+	assertInstructions(t, expected, instructions)
+}
+
+func TestLowerReassignedSlots(t *testing.T) {
+	f := buildLoop()
+	f.Locals[0].Slot = 3
+
+	expected := []bytecode.Instructions{
+		bytecode.Make(bytecode.OpGetLocal, 3),
+		bytecode.Make(bytecode.OpJumpNotTruthy, 8),
+		bytecode.Make(bytecode.OpJump, 11),
+		bytecode.Make(bytecode.OpGetLocal, 3),
+		bytecode.Make(bytecode.OpReturnValue),
+		bytecode.Make(bytecode.OpGetLocal, 3),
+		bytecode.Make(bytecode.OpConstant, 0),
+		bytecode.Make(bytecode.OpSub),
+		bytecode.Make(bytecode.OpSetLocal, 3),
+		bytecode.Make(bytecode.OpJump, 0),
+	}
+
+	instructions, _ := f.Lower()
+	assertInstructions(t, expected, instructions)
+}
+
+func TestLowerPositions(t *testing.T) {
+	f := buildLoop()
+	condition, exit, body := f.Blocks[1], f.Blocks[2], f.Blocks[3]
+	condition.Instructions[0].Position = bytecode.Position{Line: 1, Column: 8}
+	for _, instr := range body.Instructions {
+		instr.Position = bytecode.Position{Line: 2, Column: 5}
+	}
+	body.Instructions[1].Position = bytecode.Position{Line: 2, Column: 13}
+	exit.Instructions[0].Position = bytecode.Position{Line: 4, Column: 8}
+
+	expected := bytecode.PositionTable{
+		{Offset: 0, Position: bytecode.Position{Line: 1, Column: 8}},
+		{Offset: 8, Position: bytecode.Position{Line: 4, Column: 8}},
+		{Offset: 11, Position: bytecode.Position{Line: 2, Column: 5}},
+		{Offset: 13, Position: bytecode.Position{Line: 2, Column: 13}},
+		{Offset: 16, Position: bytecode.Position{Line: 2, Column: 5}},
+	}
+
+	_, actual := f.Lower()
+	if len(actual) != len(expected) {
+		t.Fatalf("wrong position table length.\nexpected=%v\ngot=%v", expected, actual)
+	}
+	for i, entry := range expected {
+		if actual[i] != entry {
+			t.Errorf("wrong position table entry %d.\nexpected=%v\ngot=%v", i, entry, actual[i])
+		}
+	}
+}
+
+func TestFunctionString(t *testing.T) {
+	expected := `loop
+locals: 0 (n)
+b0:
+    jump b1
+b1:
+    OpGetLocal 0 (n)
+    branch b2 else b3
+b3:
+    OpGetLocal 0 (n)
+    return value
+b2:
+    OpGetLocal 0 (n)
+    OpConstant 0
+    OpSub
+    OpSetLocal 0 (n)
+    jump b1
+`
+
+	if actual := buildLoop().String(); actual != expected {
+		t.Errorf("function string is wrong.\nexpected=%q\ngot=%q", expected, actual)
+	}
+}
+
+func assertInstructions(t *testing.T, expected []bytecode.Instructions, actual bytecode.Instructions) {
+	t.Helper()
+
+	concatted := bytecode.Instructions{}
+	for _, instr := range expected {
+		concatted = append(concatted, instr...)
+	}
+
+	if actual.String() != concatted.String() {
+		t.Errorf("wrong instructions.\nexpected=%q\ngot=%q", concatted, actual)
+	}
+}
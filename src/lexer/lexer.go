@@ -32,6 +32,8 @@ func (l *Lexer) NextToken() token.Token {
 	case '=':
 		if l.peekChar() == '=' {
 			tok = l.readTwoCharacterToken(token.EQ)
+		} else if l.peekChar() == '>' {
+			tok = l.readTwoCharacterToken(token.ARROW)
 		} else {
 			tok = l.newToken(token.ASSIGN, l.char)
 		}
@@ -39,13 +41,15 @@ func (l *Lexer) NextToken() token.Token {
 		if l.peekChar() == '&' {
 			tok = l.readTwoCharacterToken(token.AND)
 		} else {
-			tok = l.newToken(token.ILLEGAL, l.char)
+			tok = l.newToken(token.AMPERSAND, l.char)
 		}
 	case '|':
 		if l.peekChar() == '|' {
 			tok = l.readTwoCharacterToken(token.OR)
+		} else if l.peekChar() == '>' {
+			tok = l.readTwoCharacterToken(token.PIPELINE)
 		} else {
-			tok = l.newToken(token.ILLEGAL, l.char)
+			tok = l.newToken(token.PIPE, l.char)
 		}
 	case '+':
 		if l.peekChar() == '+' {
@@ -138,6 +142,12 @@ func (l *Lexer) NextToken() token.Token {
 		tok = l.newToken(token.LBRACKET, l.char)
 	case ']':
 		tok = l.newToken(token.RBRACKET, l.char)
+	case '#':
+		if l.peekChar() == '{' {
+			tok = l.readTwoCharacterToken(token.LSET)
+		} else {
+			tok = l.newToken(token.ILLEGAL, l.char)
+		}
 	case '"':
 		tok.Type = token.STRING
 		tok.Literal = l.readString()
@@ -120,6 +120,11 @@ func TestNextToken(t *testing.T) {
 	i //= 9;
 
 	2**3;
+
+	let s = #{1, 2} | #{3} & #{2};
+	2 in s;
+
+	s |> map((x) => x == 5);
 	`
 
 	tests := []struct {
@@ -448,6 +453,42 @@ func TestNextToken(t *testing.T) {
 		{token.INT, "3"},
 		{token.SEMICOLON, ";"},
 
+		{token.LET, "let"},
+		{token.IDENT, "s"},
+		{token.ASSIGN, "="},
+		{token.LSET, "#{"},
+		{token.INT, "1"},
+		{token.COMMA, ","},
+		{token.INT, "2"},
+		{token.RBRACE, "}"},
+		{token.PIPE, "|"},
+		{token.LSET, "#{"},
+		{token.INT, "3"},
+		{token.RBRACE, "}"},
+		{token.AMPERSAND, "&"},
+		{token.LSET, "#{"},
+		{token.INT, "2"},
+		{token.RBRACE, "}"},
+		{token.SEMICOLON, ";"},
+		{token.INT, "2"},
+		{token.IN, "in"},
+		{token.IDENT, "s"},
+		{token.SEMICOLON, ";"},
+
+		{token.IDENT, "s"},
+		{token.PIPELINE, "|>"},
+		{token.IDENT, "map"},
+		{token.LPAREN, "("},
+		{token.LPAREN, "("},
+		{token.IDENT, "x"},
+		{token.RPAREN, ")"},
+		{token.ARROW, "=>"},
+		{token.IDENT, "x"},
+		{token.EQ, "=="},
+		{token.INT, "5"},
+		{token.RPAREN, ")"},
+		{token.SEMICOLON, ";"},
+
 		{token.EOF, ""},
 	}
 
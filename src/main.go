@@ -3,28 +3,92 @@ package main
 import (
 	"flag"
 	"fmt"
+	"io"
 	"monkey/repl"
 	"os"
 	"os/user"
+	"path/filepath"
+	"strings"
 )
 
 // By default, give the user the compiler/VM engine, but allow for interpreter/evaluator access if specified.
 var engine = flag.String("engine", "vm", "use 'vm' or 'eval'")
 
-// By default, open a top-level REPL for the user to interact with, but allow for running a specific file of Monkey code if desired.
-var filename = flag.String("filename", "", "specify a file to run")
+// By default, open a top-level REPL for the user to interact with, but allow for running a specific file of Monkey code (or of bytecode built from it) if desired.
+var filename = flag.String("filename", "", "specify a file to run (a source file, or a .moc file of bytecode built with `monkey build`)")
+
+// By default, programs are run without static type checking, but the type checker can be enabled if desired.
+var check = flag.Bool("check", false, "statically type check programs before running them")
+
+// By default, assert statements are checked, but they can be stripped at compile time for speed.
+var noAsserts = flag.Bool("no-asserts", false, "strip assert statements when compiling programs (or skip them when evaluating)")
+
+// By default, programs are optimized as they're compiled, but the optimizations can be disabled if desired.
+var noOptimizations = flag.Bool("O0", false, "disable compiler optimizations (constant folding, dead-code elimination, peephole optimizations and superinstructions)")
 
 // Entrypoint for the Monkey interpreter program.
 func main() {
 	flag.Parse()
 
+	// `monkey expand [-once] file.mo` prints the program in the file after macro expansion
+	if flag.Arg(0) == "expand" {
+		expandFlags := flag.NewFlagSet("expand", flag.ExitOnError)
+		once := expandFlags.Bool("once", false, "perform a single step of macro expansion")
+		expandFlags.Parse(flag.Args()[1:])
+		if expandFlags.NArg() != 1 {
+			fmt.Println("Usage: monkey expand [-once] <file>")
+			os.Exit(1)
+		}
+		repl.ExpandFile(os.Stdout, expandFlags.Arg(0), *once)
+		return
+	}
+
+	options := repl.Options{TypeCheck: *check, NoAsserts: *noAsserts, NoOptimizations: *noOptimizations}
+
+	// `monkey ir file.mo` prints the intermediate representation that the compiler generates for the program in the file
+	if flag.Arg(0) == "ir" {
+		if flag.NArg() != 2 {
+			fmt.Println("Usage: monkey [-O0] [--no-asserts] ir <file>")
+			os.Exit(1)
+		}
+		repl.PrintIR(os.Stdout, flag.Arg(1), options)
+		return
+	}
+
+	// `monkey build file.mo -o file.moc` compiles the program in the file to serialized bytecode, which can be run later
+	if flag.Arg(0) == "build" {
+		buildFlags := flag.NewFlagSet("build", flag.ExitOnError)
+		output := buildFlags.String("o", "", "the file to write the bytecode to (defaults to the source file with a .moc extension)")
+
+		// The output flag may come before or after the source file
+		buildFlags.Parse(flag.Args()[1:])
+		source := buildFlags.Arg(0)
+		if source != "" {
+			buildFlags.Parse(buildFlags.Args()[1:])
+		}
+		if source == "" || buildFlags.NArg() != 0 {
+			fmt.Println("Usage: monkey [-O0] [--no-asserts] [--check] build <file> [-o <output>]")
+			os.Exit(1)
+		}
+
+		if *output == "" {
+			*output = strings.TrimSuffix(source, filepath.Ext(source)) + ".moc"
+		}
+		if !repl.BuildFile(os.Stdout, source, *output, options) {
+			os.Exit(1)
+		}
+		return
+	}
+
+	if *engine != "vm" && *engine != "eval" {
+		fmt.Printf("Invalid engine to use: %q\n", *engine)
+		os.Exit(1)
+	}
+
 	if *filename != "" {
-		r, err := repl.NewREPL(os.Stdout)
-		if err != nil {
-			fmt.Println(err)
+		if !runFile(os.Stdout, *engine, *filename, options) {
 			os.Exit(1)
 		}
-		r.ExecuteFile(*filename)
 		return
 	}
 
@@ -37,16 +101,28 @@ func main() {
 	fmt.Printf("Feel free to type in commands!\n")
 
 	if *engine == "vm" {
-		r, err := repl.NewREPL(os.Stdout)
+		r, err := repl.NewREPL(os.Stdout, options)
 		if err != nil {
 			fmt.Println(err)
 			os.Exit(1)
 		}
 		r.Start()
-	} else if *engine == "eval" {
-		repl.StartInterpreter(os.Stdin, os.Stdout)
 	} else {
-		fmt.Printf("Invalid engine to use for REPL: %q\n", *engine)
-		os.Exit(1)
+		repl.StartInterpreter(os.Stdin, os.Stdout, options)
+	}
+}
+
+// Runs the program in the given file with the given engine ('vm' or 'eval'), reporting whether it ran successfully.
+// Any errors (e.g. failing to load, compile or run the program) are printed to the output.
+func runFile(out io.Writer, engine string, filename string, options repl.Options) bool {
+	if engine == "eval" {
+		return repl.EvaluateFile(out, filename, options)
+	}
+
+	r, err := repl.NewREPL(out, options)
+	if err != nil {
+		fmt.Fprintln(out, err)
+		return false
 	}
+	return r.ExecuteFile(filename)
 }
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"monkey/repl"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRunFileEngines(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "program.mo")
+	if err := os.WriteFile(filename, []byte("let x = 2;\n-true"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		engine   string
+		expected string
+	}{
+		{"eval", "Whoops! Evaluation failed:\n " + filename + ":2:0: unsupported type for negation: BOOLEAN\n"},
+		{"vm", "Whoops! Executing bytecode failed:\n " + filename + ":2:0: unsupported type for negation: BOOLEAN\n"},
+	}
+
+	for _, test := range tests {
+		var out bytes.Buffer
+		if runFile(&out, test.engine, filename, repl.Options{}) {
+			t.Errorf("expected running the failing program with engine %q to report a failure", test.engine)
+		}
+		if out.String() != test.expected {
+			t.Errorf("wrong output with engine %q. expected=%q, got=%q", test.engine, test.expected, out.String())
+		}
+	}
+
+	// Bytecode files can only be run by the VM
+	bytecodeFilename := strings.TrimSuffix(filename, ".mo") + ".moc"
+	if !repl.BuildFile(&bytes.Buffer{}, filename, bytecodeFilename, repl.Options{}) {
+		t.Fatalf("failed to build %s", filename)
+	}
+	var out bytes.Buffer
+	if runFile(&out, "eval", bytecodeFilename, repl.Options{}) {
+		t.Errorf("expected running a bytecode file with the evaluator to report a failure")
+	}
+	if !strings.Contains(out.String(), "can only be run with the vm engine") {
+		t.Errorf("expected bytecode file to be rejected by the evaluator. got=%q", out.String())
+	}
+}
+
+func TestRunFileFailures(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "program.mo")
+	if err := os.WriteFile(filename, []byte("let x = 2;\nputs(x * 3);"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, engine := range []string{"vm", "eval"} {
+		var out bytes.Buffer
+		if !runFile(&out, engine, filename, repl.Options{}) {
+			t.Errorf("expected running the program with engine %q to succeed. got=%q", engine, out.String())
+		}
+	}
+
+	// A corrupted bytecode file fails to load
+	bytecodeFilename := filepath.Join(dir, "program.moc")
+	if !repl.BuildFile(&bytes.Buffer{}, filename, bytecodeFilename, repl.Options{}) {
+		t.Fatalf("failed to build %s", filename)
+	}
+	data, err := os.ReadFile(bytecodeFilename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[len(data)-1] ^= 0xff
+	if err := os.WriteFile(bytecodeFilename, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		filename string
+		expected string
+	}{
+		{bytecodeFilename, "checksum mismatch"},
+		{filepath.Join(dir, "missing.mo"), "Error reading from file"},
+		{writeProgram(t, dir, "undefined.mo", "puts(y);"), "undefined variable: y"},
+	}
+
+	for _, test := range tests {
+		var out bytes.Buffer
+		if runFile(&out, "vm", test.filename, repl.Options{}) {
+			t.Errorf("expected running %s to report a failure", filepath.Base(test.filename))
+		}
+		if !strings.Contains(out.String(), test.expected) {
+			t.Errorf("wrong output running %s. expected it to contain %q, got=%q", filepath.Base(test.filename), test.expected, out.String())
+		}
+	}
+}
+
+func writeProgram(t *testing.T, dir string, name string, input string) string {
+	t.Helper()
+
+	filename := filepath.Join(dir, name)
+	if err := os.WriteFile(filename, []byte(input), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return filename
+}
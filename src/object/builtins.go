@@ -45,6 +45,18 @@ var BuiltIns = []struct {
 		"sum",
 		sum,
 	},
+	{
+		"union",
+		union,
+	},
+	{
+		"intersection",
+		intersection,
+	},
+	{
+		"difference",
+		difference,
+	},
 }
 
 func GetBuiltInByName(name string) *BuiltIn {
@@ -61,26 +73,41 @@ func newError(format string, a ...interface{}) *Error {
 }
 
 var puts = &BuiltIn{
-	Fn: func(args ...Object) Object {
+	HookedFn: func(caller HookCaller, args ...Object) Object {
 		if len(args) == 0 {
 			return newError("need at least one argument provided to `puts`")
 		}
 
 		for _, arg := range args {
-			fmt.Print(arg.Inspect())
+			str, err := InspectWithHooks(caller, arg)
+			if err != nil {
+				return newError("%s", err)
+			}
+			fmt.Fprint(caller.Output(), str)
 		}
-		fmt.Println()
+		fmt.Fprintln(caller.Output())
 
 		return nil
 	},
 }
 
 var length = &BuiltIn{
-	Fn: func(args ...Object) Object {
+	HookedFn: func(caller HookCaller, args ...Object) Object {
 		if len(args) != 1 {
 			return newError("wrong number of arguments. expected=1, got=%d", len(args))
 		}
 
+		if hook, ok := LookUpHook(args[0], LengthHook); ok {
+			result, err := caller.CallHook(hook, args[0])
+			if err != nil {
+				return newError("%s", err)
+			}
+			if _, ok := result.(*Integer); !ok {
+				return newError("%s must return an integer, got %s", LengthHook, result.Type())
+			}
+			return result
+		}
+
 		switch arg := args[0].(type) {
 		case *String:
 			return &Integer{Value: int64(len(arg.Value))}
@@ -88,6 +115,8 @@ var length = &BuiltIn{
 			return &Integer{Value: int64(len(arg.Elements))}
 		case *HashMap:
 			return &Integer{Value: int64(len(arg.KVPairs))}
+		case *Set:
+			return &Integer{Value: int64(len(arg.Elements))}
 		default:
 			return newError("argument to `len` is not supported, got %s", arg.Type())
 		}
@@ -275,3 +304,51 @@ var sum = &BuiltIn{
 		}
 	},
 }
+
+var union = &BuiltIn{
+	Fn: func(args ...Object) Object {
+		left, right, err := setOperands("union", args)
+		if err != nil {
+			return err
+		}
+		return left.Union(right)
+	},
+}
+
+var intersection = &BuiltIn{
+	Fn: func(args ...Object) Object {
+		left, right, err := setOperands("intersection", args)
+		if err != nil {
+			return err
+		}
+		return left.Intersection(right)
+	},
+}
+
+var difference = &BuiltIn{
+	Fn: func(args ...Object) Object {
+		left, right, err := setOperands("difference", args)
+		if err != nil {
+			return err
+		}
+		return left.Difference(right)
+	},
+}
+
+func setOperands(name string, args []Object) (*Set, *Set, *Error) {
+	if len(args) != 2 {
+		return nil, nil, newError("wrong number of arguments. expected=2, got=%d", len(args))
+	}
+
+	left, ok := args[0].(*Set)
+	if !ok {
+		return nil, nil, newError("first argument to `%s` must be a set, got %s", name, args[0].Type())
+	}
+
+	right, ok := args[1].(*Set)
+	if !ok {
+		return nil, nil, newError("second argument to `%s` must be a set, got %s", name, args[1].Type())
+	}
+
+	return left, right, nil
+}
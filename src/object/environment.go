@@ -1,19 +1,51 @@
 package object
 
-// Represents an environment in which bindings can be set.
+import (
+	"io"
+	"os"
+)
+
+// Represents the kind of a binding in an environment, which determines whether the binding can be assigned a new value.
+type BindingKind int
+
+const (
+	VariableBinding     BindingKind = iota // declared with `let`, as a function parameter, or as a function declaration
+	ConstantBinding                        // declared with `const`
+	FunctionNameBinding                    // the name of a function, bound within its own body so that it can recurse
+)
+
+// Represents an environment in which bindings can be set. Many environments (e.g. those of blocks) never hold any
+// bindings, so their maps are only allocated once needed.
 type Environment struct {
-	store map[string]Object
-	outer *Environment
+	store    map[string]Object
+	kinds    map[string]BindingKind // Only records bindings that aren't variables.
+	outer    *Environment
+	isBlock  bool            // Whether this environment belongs to a block (e.g. the body of a loop) rather than a function.
+	deferred []*DeferredCall // The calls deferred by the function (or program) that this environment belongs to.
+
+	noAsserts bool      // Whether assert statements are skipped rather than checked (inherited by enclosed environments).
+	output    io.Writer // The writer to which the program prints (inherited by enclosed environments).
+	filename  string    // The name of the file being run, if any (inherited by enclosed environments).
 }
 
 func NewEnvironment() *Environment {
-	s := make(map[string]Object)
-	return &Environment{store: s, outer: nil}
+	return &Environment{outer: nil, output: os.Stdout}
 }
 
 func NewEnclosedEnvironment(outer *Environment) *Environment {
 	env := NewEnvironment()
 	env.outer = outer
+	env.noAsserts = outer.noAsserts
+	env.output = outer.output
+	env.filename = outer.filename
+	return env
+}
+
+// Creates the environment of a block (e.g. the consequence of a conditional or the body of a loop), whose bindings are
+// released once the block ends. Calls deferred within a block belong to the enclosing function.
+func NewBlockEnvironment(outer *Environment) *Environment {
+	env := NewEnclosedEnvironment(outer)
+	env.isBlock = true
 	return env
 }
 
@@ -26,6 +58,104 @@ func (e *Environment) Get(name string) (Object, bool) {
 }
 
 func (e *Environment) Set(name string, obj Object) Object {
+	return e.SetBinding(name, obj, VariableBinding)
+}
+
+// Sets a binding of the given kind in this environment.
+func (e *Environment) SetBinding(name string, obj Object, kind BindingKind) Object {
+	if e.store == nil {
+		e.store = make(map[string]Object)
+	}
 	e.store[name] = obj
+
+	if kind != VariableBinding {
+		if e.kinds == nil {
+			e.kinds = make(map[string]BindingKind)
+		}
+		e.kinds[name] = kind
+	} else if e.kinds != nil {
+		delete(e.kinds, name)
+	}
+
 	return obj
 }
+
+// Reports whether a variable or constant with the given name has been declared in this environment itself (as opposed
+// to an enclosing environment), in which case the name can't be declared again.
+func (e *Environment) IsDeclared(name string) bool {
+	_, ok := e.store[name]
+	return ok && e.kinds[name] != FunctionNameBinding
+}
+
+// Returns the kind of the innermost binding with the given name, if there is one.
+func (e *Environment) Kind(name string) (BindingKind, bool) {
+	if _, ok := e.store[name]; ok {
+		return e.kinds[name], true
+	}
+	if e.outer != nil {
+		return e.outer.Kind(name)
+	}
+	return VariableBinding, false
+}
+
+// Assigns a new value to the innermost binding with the given name, reporting whether there is such a binding.
+func (e *Environment) Assign(name string, obj Object) bool {
+	if _, ok := e.store[name]; ok {
+		e.store[name] = obj
+		return true
+	}
+	if e.outer != nil {
+		return e.outer.Assign(name, obj)
+	}
+	return false
+}
+
+// Makes assert statements evaluated in this environment (and the environments it encloses, including those of the
+// functions defined in it) be skipped rather than checked, like compiling with the `NoAsserts` option.
+func (e *Environment) DisableAsserts() {
+	e.noAsserts = true
+}
+
+func (e *Environment) AssertsDisabled() bool {
+	return e.noAsserts
+}
+
+// Makes the program evaluated in this environment (and the environments it encloses) print to the given writer
+// rather than to standard output.
+func (e *Environment) SetOutput(w io.Writer) {
+	e.output = w
+}
+
+func (e *Environment) Output() io.Writer {
+	return e.output
+}
+
+// Records the name of the file whose program is evaluated in this environment (and the environments it encloses), so
+// that the errors it reports include it, like compiling with the `Filename` option.
+func (e *Environment) SetFilename(filename string) {
+	e.filename = filename
+}
+
+func (e *Environment) Filename() string {
+	return e.filename
+}
+
+// Records a call to run when the function (or program) that this environment belongs to finishes.
+func (e *Environment) Defer(call *DeferredCall) {
+	if e.isBlock && e.outer != nil {
+		e.outer.Defer(call)
+		return
+	}
+	e.deferred = append(e.deferred, call)
+}
+
+// Removes and returns the calls deferred in this environment, in the order in which they should run (i.e. the most
+// recently deferred call first).
+func (e *Environment) TakeDeferred() []*DeferredCall {
+	calls := make([]*DeferredCall, len(e.deferred))
+	for i, call := range e.deferred {
+		calls[len(e.deferred)-1-i] = call
+	}
+	e.deferred = nil
+	return calls
+}
@@ -0,0 +1,73 @@
+package object
+
+import (
+	"fmt"
+	"monkey/bytecode"
+	"strings"
+)
+
+// The name given to the program's top-level code in stack traces.
+const MainFunctionName = "<main>"
+
+// The number of times that a frame is repeated in a formatted stack trace (e.g. by deep recursion) before the rest of
+// its repetitions are elided.
+const maxRepeatedFrames = 3
+
+// Represents a call which was active when a runtime error occurred.
+type StackFrame struct {
+	Function string            // the name of the function (empty for anonymous functions)
+	Position bytecode.Position // the position being run in the function (zero if unknown)
+}
+
+func (sf StackFrame) format(filename string) string {
+	name := sf.Function
+	if name == "" {
+		name = "<anonymous>"
+	}
+	if sf.Position == (bytecode.Position{}) {
+		return name
+	}
+	return fmt.Sprintf("%s (%s)", name, sf.Position.Format(filename))
+}
+
+// Represents an error which aborted a running program, along with the stack trace of the calls that were active when
+// it occurred.
+type RuntimeError struct {
+	Message  string
+	Position bytecode.Position // where the error occurred (zero if unknown, or if the message already includes it)
+	Filename string            // the name of the file the program was compiled from (if any)
+	Trace    []StackFrame      // the active calls, innermost first and ending with the top-level code
+}
+
+// Returns the error's message, prefixed with the location at which it occurred if it's known.
+func (re *RuntimeError) Error() string {
+	if re.Position == (bytecode.Position{}) {
+		return re.Message
+	}
+	return re.Position.Format(re.Filename) + ": " + re.Message
+}
+
+// Formats the stack trace, with one line per frame (innermost first). Consecutive repetitions of a frame beyond the
+// first few are elided.
+func (re *RuntimeError) StackTrace() string {
+	var out strings.Builder
+	out.WriteString("stack trace (most recent call first):\n")
+
+	for i := 0; i < len(re.Trace); {
+		repeats := 1
+		for i+repeats < len(re.Trace) && re.Trace[i+repeats] == re.Trace[i] {
+			repeats++
+		}
+
+		for j := 0; j < min(repeats, maxRepeatedFrames); j++ {
+			out.WriteString("    at " + re.Trace[i].format(re.Filename) + "\n")
+		}
+		if repeats > maxRepeatedFrames {
+			out.WriteString(fmt.Sprintf("    ... (repeated %d more times)\n", repeats-maxRepeatedFrames))
+		}
+
+		i += repeats
+	}
+
+	return out.String()
+}
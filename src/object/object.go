@@ -20,11 +20,13 @@ const (
 	STRING_OBJ            = "STRING"
 	ARRAY_OBJ             = "ARRAY"
 	HASHMAP_OBJ           = "HASHMAP"
+	SET_OBJ               = "SET"
 	RETURN_VALUE_OBJ      = "RETURN_VALUE"
 	FUNCTION_OBJ          = "FUNCTION"
 	COMPILED_FUNCTION_OBJ = "COMPILED_FUNCTION_OBJ"
 	BUILTIN_OBJ           = "BUILTIN"
 	CLOSURE_OBJ           = "CLOSURE"
+	UPVALUE_OBJ           = "UPVALUE"
 	QUOTE_OBJ             = "QUOTE"
 	MACRO_OBJ             = "MACRO"
 	ERROR_OBJ             = "ERROR"
@@ -171,11 +173,12 @@ func (hm *HashMap) Type() ObjectType {
 	return HASHMAP_OBJ
 }
 
+// Pairs are listed in the sorted order of their keys so that the output is deterministic.
 func (hm *HashMap) Inspect() string {
 	var out bytes.Buffer
 
 	pairs := []string{}
-	for _, pair := range hm.KVPairs {
+	for _, pair := range hm.SortedPairs() {
 		pairs = append(pairs, pair.Key.Inspect()+": "+pair.Value.Inspect())
 	}
 
@@ -186,6 +189,98 @@ func (hm *HashMap) Inspect() string {
 	return out.String()
 }
 
+// Returns the key-value pairs of the hashmap, ordered by their keys first by type and then by value.
+func (hm *HashMap) SortedPairs() []HashMapPair {
+	keys := make([]Object, 0, len(hm.KVPairs))
+	pairsByKey := make(map[Object]HashMapPair, len(hm.KVPairs))
+	for _, pair := range hm.KVPairs {
+		keys = append(keys, pair.Key)
+		pairsByKey[pair.Key] = pair
+	}
+	sortObjects(keys)
+
+	pairs := make([]HashMapPair, len(keys))
+	for i, key := range keys {
+		pairs[i] = pairsByKey[key]
+	}
+	return pairs
+}
+
+// Represents a set of hashable values, keyed by their hash keys.
+type Set struct {
+	Elements map[HashKey]Object
+}
+
+func NewSet() *Set {
+	return &Set{Elements: make(map[HashKey]Object)}
+}
+
+func (s *Set) Type() ObjectType {
+	return SET_OBJ
+}
+
+// Elements are listed in sorted order so that the output is deterministic.
+func (s *Set) Inspect() string {
+	var out bytes.Buffer
+
+	elements := []string{}
+	for _, el := range s.SortedElements() {
+		elements = append(elements, el.Inspect())
+	}
+
+	out.WriteString("#{")
+	out.WriteString(strings.Join(elements, ", "))
+	out.WriteString("}")
+
+	return out.String()
+}
+
+// Returns the elements of the set, ordered first by type and then by value.
+func (s *Set) SortedElements() []Object {
+	elements := make([]Object, 0, len(s.Elements))
+	for _, el := range s.Elements {
+		elements = append(elements, el)
+	}
+	sortObjects(elements)
+	return elements
+}
+
+func (s *Set) Contains(obj Hashable) bool {
+	_, ok := s.Elements[obj.HashKey()]
+	return ok
+}
+
+func (s *Set) Union(other *Set) *Set {
+	result := NewSet()
+	for key, el := range s.Elements {
+		result.Elements[key] = el
+	}
+	for key, el := range other.Elements {
+		result.Elements[key] = el
+	}
+	return result
+}
+
+func (s *Set) Intersection(other *Set) *Set {
+	result := NewSet()
+	for key, el := range s.Elements {
+		if _, ok := other.Elements[key]; ok {
+			result.Elements[key] = el
+		}
+	}
+	return result
+}
+
+func (s *Set) Difference(other *Set) *Set {
+	result := NewSet()
+	for key, el := range s.Elements {
+		if _, ok := other.Elements[key]; !ok {
+			result.Elements[key] = el
+		}
+	}
+	return result
+}
+
 // Represents a value that should be returned by a given return statement.
 type ReturnValue struct {
 	Value Object
@@ -201,6 +296,7 @@ func (rv *ReturnValue) Inspect() string {
 
 // Represents a function.
 type Function struct {
+	Name       string // the name the function is bound to within its own body, if it has one
 	Parameters []*ast.Identifier
 	Body       *ast.BlockStatement
 	Env        *Environment
@@ -230,9 +326,12 @@ func (f *Function) Inspect() string {
 
 // Represents a compiled function, containing some bytecode instructions.
 type CompiledFunction struct {
+	Name          string // The name the function was declared with or bound to (empty for anonymous functions)
 	Instructions  bytecode.Instructions
 	NumLocals     int // The number of local bindings this function is going to create/use
 	NumParameters int
+
+	Positions bytecode.PositionTable // The positions in the source code of the function's instructions
 }
 
 func (cf *CompiledFunction) Type() ObjectType {
@@ -246,9 +345,21 @@ func (cf *CompiledFunction) Inspect() string {
 // Represents a function built into the Monkey programming language implementation.
 type BuiltInFunction func(args ...Object) Object
 
-// Wraps a built-in function.
+// Represents a built-in function which calls the hooks of user types, e.g. `len` calling `__len__`.
+type HookedBuiltInFunction func(caller HookCaller, args ...Object) Object
+
+// Wraps a built-in function. Exactly one of Fn and HookedFn is set.
 type BuiltIn struct {
-	Fn BuiltInFunction
+	Fn       BuiltInFunction
+	HookedFn HookedBuiltInFunction
+}
+
+// Calls the built-in function, using the provided caller to call the hooks of user types if necessary.
+func (bi *BuiltIn) Call(caller HookCaller, args ...Object) Object {
+	if bi.HookedFn != nil {
+		return bi.HookedFn(caller, args...)
+	}
+	return bi.Fn(args...)
 }
 
 func (bi *BuiltIn) Type() ObjectType {
@@ -259,10 +370,18 @@ func (bi *BuiltIn) Inspect() string {
 	return "built-in function"
 }
 
-// Represents a closure, which consists of a compiled function and some free variables that it carries around.
+// Represents a closure, which consists of a compiled function and the upvalues (captured free variables) that it
+// carries around.
+// Represents a function call postponed by a `defer` statement until the function containing the statement returns.
+// The function and its arguments are evaluated when the statement runs.
+type DeferredCall struct {
+	Fn   Object
+	Args []Object
+}
+
 type Closure struct {
 	Fn       *CompiledFunction
-	FreeVars []Object
+	Upvalues []*Upvalue
 }
 
 func (c *Closure) Type() ObjectType {
@@ -273,6 +392,41 @@ func (c *Closure) Inspect() string {
 	return fmt.Sprintf("Closure[%p]", c)
 }
 
+// Represents a variable captured by a closure. While the scope declaring the variable is still active, the upvalue
+// is open and points to the variable's slot on the VM stack, so that the closure and its enclosing function share
+// any updates to the variable. Once that scope ends, the upvalue is closed: the variable's value is moved into the
+// upvalue itself, where it lives on for as long as the closures referencing it do.
+type Upvalue struct {
+	Location *Object
+	Slot     int // The index of the variable's stack slot while the upvalue is open.
+
+	closed Object
+}
+
+func NewOpenUpvalue(location *Object, slot int) *Upvalue {
+	return &Upvalue{Location: location, Slot: slot}
+}
+
+func NewClosedUpvalue(value Object) *Upvalue {
+	u := &Upvalue{Slot: -1, closed: value}
+	u.Location = &u.closed
+	return u
+}
+
+func (u *Upvalue) Close() {
+	u.closed = *u.Location
+	u.Location = &u.closed
+	u.Slot = -1
+}
+
+func (u *Upvalue) Type() ObjectType {
+	return UPVALUE_OBJ
+}
+
+func (u *Upvalue) Inspect() string {
+	return fmt.Sprintf("Upvalue[%p]", u)
+}
+
 // Represents some code (an AST node) that is quoted & not yet evaluated.
 type Quote struct {
 	Node ast.Node
@@ -318,6 +472,8 @@ func (m *Macro) Inspect() string {
 // Represents an error encountered while evaluating a program.
 type Error struct {
 	Message string
+	Trace   []StackFrame // the calls the error has been propagated through, innermost first (see `RuntimeError`)
+	Located bool         // whether the message already starts with the location of the error
 }
 
 func (e *Error) Type() ObjectType {
@@ -327,3 +483,13 @@ func (e *Error) Type() ObjectType {
 func (e *Error) Inspect() string {
 	return "ERROR: " + e.Message
 }
+
+// Returns the error as a runtime error, along with the stack trace recorded by the evaluator. The error occurred at the
+// position recorded for the innermost call, unless its message already includes its location.
+func (e *Error) RuntimeError() *RuntimeError {
+	runtimeErr := &RuntimeError{Message: e.Message, Trace: e.Trace}
+	if !e.Located && len(e.Trace) > 0 {
+		runtimeErr.Position = e.Trace[0].Position
+	}
+	return runtimeErr
+}
@@ -1,6 +1,9 @@
 package object
 
-import "testing"
+import (
+	"monkey/bytecode"
+	"testing"
+)
 
 func TestStringHashKey(t *testing.T) {
 	hello1 := &String{Value: "Hello World"}
@@ -58,3 +61,67 @@ func TestIntegerHashKey(t *testing.T) {
 		t.Errorf("integers with different content have the same hash keys")
 	}
 }
+
+func TestSetInspect(t *testing.T) {
+	set := NewSet()
+	for _, el := range []Object{&Integer{Value: 10}, &String{Value: "b"}, &Integer{Value: -2}, &Boolean{Value: true}, &String{Value: "a"}, &Integer{Value: 9}} {
+		set.Elements[el.(Hashable).HashKey()] = el
+	}
+
+	expected := "#{true, -2, 9, 10, a, b}"
+	for i := 0; i < 10; i++ {
+		if set.Inspect() != expected {
+			t.Fatalf("set.Inspect() is wrong. expected=%q, got=%q", expected, set.Inspect())
+		}
+	}
+}
+
+func TestHashMapInspect(t *testing.T) {
+	hashMap := &HashMap{KVPairs: map[HashKey]HashMapPair{}}
+	for i, key := range []Object{&Integer{Value: 10}, &String{Value: "b"}, &Integer{Value: -2}, &Boolean{Value: true}, &String{Value: "a"}} {
+		hashMap.KVPairs[key.(Hashable).HashKey()] = HashMapPair{Key: key, Value: &Integer{Value: int64(i)}}
+	}
+
+	// Pairs are listed in the order of their keys, regardless of the order in which they were inserted
+	expected := "{true: 3, -2: 2, 10: 0, a: 4, b: 1}"
+	for i := 0; i < 10; i++ {
+		if hashMap.Inspect() != expected {
+			t.Fatalf("hashMap.Inspect() is wrong. expected=%q, got=%q", expected, hashMap.Inspect())
+		}
+	}
+}
+
+func TestRuntimeError(t *testing.T) {
+	frame := func(function string, line int) StackFrame {
+		return StackFrame{Function: function, Position: bytecode.Position{Line: line, Column: 4}}
+	}
+
+	err := &RuntimeError{
+		Message:  "division by zero",
+		Position: bytecode.Position{Line: 2, Column: 4},
+		Filename: "main.mo",
+		Trace:    []StackFrame{frame("f", 2), frame("r", 5), frame("r", 5), frame("r", 5), frame("r", 5), frame("r", 5), {Function: ""}, frame(MainFunctionName, 9)},
+	}
+
+	if err.Error() != "main.mo:2:4: division by zero" {
+		t.Errorf("wrong error. expected=%q, got=%q", "main.mo:2:4: division by zero", err.Error())
+	}
+
+	expected := `stack trace (most recent call first):
+    at f (main.mo:2:4)
+    at r (main.mo:5:4)
+    at r (main.mo:5:4)
+    at r (main.mo:5:4)
+    ... (repeated 2 more times)
+    at <anonymous>
+    at <main> (main.mo:9:4)
+`
+	if err.StackTrace() != expected {
+		t.Errorf("wrong stack trace.\nexpected=%q\ngot=%q", expected, err.StackTrace())
+	}
+
+	err.Position = bytecode.Position{}
+	if err.Error() != "division by zero" {
+		t.Errorf("wrong error. expected=%q, got=%q", "division by zero", err.Error())
+	}
+}
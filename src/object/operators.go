@@ -0,0 +1,409 @@
+package object
+
+import (
+	"fmt"
+	"math"
+	"monkey/ast"
+)
+
+// The boolean and null objects, shared by both the evaluator and the VM. Booleans and null are always represented by
+// these objects, so that they can be compared by identity.
+var (
+	TRUE  = &Boolean{Value: true}
+	FALSE = &Boolean{Value: false}
+	NULL  = &Null{}
+)
+
+// The formats of the errors reported when an object can't be used as a hashmap key or a set element.
+const (
+	UnusableHashKeyFormat    = "unusable as hash key: %s"
+	UnusableSetElementFormat = "unusable as set element: %s"
+)
+
+// The semantics of the operators below are shared by the evaluator and the VM, so that both engines produce the same
+// results and report the same errors. The operators are identified by their symbols in the source code.
+
+// The hooks through which user types implement the arithmetic operators.
+var binaryOperationHooks = map[string]string{
+	"+":  AddHook,
+	"-":  SubHook,
+	"*":  MulHook,
+	"/":  DivHook,
+	"//": IntegerDivHook,
+	"**": ExpHook,
+	"%":  ModHook,
+}
+
+func NativeBoolToBooleanObject(input bool) *Boolean {
+	if input {
+		return TRUE
+	}
+	return FALSE
+}
+
+// Reports whether the object counts as true in a condition: everything other than false and null does.
+func IsTruthy(obj Object) bool {
+	switch obj := obj.(type) {
+	case *Boolean:
+		return obj.Value
+	case *Null:
+		return false
+	default:
+		return true
+	}
+}
+
+// Applies one of the arithmetic operators (`+`, `-`, `*`, `/`, `//`, `**`, `%`) or set operators (`|`, `&`, `-`).
+func BinaryOperation(caller HookCaller, operator string, left Object, right Object) (Object, error) {
+	leftType := left.Type()
+	rightType := right.Type()
+
+	switch {
+	case IsNumerical(leftType) && IsNumerical(rightType):
+		return binaryNumericalOperation(operator, left, right)
+	case leftType == STRING_OBJ && rightType == STRING_OBJ:
+		return binaryStringOperation(operator, left, right)
+	case leftType == ARRAY_OBJ && rightType == ARRAY_OBJ:
+		return binaryArrayOperation(operator, left, right)
+	case leftType == SET_OBJ && rightType == SET_OBJ:
+		return binarySetOperation(operator, left, right)
+	}
+
+	if hook, ok := LookUpBinaryHook(left, right, binaryOperationHooks[operator]); ok {
+		return caller.CallHook(hook, left, right)
+	}
+
+	return nil, fmt.Errorf("unsupported types for binary operation: %s %s", leftType, rightType)
+}
+
+func binaryNumericalOperation(operator string, left Object, right Object) (Object, error) {
+	var result float64
+
+	leftValue, leftIsFloat, _ := GetNumericalValue(left)
+	rightValue, rightIsFloat, _ := GetNumericalValue(right)
+
+	isFloatOperation := leftIsFloat || rightIsFloat
+
+	switch operator {
+	case "+":
+		result = leftValue + rightValue
+	case "-":
+		result = leftValue - rightValue
+	case "*":
+		result = leftValue * rightValue
+	case "/":
+		if rightValue == 0 {
+			return nil, fmt.Errorf("division by zero")
+		}
+		result = leftValue / rightValue
+		if !isFloatOperation && int64(leftValue)%int64(rightValue) != 0 {
+			isFloatOperation = true
+		}
+	case "//":
+		if rightValue == 0 {
+			return nil, fmt.Errorf("division by zero")
+		}
+		return &Integer{Value: int64(leftValue / rightValue)}, nil
+	case "**":
+		result = math.Pow(leftValue, rightValue)
+	case "%":
+		if isFloatOperation {
+			return nil, fmt.Errorf("modulus operation not supported for float values")
+		}
+		if rightValue == 0 {
+			return nil, fmt.Errorf("division by zero")
+		}
+		return &Integer{Value: int64(leftValue) % int64(rightValue)}, nil
+	default:
+		return nil, fmt.Errorf("unknown binary numerical operator: %s", operator)
+	}
+
+	if isFloatOperation {
+		return &Float{Value: result}, nil
+	}
+	return &Integer{Value: int64(result)}, nil
+}
+
+func binaryStringOperation(operator string, left Object, right Object) (Object, error) {
+	leftValue := left.(*String).Value
+	rightValue := right.(*String).Value
+
+	switch operator {
+	case "+":
+		return &String{Value: leftValue + rightValue}, nil
+	default:
+		return nil, fmt.Errorf("unknown binary string operator: %s", operator)
+	}
+}
+
+func binaryArrayOperation(operator string, left Object, right Object) (Object, error) {
+	leftElements := left.(*Array).Elements
+	rightElements := right.(*Array).Elements
+
+	switch operator {
+	case "+":
+		elements := make([]Object, 0, len(leftElements)+len(rightElements))
+		elements = append(elements, leftElements...)
+		elements = append(elements, rightElements...)
+		return &Array{Elements: elements}, nil
+	default:
+		return nil, fmt.Errorf("unknown binary array operator: %s", operator)
+	}
+}
+
+func binarySetOperation(operator string, left Object, right Object) (Object, error) {
+	leftSet := left.(*Set)
+	rightSet := right.(*Set)
+
+	switch operator {
+	case "|":
+		return leftSet.Union(rightSet), nil
+	case "&":
+		return leftSet.Intersection(rightSet), nil
+	case "-":
+		return leftSet.Difference(rightSet), nil
+	default:
+		return nil, fmt.Errorf("unknown binary set operator: %s", operator)
+	}
+}
+
+// Applies one of the logical operators (`&&`, `||`), which are only supported for booleans. Both operands are always
+// evaluated (i.e. the operators don't short-circuit).
+func LogicalOperation(operator string, left Object, right Object) (Object, error) {
+	leftBoolean, leftOk := left.(*Boolean)
+	rightBoolean, rightOk := right.(*Boolean)
+	if !leftOk || !rightOk {
+		return nil, fmt.Errorf("unsupported types for logical operation: %s %s", left.Type(), right.Type())
+	}
+
+	switch operator {
+	case "&&":
+		return NativeBoolToBooleanObject(leftBoolean.Value && rightBoolean.Value), nil
+	case "||":
+		return NativeBoolToBooleanObject(leftBoolean.Value || rightBoolean.Value), nil
+	default:
+		return nil, fmt.Errorf("unknown logical boolean operator: %s", operator)
+	}
+}
+
+// Applies one of the comparison operators (`==`, `!=`, `<`, `>`, `<=`, `>=`).
+func Comparison(caller HookCaller, operator string, left Object, right Object) (Object, error) {
+	leftType := left.Type()
+	rightType := right.Type()
+
+	if IsNumerical(leftType) && IsNumerical(rightType) {
+		return numericalComparison(operator, left, right)
+	} else if leftType == BOOLEAN_OBJ && rightType == BOOLEAN_OBJ {
+		return booleanComparison(operator, left, right)
+	} else if leftType == STRING_OBJ && rightType == STRING_OBJ {
+		return stringComparison(operator, left, right)
+	}
+
+	result, handled, err := hookedComparison(caller, operator, left, right)
+	if handled || err != nil {
+		return result, err
+	}
+
+	return nil, fmt.Errorf("unsupported types for binary comparison: %s %s", leftType, rightType)
+}
+
+// Applies a comparison involving a user type through its `__eq__` or `__lt__` hook. Inequality is the negation of
+// `__eq__`, and the remaining orderings are derived from `__lt__` by swapping and/or negating its operands. Reports
+// whether a hook was found to apply the comparison.
+func hookedComparison(caller HookCaller, operator string, left Object, right Object) (Object, bool, error) {
+	hookName := LessThanHook
+	if operator == "==" || operator == "!=" {
+		hookName = EqualHook
+	}
+
+	hook, ok := LookUpBinaryHook(left, right, hookName)
+	if !ok {
+		return nil, false, nil
+	}
+
+	swapped := operator == ">" || operator == "<="
+	negated := operator == "!=" || operator == "<=" || operator == ">="
+
+	args := []Object{left, right}
+	if swapped {
+		args = []Object{right, left}
+	}
+
+	result, err := caller.CallHook(hook, args...)
+	if err != nil {
+		return nil, true, err
+	}
+
+	return NativeBoolToBooleanObject(IsTruthy(result) != negated), true, nil
+}
+
+func numericalComparison(operator string, left Object, right Object) (Object, error) {
+	leftValue, _, _ := GetNumericalValue(left)
+	rightValue, _, _ := GetNumericalValue(right)
+
+	switch operator {
+	case "==":
+		return NativeBoolToBooleanObject(floatEquality(leftValue, rightValue)), nil
+	case "!=":
+		return NativeBoolToBooleanObject(!floatEquality(leftValue, rightValue)), nil
+	case "<":
+		return NativeBoolToBooleanObject(leftValue < rightValue), nil
+	case ">":
+		return NativeBoolToBooleanObject(leftValue > rightValue), nil
+	case "<=":
+		return NativeBoolToBooleanObject(leftValue < rightValue || floatEquality(leftValue, rightValue)), nil
+	case ">=":
+		return NativeBoolToBooleanObject(leftValue > rightValue || floatEquality(leftValue, rightValue)), nil
+	default:
+		return nil, fmt.Errorf("unknown binary numerical comparison operator: %s", operator)
+	}
+}
+
+func booleanComparison(operator string, left Object, right Object) (Object, error) {
+	leftValue := left.(*Boolean).Value
+	rightValue := right.(*Boolean).Value
+
+	switch operator {
+	case "==":
+		return NativeBoolToBooleanObject(leftValue == rightValue), nil
+	case "!=":
+		return NativeBoolToBooleanObject(leftValue != rightValue), nil
+	default:
+		return nil, fmt.Errorf("unknown binary boolean comparison operator: %s", operator)
+	}
+}
+
+func stringComparison(operator string, left Object, right Object) (Object, error) {
+	leftValue := left.(*String).Value
+	rightValue := right.(*String).Value
+
+	switch operator {
+	case "==":
+		return NativeBoolToBooleanObject(leftValue == rightValue), nil
+	case "!=":
+		return NativeBoolToBooleanObject(leftValue != rightValue), nil
+	default:
+		return nil, fmt.Errorf("unknown binary string comparison operator: %s", operator)
+	}
+}
+
+func floatEquality(float1 float64, float2 float64) bool {
+	return math.Abs(float1-float2) <= ast.FLOAT_64_EQUALITY_THRESHOLD
+}
+
+// Applies the `in` operator, testing whether the element is in the container (a set, or the keys of a hashmap).
+func Membership(caller HookCaller, element Object, container Object) (Object, error) {
+	switch container := container.(type) {
+	case *Set:
+		key, err := RequireHashKey(caller, element, UnusableSetElementFormat)
+		if err != nil {
+			return nil, err
+		}
+		_, found := container.Elements[key]
+		return NativeBoolToBooleanObject(found), nil
+	case *HashMap:
+		key, err := RequireHashKey(caller, element, UnusableHashKeyFormat)
+		if err != nil {
+			return nil, err
+		}
+		_, found := container.KVPairs[key]
+		return NativeBoolToBooleanObject(found), nil
+	default:
+		return nil, fmt.Errorf("unsupported type for membership test: %s", container.Type())
+	}
+}
+
+// Applies the `-` prefix operator.
+func Negation(operand Object) (Object, error) {
+	switch operand := operand.(type) {
+	case *Integer:
+		return &Integer{Value: -operand.Value}, nil
+	case *Float:
+		return &Float{Value: -operand.Value}, nil
+	default:
+		return nil, fmt.Errorf("unsupported type for negation: %s", operand.Type())
+	}
+}
+
+// Applies the `!` prefix operator.
+func Not(operand Object) Object {
+	return NativeBoolToBooleanObject(!IsTruthy(operand))
+}
+
+// Applies the index operator. Indexing an array out of bounds, or a hashmap with a key that it doesn't contain,
+// produces null (unless the hashmap is a user type whose `__index__` hook handles the key).
+func Index(caller HookCaller, left Object, index Object) (Object, error) {
+	switch left := left.(type) {
+	case *Array:
+		i, ok := index.(*Integer)
+		if !ok {
+			break
+		}
+		if i.Value < 0 || i.Value >= int64(len(left.Elements)) {
+			return NULL, nil
+		}
+		return left.Elements[i.Value], nil
+
+	case *HashMap:
+		key, err := RequireHashKey(caller, index, UnusableHashKeyFormat)
+		if err != nil {
+			return nil, err
+		}
+
+		if pair, ok := left.KVPairs[key]; ok {
+			return pair.Value, nil
+		}
+
+		// User types can handle indexing with keys that they don't contain through their `__index__` hook
+		if hook, ok := LookUpHook(left, IndexHook); ok {
+			return caller.CallHook(hook, left, index)
+		}
+
+		return NULL, nil
+	}
+
+	return nil, fmt.Errorf("index operator not supported: %s", left.Type())
+}
+
+// Returns the hash key of the object like `HashKeyOf`, except that an object which isn't hashable is reported as an
+// error, formatted using the provided format and the object's type.
+func RequireHashKey(caller HookCaller, obj Object, unhashableFormat string) (HashKey, error) {
+	key, ok, err := HashKeyOf(caller, obj)
+	if err != nil {
+		return HashKey{}, err
+	}
+	if !ok {
+		return HashKey{}, fmt.Errorf(unhashableFormat, obj.Type())
+	}
+	return key, nil
+}
+
+// Builds a hashmap from its keys and the corresponding values.
+func NewHashMap(caller HookCaller, keys []Object, values []Object) (*HashMap, error) {
+	kvPairs := make(map[HashKey]HashMapPair, len(keys))
+
+	for i, key := range keys {
+		hashKey, err := RequireHashKey(caller, key, UnusableHashKeyFormat)
+		if err != nil {
+			return nil, err
+		}
+		kvPairs[hashKey] = HashMapPair{Key: key, Value: values[i]}
+	}
+
+	return &HashMap{KVPairs: kvPairs}, nil
+}
+
+// Builds a set of the given elements.
+func NewSetOf(caller HookCaller, elements []Object) (*Set, error) {
+	set := NewSet()
+
+	for _, element := range elements {
+		key, err := RequireHashKey(caller, element, UnusableSetElementFormat)
+		if err != nil {
+			return nil, err
+		}
+		set.Elements[key] = element
+	}
+
+	return set, nil
+}
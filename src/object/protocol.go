@@ -0,0 +1,160 @@
+package object
+
+import (
+	"bytes"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"strings"
+)
+
+// The names of the hooks through which user-defined types implement operators and built-in protocols. A user type
+// is a hashmap which maps one or more of these names to functions; for example, a hashmap with an "__add__" key
+// supports the `+` operator. Binary operator hooks are called with both operands, e.g. `__add__(left, right)`, and
+// the hook of the left operand takes precedence over that of the right operand.
+const (
+	AddHook        = "__add__"
+	SubHook        = "__sub__"
+	MulHook        = "__mul__"
+	DivHook        = "__div__"
+	IntegerDivHook = "__floordiv__"
+	ExpHook        = "__pow__"
+	ModHook        = "__mod__"
+	EqualHook      = "__eq__"
+	LessThanHook   = "__lt__"
+	StringHook     = "__str__"
+	LengthHook     = "__len__"
+	IndexHook      = "__index__"
+	HashHook       = "__hash__"
+)
+
+// Calls the functions implementing the hooks of user types. It is implemented by the engines executing Monkey
+// programs (the VM and the evaluator), since only they know how to call Monkey functions. The engines also provide
+// the writer to which the program prints (e.g. with `puts`).
+type HookCaller interface {
+	CallHook(hook Object, args ...Object) (Object, error)
+	Output() io.Writer
+}
+
+// Returns the function implementing the named hook, if the object is a user type which defines it.
+func LookUpHook(obj Object, name string) (Object, bool) {
+	hashmap, ok := obj.(*HashMap)
+	if !ok {
+		return nil, false
+	}
+
+	pair, ok := hashmap.KVPairs[(&String{Value: name}).HashKey()]
+	if !ok {
+		return nil, false
+	}
+	return pair.Value, true
+}
+
+// Returns the function implementing the named hook for a binary operation, preferring the left operand's hook.
+func LookUpBinaryHook(left Object, right Object, name string) (Object, bool) {
+	if hook, ok := LookUpHook(left, name); ok {
+		return hook, true
+	}
+	return LookUpHook(right, name)
+}
+
+// Returns the hash key of the object, calling its `__hash__` hook if it is a user type which implements one. User
+// types whose hooks return equal values are treated as the same hashmap key or set element. Reports false if the
+// object isn't hashable.
+func HashKeyOf(caller HookCaller, obj Object) (HashKey, bool, error) {
+	if hashable, ok := obj.(Hashable); ok {
+		return hashable.HashKey(), true, nil
+	}
+
+	hook, ok := LookUpHook(obj, HashHook)
+	if !ok {
+		return HashKey{}, false, nil
+	}
+
+	result, err := caller.CallHook(hook, obj)
+	if err != nil {
+		return HashKey{}, false, err
+	}
+
+	hashable, ok := result.(Hashable)
+	if !ok {
+		return HashKey{}, false, fmt.Errorf("%s must return a hashable value, got %s", HashHook, result.Type())
+	}
+
+	key := hashable.HashKey()
+	h := fnv.New64a()
+	fmt.Fprintf(h, "%s:%d", key.Type, key.Value)
+	return HashKey{Type: obj.Type(), Value: h.Sum64()}, true, nil
+}
+
+// Returns the string representation of the object like `Inspect`, except that the `__str__` hooks of user types
+// (including those nested within arrays, hashmaps, and sets) are used to represent them.
+func InspectWithHooks(caller HookCaller, obj Object) (string, error) {
+	if hook, ok := LookUpHook(obj, StringHook); ok {
+		result, err := caller.CallHook(hook, obj)
+		if err != nil {
+			return "", err
+		}
+
+		str, ok := result.(*String)
+		if !ok {
+			return "", fmt.Errorf("%s must return a string, got %s", StringHook, result.Type())
+		}
+		return str.Value, nil
+	}
+
+	var out bytes.Buffer
+
+	switch obj := obj.(type) {
+	case *Array:
+		elements, err := inspectAllWithHooks(caller, obj.Elements)
+		if err != nil {
+			return "", err
+		}
+
+		out.WriteString("[")
+		out.WriteString(strings.Join(elements, ", "))
+		out.WriteString("]")
+
+	case *HashMap:
+		pairs := []string{}
+		for _, pair := range obj.SortedPairs() {
+			kv, err := inspectAllWithHooks(caller, []Object{pair.Key, pair.Value})
+			if err != nil {
+				return "", err
+			}
+			pairs = append(pairs, kv[0]+": "+kv[1])
+		}
+
+		out.WriteString("{")
+		out.WriteString(strings.Join(pairs, ", "))
+		out.WriteString("}")
+
+	case *Set:
+		elements, err := inspectAllWithHooks(caller, obj.SortedElements())
+		if err != nil {
+			return "", err
+		}
+
+		out.WriteString("#{")
+		out.WriteString(strings.Join(elements, ", "))
+		out.WriteString("}")
+
+	default:
+		return obj.Inspect(), nil
+	}
+
+	return out.String(), nil
+}
+
+func inspectAllWithHooks(caller HookCaller, objs []Object) ([]string, error) {
+	result := []string{}
+	for _, obj := range objs {
+		str, err := InspectWithHooks(caller, obj)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, str)
+	}
+	return result, nil
+}
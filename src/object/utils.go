@@ -1,6 +1,12 @@
 package object
 
-import "fmt"
+import (
+	"fmt"
+	"monkey/ast"
+	"monkey/bytecode"
+	"sort"
+	"strings"
+)
 
 func IsNumerical(objectType ObjectType) bool {
 	return objectType == INTEGER_OBJ || objectType == FLOAT_OBJ
@@ -16,3 +22,65 @@ func GetNumericalValue(obj Object) (float64, bool, error) {
 		return 0, false, fmt.Errorf("unsupported numerical type: %s", obj.Type())
 	}
 }
+
+// Sorts objects in place, ordering first by type and then by value. Objects of types without a natural
+// ordering are ordered by their string representations.
+func sortObjects(objs []Object) {
+	sort.SliceStable(objs, func(i int, j int) bool {
+		left, right := objs[i], objs[j]
+		if left.Type() != right.Type() {
+			return left.Type() < right.Type()
+		}
+
+		switch left := left.(type) {
+		case *Integer:
+			return left.Value < right.(*Integer).Value
+		case *Float:
+			return left.Value < right.(*Float).Value
+		case *Boolean:
+			return !left.Value && right.(*Boolean).Value
+		case *String:
+			return left.Value < right.(*String).Value
+		default:
+			return left.Inspect() < right.Inspect()
+		}
+	})
+}
+
+// Returns the description of an assertion reported when it fails (by either engine): the position of the assertion in
+// the source code (including the name of the given file, if known), followed by the source text of the asserted
+// condition.
+func AssertionDescription(filename string, node *ast.AssertStatement) string {
+	position := bytecode.Position{Line: node.Token.LineNumber, Column: node.Token.ColumnNumber}
+	return fmt.Sprintf("%s: assertion failed: %s", position.Format(filename), node.Condition.String())
+}
+
+// Formats the error reported when an assertion fails, given its description (the location and source text of the
+// asserted condition), the value of its message (or nil), and the values of the identifiers referenced by the
+// condition. User types are inspected through their `__str__` hooks where possible.
+func FormatAssertionFailure(caller HookCaller, description string, message Object, names []string, values []Object) string {
+	var out strings.Builder
+
+	out.WriteString(description)
+	if message != nil {
+		out.WriteString(": " + inspectForAssertion(caller, message))
+	}
+
+	if len(names) > 0 {
+		bindings := make([]string, len(names))
+		for i, name := range names {
+			bindings[i] = name + " = " + inspectForAssertion(caller, values[i])
+		}
+		out.WriteString(" (where " + strings.Join(bindings, ", ") + ")")
+	}
+
+	return out.String()
+}
+
+func inspectForAssertion(caller HookCaller, obj Object) string {
+	str, err := InspectWithHooks(caller, obj)
+	if err != nil {
+		return obj.Inspect()
+	}
+	return str
+}
@@ -37,6 +37,59 @@ func TestParsingArrayLiterals(t *testing.T) {
 	testFloat(t, array.Elements[3], 6.97)
 }
 
+func TestParsingSetLiterals(t *testing.T) {
+	input := `#{1, 2 * 2, "hello"}`
+
+	l := lexer.NewLexer(input)
+	p := NewParser(l)
+	program := p.ParseProgram()
+	checkParserErrors(t, p)
+	if len(program.Statements) != 1 {
+		t.Fatalf("program contains wrong number of statements. expected=%d, got=%d", 1, len(program.Statements))
+	}
+
+	statement, ok := program.Statements[0].(*ast.ExpressionStatement)
+	if !ok {
+		t.Fatalf("program.Statements[0] is not an *ast.ExpressionStatement. got=%T", program.Statements[0])
+	}
+
+	set, ok := statement.Expression.(*ast.SetLiteral)
+	if !ok {
+		t.Fatalf("statement.Expression is not an ast.SetLiteral. got=%T", statement.Expression)
+	}
+
+	if len(set.Elements) != 3 {
+		t.Fatalf("len(set.Elements) is wrong. expected=3, got=%d", len(set.Elements))
+	}
+
+	testIntegerLiteral(t, set.Elements[0], 1)
+	testInfixExpression(t, set.Elements[1], 2, "*", 2)
+	testStringLiteral(t, set.Elements[2], "hello")
+}
+
+func TestParsingEmptySetLiteral(t *testing.T) {
+	input := "#{}"
+
+	l := lexer.NewLexer(input)
+	p := NewParser(l)
+	program := p.ParseProgram()
+	checkParserErrors(t, p)
+
+	statement, ok := program.Statements[0].(*ast.ExpressionStatement)
+	if !ok {
+		t.Fatalf("program.Statements[0] is not an *ast.ExpressionStatement. got=%T", program.Statements[0])
+	}
+
+	set, ok := statement.Expression.(*ast.SetLiteral)
+	if !ok {
+		t.Fatalf("statement.Expression is not an ast.SetLiteral. got=%T", statement.Expression)
+	}
+
+	if len(set.Elements) != 0 {
+		t.Errorf("len(set.Elements) is wrong. expected=0, got=%d", len(set.Elements))
+	}
+}
+
 func TestParsingIndexExpressions(t *testing.T) {
 	input := `myArray[1 * 3]`
 
@@ -62,14 +62,28 @@ func (p *Parser) parseInfixExpression(left ast.Expression) ast.Expression {
 }
 
 func (p *Parser) parseGroupedExpression() ast.Expression {
+	// Empty parentheses and comma-separated lists can only be the parameters of an arrow function
+	if p.peekTokenIs(token.RPAREN) {
+		p.nextToken()
+		if !p.expectPeek(token.ARROW) {
+			return nil
+		}
+		return p.parseArrowFunctionBody([]*ast.Identifier{})
+	}
+
 	p.nextToken()
 
 	exp := p.parseExpression(LOWEST)
 
+	if p.peekTokenIs(token.COMMA) {
+		return p.parseArrowFunctionParameters(exp)
+	}
+
 	if !p.expectPeek(token.RPAREN) {
 		return nil
 	}
 
+	p.parenthesized = exp
 	return exp
 }
 
@@ -91,6 +91,9 @@ func TestParsingInfixExpressions(t *testing.T) {
 		{"false || false;", false, "||", false},
 		{"5 % 2;", 5, "%", 2},
 		{"2**3;", 2, "**", 3},
+		{"a | b;", "a", "|", "b"},
+		{"a & b;", "a", "&", "b"},
+		{"1 in s;", 1, "in", "s"},
 	}
 
 	for _, test := range infixTests {
@@ -294,6 +297,46 @@ func TestOperatorPrecedenceParsing(t *testing.T) {
 			"-6 + 7 * 8 - 4 % 9 / 10",
 			"(((-6) + (7 * 8)) - ((4 % 9) / 10))",
 		},
+		{
+			"a | b & c - d",
+			"((a | (b & c)) - d)",
+		},
+		{
+			"x + 1 in a | b",
+			"((x + 1) in (a | b))",
+		},
+		{
+			"#{1, 2 + 3}",
+			"#{1, (2 + 3)}",
+		},
+		{
+			"a |> f",
+			"f(a)",
+		},
+		{
+			"a + 1 |> f(b) |> g",
+			"g(f((a + 1), b))",
+		},
+		{
+			"(x) => x * 2",
+			"fn(x) (x * 2)",
+		},
+		{
+			"() => 1 + 2",
+			"fn() (1 + 2)",
+		},
+		{
+			"map(a, (x, y) => x + y)",
+			"map(a, fn(x, y) (x + y))",
+		},
+		{
+			"a |> map((x) => x * 2) |> sum",
+			"sum(map(a, fn(x) (x * 2)))",
+		},
+		{
+			"a |> (x) => x + 1",
+			"fn(x) (x + 1)(a)",
+		},
 	}
 
 	for _, test := range tests {
@@ -1,6 +1,7 @@
 package parser
 
 import (
+	"fmt"
 	"monkey/ast"
 	"monkey/token"
 )
@@ -8,50 +9,215 @@ import (
 func (p *Parser) parseFunctionLiteral() ast.Expression {
 	function := &ast.FunctionLiteral{Token: p.currToken}
 
-	if !p.expectPeek(token.LPAREN) {
+	if !p.parseFunctionSignatureAndBody(function) {
 		return nil
 	}
 
-	function.Parameters = p.parseFunctionParameters()
+	return function
+}
+
+// Parses a function declaration statement in the form "fn <identifier> <parameters> <block statement>".
+func (p *Parser) parseFunctionDeclaration() ast.Statement {
+	declaration := &ast.FunctionDeclaration{Token: p.currToken}
 
-	if !p.expectPeek(token.LBRACE) {
+	if !p.expectPeek(token.IDENT) {
 		return nil
 	}
+	declaration.Name = &ast.Identifier{Token: p.currToken, Value: p.currToken.Literal}
+
+	declaration.Function = &ast.FunctionLiteral{Token: declaration.Token, Name: declaration.Name.Value}
+	if !p.parseFunctionSignatureAndBody(declaration.Function) {
+		return nil
+	}
+
+	if p.peekTokenIs(token.SEMICOLON) {
+		p.nextToken()
+	}
+
+	return declaration
+}
+
+// Parses the parameters, optional return type annotation, and body of a function, starting from the token
+// preceding its parameter list. Reports whether the function was parsed successfully.
+func (p *Parser) parseFunctionSignatureAndBody(function *ast.FunctionLiteral) bool {
+	if !p.expectPeek(token.LPAREN) {
+		return false
+	}
+
+	function.Parameters, function.ParameterTypes = p.parseFunctionParameters()
+
+	returnType, ok := p.parseOptionalTypeAnnotation()
+	if !ok {
+		return false
+	}
+	function.ReturnType = returnType
+
+	if !p.expectPeek(token.LBRACE) {
+		return false
+	}
 
 	function.Body = p.parseBlockStatement()
 
-	return function
+	return true
 }
 
-func (p *Parser) parseFunctionParameters() []*ast.Identifier {
+// Parses a function's parameters along with their (optional) type annotations. The returned slice of type
+// annotations is parallel to the returned parameters, with nil entries for parameters that aren't annotated.
+func (p *Parser) parseFunctionParameters() ([]*ast.Identifier, []*ast.TypeAnnotation) {
 	params := []*ast.Identifier{}
+	paramTypes := []*ast.TypeAnnotation{}
 
 	if p.peekTokenIs(token.RPAREN) {
 		p.nextToken()
-		return params
+		return params, paramTypes
 	}
 
-	p.nextToken()
+	for {
+		p.nextToken()
 
-	param := &ast.Identifier{Token: p.currToken, Value: p.currToken.Literal}
-	params = append(params, param)
+		param := p.parseBindingName()
+		paramType, ok := p.parseOptionalTypeAnnotation()
+		if !ok {
+			return nil, nil
+		}
+		params = append(params, param)
+		paramTypes = append(paramTypes, paramType)
 
-	for p.peekTokenIs(token.COMMA) {
-		p.nextToken()
+		if !p.peekTokenIs(token.COMMA) {
+			break
+		}
 		p.nextToken()
-		param := &ast.Identifier{Token: p.currToken, Value: p.currToken.Literal}
-		params = append(params, param)
 	}
 
 	if !p.expectPeek(token.RPAREN) {
-		return nil
+		return nil, nil
 	}
 
-	return params
+	return params, paramTypes
+}
+
+// Parses the name of a binding (i.e. of a variable, constant or parameter) at the current token. Within quoted code, the
+// name can be given by an `unquote` call, e.g. "let unquote(name) = 1", which is replaced by the identifier it
+// evaluates to when the code is quoted.
+func (p *Parser) parseBindingName() *ast.Identifier {
+	name := &ast.Identifier{Token: p.currToken, Value: p.currToken.Literal}
+	if p.quoteDepth > 0 && name.Value == "unquote" && p.peekTokenIs(token.LPAREN) {
+		p.nextToken()
+		name.Unquote = p.parseCallExpression(&ast.Identifier{Token: name.Token, Value: name.Value}).(*ast.CallExpression)
+	}
+	return name
 }
 
 func (p *Parser) parseCallExpression(function ast.Expression) ast.Expression {
 	callExpression := &ast.CallExpression{Token: p.currToken, Function: function}
+	if function.TokenLiteral() == "quote" {
+		p.quoteDepth++
+		defer func() { p.quoteDepth-- }()
+	}
 	callExpression.Arguments = p.parseExpressionList(token.RPAREN)
 	return callExpression
 }
+
+// Parses a pipeline expression in the form "<expression> |> <expression>", desugaring it into a call expression
+// which passes the value on the left as the first argument of the call on the right. If the right-hand side is not
+// itself a call expression, it is called with the value on the left as its only argument.
+func (p *Parser) parsePipelineExpression(left ast.Expression) ast.Expression {
+	pipelineToken := p.currToken
+
+	precedence := p.currPrecedence()
+	p.nextToken()
+	right := p.parseExpression(precedence)
+	if right == nil {
+		return nil
+	}
+
+	if call, ok := right.(*ast.CallExpression); ok {
+		arguments := append([]ast.Expression{left}, call.Arguments...)
+		return &ast.CallExpression{Token: call.Token, Function: call.Function, Arguments: arguments}
+	}
+
+	return &ast.CallExpression{Token: pipelineToken, Function: right, Arguments: []ast.Expression{left}}
+}
+
+// Parses an arrow function with a single parameter, e.g. "(x) => x * 2", where the parenthesized parameter has
+// already been parsed as the expression on the left of the arrow. The parameter must be parenthesized, so a bare
+// "x => x * 2" isn't an arrow function.
+func (p *Parser) parseArrowFunction(left ast.Expression) ast.Expression {
+	if left != p.parenthesized {
+		msg := fmt.Sprintf("line %d, column %d: expected the parameters of an arrow function to be parenthesized, got %s instead", p.currToken.LineNumber, p.currToken.ColumnNumber, left)
+		p.errors = append(p.errors, msg)
+		return nil
+	}
+
+	param, ok := left.(*ast.Identifier)
+	if !ok {
+		p.createArrowFunctionParameterError(left)
+		return nil
+	}
+
+	return p.parseArrowFunctionBody([]*ast.Identifier{param})
+}
+
+// Parses the remaining parameters of an arrow function with multiple parameters, e.g. "(x, y) => x + y", after the
+// first parameter has been parsed as the start of a grouped expression.
+func (p *Parser) parseArrowFunctionParameters(first ast.Expression) ast.Expression {
+	param, ok := first.(*ast.Identifier)
+	if !ok {
+		p.createArrowFunctionParameterError(first)
+		return nil
+	}
+
+	params := []*ast.Identifier{param}
+	for p.peekTokenIs(token.COMMA) {
+		p.nextToken()
+		if !p.expectPeek(token.IDENT) {
+			return nil
+		}
+		params = append(params, &ast.Identifier{Token: p.currToken, Value: p.currToken.Literal})
+	}
+
+	if !p.expectPeek(token.RPAREN) {
+		return nil
+	}
+
+	if !p.expectPeek(token.ARROW) {
+		return nil
+	}
+
+	return p.parseArrowFunctionBody(params)
+}
+
+// Parses the body following the '=>' token of an arrow function and desugars the arrow function into a function
+// literal. The body is either a block statement or a single expression, which becomes the function's return value.
+func (p *Parser) parseArrowFunctionBody(params []*ast.Identifier) ast.Expression {
+	function := &ast.FunctionLiteral{
+		Token:      token.Token{Type: token.FUNCTION, Literal: "fn", LineNumber: p.currToken.LineNumber, ColumnNumber: p.currToken.ColumnNumber},
+		Parameters: params,
+	}
+
+	if p.peekTokenIs(token.LBRACE) {
+		p.nextToken()
+		function.Body = p.parseBlockStatement()
+		return function
+	}
+
+	p.nextToken()
+
+	bodyToken := p.currToken
+	body := p.parseExpression(LOWEST)
+	if body == nil {
+		return nil
+	}
+
+	function.Body = &ast.BlockStatement{
+		Token:      bodyToken,
+		Statements: []ast.Statement{&ast.ExpressionStatement{Token: bodyToken, Expression: body}},
+	}
+
+	return function
+}
+
+func (p *Parser) createArrowFunctionParameterError(exp ast.Expression) {
+	msg := fmt.Sprintf("line %d, column %d: expected arrow function parameter to be an identifier, got %s instead", p.currToken.LineNumber, p.currToken.ColumnNumber, exp)
+	p.errors = append(p.errors, msg)
+}
@@ -72,6 +72,55 @@ func TestFunctionLiteralWithName(t *testing.T) {
 	}
 }
 
+func TestFunctionDeclarationParsing(t *testing.T) {
+	input := `fn add(x, y) { x + y; }`
+
+	l := lexer.NewLexer(input)
+	p := NewParser(l)
+	program := p.ParseProgram()
+	checkParserErrors(t, p)
+	if len(program.Statements) != 1 {
+		t.Fatalf("program contains wrong number of statements. expected=%d, got=%d", 1, len(program.Statements))
+	}
+
+	declaration, ok := program.Statements[0].(*ast.FunctionDeclaration)
+	if !ok {
+		t.Fatalf("program.Statements[0] is not an *ast.FunctionDeclaration. got=%T", program.Statements[0])
+	}
+
+	if !testIdentifier(t, declaration.Name, "add") {
+		return
+	}
+
+	function := declaration.Function
+	if function.Name != "add" {
+		t.Fatalf("function literal name was wrong. expected='add', got=%q", function.Name)
+	}
+
+	if len(function.Parameters) != 2 {
+		t.Fatalf("function literal parameters wrong. expected 2, got=%d\n", len(function.Parameters))
+	}
+
+	testLiteralExpression(t, function.Parameters[0], "x")
+	testLiteralExpression(t, function.Parameters[1], "y")
+
+	if len(function.Body.Statements) != 1 {
+		t.Fatalf("function.Body contains wrong number of statements. expected=%d, got=%d\n", 1, len(function.Body.Statements))
+	}
+
+	bodyStatement, ok := function.Body.Statements[0].(*ast.ExpressionStatement)
+	if !ok {
+		t.Fatalf("function body statement is not an ast.ExpressionStatement. got=%T", function.Body.Statements[0])
+	}
+
+	testInfixExpression(t, bodyStatement.Expression, "x", "+", "y")
+
+	expectedString := "fn add(x, y) (x + y)"
+	if declaration.String() != expectedString {
+		t.Errorf("declaration.String() wrong. expected=%q, got=%q", expectedString, declaration.String())
+	}
+}
+
 func TestFunctionParameterParsing(t *testing.T) {
 	tests := []struct {
 		input          string
@@ -185,3 +234,94 @@ func TestCallExpressionParameterParsing(t *testing.T) {
 		}
 	}
 }
+
+func TestArrowFunctionParsing(t *testing.T) {
+	tests := []struct {
+		input          string
+		expectedParams []string
+	}{
+		{input: `() => 1 + 1`, expectedParams: []string{}},
+		{input: `(x) => 1 + 1`, expectedParams: []string{"x"}},
+		{input: `(x, y, z) => 1 + 1`, expectedParams: []string{"x", "y", "z"}},
+		{input: `(x, y) => { 1 + 1; }`, expectedParams: []string{"x", "y"}},
+	}
+
+	for _, test := range tests {
+		l := lexer.NewLexer(test.input)
+		p := NewParser(l)
+		program := p.ParseProgram()
+		checkParserErrors(t, p)
+
+		statement := program.Statements[0].(*ast.ExpressionStatement)
+		function, ok := statement.Expression.(*ast.FunctionLiteral)
+		if !ok {
+			t.Fatalf("statement.Expression is not an ast.FunctionLiteral. got=%T", statement.Expression)
+		}
+
+		if len(function.Parameters) != len(test.expectedParams) {
+			t.Errorf("length of parameters wrong. expected=%d, got=%d\n", len(test.expectedParams), len(function.Parameters))
+		}
+
+		for i, ident := range test.expectedParams {
+			testLiteralExpression(t, function.Parameters[i], ident)
+		}
+
+		if len(function.Body.Statements) != 1 {
+			t.Fatalf("function.Body contains wrong number of statements. expected=%d, got=%d\n", 1, len(function.Body.Statements))
+		}
+
+		bodyStatement, ok := function.Body.Statements[0].(*ast.ExpressionStatement)
+		if !ok {
+			t.Fatalf("function body statement is not an ast.ExpressionStatement. got=%T", function.Body.Statements[0])
+		}
+
+		testInfixExpression(t, bodyStatement.Expression, 1, "+", 1)
+	}
+}
+
+func TestArrowFunctionParameterErrors(t *testing.T) {
+	tests := []struct {
+		input         string
+		expectedError string
+	}{
+		{
+			input:         `(1) => 2`,
+			expectedError: "line 1, column 4: expected arrow function parameter to be an identifier, got 1 instead",
+		},
+		{
+			input:         `(x, 1) => 2`,
+			expectedError: "line 1, column 4: expected next token to be IDENT, got INT instead",
+		},
+		{
+			input:         `(x, y)`,
+			expectedError: "line 1, column 6: expected next token to be =>, got EOF instead",
+		},
+		{
+			input:         `x => x * 2`,
+			expectedError: "line 1, column 2: expected the parameters of an arrow function to be parenthesized, got x instead",
+		},
+		{
+			input:         `map(a, x => x * 2)`,
+			expectedError: "line 1, column 9: expected the parameters of an arrow function to be parenthesized, got x instead",
+		},
+		{
+			input:         `a |> x => x + 1`,
+			expectedError: "line 1, column 7: expected the parameters of an arrow function to be parenthesized, got x instead",
+		},
+	}
+
+	for _, test := range tests {
+		l := lexer.NewLexer(test.input)
+		p := NewParser(l)
+		p.ParseProgram()
+
+		errors := p.Errors()
+		if len(errors) == 0 {
+			t.Fatalf("expected parser errors for input %q, got none", test.input)
+		}
+
+		if errors[0] != test.expectedError {
+			t.Errorf("wrong parser error. expected=%q, got=%q", test.expectedError, errors[0])
+		}
+	}
+}
@@ -12,7 +12,7 @@ func (p *Parser) parseMacroLiteral() ast.Expression {
 		return nil
 	}
 
-	macro.Parameters = p.parseFunctionParameters()
+	macro.Parameters, _ = p.parseFunctionParameters()
 
 	if !p.expectPeek(token.LBRACE) {
 		return nil
@@ -41,3 +41,34 @@ func TestMacroLiteralParsing(t *testing.T) {
 	}
 	testInfixExpression(t, bodyStatement.Expression, "x", "+", "y")
 }
+
+func TestUnquotedBindingNameParsing(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{`quote(fn() { let unquote(name) = 1; })`, "quote(fn() let unquote(name) = 1;)"},
+		{`quote(fn() { const unquote(f(name)) = 1; })`, "quote(fn() const unquote(f(name)) = 1;)"},
+		{`quote(fn(a, unquote(b)) { a })`, "quote(fn(a, unquote(b)) a)"},
+	}
+
+	for _, test := range tests {
+		l := lexer.NewLexer(test.input)
+		p := NewParser(l)
+		program := p.ParseProgram()
+		checkParserErrors(t, p)
+
+		if program.String() != test.expected {
+			t.Errorf("wrong program. expected=%q, got=%q", test.expected, program.String())
+		}
+	}
+
+	// Outside of quoted code, `unquote` can't name a binding
+	l := lexer.NewLexer(`let unquote(name) = 1;`)
+	p := NewParser(l)
+	p.ParseProgram()
+	expectedError := "line 1, column 11: expected next token to be =, got ( instead"
+	if len(p.Errors()) == 0 || p.Errors()[0] != expectedError {
+		t.Errorf("wrong parser errors. expected first error %q, got=%q", expectedError, p.Errors())
+	}
+}
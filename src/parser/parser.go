@@ -20,6 +20,9 @@ type Parser struct {
 
 	prefixParseFns map[token.TokenType]prefixParseFn
 	infixParseFns  map[token.TokenType]infixParseFn
+
+	parenthesized ast.Expression // The expression most recently parsed within parentheses (see parseArrowFunction).
+	quoteDepth    int            // The number of `quote` calls whose arguments are being parsed (see parseBindingName).
 }
 
 type (
@@ -31,11 +34,13 @@ type (
 const (
 	_ int = iota
 	LOWEST
+	PIPELINE     // |>
+	ARROW        // (X) => Y
 	EQUALS       // == or !=
 	AND_OR       // && or ||
-	LESS_GREATER // > or < or <= or >=
-	SUM          // + or -
-	PRODUCT      // * or / or // or %
+	LESS_GREATER // > or < or <= or >= or in
+	SUM          // + or - or |
+	PRODUCT      // * or / or // or % or &
 	EXPONENT     // **
 	PREFIX       // -X or !X
 	CALL         // myFunction(X)
@@ -43,6 +48,8 @@ const (
 )
 
 var precedences = map[token.TokenType]int{
+	token.PIPELINE:    PIPELINE,
+	token.ARROW:       ARROW,
 	token.EQ:          EQUALS,
 	token.NOT_EQ:      EQUALS,
 	token.AND:         AND_OR,
@@ -51,17 +58,28 @@ var precedences = map[token.TokenType]int{
 	token.GT:          LESS_GREATER,
 	token.LTE:         LESS_GREATER,
 	token.GTE:         LESS_GREATER,
+	token.IN:          LESS_GREATER,
 	token.PLUS:        SUM,
 	token.MINUS:       SUM,
+	token.PIPE:        SUM,
 	token.MUL:         PRODUCT,
 	token.DIV:         PRODUCT,
 	token.INTEGER_DIV: PRODUCT,
 	token.MODULO:      PRODUCT,
+	token.AMPERSAND:   PRODUCT,
 	token.EXP:         EXPONENT,
 	token.LPAREN:      CALL,
 	token.LBRACKET:    INDEX,
 }
 
+// The operators of prefix & infix expressions (as opposed to other expressions starting with or containing an operator,
+// like grouped or pipeline expressions).
+var PrefixOperators = []token.TokenType{token.BANG, token.MINUS}
+var InfixOperators = []token.TokenType{
+	token.PLUS, token.MINUS, token.MUL, token.DIV, token.INTEGER_DIV, token.EXP, token.MODULO, token.AND, token.OR,
+	token.EQ, token.NOT_EQ, token.LT, token.GT, token.LTE, token.GTE, token.IN, token.PIPE, token.AMPERSAND,
+}
+
 func NewParser(l *lexer.Lexer) *Parser {
 	p := &Parser{l: l, errors: []string{}}
 
@@ -70,8 +88,6 @@ func NewParser(l *lexer.Lexer) *Parser {
 	p.registerPrefix(token.INT, p.parseIntegerLiteral)
 	p.registerPrefix(token.FLOAT, p.parseFloat)
 	p.registerPrefix(token.STRING, p.parseString)
-	p.registerPrefix(token.BANG, p.parsePrefixExpression)
-	p.registerPrefix(token.MINUS, p.parsePrefixExpression)
 	p.registerPrefix(token.TRUE, p.parseBoolean)
 	p.registerPrefix(token.FALSE, p.parseBoolean)
 	p.registerPrefix(token.LPAREN, p.parseGroupedExpression)
@@ -82,24 +98,18 @@ func NewParser(l *lexer.Lexer) *Parser {
 	p.registerPrefix(token.FUNCTION, p.parseFunctionLiteral)
 	p.registerPrefix(token.LBRACKET, p.parseArrayLiteral)
 	p.registerPrefix(token.LBRACE, p.parseHashMapLiteral)
+	p.registerPrefix(token.LSET, p.parseSetLiteral)
 	p.registerPrefix(token.MACRO, p.parseMacroLiteral)
+	for _, operator := range PrefixOperators {
+		p.registerPrefix(operator, p.parsePrefixExpression)
+	}
 
 	p.infixParseFns = make(map[token.TokenType]infixParseFn)
-	p.registerInfix(token.PLUS, p.parseInfixExpression)
-	p.registerInfix(token.MINUS, p.parseInfixExpression)
-	p.registerInfix(token.MUL, p.parseInfixExpression)
-	p.registerInfix(token.DIV, p.parseInfixExpression)
-	p.registerInfix(token.INTEGER_DIV, p.parseInfixExpression)
-	p.registerInfix(token.EXP, p.parseInfixExpression)
-	p.registerInfix(token.MODULO, p.parseInfixExpression)
-	p.registerInfix(token.AND, p.parseInfixExpression)
-	p.registerInfix(token.OR, p.parseInfixExpression)
-	p.registerInfix(token.EQ, p.parseInfixExpression)
-	p.registerInfix(token.NOT_EQ, p.parseInfixExpression)
-	p.registerInfix(token.LT, p.parseInfixExpression)
-	p.registerInfix(token.GT, p.parseInfixExpression)
-	p.registerInfix(token.LTE, p.parseInfixExpression)
-	p.registerInfix(token.GTE, p.parseInfixExpression)
+	for _, operator := range InfixOperators {
+		p.registerInfix(operator, p.parseInfixExpression)
+	}
+	p.registerInfix(token.PIPELINE, p.parsePipelineExpression)
+	p.registerInfix(token.ARROW, p.parseArrowFunction)
 	p.registerInfix(token.LPAREN, p.parseCallExpression)
 	p.registerInfix(token.LBRACKET, p.parseIndexExpression)
 
@@ -20,6 +20,12 @@ func (p *Parser) parseStatement() ast.Statement {
 		return p.parsePostfixStatement()
 	case p.currToken.Type == token.RETURN:
 		return p.parseReturnStatement()
+	case p.currToken.Type == token.DEFER:
+		return p.parseDeferStatement()
+	case p.currToken.Type == token.ASSERT:
+		return p.parseAssertStatement()
+	case p.currToken.Type == token.FUNCTION && p.peekTokenIs(token.IDENT):
+		return p.parseFunctionDeclaration()
 	default:
 		return p.parseExpressionStatement()
 	}
@@ -37,7 +43,12 @@ func (p *Parser) parseBindingDeclarationStatement(isConst bool) ast.Statement {
 		return nil
 	}
 
-	name := &ast.Identifier{Token: p.currToken, Value: p.currToken.Literal}
+	name := p.parseBindingName()
+
+	typeAnnotation, ok := p.parseOptionalTypeAnnotation()
+	if !ok {
+		return nil
+	}
 
 	if !p.expectPeek(token.ASSIGN) {
 		return nil
@@ -47,7 +58,7 @@ func (p *Parser) parseBindingDeclarationStatement(isConst bool) ast.Statement {
 
 	value := p.parseExpression(LOWEST)
 
-	if fl, ok := value.(*ast.FunctionLiteral); ok {
+	if fl, ok := value.(*ast.FunctionLiteral); ok && name.Unquote == nil {
 		fl.Name = name.Value
 	}
 
@@ -58,9 +69,11 @@ func (p *Parser) parseBindingDeclarationStatement(isConst bool) ast.Statement {
 	switch statement := statement.(type) {
 	case *ast.LetStatement:
 		statement.Name = name
+		statement.Type = typeAnnotation
 		statement.Value = value
 	case *ast.ConstStatement:
 		statement.Name = name
+		statement.Type = typeAnnotation
 		statement.Value = value
 	}
 
@@ -133,6 +146,9 @@ func (p *Parser) parseOperatorAssignStatement() ast.Statement {
 		return nil
 	}
 
+	operatorTok.LineNumber = operatorAssignmentToken.LineNumber
+	operatorTok.ColumnNumber = operatorAssignmentToken.ColumnNumber
+
 	valueExpression := ast.InfixExpression{Token: operatorTok, Left: identifier, Operator: operatorTok.Literal, Right: rightExpression}
 	assignStatement.Value = &valueExpression
 
@@ -191,6 +207,48 @@ func (p *Parser) parseReturnStatement() ast.Statement {
 	return returnStatement
 }
 
+func (p *Parser) parseDeferStatement() ast.Statement {
+	deferStatement := &ast.DeferStatement{Token: p.currToken}
+
+	p.nextToken()
+
+	call := p.parseExpression(LOWEST)
+	if _, ok := call.(*ast.CallExpression); !ok {
+		if call != nil {
+			msg := fmt.Sprintf("line %d, column %d: expected a function call to defer. got %s instead", deferStatement.Token.LineNumber, deferStatement.Token.ColumnNumber, call.String())
+			p.errors = append(p.errors, msg)
+		}
+		return nil
+	}
+	deferStatement.Call = call
+
+	if p.peekTokenIs(token.SEMICOLON) {
+		p.nextToken()
+	}
+
+	return deferStatement
+}
+
+func (p *Parser) parseAssertStatement() ast.Statement {
+	assertStatement := &ast.AssertStatement{Token: p.currToken}
+
+	p.nextToken()
+
+	assertStatement.Condition = p.parseExpression(LOWEST)
+
+	if p.peekTokenIs(token.COMMA) {
+		p.nextToken()
+		p.nextToken()
+		assertStatement.Message = p.parseExpression(LOWEST)
+	}
+
+	if p.peekTokenIs(token.SEMICOLON) {
+		p.nextToken()
+	}
+
+	return assertStatement
+}
+
 func (p *Parser) parseBlockStatement() *ast.BlockStatement {
 	return p.parseBlock([]token.TokenType{token.RBRACE})
 }
@@ -172,6 +172,118 @@ func TestReturnStatements(t *testing.T) {
 	}
 }
 
+func TestDeferStatements(t *testing.T) {
+	tests := []struct {
+		input            string
+		expectedFunction string
+		expectedNumArgs  int
+	}{
+		{"defer close();", "close", 0},
+		{"defer puts(1, 2)", "puts", 2},
+		{"defer fn(x) { x }(5);", "fn(x) x", 1},
+	}
+
+	for _, tt := range tests {
+		l := lexer.NewLexer(tt.input)
+		p := NewParser(l)
+		program := p.ParseProgram()
+		checkParserErrors(t, p)
+		if len(program.Statements) != 1 {
+			t.Fatalf("program contains wrong number of statements. expected=%d, got=%d", 1, len(program.Statements))
+		}
+
+		statement := program.Statements[0]
+		deferStatement, ok := statement.(*ast.DeferStatement)
+		if !ok {
+			t.Fatalf("statement is not an *ast.DeferStatement. got=%T", statement)
+		}
+
+		if deferStatement.TokenLiteral() != "defer" {
+			t.Fatalf("deferStatement.TokenLiteral is not 'defer', got %q", deferStatement.TokenLiteral())
+		}
+
+		call, ok := deferStatement.Call.(*ast.CallExpression)
+		if !ok {
+			t.Fatalf("deferStatement.Call is not an *ast.CallExpression. got=%T", deferStatement.Call)
+		}
+		if call.Function.String() != tt.expectedFunction {
+			t.Errorf("call.Function is not %q. got=%q", tt.expectedFunction, call.Function.String())
+		}
+		if len(call.Arguments) != tt.expectedNumArgs {
+			t.Errorf("wrong number of arguments. expected=%d, got=%d", tt.expectedNumArgs, len(call.Arguments))
+		}
+	}
+}
+
+func TestDeferStatementErrors(t *testing.T) {
+	tests := []struct {
+		input         string
+		expectedError string
+	}{
+		{"defer x;", "line 1, column 0: expected a function call to defer. got x instead"},
+		{"fn() { defer 1 + 2 }", "line 1, column 7: expected a function call to defer. got (1 + 2) instead"},
+	}
+
+	for _, test := range tests {
+		l := lexer.NewLexer(test.input)
+		p := NewParser(l)
+		p.ParseProgram()
+
+		errorCreated := false
+		for _, err := range p.errors {
+			if err == test.expectedError {
+				errorCreated = true
+			}
+		}
+		if !errorCreated {
+			t.Errorf("expected parser error %q, got %v", test.expectedError, p.errors)
+		}
+	}
+}
+
+func TestAssertStatements(t *testing.T) {
+	tests := []struct {
+		input             string
+		expectedCondition string
+		expectedMessage   string
+	}{
+		{"assert x;", "x", ""},
+		{"assert x > 0, \"x must be positive\"", "(x > 0)", "x must be positive"},
+		{"assert f(a, b) == 2, msg;", "(f(a, b) == 2)", "msg"},
+	}
+
+	for _, tt := range tests {
+		l := lexer.NewLexer(tt.input)
+		p := NewParser(l)
+		program := p.ParseProgram()
+		checkParserErrors(t, p)
+		if len(program.Statements) != 1 {
+			t.Fatalf("program contains wrong number of statements. expected=%d, got=%d", 1, len(program.Statements))
+		}
+
+		statement := program.Statements[0]
+		assertStatement, ok := statement.(*ast.AssertStatement)
+		if !ok {
+			t.Fatalf("statement is not an *ast.AssertStatement. got=%T", statement)
+		}
+
+		if assertStatement.TokenLiteral() != "assert" {
+			t.Fatalf("assertStatement.TokenLiteral is not 'assert', got %q", assertStatement.TokenLiteral())
+		}
+		if assertStatement.Condition.String() != tt.expectedCondition {
+			t.Errorf("assertStatement.Condition is not %q. got=%q", tt.expectedCondition, assertStatement.Condition.String())
+		}
+
+		if tt.expectedMessage == "" {
+			if assertStatement.Message != nil {
+				t.Errorf("assertStatement.Message is not nil. got=%q", assertStatement.Message.String())
+			}
+		} else if assertStatement.Message == nil || assertStatement.Message.String() != tt.expectedMessage {
+			t.Errorf("assertStatement.Message is not %q. got=%v", tt.expectedMessage, assertStatement.Message)
+		}
+	}
+}
+
 func testLetStatement(t *testing.T, statement ast.Statement, name string) bool {
 	if statement.TokenLiteral() != "let" {
 		t.Errorf("statement.TokenLiteral not 'let'. got=%q", statement.TokenLiteral())
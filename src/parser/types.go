@@ -0,0 +1,43 @@
+package parser
+
+import (
+	"fmt"
+	"monkey/ast"
+	"monkey/token"
+)
+
+// Parses an optional type annotation in the form ": <type> | <type> | ...". If the next token isn't a colon, there
+// is no annotation and nil is returned. The boolean result is false if the annotation is malformed.
+func (p *Parser) parseOptionalTypeAnnotation() (*ast.TypeAnnotation, bool) {
+	if !p.peekTokenIs(token.COLON) {
+		return nil, true
+	}
+	p.nextToken()
+
+	if !p.expectTypeName() {
+		return nil, false
+	}
+	annotation := &ast.TypeAnnotation{Token: p.currToken, Types: []string{p.currToken.Literal}}
+
+	for p.peekTokenIs(token.PIPE) {
+		p.nextToken()
+		if !p.expectTypeName() {
+			return nil, false
+		}
+		annotation.Types = append(annotation.Types, p.currToken.Literal)
+	}
+
+	return annotation, true
+}
+
+// Type names are identifiers, with the exception of the function type which is written using the 'fn' keyword.
+func (p *Parser) expectTypeName() bool {
+	if p.peekTokenIs(token.IDENT) || p.peekTokenIs(token.FUNCTION) {
+		p.nextToken()
+		return true
+	}
+
+	msg := fmt.Sprintf("line %d, column %d: expected type name, got %s instead", p.peekToken.LineNumber, p.peekToken.ColumnNumber, p.peekToken.Type)
+	p.errors = append(p.errors, msg)
+	return false
+}
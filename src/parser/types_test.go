@@ -0,0 +1,98 @@
+package parser
+
+import (
+	"monkey/ast"
+	"monkey/lexer"
+	"testing"
+)
+
+func TestTypeAnnotations(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"let n: int = 5;", "let n: int = 5;"},
+		{"const PI: float = 3.14;", "const PI: float = 3.14;"},
+		{"let x: int | string | null = y;", "let x: int | string | null = y;"},
+		{"let f: fn = g;", "let f: fn = g;"},
+		{"fn(x: float): float { x }", "fn(x: float): float x"},
+		{"fn(x: int, y, z: any) { x }", "fn(x: int, y, z: any) x"},
+		{"fn(): int | null { 1 }", "fn(): int | null 1"},
+	}
+
+	for _, test := range tests {
+		l := lexer.NewLexer(test.input)
+		p := NewParser(l)
+		program := p.ParseProgram()
+		checkParserErrors(t, p)
+
+		actual := program.String()
+		if actual != test.expected {
+			t.Errorf("expected=%q, got=%q", test.expected, actual)
+		}
+	}
+}
+
+func TestFunctionParameterTypes(t *testing.T) {
+	input := `fn(x: int, y, z: int | float): bool { true }`
+
+	l := lexer.NewLexer(input)
+	p := NewParser(l)
+	program := p.ParseProgram()
+	checkParserErrors(t, p)
+
+	statement := program.Statements[0].(*ast.ExpressionStatement)
+	function, ok := statement.Expression.(*ast.FunctionLiteral)
+	if !ok {
+		t.Fatalf("statement.Expression is not an ast.FunctionLiteral. got=%T", statement.Expression)
+	}
+
+	expectedParamTypes := []string{"int", "", "int | float"}
+	if len(function.ParameterTypes) != len(expectedParamTypes) {
+		t.Fatalf("function parameter types are of the wrong length. expected=%d, got=%d", len(expectedParamTypes), len(function.ParameterTypes))
+	}
+
+	for i, expected := range expectedParamTypes {
+		paramType := function.ParameterTypes[i]
+		if expected == "" {
+			if paramType != nil {
+				t.Errorf("parameter %d should not be annotated. got=%q", i, paramType.String())
+			}
+			continue
+		}
+
+		if paramType == nil || paramType.String() != expected {
+			t.Errorf("parameter %d has the wrong type annotation. expected=%q, got=%v", i, expected, paramType)
+		}
+	}
+
+	if function.ReturnType == nil || function.ReturnType.String() != "bool" {
+		t.Errorf("function has the wrong return type annotation. expected=%q, got=%v", "bool", function.ReturnType)
+	}
+}
+
+func TestTypeAnnotationErrors(t *testing.T) {
+	tests := []struct {
+		input         string
+		expectedError string
+	}{
+		{"let n: = 5;", "line 1, column 7: expected type name, got = instead"},
+		{"let n: int | = 5;", "line 1, column 13: expected type name, got = instead"},
+		{"fn(x: 5) { x }", "line 1, column 6: expected type name, got INT instead"},
+	}
+
+	for _, test := range tests {
+		l := lexer.NewLexer(test.input)
+		p := NewParser(l)
+		p.ParseProgram()
+
+		errors := p.Errors()
+		if len(errors) == 0 {
+			t.Fatalf("expected parser errors for input %q, got none", test.input)
+		}
+
+		if errors[0] != test.expectedError {
+			t.Errorf("wrong parser error. expected=%q, got=%q", test.expectedError, errors[0])
+		}
+	}
+}
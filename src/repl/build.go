@@ -0,0 +1,53 @@
+package repl
+
+import (
+	"fmt"
+	"io"
+	"monkey/compiler"
+	"os"
+)
+
+// Compiles the program in the given file and writes its serialized bytecode to the output file, so that it can be run
+// later without being compiled again.
+func BuildFile(out io.Writer, filename string, output string, options Options) bool {
+	c, ok := compileFile(out, filename, options)
+	if !ok {
+		return false
+	}
+
+	data, err := c.Bytecode().Serialize()
+	if err != nil {
+		fmt.Fprintf(out, "Whoops! Serializing bytecode failed:\n %s\n", err)
+		return false
+	}
+
+	err = os.WriteFile(output, data, 0644)
+	if err != nil {
+		fmt.Fprintf(out, "Error writing to file: %s\n", err)
+		return false
+	}
+	return true
+}
+
+// Compiles the program in the given file (see `pipeline.compile`), reporting any errors to the output.
+func compileFile(out io.Writer, filename string, options Options) (*compiler.Compiler, bool) {
+	bytes, err := os.ReadFile(filename)
+	if err != nil {
+		fmt.Fprintf(out, "Error reading from file: %s\n", err)
+		return nil, false
+	}
+
+	return compileSource(out, filename, string(bytes), options)
+}
+
+// Compiles the source code of a whole program like compileFile. Since nothing else shares its globals, the compiler
+// keeps no state, so that calls of functions stored in globals are compiled to direct calls where it's safe to do so.
+func compileSource(out io.Writer, filename string, input string, options Options) (*compiler.Compiler, bool) {
+	p := newPipeline(options)
+	c := compiler.NewCompiler()
+	c.SetOptions(p.compilerOptions(filename))
+	if !p.compile(out, input, c) {
+		return nil, false
+	}
+	return c, true
+}
@@ -0,0 +1,71 @@
+package repl
+
+import (
+	"bytes"
+	"monkey/bytecode"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestBuiltFilesRunLikeSource(t *testing.T) {
+	input := `let unless = macro(cond, body) { quote(if (!unquote(cond)) { unquote(body) }) };
+fn square(x) { x * x }
+let total = 0;
+for (let i = 1; i <= 3; i += 1) { total += square(i); }
+unless(total > 100, puts("total:", total));
+assert total == 14;
+[total, square(total)]
+`
+
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "program.mo")
+	bytecodeFilename := filepath.Join(dir, "program.moc")
+	if err := os.WriteFile(filename, []byte(input), 0644); err != nil {
+		t.Fatalf("failed to write the program: %s", err)
+	}
+
+	var buildOutput bytes.Buffer
+	if !BuildFile(&buildOutput, filename, bytecodeFilename, Options{}) {
+		t.Fatalf("building the program failed: %s", buildOutput.String())
+	}
+
+	expected := "total:14\n[14, 196]\n"
+	for _, file := range []string{filename, bytecodeFilename} {
+		var out bytes.Buffer
+		r, err := NewREPL(&out, Options{})
+		if err != nil {
+			t.Fatalf("failed to create the REPL: %s", err)
+		}
+		if !r.ExecuteFile(file) {
+			t.Errorf("running %s failed: %s", filepath.Base(file), out.String())
+		}
+
+		if out.String() != expected {
+			t.Errorf("wrong output running %s. expected=%q, got=%q", filepath.Base(file), expected, out.String())
+		}
+	}
+}
+
+func TestCompileSourceCallsGlobalsDirectly(t *testing.T) {
+	input := "fn double(x) { x * 2 }\ndouble(2);"
+
+	var out bytes.Buffer
+	c, ok := compileSource(&out, "", input, Options{})
+	if !ok {
+		t.Fatalf("compilation failed: %s", out.String())
+	}
+
+	instructions := c.Bytecode().Instructions
+	for i := 0; i < len(instructions); {
+		op, _, width, err := bytecode.ReadInstruction(instructions[i:])
+		if err != nil {
+			t.Fatalf("failed to read instruction at %d: %s", i, err)
+		}
+		if op == bytecode.OpCallGlobal {
+			return
+		}
+		i += width
+	}
+	t.Errorf("the call of a global function wasn't compiled to OpCallGlobal. got=\n%s", instructions)
+}
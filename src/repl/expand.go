@@ -0,0 +1,78 @@
+package repl
+
+import (
+	"fmt"
+	"io"
+	"monkey/ast"
+	"monkey/evaluator"
+	"monkey/lexer"
+	"monkey/object"
+	"monkey/parser"
+	"os"
+	"strings"
+)
+
+// The REPL commands which print the given code after macro expansion, either fully or by a single step.
+const EXPAND_COMMAND = ":expand"
+const EXPAND_ONCE_COMMAND = ":expand1"
+
+// Prints the program in the given file after expanding the macros defined in it. If once is set, only a single step
+// of expansion is performed, so only the outermost macro calls are expanded: macro calls passed to them as arguments,
+// or within the code they produce, are left unexpanded.
+func ExpandFile(out io.Writer, filename string, once bool) {
+	bytes, err := os.ReadFile(filename)
+	if err != nil {
+		fmt.Fprintf(out, "Error reading from file: %s\n", err)
+		return
+	}
+
+	expandInput(out, string(bytes), object.NewEnvironment(), once)
+}
+
+// Handles the input if it's an expansion command, reporting whether it was one. Macros defined in the expanded code
+// are only visible to that code, but macros defined previously in the REPL session can be used.
+func handleExpandCommand(out io.Writer, input string, macroEnv *object.Environment) bool {
+	trimmed := strings.TrimSpace(input)
+
+	var once bool
+	var code string
+	switch {
+	case strings.HasPrefix(trimmed, EXPAND_ONCE_COMMAND):
+		once = true
+		code = strings.TrimPrefix(trimmed, EXPAND_ONCE_COMMAND)
+	case strings.HasPrefix(trimmed, EXPAND_COMMAND):
+		code = strings.TrimPrefix(trimmed, EXPAND_COMMAND)
+	default:
+		return false
+	}
+
+	expandInput(out, code, object.NewEnclosedEnvironment(macroEnv), once)
+	return true
+}
+
+func expandInput(out io.Writer, input string, macroEnv *object.Environment, once bool) {
+	l := lexer.NewLexer(input)
+	p := parser.NewParser(l)
+	program := p.ParseProgram()
+	if len(p.Errors()) != 0 {
+		printParserErrors(out, p.Errors())
+		return
+	}
+
+	evaluator.DefineMacros(program, macroEnv)
+
+	var expanded *ast.Program
+	var err error
+	if once {
+		expanded, _, err = evaluator.ExpandMacrosOnce(program, macroEnv)
+	} else {
+		expanded, err = evaluator.ExpandMacros(program, macroEnv)
+	}
+	if err != nil {
+		fmt.Fprintf(out, "Whoops! Macro expansion failed:\n %s\n", err)
+		return
+	}
+
+	io.WriteString(out, ast.Format(expanded))
+	io.WriteString(out, "\n")
+}
@@ -4,18 +4,49 @@ import (
 	"bufio"
 	"fmt"
 	"io"
+	"monkey/compiler"
 	"monkey/evaluator"
 	"monkey/lexer"
 	"monkey/object"
 	"monkey/parser"
+	"monkey/typecheck"
+	"os"
+	"path/filepath"
 )
 
-// Starts the REPL for the Monkey programming language interpreter for the user to interact with.
-func StartInterpreter(in io.Reader, out io.Writer) {
-	scanner := bufio.NewScanner(in)
+// The state of the interpreter (i.e. the evaluator engine), which persists across the inputs of its REPL.
+type interpreter struct {
+	out      io.Writer
+	options  Options
+	checker  *typecheck.Checker
+	env      *object.Environment
+	macroEnv *object.Environment
+	expander *evaluator.MacroExpander
+}
+
+func newInterpreter(out io.Writer, options Options) *interpreter {
 	env := object.NewEnvironment()
+	env.SetOutput(out)
+	if options.NoAsserts {
+		env.DisableAsserts()
+	}
 	macroEnv := object.NewEnvironment()
 
+	return &interpreter{
+		out:      out,
+		options:  options,
+		checker:  typecheck.NewChecker(),
+		env:      env,
+		macroEnv: macroEnv,
+		expander: evaluator.NewMacroExpander(macroEnv),
+	}
+}
+
+// Starts the REPL for the Monkey programming language interpreter for the user to interact with.
+func StartInterpreter(in io.Reader, out io.Writer, options Options) {
+	scanner := bufio.NewScanner(in)
+	i := newInterpreter(out, options)
+
 	for {
 		// Reading Input
 		fmt.Fprint(out, PROMPT)
@@ -24,29 +55,86 @@ func StartInterpreter(in io.Reader, out io.Writer) {
 			return
 		}
 
-		// Lexing
 		line := scanner.Text()
-		l := lexer.NewLexer(line)
 
-		// Parsing
-		p := parser.NewParser(l)
-		program := p.ParseProgram()
-		if len(p.Errors()) != 0 {
-			printParserErrors(out, p.Errors())
+		// Handle macro expansion commands
+		if handleExpandCommand(out, line, i.macroEnv) {
 			continue
 		}
 
-		// Macro Expansion
-		evaluator.DefineMacros(program, macroEnv)
-		expanded := evaluator.ExpandMacros(program, macroEnv)
+		i.evaluateInput(line)
+	}
+}
+
+// Runs the Monkey program in the given file with the interpreter, reporting whether it ran successfully (any errors
+// are printed to the output). Files of bytecode built with `monkey build` can only be run by the VM.
+func EvaluateFile(out io.Writer, filename string, options Options) bool {
+	bytes, err := os.ReadFile(filename)
+	if err != nil {
+		fmt.Fprintf(out, "Error reading from file: %s\n", err)
+		return false
+	}
 
-		// Evaluation
-		evaluated := evaluator.Eval(expanded, env)
+	if compiler.IsSerializedBytecode(bytes) || filepath.Ext(filename) == ".moc" {
+		fmt.Fprintf(out, "Whoops! %s is a bytecode file, which can only be run with the vm engine\n", filename)
+		return false
+	}
+
+	i := newInterpreter(out, options)
+	i.env.SetFilename(filename)
+	return i.evaluateInput(string(bytes))
+}
+
+// Evaluates the input, printing its result, and reports whether it was evaluated successfully (any errors are printed
+// to the output).
+func (i *interpreter) evaluateInput(input string) bool {
+	// Lexing
+	l := lexer.NewLexer(input)
+
+	// Parsing
+	p := parser.NewParser(l)
+	program := p.ParseProgram()
+	if len(p.Errors()) != 0 {
+		printParserErrors(i.out, p.Errors())
+		return false
+	}
+
+	// Type Checking
+	if i.options.TypeCheck {
+		typeErrors := i.checker.Check(program)
+		if len(typeErrors) != 0 {
+			printTypeErrors(i.out, typeErrors)
+			return false
+		}
+	}
+
+	// Macro Expansion
+	evaluator.DefineMacros(program, i.macroEnv)
+	expanded, err := i.expander.Expand(program)
+	if err != nil {
+		fmt.Fprintf(i.out, "Whoops! Macro expansion failed:\n %s\n", err)
+		return false
+	}
+
+	// Evaluation
+	evaluated := evaluator.Eval(expanded, i.env)
+
+	if errObj, ok := evaluated.(*object.Error); ok {
+		runtimeErr := errObj.RuntimeError()
+		runtimeErr.Filename = i.env.Filename()
+		printRuntimeError(i.out, "Evaluation failed", runtimeErr)
+		return false
+	}
 
-		// Printing Output
-		if evaluated != nil {
-			io.WriteString(out, evaluated.Inspect())
-			io.WriteString(out, "\n")
+	// Printing Output
+	if evaluated != nil {
+		output, err := evaluator.Inspect(evaluated, i.env)
+		if err != nil {
+			printRuntimeError(i.out, "Evaluation failed", err)
+			return false
 		}
+		io.WriteString(i.out, output)
+		io.WriteString(i.out, "\n")
 	}
+	return true
 }
@@ -0,0 +1,70 @@
+package repl
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func runInterpreter(input string, options Options) string {
+	var out bytes.Buffer
+	StartInterpreter(strings.NewReader(input), &out, options)
+	return strings.ReplaceAll(out.String(), PROMPT, "")
+}
+
+func TestInterpreterStringHooks(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{`{"__str__": fn(v) { "point" }}`, "point\n"},
+		{`[{"__str__": fn(v) { "point" }}]`, "[point]\n"},
+		{`{"__str__": fn(v) { 1 }}`, "Whoops! Evaluation failed:\n __str__ must return a string, got INTEGER\n"},
+	}
+
+	for _, test := range tests {
+		output := runInterpreter(test.input, Options{})
+		if output != test.expected {
+			t.Errorf("wrong output for %q. expected=%q, got=%q", test.input, test.expected, output)
+		}
+	}
+}
+
+func TestInterpreterNoAsserts(t *testing.T) {
+	// Each line is a separate input
+	input := "let x = -1;\nassert x > 0;\nx"
+
+	expected := "Whoops! Evaluation failed:\n line 1, column 0: assertion failed: (x > 0) (where x = -1)\n-1\n"
+	if output := runInterpreter(input, Options{}); output != expected {
+		t.Errorf("wrong output with asserts. expected=%q, got=%q", expected, output)
+	}
+
+	expected = "-1\n"
+	if output := runInterpreter(input, Options{NoAsserts: true}); output != expected {
+		t.Errorf("wrong output without asserts. expected=%q, got=%q", expected, output)
+	}
+}
+
+func TestInterpreterRuntimeErrors(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"1 / 0", "Whoops! Evaluation failed:\n line 1, column 2: division by zero\n"},
+		{
+			"fn f(x) { x / 0 }; fn g() { f(1) }; g()",
+			"Whoops! Evaluation failed:\n line 1, column 12: division by zero\n" +
+				"stack trace (most recent call first):\n" +
+				"    at f (line 1, column 12)\n" +
+				"    at g (line 1, column 28)\n" +
+				"    at <main> (line 1, column 36)\n",
+		},
+	}
+
+	for _, test := range tests {
+		output := runInterpreter(test.input, Options{})
+		if output != test.expected {
+			t.Errorf("wrong output for %q. expected=%q, got=%q", test.input, test.expected, output)
+		}
+	}
+}
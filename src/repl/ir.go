@@ -0,0 +1,21 @@
+package repl
+
+import (
+	"io"
+)
+
+// Prints the intermediate representation that the compiler generates for the program in the given file: the
+// control-flow graph of the program's top-level code, followed by those of the functions defined in it.
+func PrintIR(out io.Writer, filename string, options Options) {
+	c, ok := compileFile(out, filename, options)
+	if !ok {
+		return
+	}
+
+	for i, function := range c.IR() {
+		if i > 0 {
+			io.WriteString(out, "\n")
+		}
+		io.WriteString(out, function.String())
+	}
+}
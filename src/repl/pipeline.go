@@ -0,0 +1,82 @@
+package repl
+
+import (
+	"fmt"
+	"io"
+	"monkey/compiler"
+	"monkey/evaluator"
+	"monkey/lexer"
+	"monkey/object"
+	"monkey/parser"
+	"monkey/typecheck"
+)
+
+// The stages through which Monkey code is compiled to bytecode, shared by the REPL and the commands which compile whole
+// files. The pipeline keeps the macros defined and the types checked so far, so that later inputs (in the REPL) can
+// use them.
+type pipeline struct {
+	options  Options
+	checker  *typecheck.Checker
+	macroEnv *object.Environment
+	expander *evaluator.MacroExpander
+}
+
+func newPipeline(options Options) *pipeline {
+	macroEnv := object.NewEnvironment()
+
+	return &pipeline{
+		options:  options,
+		checker:  typecheck.NewChecker(),
+		macroEnv: macroEnv,
+		expander: evaluator.NewMacroExpander(macroEnv),
+	}
+}
+
+// Lexes, parses, expands the macros of, (optionally) type checks, and compiles the input with the given compiler,
+// reporting any errors to the output.
+func (p *pipeline) compile(out io.Writer, input string, c *compiler.Compiler) bool {
+	// Lexing
+	l := lexer.NewLexer(input)
+
+	// Parsing
+	ps := parser.NewParser(l)
+	program := ps.ParseProgram()
+	if len(ps.Errors()) != 0 {
+		printParserErrors(out, ps.Errors())
+		return false
+	}
+
+	// Macro Expansion (macro bodies are run at compile time by the evaluator)
+	evaluator.DefineMacros(program, p.macroEnv)
+	program, err := p.expander.Expand(program)
+	if err != nil {
+		fmt.Fprintf(out, "Whoops! Macro expansion failed:\n %s\n", err)
+		return false
+	}
+
+	// Type Checking
+	if p.options.TypeCheck {
+		typeErrors := p.checker.Check(program)
+		if len(typeErrors) != 0 {
+			printTypeErrors(out, typeErrors)
+			return false
+		}
+	}
+
+	// Compilation
+	err = c.Compile(program)
+	if err != nil {
+		fmt.Fprintf(out, "Whoops! Compilation failed:\n %s\n", err)
+		return false
+	}
+	return true
+}
+
+// Returns the options with which the compiler compiles code from the given file (if any).
+func (p *pipeline) compilerOptions(filename string) compiler.Options {
+	return compiler.Options{
+		Filename:        filename,
+		NoAsserts:       p.options.NoAsserts,
+		NoOptimizations: p.options.NoOptimizations,
+	}
+}
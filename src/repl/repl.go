@@ -1,14 +1,14 @@
 package repl
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"monkey/compiler"
-	"monkey/lexer"
 	"monkey/object"
-	"monkey/parser"
 	"monkey/vm"
 	"os"
+	"path/filepath"
 	"strings"
 
 	"github.com/chzyer/readline"
@@ -30,17 +30,25 @@ const MONKEY_FACE = `            __,__
            '-----'
 `
 
+// Options configuring how the REPL processes Monkey code.
+type Options struct {
+	TypeCheck       bool // statically type check each input before running it
+	NoAsserts       bool // skip assert statements (stripping them when compiling)
+	NoOptimizations bool // disable compiler optimizations
+}
+
 // The REPL for the Monkey programming language.
 type REPL struct {
 	out         io.Writer
 	rl          *readline.Instance
+	pipeline    *pipeline
 	constants   []object.Object
 	symbolTable *compiler.SymbolTable
 	globals     []object.Object
 }
 
 // Creates a new REPL for the user to interact with Monkey at the top level.
-func NewREPL(out io.Writer) (*REPL, error) {
+func NewREPL(out io.Writer, options Options) (*REPL, error) {
 	// Configure readline with custom settings
 	config := &readline.Config{
 		Prompt:            PROMPT,
@@ -66,6 +74,7 @@ func NewREPL(out io.Writer) (*REPL, error) {
 	return &REPL{
 		out:         out,
 		rl:          rl,
+		pipeline:    newPipeline(options),
 		constants:   constants,
 		symbolTable: symbolTable,
 		globals:     globals,
@@ -98,21 +107,42 @@ func (r *REPL) Start() {
 			continue
 		}
 
+		// Handle macro expansion commands
+		if handleExpandCommand(r.out, input, r.pipeline.macroEnv) {
+			continue
+		}
+
 		r.executeInput(input)
 	}
 }
 
-func (r *REPL) ExecuteFile(filename string) {
+// Runs the Monkey program in the given file (or the bytecode built from it) on the VM, reporting whether it ran
+// successfully (any errors are printed to the output).
+func (r *REPL) ExecuteFile(filename string) bool {
 	defer r.rl.Close()
 
 	bytes, err := os.ReadFile(filename)
 	if err != nil {
 		fmt.Fprintf(r.out, "Error reading from file: %s\n", err)
-		return
+		return false
+	}
+
+	// Files of serialized bytecode (see `monkey build`) are run directly, without being compiled
+	if compiler.IsSerializedBytecode(bytes) || filepath.Ext(filename) == ".moc" {
+		bytecode, err := compiler.DeserializeBytecode(bytes)
+		if err != nil {
+			fmt.Fprintf(r.out, "Whoops! Loading bytecode failed:\n %s\n", err)
+			return false
+		}
+		return r.runBytecode(bytecode)
 	}
 
-	input := string(bytes)
-	r.executeInput(input)
+	// The file is compiled on its own rather than continuing from the REPL's state (see compileSource)
+	c, ok := compileSource(r.out, filename, string(bytes), r.pipeline.options)
+	if !ok {
+		return false
+	}
+	return r.runBytecode(c.Bytecode())
 }
 
 func (r *REPL) readMultiLineInput() (string, error) {
@@ -141,41 +171,53 @@ func (r *REPL) readMultiLineInput() (string, error) {
 }
 
 func (r *REPL) executeInput(input string) {
-	// Lexing
-	l := lexer.NewLexer(input)
-
-	// Parsing
-	p := parser.NewParser(l)
-	program := p.ParseProgram()
-	if len(p.Errors()) != 0 {
-		printParserErrors(r.out, p.Errors())
-		return
-	}
-
-	// Compilation
 	compiler := compiler.NewCompilerWithState(r.symbolTable, r.constants)
-	err := compiler.Compile(program)
-	if err != nil {
-		fmt.Fprintf(r.out, "Whoops! Compilation failed:\n %s\n", err)
+	compiler.SetOptions(r.pipeline.compilerOptions(""))
+	if !r.pipeline.compile(r.out, input, compiler) {
+		return
 	}
 
 	bytecode := compiler.Bytecode()
 	r.constants = bytecode.Constants
 
+	r.runBytecode(bytecode)
+}
+
+// Runs the compiled program on the VM, printing its result, and reports whether it ran successfully (any errors are
+// printed to the output).
+func (r *REPL) runBytecode(bytecode *compiler.Bytecode) bool {
 	// Virtual Machine (VM)
 	vm := vm.NewVMWithGlobalsStore(bytecode, r.globals)
-	err = vm.Run()
+	vm.SetOutput(r.out)
+	r.globals = vm.Globals()
+	err := vm.Run()
 	if err != nil {
-		fmt.Fprintf(r.out, "Whoops! Executing bytecode failed:\n %s\n", err)
-		return
+		printRuntimeError(r.out, "Executing bytecode failed", err)
+		return false
 	}
 
 	// Printing Output
 	lastPopped := vm.LastPoppedStackElem()
 	if lastPopped != nil {
-		io.WriteString(r.out, lastPopped.Inspect())
+		output, err := object.InspectWithHooks(vm, lastPopped)
+		if err != nil {
+			printRuntimeError(r.out, "Executing bytecode failed", err)
+			return false
+		}
+		io.WriteString(r.out, output)
 		io.WriteString(r.out, "\n")
 	}
+	return true
+}
+
+// Prints an error which aborted the program, followed by its stack trace if it occurred within a function.
+func printRuntimeError(out io.Writer, failure string, err error) {
+	fmt.Fprintf(out, "Whoops! %s:\n %s\n", failure, err)
+
+	var runtimeErr *object.RuntimeError
+	if errors.As(err, &runtimeErr) && len(runtimeErr.Trace) > 1 {
+		io.WriteString(out, runtimeErr.StackTrace())
+	}
 }
 
 func printParserErrors(out io.Writer, errors []string) {
@@ -186,3 +228,12 @@ func printParserErrors(out io.Writer, errors []string) {
 		io.WriteString(out, "\t"+msg+"\n")
 	}
 }
+
+func printTypeErrors(out io.Writer, errors []string) {
+	io.WriteString(out, MONKEY_FACE)
+	io.WriteString(out, "Woops! We ran into some monkey business here!\n")
+	io.WriteString(out, " type errors:\n")
+	for _, msg := range errors {
+		io.WriteString(out, "\t"+msg+"\n")
+	}
+}
@@ -46,6 +46,12 @@ const (
 	AND = "&&"
 	OR  = "||"
 
+	PIPE      = "|"
+	AMPERSAND = "&"
+
+	PIPELINE = "|>"
+	ARROW    = "=>"
+
 	EQ     = "=="
 	NOT_EQ = "!="
 	LT     = "<"
@@ -68,6 +74,7 @@ const (
 	RBRACE   = "}"
 	LBRACKET = "["
 	RBRACKET = "]"
+	LSET     = "#{"
 
 	// Keywords
 	FUNCTION = "FUNCTION"
@@ -82,6 +89,9 @@ const (
 	FOR      = "FOR"
 	RETURN   = "RETURN"
 	MACRO    = "MACRO"
+	DEFER    = "DEFER"
+	ASSERT   = "ASSERT"
+	IN       = "IN"
 )
 
 var OPERATOR_ASSIGNMENTS = []TokenType{
@@ -107,6 +117,9 @@ var keywords = map[string]TokenType{
 	"for":     FOR,
 	"return":  RETURN,
 	"macro":   MACRO,
+	"defer":   DEFER,
+	"assert":  ASSERT,
+	"in":      IN,
 }
 
 func LookupIdent(ident string) TokenType {
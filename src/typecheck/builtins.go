@@ -0,0 +1,18 @@
+package typecheck
+
+// Signatures of the built-in functions. Built-in functions which accept a variable number of arguments have nil
+// parameters, so that their calls aren't checked beyond the return type.
+var builtInTypes = map[string]*functionType{
+	"puts":         {params: nil, returnType: nullType},
+	"len":          {params: []Type{newUnion(stringType, arrayType, hashMapType, setType)}, returnType: intType},
+	"first":        {params: []Type{arrayType}, returnType: anyType},
+	"last":         {params: []Type{arrayType}, returnType: anyType},
+	"rest":         {params: []Type{arrayType}, returnType: newUnion(arrayType, nullType)},
+	"append":       {params: []Type{arrayType, anyType}, returnType: arrayType},
+	"join":         {params: nil, returnType: stringType},
+	"split":        {params: nil, returnType: arrayType},
+	"sum":          {params: []Type{arrayType}, returnType: newUnion(intType, floatType)},
+	"union":        {params: []Type{setType, setType}, returnType: setType},
+	"intersection": {params: []Type{setType, setType}, returnType: setType},
+	"difference":   {params: []Type{setType, setType}, returnType: setType},
+}
@@ -0,0 +1,651 @@
+package typecheck
+
+import (
+	"fmt"
+	"monkey/ast"
+	"monkey/token"
+)
+
+// Represents a binding tracked by the type checker. Bindings with a declared (annotated) type must always hold
+// values of that type, while the types of unannotated bindings are inferred and widen as they're reassigned.
+type binding struct {
+	typ      Type
+	declared bool
+}
+
+// Represents a scope of bindings, enclosed by an outer scope (if any).
+type scope struct {
+	bindings map[string]*binding
+	outer    *scope
+}
+
+func newScope(outer *scope) *scope {
+	return &scope{bindings: make(map[string]*binding), outer: outer}
+}
+
+func (s *scope) lookup(name string) (*binding, bool) {
+	b, ok := s.bindings[name]
+	if !ok && s.outer != nil {
+		return s.outer.lookup(name)
+	}
+	return b, ok
+}
+
+func (s *scope) define(name string, typ Type, declared bool) {
+	s.bindings[name] = &binding{typ: typ, declared: declared}
+}
+
+// Tracks the return types of the function currently being checked.
+type functionContext struct {
+	returnType  Type   // the annotated return type, or nil if it should be inferred
+	returnTypes []Type // the types of the values returned by return statements
+}
+
+// Represents the static type checker for Monkey programs, which walks the AST of a program before it is compiled
+// (or evaluated) and reports type mismatches along with their line & column numbers. Annotated bindings, function
+// parameters, and return values are checked against their annotations, and the types of everything else are
+// inferred. Bindings persist across calls to Check, so that a single checker can be used for all REPL inputs.
+type Checker struct {
+	global    *scope
+	scope     *scope
+	functions []*functionContext
+	errors    []string
+}
+
+func NewChecker() *Checker {
+	global := newScope(nil)
+	for name, builtInType := range builtInTypes {
+		global.define(name, builtInType, true)
+	}
+
+	return &Checker{global: global, scope: global}
+}
+
+// Type checks the provided program, returning the errors encountered. If there are any errors, the bindings defined
+// by the program are discarded, since the program won't be run.
+func (c *Checker) Check(program *ast.Program) []string {
+	c.errors = []string{}
+
+	snapshot := make(map[string]binding, len(c.global.bindings))
+	for name, b := range c.global.bindings {
+		snapshot[name] = *b
+	}
+
+	c.hoistFunctionDeclarations(program.Statements)
+	for _, statement := range program.Statements {
+		c.checkStatement(statement)
+	}
+
+	if len(c.errors) > 0 {
+		c.global.bindings = make(map[string]*binding, len(snapshot))
+		for name, b := range snapshot {
+			c.global.bindings[name] = &binding{typ: b.typ, declared: b.declared}
+		}
+	}
+
+	return c.errors
+}
+
+// Returns the type of the value produced by the statement, which is null for anything but expression statements.
+func (c *Checker) checkStatement(statement ast.Statement) Type {
+	switch statement := statement.(type) {
+	case *ast.ExpressionStatement:
+		return c.checkExpression(statement.Expression)
+
+	case *ast.LetStatement:
+		c.checkBinding(statement.Name, statement.Type, statement.Value)
+
+	case *ast.ConstStatement:
+		c.checkBinding(statement.Name, statement.Type, statement.Value)
+
+	case *ast.FunctionDeclaration:
+		c.scope.define(statement.Name.Value, c.checkFunctionLiteral(statement.Function), false)
+
+	case *ast.AssignStatement:
+		valueType := c.checkExpression(statement.Value)
+
+		// Assignments to undefined bindings are reported by the compiler
+		b, ok := c.scope.lookup(statement.Name.Value)
+		if !ok {
+			break
+		}
+
+		if b.declared {
+			if !isAssignable(b.typ, valueType) {
+				c.errorf(statement.Name.Token, "cannot assign %s to '%s' of type %s", valueType, statement.Name.Value, b.typ)
+			}
+		} else {
+			b.typ = newUnion(b.typ, valueType)
+		}
+
+	case *ast.ReturnStatement:
+		returnType := c.checkExpression(statement.ReturnValue)
+		if len(c.functions) == 0 {
+			break
+		}
+
+		function := c.functions[len(c.functions)-1]
+		if function.returnType != nil && !isAssignable(function.returnType, returnType) {
+			c.errorf(statement.Token, "cannot return %s from function with return type %s", returnType, function.returnType)
+		}
+		function.returnTypes = append(function.returnTypes, returnType)
+
+	case *ast.DeferStatement:
+		c.checkExpression(statement.Call)
+
+	case *ast.AssertStatement:
+		c.checkExpression(statement.Condition)
+		if statement.Message != nil {
+			c.checkExpression(statement.Message)
+		}
+
+	case *ast.BlockStatement:
+		return c.checkBlock(statement)
+	}
+
+	return nullType
+}
+
+func (c *Checker) checkBinding(name *ast.Identifier, annotation *ast.TypeAnnotation, value ast.Expression) {
+	var declaredType Type
+	if annotation != nil {
+		declaredType = c.resolveAnnotation(annotation)
+	}
+
+	// Define function bindings before checking the function body, so that recursive calls can be checked
+	if function, ok := value.(*ast.FunctionLiteral); ok {
+		if declaredType != nil {
+			c.scope.define(name.Value, declaredType, true)
+		} else {
+			c.scope.define(name.Value, signatureOf(function), false)
+		}
+	}
+
+	valueType := c.checkExpression(value)
+
+	if declaredType != nil {
+		if !isAssignable(declaredType, valueType) {
+			c.errorf(name.Token, "cannot assign %s to '%s' of type %s", valueType, name.Value, declaredType)
+		}
+		c.scope.define(name.Value, declaredType, true)
+	} else {
+		c.scope.define(name.Value, valueType, false)
+	}
+}
+
+// Returns the type of the value produced by the block, i.e. the type of its last expression statement (or null).
+func (c *Checker) checkBlock(block *ast.BlockStatement) Type {
+	var blockType Type = nullType
+	if block == nil {
+		return blockType
+	}
+
+	c.hoistFunctionDeclarations(block.Statements)
+	for _, statement := range block.Statements {
+		if _, ok := statement.(*ast.FunctionDeclaration); ok {
+			c.checkStatement(statement)
+			continue
+		}
+		blockType = c.checkStatement(statement)
+	}
+
+	return blockType
+}
+
+// Defines the functions declared among the provided statements before any of the statements are checked, since
+// function declarations are hoisted to the top of their block.
+func (c *Checker) hoistFunctionDeclarations(statements []ast.Statement) {
+	for _, statement := range statements {
+		if declaration, ok := statement.(*ast.FunctionDeclaration); ok {
+			c.scope.define(declaration.Name.Value, signatureOf(declaration.Function), false)
+		}
+	}
+}
+
+// Checks a block which introduces its own scope, e.g. the body of a conditional or loop.
+func (c *Checker) checkScopedBlock(block *ast.BlockStatement) Type {
+	c.enterScope()
+	defer c.leaveScope()
+
+	return c.checkBlock(block)
+}
+
+func (c *Checker) enterScope() {
+	c.scope = newScope(c.scope)
+}
+
+func (c *Checker) leaveScope() {
+	c.scope = c.scope.outer
+}
+
+func (c *Checker) checkExpression(expression ast.Expression) Type {
+	switch expression := expression.(type) {
+	case *ast.IntegerLiteral:
+		return intType
+
+	case *ast.Float:
+		return floatType
+
+	case *ast.Boolean:
+		return boolType
+
+	case *ast.StringLiteral:
+		return stringType
+
+	case *ast.Identifier:
+		// Undefined identifiers are reported by the compiler
+		if b, ok := c.scope.lookup(expression.Value); ok {
+			return b.typ
+		}
+		return anyType
+
+	case *ast.PrefixExpression:
+		return c.checkPrefixExpression(expression)
+
+	case *ast.InfixExpression:
+		return c.checkInfixExpression(expression)
+
+	case *ast.IfExpression:
+		branchTypes := []Type{}
+		for _, clause := range expression.Clauses {
+			c.checkExpression(clause.Condition)
+			branchTypes = append(branchTypes, c.checkScopedBlock(clause.Consequence))
+		}
+		branchTypes = append(branchTypes, c.checkScopedBlock(expression.Alternative))
+		return newUnion(branchTypes...)
+
+	case *ast.SwitchStatement:
+		c.checkExpression(expression.SwitchExpression)
+		branchTypes := []Type{}
+		for _, switchCase := range expression.Cases {
+			c.checkExpression(switchCase.Expression)
+			branchTypes = append(branchTypes, c.checkScopedBlock(switchCase.Consequence))
+		}
+		branchTypes = append(branchTypes, c.checkScopedBlock(expression.Default))
+		return newUnion(branchTypes...)
+
+	case *ast.WhileLoop:
+		c.checkExpression(expression.Condition)
+		c.checkScopedBlock(expression.Body)
+		return nullType
+
+	case *ast.ForLoop:
+		// The loop variable is scoped to the loop, so the whole loop is checked in its own scope
+		c.enterScope()
+		defer c.leaveScope()
+
+		c.checkStatement(expression.Init)
+		c.checkExpression(expression.Condition)
+		c.checkStatement(expression.Afterthought)
+		c.checkScopedBlock(expression.Body)
+		return nullType
+
+	case *ast.FunctionLiteral:
+		return c.checkFunctionLiteral(expression)
+
+	case *ast.CallExpression:
+		return c.checkCallExpression(expression)
+
+	case *ast.ArrayLiteral:
+		for _, element := range expression.Elements {
+			c.checkExpression(element)
+		}
+		return arrayType
+
+	case *ast.HashMapLiteral:
+		for key, value := range expression.KVPairs {
+			c.checkHashable(expression.Token, c.checkExpression(key), "unusable as hash key: %s")
+			c.checkExpression(value)
+		}
+		return hashMapType
+
+	case *ast.SetLiteral:
+		for _, element := range expression.Elements {
+			c.checkHashable(expression.Token, c.checkExpression(element), "unusable as set element: %s")
+		}
+		return setType
+
+	case *ast.IndexExpression:
+		return c.checkIndexExpression(expression)
+	}
+
+	// Macros (and anything else the checker doesn't know about) are left unchecked
+	return anyType
+}
+
+func (c *Checker) checkPrefixExpression(expression *ast.PrefixExpression) Type {
+	operandType := c.checkExpression(expression.Right)
+
+	switch expression.Operator {
+	case "!":
+		return boolType
+	case "-":
+		for _, member := range membersOf(operandType) {
+			if member != intType && member != floatType && member != anyType {
+				c.errorf(expression.Token, "unsupported operand type for -: %s", operandType)
+				return anyType
+			}
+		}
+		return operandType
+	}
+
+	return anyType
+}
+
+func (c *Checker) checkInfixExpression(expression *ast.InfixExpression) Type {
+	leftType := c.checkExpression(expression.Left)
+	rightType := c.checkExpression(expression.Right)
+
+	// Operations on unions must be valid for every combination of the unions' members
+	resultTypes := []Type{}
+	for _, left := range membersOf(leftType) {
+		for _, right := range membersOf(rightType) {
+			resultType, ok := infixResultType(expression.Operator, left, right)
+			if !ok {
+				c.errorf(expression.Token, "unsupported operand types for %s: %s and %s", expression.Operator, leftType, rightType)
+				return anyType
+			}
+			resultTypes = append(resultTypes, resultType)
+		}
+	}
+
+	return newUnion(resultTypes...)
+}
+
+// Returns the type of the result of applying the infix operator to operands of the provided (non-union) types,
+// mirroring the operations supported by the virtual machine.
+func infixResultType(operator string, left Type, right Type) (Type, bool) {
+	if left == anyType || right == anyType {
+		switch operator {
+		case "==", "!=", "<", ">", "<=", ">=", "&&", "||", "in":
+			return boolType, true
+		default:
+			return anyType, true
+		}
+	}
+
+	// Hashmaps may be user types implementing the operator through a hook (e.g. `__add__`), which can return anything
+	if (left == hashMapType || right == hashMapType) && hookedOperators[operator] {
+		switch operator {
+		case "==", "!=", "<", ">", "<=", ">=":
+			return boolType, true
+		default:
+			return anyType, true
+		}
+	}
+
+	numerical := isNumerical(left) && isNumerical(right)
+
+	switch operator {
+	case "+":
+		switch {
+		case numerical:
+			return arithmeticResultType(left, right), true
+		case left == stringType && right == stringType:
+			return stringType, true
+		case left == arrayType && right == arrayType:
+			return arrayType, true
+		}
+	case "-":
+		switch {
+		case numerical:
+			return arithmeticResultType(left, right), true
+		case left == setType && right == setType:
+			return setType, true
+		}
+	case "*", "**":
+		if numerical {
+			return arithmeticResultType(left, right), true
+		}
+	case "/":
+		// Dividing two integers produces a float unless the division is exact
+		if left == intType && right == intType {
+			return newUnion(intType, floatType), true
+		} else if numerical {
+			return floatType, true
+		}
+	case "//":
+		if numerical {
+			return intType, true
+		}
+	case "%":
+		if left == intType && right == intType {
+			return intType, true
+		}
+	case "<", ">", "<=", ">=":
+		if numerical {
+			return boolType, true
+		}
+	case "==", "!=":
+		if numerical || (left == right && (left == boolType || left == stringType)) {
+			return boolType, true
+		}
+	case "&&", "||":
+		if left == boolType && right == boolType {
+			return boolType, true
+		}
+	case "|", "&":
+		if left == setType && right == setType {
+			return setType, true
+		}
+	case "in":
+		if right == setType || right == hashMapType {
+			return boolType, true
+		}
+	}
+
+	return nil, false
+}
+
+func isNumerical(t Type) bool {
+	return t == intType || t == floatType
+}
+
+func arithmeticResultType(left Type, right Type) Type {
+	if left == intType && right == intType {
+		return intType
+	}
+	return floatType
+}
+
+// The infix operators which user types can implement through hooks.
+var hookedOperators = map[string]bool{
+	"+": true, "-": true, "*": true, "/": true, "//": true, "**": true, "%": true,
+	"==": true, "!=": true, "<": true, ">": true, "<=": true, ">=": true,
+}
+
+// Reports an error if values of the provided type can't be used as hashmap keys or set elements. Hashmaps are
+// allowed, since they may be user types implementing the `__hash__` hook.
+func (c *Checker) checkHashable(tok token.Token, t Type, format string) {
+	for _, member := range membersOf(t) {
+		if member != intType && member != boolType && member != stringType && member != hashMapType && member != anyType {
+			c.errorf(tok, format, t)
+			return
+		}
+	}
+}
+
+func (c *Checker) checkIndexExpression(expression *ast.IndexExpression) Type {
+	leftType := c.checkExpression(expression.Left)
+	indexType := c.checkExpression(expression.Index)
+
+	for _, member := range membersOf(leftType) {
+		switch member {
+		case anyType, hashMapType:
+		case arrayType:
+			if !isAssignable(intType, indexType) {
+				c.errorf(expression.Token, "array index must be int, got %s", indexType)
+				return anyType
+			}
+		default:
+			c.errorf(expression.Token, "index operator not supported: %s", leftType)
+			return anyType
+		}
+	}
+
+	// Elements of arrays & hashmaps aren't tracked by the type checker
+	return anyType
+}
+
+func (c *Checker) checkCallExpression(expression *ast.CallExpression) Type {
+	// The arguments of quote & unquote are code, not values
+	if identifier, ok := expression.Function.(*ast.Identifier); ok && (identifier.Value == "quote" || identifier.Value == "unquote") {
+		return anyType
+	}
+
+	calleeType := c.checkExpression(expression.Function)
+
+	argTypes := []Type{}
+	for _, arg := range expression.Arguments {
+		argTypes = append(argTypes, c.checkExpression(arg))
+	}
+
+	resultTypes := []Type{}
+	for _, member := range membersOf(calleeType) {
+		if member == anyType {
+			resultTypes = append(resultTypes, anyType)
+			continue
+		}
+
+		function, ok := member.(*functionType)
+		if !ok {
+			c.errorf(expression.Token, "cannot call value of type %s", calleeType)
+			return anyType
+		}
+
+		if function.params != nil {
+			if len(function.params) != len(argTypes) {
+				c.errorf(expression.Token, "wrong number of arguments: expected=%d, got=%d", len(function.params), len(argTypes))
+				return function.returnType
+			}
+
+			for i, argType := range argTypes {
+				if !isAssignable(function.params[i], argType) {
+					c.errorf(expression.Token, "cannot use %s as argument %d of type %s", argType, i+1, function.params[i])
+				}
+			}
+		}
+
+		resultTypes = append(resultTypes, function.returnType)
+	}
+
+	return newUnion(resultTypes...)
+}
+
+func (c *Checker) checkFunctionLiteral(function *ast.FunctionLiteral) Type {
+	functionScope := newScope(c.scope)
+
+	params := []Type{}
+	for i, param := range function.Parameters {
+		if i < len(function.ParameterTypes) && function.ParameterTypes[i] != nil {
+			paramType := c.resolveAnnotation(function.ParameterTypes[i])
+			functionScope.define(param.Value, paramType, true)
+			params = append(params, paramType)
+		} else {
+			functionScope.define(param.Value, anyType, false)
+			params = append(params, anyType)
+		}
+	}
+
+	context := &functionContext{}
+	if function.ReturnType != nil {
+		context.returnType = c.resolveAnnotation(function.ReturnType)
+	}
+
+	outerScope := c.scope
+	c.scope = functionScope
+	c.functions = append(c.functions, context)
+
+	bodyType := c.checkBlock(function.Body)
+
+	c.scope = outerScope
+	c.functions = c.functions[:len(c.functions)-1]
+
+	// Unless the function ends with a return statement, the value of its last statement is implicitly returned
+	returnTypes := context.returnTypes
+	statements := function.Body.Statements
+	if len(statements) == 0 || !isReturnStatement(statements[len(statements)-1]) {
+		if context.returnType != nil && !isAssignable(context.returnType, bodyType) {
+			tok := function.Token
+			if len(statements) > 0 {
+				tok = tokenOf(statements[len(statements)-1], tok)
+			}
+			c.errorf(tok, "cannot return %s from function with return type %s", bodyType, context.returnType)
+		}
+		returnTypes = append(returnTypes, bodyType)
+	}
+
+	returnType := context.returnType
+	if returnType == nil {
+		returnType = newUnion(returnTypes...)
+	}
+
+	return &functionType{params: params, returnType: returnType}
+}
+
+func isReturnStatement(statement ast.Statement) bool {
+	_, ok := statement.(*ast.ReturnStatement)
+	return ok
+}
+
+func tokenOf(statement ast.Statement, fallback token.Token) token.Token {
+	switch statement := statement.(type) {
+	case *ast.ExpressionStatement:
+		return statement.Token
+	case *ast.LetStatement:
+		return statement.Token
+	case *ast.ConstStatement:
+		return statement.Token
+	case *ast.AssignStatement:
+		return statement.Token
+	}
+	return fallback
+}
+
+// Returns the type of the function literal based only on its annotations, without checking its body. This is used
+// to define function bindings before their bodies are checked, so that recursive calls can be checked.
+func signatureOf(function *ast.FunctionLiteral) Type {
+	params := []Type{}
+	for i := range function.Parameters {
+		paramType := Type(anyType)
+		if i < len(function.ParameterTypes) && function.ParameterTypes[i] != nil {
+			paramType = annotationType(function.ParameterTypes[i])
+		}
+		params = append(params, paramType)
+	}
+
+	returnType := Type(anyType)
+	if function.ReturnType != nil {
+		returnType = annotationType(function.ReturnType)
+	}
+
+	return &functionType{params: params, returnType: returnType}
+}
+
+// Returns the type described by the annotation, reporting any unknown type names.
+func (c *Checker) resolveAnnotation(annotation *ast.TypeAnnotation) Type {
+	for _, name := range annotation.Types {
+		if _, ok := typesByName[name]; !ok {
+			c.errorf(annotation.Token, "unknown type: %s", name)
+		}
+	}
+	return annotationType(annotation)
+}
+
+// Returns the type described by the annotation. Unknown type names are treated as `any`.
+func annotationType(annotation *ast.TypeAnnotation) Type {
+	types := []Type{}
+	for _, name := range annotation.Types {
+		t, ok := typesByName[name]
+		if !ok {
+			t = anyType
+		}
+		types = append(types, t)
+	}
+	return newUnion(types...)
+}
+
+func (c *Checker) errorf(tok token.Token, format string, args ...interface{}) {
+	msg := fmt.Sprintf("line %d, column %d: %s", tok.LineNumber, tok.ColumnNumber, fmt.Sprintf(format, args...))
+	c.errors = append(c.errors, msg)
+}
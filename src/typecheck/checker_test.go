@@ -0,0 +1,259 @@
+package typecheck
+
+import (
+	"monkey/ast"
+	"monkey/lexer"
+	"monkey/parser"
+	"testing"
+)
+
+type checkerTestCase struct {
+	input          string
+	expectedErrors []string
+}
+
+func TestAnnotatedBindings(t *testing.T) {
+	tests := []checkerTestCase{
+		{input: `let n: int = 5;`, expectedErrors: []string{}},
+		{input: `let f: float = 5;`, expectedErrors: []string{}},
+		{input: `const s: string = "hi";`, expectedErrors: []string{}},
+		{input: `let a: any = [1, 2];`, expectedErrors: []string{}},
+		{input: `let x: int | string = "one"; x = 1;`, expectedErrors: []string{}},
+		{
+			input:          `let n: int = "five";`,
+			expectedErrors: []string{"line 1, column 4: cannot assign string to 'n' of type int"},
+		},
+		{
+			input:          `let n: int = 5.5;`,
+			expectedErrors: []string{"line 1, column 4: cannot assign float to 'n' of type int"},
+		},
+		{
+			input:          "let x: int | string = 1;\nx = true;",
+			expectedErrors: []string{"line 2, column 0: cannot assign bool to 'x' of type int | string"},
+		},
+		{
+			input:          `let n: int = 5; n += 0.5;`,
+			expectedErrors: []string{"line 1, column 16: cannot assign float to 'n' of type int"},
+		},
+		{
+			input:          `let n: number = 5;`,
+			expectedErrors: []string{"line 1, column 7: unknown type: number"},
+		},
+	}
+
+	runCheckerTests(t, tests)
+}
+
+func TestInference(t *testing.T) {
+	tests := []checkerTestCase{
+		{input: `let x = 5; let y: int = x * 2;`, expectedErrors: []string{}},
+		{input: `let x = 5; x = "five"; let y: int | string = x;`, expectedErrors: []string{}},
+		{input: `let x = if (true) { 1 } else { "one" }; let y: int | string = x;`, expectedErrors: []string{}},
+		{input: `let s = "a" + "b"; let t: string = s;`, expectedErrors: []string{}},
+		{input: `let b: bool = 1 < 2 && ("a" == "b");`, expectedErrors: []string{}},
+		{input: `let s: set = #{1} | #{2}; let b: bool = 1 in s;`, expectedErrors: []string{}},
+		{
+			input:          `let x = 5; x = "five"; let y: int = x;`,
+			expectedErrors: []string{"line 1, column 27: cannot assign int | string to 'y' of type int"},
+		},
+		{
+			input:          `let x = if (true) { 1 }; let y: int = x;`,
+			expectedErrors: []string{"line 1, column 29: cannot assign int | null to 'y' of type int"},
+		},
+		{
+			input:          `let q: int = 4 / 2;`,
+			expectedErrors: []string{"line 1, column 4: cannot assign float | int to 'q' of type int"},
+		},
+		{
+			input:          `let l: string = len("abc");`,
+			expectedErrors: []string{"line 1, column 4: cannot assign int to 'l' of type string"},
+		},
+	}
+
+	runCheckerTests(t, tests)
+}
+
+func TestOperators(t *testing.T) {
+	tests := []checkerTestCase{
+		{input: `1 + 2.5; "a" + "b"; [1] + [2]; #{1} - #{2}; 7 // 2; 7 % 2;`, expectedErrors: []string{}},
+		{input: `let f = fn(x) { x + 1 }; f(1) - "anything";`, expectedErrors: []string{}},
+		{input: `let x: int | float = 1; x * 2;`, expectedErrors: []string{}},
+		{input: `let v = {"__add__": fn(a, b) { a }}; v + v; v < v; {v: 1};`, expectedErrors: []string{}},
+		{
+			input:          `1 + "two";`,
+			expectedErrors: []string{"line 1, column 2: unsupported operand types for +: int and string"},
+		},
+		{
+			input:          `let x: int | string = 1; x * 2;`,
+			expectedErrors: []string{"line 1, column 27: unsupported operand types for *: int | string and int"},
+		},
+		{
+			input:          `-"hi";`,
+			expectedErrors: []string{"line 1, column 0: unsupported operand type for -: string"},
+		},
+		{
+			input:          `1 == "1";`,
+			expectedErrors: []string{"line 1, column 2: unsupported operand types for ==: int and string"},
+		},
+		{
+			input:          `1.5 % 2;`,
+			expectedErrors: []string{"line 1, column 4: unsupported operand types for %: float and int"},
+		},
+		{
+			input:          `1 in [1, 2];`,
+			expectedErrors: []string{"line 1, column 2: unsupported operand types for in: int and array"},
+		},
+		{
+			input:          `{[1]: 2};`,
+			expectedErrors: []string{"line 1, column 0: unusable as hash key: array"},
+		},
+		{
+			input:          `"abc"[0];`,
+			expectedErrors: []string{"line 1, column 5: index operator not supported: string"},
+		},
+		{
+			input:          `[1, 2]["one"];`,
+			expectedErrors: []string{"line 1, column 6: array index must be int, got string"},
+		},
+	}
+
+	runCheckerTests(t, tests)
+}
+
+func TestFunctions(t *testing.T) {
+	tests := []checkerTestCase{
+		{input: `let half = fn(x: float): float { x / 2 }; half(3);`, expectedErrors: []string{}},
+		{input: `let f = fn(x: int) { return x; }; let y: int = f(1);`, expectedErrors: []string{}},
+		{input: `let apply = fn(f: fn, x) { f(x) }; apply(fn(x) { x }, 1);`, expectedErrors: []string{}},
+		{input: `let double = (x) => x * 2; let y: int = double(2) + 1;`, expectedErrors: []string{}},
+		{
+			input: `
+			let fib = fn(n: int): int {
+				if (n < 2) { return n; }
+				fib(n - 1) + fib(n - 2)
+			};
+			fib(10);
+			`,
+			expectedErrors: []string{},
+		},
+		{
+			input: `
+			let even: bool = isEven(4);
+			fn isEven(n: int): bool { if (n == 0) { return true; } isOdd(n - 1) }
+			fn isOdd(n: int): bool { if (n == 0) { return false; } isEven(n - 1) }
+			`,
+			expectedErrors: []string{},
+		},
+		{
+			input:          `let s: string = half(1); fn half(x: int): float { x / 2 }`,
+			expectedErrors: []string{"line 1, column 4: cannot assign float to 's' of type string"},
+		},
+		{
+			input:          `fn f(x: int) { x } f("one");`,
+			expectedErrors: []string{"line 1, column 20: cannot use string as argument 1 of type int"},
+		},
+		{
+			input:          `let f = fn(x: int): int { x }; f("one");`,
+			expectedErrors: []string{"line 1, column 32: cannot use string as argument 1 of type int"},
+		},
+		{
+			input:          `let f = fn(x: int): int { x }; f(1, 2);`,
+			expectedErrors: []string{"line 1, column 32: wrong number of arguments: expected=1, got=2"},
+		},
+		{
+			input:          `let f = fn(x: int): string { x };`,
+			expectedErrors: []string{"line 1, column 29: cannot return int from function with return type string"},
+		},
+		{
+			input:          `let f = fn(x: int): string { if (x > 0) { return "pos"; } return x; };`,
+			expectedErrors: []string{"line 1, column 58: cannot return int from function with return type string"},
+		},
+		{
+			input:          `let f = fn(): int { let x = 1; };`,
+			expectedErrors: []string{"line 1, column 20: cannot return null from function with return type int"},
+		},
+		{
+			input:          `let f = fn() { 1 }; let s: string = f();`,
+			expectedErrors: []string{"line 1, column 24: cannot assign int to 's' of type string"},
+		},
+		{
+			input:          `let x = 5; x(1);`,
+			expectedErrors: []string{"line 1, column 12: cannot call value of type int"},
+		},
+		{
+			input:          `let f: fn = 5;`,
+			expectedErrors: []string{"line 1, column 4: cannot assign int to 'f' of type fn"},
+		},
+		{
+			input:          `union(#{1}, [1]);`,
+			expectedErrors: []string{"line 1, column 5: cannot use array as argument 2 of type set"},
+		},
+	}
+
+	runCheckerTests(t, tests)
+}
+
+func TestBlockScopes(t *testing.T) {
+	tests := []checkerTestCase{
+		{input: `let x: int = 1; if (true) { let x = "one"; }; x = 2;`, expectedErrors: []string{}},
+		{input: `for (let i = 0; i < 3; i++) { }; let i: string = "i";`, expectedErrors: []string{}},
+		{input: `let n = 0; while (n < 3) { let n: string = "n"; }; let m: int = n;`, expectedErrors: []string{}},
+		{
+			input:          `let x: int = 1; if (true) { x = "one"; }`,
+			expectedErrors: []string{"line 1, column 28: cannot assign string to 'x' of type int"},
+		},
+		{
+			input:          `switch 1 { case 1: let s: string = 1; }`,
+			expectedErrors: []string{"line 1, column 23: cannot assign int to 's' of type string"},
+		},
+	}
+
+	runCheckerTests(t, tests)
+}
+
+func TestCheckerPersistsBindings(t *testing.T) {
+	checker := NewChecker()
+
+	errors := checker.Check(parse(`let n: int = 1;`))
+	if len(errors) != 0 {
+		t.Fatalf("unexpected type errors: %v", errors)
+	}
+
+	// Bindings from programs with type errors are discarded, since those programs aren't run
+	errors = checker.Check(parse(`let n: string = 1;`))
+	if len(errors) != 1 {
+		t.Fatalf("expected 1 type error, got %v", errors)
+	}
+
+	errors = checker.Check(parse(`n = "one";`))
+	expected := "line 1, column 0: cannot assign string to 'n' of type int"
+	if len(errors) != 1 || errors[0] != expected {
+		t.Fatalf("wrong type errors. expected=%q, got=%v", expected, errors)
+	}
+}
+
+func runCheckerTests(t *testing.T, tests []checkerTestCase) {
+	t.Helper()
+
+	for _, test := range tests {
+		checker := NewChecker()
+		errors := checker.Check(parse(test.input))
+
+		if len(errors) != len(test.expectedErrors) {
+			t.Errorf("wrong number of type errors for input %q. expected=%v, got=%v", test.input, test.expectedErrors, errors)
+			continue
+		}
+
+		for i, expected := range test.expectedErrors {
+			if errors[i] != expected {
+				t.Errorf("wrong type error for input %q. expected=%q, got=%q", test.input, expected, errors[i])
+			}
+		}
+	}
+}
+
+func parse(input string) *ast.Program {
+	l := lexer.NewLexer(input)
+	p := parser.NewParser(l)
+	return p.ParseProgram()
+}
@@ -0,0 +1,188 @@
+package typecheck
+
+import (
+	"sort"
+	"strings"
+)
+
+// Represents a static type in the Monkey type checker.
+type Type interface {
+	String() string
+}
+
+// Represents a basic (non-composite) type, e.g. int or string. Arrays, hashmaps, and sets are treated as basic
+// types since their elements aren't tracked by the type checker.
+type basicType string
+
+func (bt basicType) String() string {
+	return string(bt)
+}
+
+const (
+	intType     = basicType("int")
+	floatType   = basicType("float")
+	boolType    = basicType("bool")
+	stringType  = basicType("string")
+	nullType    = basicType("null")
+	arrayType   = basicType("array")
+	hashMapType = basicType("hashmap")
+	setType     = basicType("set")
+)
+
+// Represents the dynamic type, which is compatible with every other type. Values of unannotated function
+// parameters, as well as values the type checker can't reason about (e.g. array elements), have this type.
+type dynamicType struct{}
+
+func (dt dynamicType) String() string {
+	return "any"
+}
+
+var anyType = dynamicType{}
+
+// Represents a union of two or more types, e.g. "int | string". Unions should be created with newUnion, which
+// keeps their members flattened, deduplicated, and sorted.
+type unionType struct {
+	members []Type
+}
+
+func (ut *unionType) String() string {
+	members := []string{}
+	for _, member := range ut.members {
+		members = append(members, member.String())
+	}
+	return strings.Join(members, " | ")
+}
+
+// Represents the type of a function. A nil params slice means that the function's parameters aren't known (e.g.
+// for the plain "fn" annotation or for variadic built-in functions), in which case calls aren't checked.
+type functionType struct {
+	params     []Type
+	returnType Type
+}
+
+func (ft *functionType) String() string {
+	if ft.params == nil {
+		return "fn"
+	}
+
+	params := []string{}
+	for _, param := range ft.params {
+		params = append(params, param.String())
+	}
+	return "fn(" + strings.Join(params, ", ") + "): " + ft.returnType.String()
+}
+
+// The function type used for the plain "fn" annotation, which accepts any function.
+var fnType = &functionType{returnType: anyType}
+
+var typesByName = map[string]Type{
+	"int":     intType,
+	"float":   floatType,
+	"bool":    boolType,
+	"string":  stringType,
+	"null":    nullType,
+	"array":   arrayType,
+	"hashmap": hashMapType,
+	"set":     setType,
+	"fn":      fnType,
+	"any":     anyType,
+}
+
+// Creates the union of the provided types. Nested unions are flattened and duplicate members are removed. If any of
+// the types is `any`, the union is `any`; if only a single distinct type remains, that type is returned.
+func newUnion(types ...Type) Type {
+	members := []Type{}
+	seen := map[string]bool{}
+
+	var add func(t Type)
+	add = func(t Type) {
+		if union, ok := t.(*unionType); ok {
+			for _, member := range union.members {
+				add(member)
+			}
+			return
+		}
+
+		if !seen[t.String()] {
+			seen[t.String()] = true
+			members = append(members, t)
+		}
+	}
+
+	for _, t := range types {
+		if _, ok := t.(dynamicType); ok {
+			return anyType
+		}
+		add(t)
+	}
+
+	if len(members) == 1 {
+		return members[0]
+	}
+
+	sort.Slice(members, func(i, j int) bool {
+		return members[i].String() < members[j].String()
+	})
+	return &unionType{members: members}
+}
+
+// Returns the members of the provided type if it is a union, or the type itself otherwise.
+func membersOf(t Type) []Type {
+	if union, ok := t.(*unionType); ok {
+		return union.members
+	}
+	return []Type{t}
+}
+
+// Reports whether a value of type `from` can be used where a value of type `to` is expected. Integers are
+// implicitly widened to floats, since the two are interchangeable in all arithmetic operations.
+func isAssignable(to Type, from Type) bool {
+	if _, ok := to.(dynamicType); ok {
+		return true
+	}
+	if _, ok := from.(dynamicType); ok {
+		return true
+	}
+
+	if fromUnion, ok := from.(*unionType); ok {
+		for _, member := range fromUnion.members {
+			if !isAssignable(to, member) {
+				return false
+			}
+		}
+		return true
+	}
+
+	if toUnion, ok := to.(*unionType); ok {
+		for _, member := range toUnion.members {
+			if isAssignable(member, from) {
+				return true
+			}
+		}
+		return false
+	}
+
+	switch to := to.(type) {
+	case basicType:
+		return to == from || (to == floatType && from == intType)
+	case *functionType:
+		fromFunction, ok := from.(*functionType)
+		if !ok {
+			return false
+		}
+		if to.params == nil || fromFunction.params == nil {
+			return true
+		}
+		if len(to.params) != len(fromFunction.params) {
+			return false
+		}
+		for i := range to.params {
+			if !isAssignable(fromFunction.params[i], to.params[i]) {
+				return false
+			}
+		}
+		return isAssignable(to.returnType, fromFunction.returnType)
+	}
+
+	return false
+}
@@ -66,6 +66,14 @@ func TestLen(t *testing.T) {
 			input:    `len({1: 2, "hi": "there", true: false})`,
 			expected: 3,
 		},
+		{
+			input:    `len(#{})`,
+			expected: 0,
+		},
+		{
+			input:    `len(#{1, 2, 2, "two"})`,
+			expected: 3,
+		},
 		{
 			input:    `len()`,
 			expected: &object.Error{Message: "wrong number of arguments. expected=1, got=0"},
@@ -311,3 +319,38 @@ func TestSum(t *testing.T) {
 
 	runVMTests(t, tests)
 }
+
+func TestSetOperations(t *testing.T) {
+	tests := []vmTestCase{
+		{
+			input:    `union(#{1, 2}, #{2, 3})`,
+			expected: inspectedSet("#{1, 2, 3}"),
+		},
+		{
+			input:    `intersection(#{1, 2}, #{2, 3})`,
+			expected: inspectedSet("#{2}"),
+		},
+		{
+			input:    `difference(#{1, 2}, #{2, 3})`,
+			expected: inspectedSet("#{1}"),
+		},
+		{
+			input:    `difference(#{}, #{2, 3})`,
+			expected: inspectedSet("#{}"),
+		},
+		{
+			input:    `union(#{1})`,
+			expected: &object.Error{Message: "wrong number of arguments. expected=2, got=1"},
+		},
+		{
+			input:    `intersection([1], #{1})`,
+			expected: &object.Error{Message: "first argument to `intersection` must be a set, got ARRAY"},
+		},
+		{
+			input:    `difference(#{1}, {1: 1})`,
+			expected: &object.Error{Message: "second argument to `difference` must be a set, got HASHMAP"},
+		},
+	}
+
+	runVMTests(t, tests)
+}
@@ -10,6 +10,8 @@ type Frame struct {
 	cl          *object.Closure
 	ip          int
 	basePointer int
+
+	deferred []*object.DeferredCall // The calls deferred by this frame, in the order in which they were deferred.
 }
 
 func NewFrame(cl *object.Closure, basePointer int) *Frame {
@@ -1,21 +1,23 @@
 package vm
 
 import (
+	"errors"
 	"fmt"
-	"math"
+	"io"
 	"monkey/bytecode"
 	"monkey/compiler"
 	"monkey/object"
+	"os"
 )
 
 const StackSize = 2048
 const GlobalsSize = 65536
 const MaxFrames = 1024
 
-var True = &object.Boolean{Value: true}
-var False = &object.Boolean{Value: false}
+var True = object.TRUE
+var False = object.FALSE
 
-var Null = &object.Null{}
+var Null = object.NULL
 
 // Represents a virtual machine used to execute bytecode instructions generated by the Monkey programming language compiler.
 type VM struct {
@@ -28,10 +30,21 @@ type VM struct {
 
 	frames      []*Frame
 	framesIndex int
+
+	openUpvalues []*object.Upvalue // The upvalues pointing to variables that are still live on the stack.
+
+	filename string // The name of the file the program was compiled from (if any), used to locate runtime errors.
+
+	output io.Writer // The writer to which the program prints.
 }
 
 func NewVM(bytecode *compiler.Bytecode) *VM {
-	mainFn := &object.CompiledFunction{Instructions: bytecode.Instructions}
+	mainFn := &object.CompiledFunction{
+		Name:         object.MainFunctionName,
+		Instructions: bytecode.Instructions,
+		NumLocals:    bytecode.NumLocals,
+		Positions:    bytecode.Positions,
+	}
 	mainClosure := &object.Closure{Fn: mainFn}
 	mainFrame := NewFrame(mainClosure, 0)
 
@@ -42,37 +55,108 @@ func NewVM(bytecode *compiler.Bytecode) *VM {
 		constants: bytecode.Constants,
 
 		stack: make([]object.Object, StackSize),
-		sp:    0,
+		sp:    mainFn.NumLocals, // Reserve slots at the bottom of the stack for the main frame's locals
 
-		globals: make([]object.Object, GlobalsSize),
+		globals: make([]object.Object, max(GlobalsSize, bytecode.NumGlobals)),
 
 		frames:      frames,
 		framesIndex: 1,
+
+		filename: bytecode.Filename,
+
+		output: os.Stdout,
 	}
 }
 
+// Creates a VM using the given globals store, which is grown (keeping its contents) if the program uses more globals
+// than it has room for. The VM's Globals should be passed to the next VM sharing the store.
 func NewVMWithGlobalsStore(bytecode *compiler.Bytecode, globals []object.Object) *VM {
 	vm := NewVM(bytecode)
+	if len(globals) < bytecode.NumGlobals {
+		globals = append(globals, make([]object.Object, bytecode.NumGlobals-len(globals))...)
+	}
 	vm.globals = globals
 	return vm
 }
 
+func (vm *VM) Globals() []object.Object {
+	return vm.globals
+}
+
+// Makes the program print to the given writer rather than to standard output.
+func (vm *VM) SetOutput(w io.Writer) {
+	vm.output = w
+}
+
+func (vm *VM) Output() io.Writer {
+	return vm.output
+}
+
+// Runs the program to completion, followed by the calls deferred at its top level. If a runtime error occurs, the
+// calls deferred by each of the active frames are run (innermost first) before the error is returned. Errors are
+// always of type `*object.RuntimeError`.
 func (vm *VM) Run() error {
+	err := vm.run(0)
+	if err != nil {
+		vm.unwindTo(0)
+		return err
+	}
+
+	// Running the deferred calls uses the stack above the last popped element, which is preserved for the caller
+	lastPopped := vm.stack[vm.sp]
+	err = vm.runDeferredCalls(vm.currentFrame())
+	vm.stack[vm.sp] = lastPopped
+	if err != nil {
+		vm.unwindTo(0)
+
+		// A deferred call which can't be made at all fails after the top-level code has finished, with no position
+		var runtimeErr *object.RuntimeError
+		if !errors.As(err, &runtimeErr) {
+			runtimeErr = &object.RuntimeError{
+				Message:  err.Error(),
+				Filename: vm.filename,
+				Trace:    []object.StackFrame{{Function: object.MainFunctionName}},
+			}
+		}
+		return runtimeErr
+	}
+	return nil
+}
+
+// Executes instructions until the frame at the given depth (the number of frames below it) returns, or until the
+// main frame's instructions are exhausted. Errors are returned as runtime errors, located at the instruction that
+// caused them.
+func (vm *VM) run(returnDepth int) error {
+	err := vm.execute(returnDepth)
+	if err != nil {
+		return vm.runtimeError(err)
+	}
+	return nil
+}
+
+func (vm *VM) execute(returnDepth int) error {
 	var ip int
 	var instr bytecode.Instructions
 	var op bytecode.Opcode
 
-	for vm.currentFrame().ip < len(vm.currentFrame().Instructions())-1 {
+	for vm.framesIndex > returnDepth && vm.currentFrame().ip < len(vm.currentFrame().Instructions())-1 {
 		vm.currentFrame().ip += 1
 
 		ip = vm.currentFrame().ip
 		instr = vm.currentFrame().Instructions()
 		op = bytecode.Opcode(instr[ip])
 
+		// An `OpWide` prefix makes each of the operands of the instruction following it 4 bytes wide
+		wide := op == bytecode.OpWide
+		if wide {
+			vm.currentFrame().ip += 1
+			ip += 1
+			op = bytecode.Opcode(instr[ip])
+		}
+
 		switch op {
 		case bytecode.OpConstant:
-			constIndex := bytecode.ReadUint16(instr[ip+1:])
-			vm.currentFrame().ip += 2
+			constIndex := vm.readOperand(instr, 2, wide)
 
 			err := vm.push(vm.constants[constIndex])
 			if err != nil {
@@ -97,18 +181,24 @@ func (vm *VM) Run() error {
 		case bytecode.OpPop:
 			vm.pop()
 		case bytecode.OpJumpNotTruthy:
-			jumpToPos := int(bytecode.ReadUint16(instr[ip+1:]))
-			vm.currentFrame().ip += 2
+			jumpToPos := vm.readOperand(instr, 2, wide)
+
+			condition := vm.pop()
+			if !object.IsTruthy(condition) {
+				vm.currentFrame().ip = jumpToPos - 1 // Set to `pos - 1` since this loop increments ip on each iteration
+			}
+		case bytecode.OpJumpTruthy:
+			jumpToPos := vm.readOperand(instr, 2, wide)
 
 			condition := vm.pop()
-			if !isTruthy(condition) {
+			if object.IsTruthy(condition) {
 				vm.currentFrame().ip = jumpToPos - 1 // Set to `pos - 1` since this loop increments ip on each iteration
 			}
 		case bytecode.OpJump:
-			jumpToPos := int(bytecode.ReadUint16(instr[ip+1:]))
+			jumpToPos := vm.readOperand(instr, 2, wide)
 			vm.currentFrame().ip = jumpToPos - 1 // Set to `pos - 1` since this loop increments ip on each iteration
 
-		case bytecode.OpAdd, bytecode.OpSub, bytecode.OpMul, bytecode.OpDiv, bytecode.OpIntegerDiv, bytecode.OpExp, bytecode.OpMod:
+		case bytecode.OpAdd, bytecode.OpSub, bytecode.OpMul, bytecode.OpDiv, bytecode.OpIntegerDiv, bytecode.OpExp, bytecode.OpMod, bytecode.OpUnion, bytecode.OpIntersection:
 			err := vm.executeBinaryOperation(op)
 			if err != nil {
 				return err
@@ -123,6 +213,11 @@ func (vm *VM) Run() error {
 			if err != nil {
 				return err
 			}
+		case bytecode.OpIn:
+			err := vm.executeMembership()
+			if err != nil {
+				return err
+			}
 
 		case bytecode.OpMinus:
 			err := vm.executeMinusOperator()
@@ -136,21 +231,18 @@ func (vm *VM) Run() error {
 			}
 
 		case bytecode.OpGetGlobal:
-			globalIndex := int(bytecode.ReadUint16(instr[ip+1:]))
-			vm.currentFrame().ip += 2
+			globalIndex := vm.readOperand(instr, 2, wide)
 
 			err := vm.push(vm.globals[globalIndex])
 			if err != nil {
 				return err
 			}
 		case bytecode.OpSetGlobal:
-			globalIndex := int(bytecode.ReadUint16(instr[ip+1:]))
-			vm.currentFrame().ip += 2
+			globalIndex := vm.readOperand(instr, 2, wide)
 
 			vm.globals[globalIndex] = vm.pop()
 		case bytecode.OpGetLocal:
-			localIndex := int(bytecode.ReadUint8(instr[ip+1:]))
-			vm.currentFrame().ip += 1
+			localIndex := vm.readOperand(instr, 1, wide)
 
 			frame := vm.currentFrame()
 			err := vm.push(vm.stack[frame.basePointer+localIndex])
@@ -158,15 +250,24 @@ func (vm *VM) Run() error {
 				return err
 			}
 		case bytecode.OpSetLocal:
-			localIndex := int(bytecode.ReadUint8(instr[ip+1:]))
-			vm.currentFrame().ip += 1
+			localIndex := vm.readOperand(instr, 1, wide)
 
 			frame := vm.currentFrame()
 			vm.stack[frame.basePointer+localIndex] = vm.pop()
 
+		case bytecode.OpClearLocal:
+			localIndex := vm.readOperand(instr, 1, wide)
+
+			frame := vm.currentFrame()
+			vm.stack[frame.basePointer+localIndex] = nil
+		case bytecode.OpSetLocalKeep:
+			localIndex := vm.readOperand(instr, 1, wide)
+
+			frame := vm.currentFrame()
+			vm.stack[frame.basePointer+localIndex] = vm.stack[vm.sp-1]
+
 		case bytecode.OpArray:
-			numElements := int(bytecode.ReadUint16(instr[ip+1:]))
-			vm.currentFrame().ip += 2
+			numElements := vm.readOperand(instr, 2, wide)
 
 			array := vm.buildArray(vm.sp-numElements, vm.sp)
 			vm.sp = vm.sp - numElements
@@ -176,8 +277,7 @@ func (vm *VM) Run() error {
 				return err
 			}
 		case bytecode.OpHashMap:
-			numElements := int(bytecode.ReadUint16(instr[ip+1:]))
-			vm.currentFrame().ip += 2
+			numElements := vm.readOperand(instr, 2, wide)
 
 			hashmap, err := vm.buildHashMap(vm.sp-numElements, vm.sp)
 			if err != nil {
@@ -189,6 +289,19 @@ func (vm *VM) Run() error {
 			if err != nil {
 				return err
 			}
+		case bytecode.OpSet:
+			numElements := vm.readOperand(instr, 2, wide)
+
+			set, err := vm.buildSet(vm.sp-numElements, vm.sp)
+			if err != nil {
+				return err
+			}
+			vm.sp -= numElements
+
+			err = vm.push(set)
+			if err != nil {
+				return err
+			}
 		case bytecode.OpIndex:
 			index := vm.pop()
 			left := vm.pop()
@@ -199,8 +312,7 @@ func (vm *VM) Run() error {
 			}
 
 		case bytecode.OpCall:
-			numArgs := int(bytecode.ReadUint8(instr[ip+1:]))
-			vm.currentFrame().ip += 1
+			numArgs := vm.readOperand(instr, 1, wide)
 
 			err := vm.executeCall(numArgs)
 			if err != nil {
@@ -209,24 +321,41 @@ func (vm *VM) Run() error {
 		case bytecode.OpReturnValue:
 			returnValue := vm.pop()
 
-			frame := vm.popFrame()        // Pop the function frame that has just finished execution
-			vm.sp = frame.basePointer - 1 // Reset the stack pointer to where it was prior to entering this function (-1 to pop off the function itself as well)
+			if vm.framesIndex == 1 {
+				// A `return` at the top level ends the program, leaving the returned value as the last popped element
+				vm.currentFrame().ip = len(vm.currentFrame().Instructions()) - 1
+				continue
+			}
 
-			err := vm.push(returnValue) // Put the function return value at the top of the stack
+			err := vm.runDeferredCalls(vm.currentFrame())
+			if err != nil {
+				return err
+			}
+
+			frame := vm.popFrame()              // Pop the function frame that has just finished execution
+			vm.closeUpvalues(frame.basePointer) // Move the function's captured locals off of the stack before they're overwritten
+			vm.sp = frame.basePointer - 1       // Reset the stack pointer to where it was prior to entering this function (-1 to pop off the function itself as well)
+
+			err = vm.push(returnValue) // Put the function return value at the top of the stack
 			if err != nil {
 				return err
 			}
 		case bytecode.OpReturn:
+			err := vm.runDeferredCalls(vm.currentFrame())
+			if err != nil {
+				return err
+			}
+
 			frame := vm.popFrame()
+			vm.closeUpvalues(frame.basePointer)
 			vm.sp = frame.basePointer - 1
 
-			err := vm.push(Null)
+			err = vm.push(Null)
 			if err != nil {
 				return err
 			}
 		case bytecode.OpGetBuiltIn:
-			builtInIndex := int(bytecode.ReadUint8(instr[ip+1:]))
-			vm.currentFrame().ip += 1
+			builtInIndex := vm.readOperand(instr, 1, wide)
 
 			definition := object.BuiltIns[builtInIndex]
 
@@ -235,29 +364,163 @@ func (vm *VM) Run() error {
 				return err
 			}
 		case bytecode.OpClosure:
-			constIndex := int(bytecode.ReadUint16(instr[ip+1:]))
-			numFreeVars := int(bytecode.ReadUint8(instr[ip+3:]))
-			vm.currentFrame().ip += 3
+			constIndex := vm.readOperand(instr, 2, wide)
+			numUpvalues := vm.readOperand(instr, 1, wide)
 
-			err := vm.pushClosure(constIndex, numFreeVars)
+			err := vm.pushClosure(constIndex, numUpvalues)
 			if err != nil {
 				return err
 			}
-		case bytecode.OpGetFreeVar:
-			freeVarIndex := int(bytecode.ReadUint8(instr[ip+1:]))
-			vm.currentFrame().ip += 1
+		case bytecode.OpGetUpvalue:
+			upvalueIndex := vm.readOperand(instr, 1, wide)
+
+			currentClosure := vm.currentFrame().cl
+			err := vm.push(*currentClosure.Upvalues[upvalueIndex].Location)
+			if err != nil {
+				return err
+			}
+		case bytecode.OpSetUpvalue:
+			upvalueIndex := vm.readOperand(instr, 1, wide)
+
+			currentClosure := vm.currentFrame().cl
+			*currentClosure.Upvalues[upvalueIndex].Location = vm.pop()
+		case bytecode.OpCaptureLocal:
+			localIndex := vm.readOperand(instr, 1, wide)
+
+			frame := vm.currentFrame()
+			err := vm.push(vm.captureUpvalue(frame.basePointer + localIndex))
+			if err != nil {
+				return err
+			}
+		case bytecode.OpCaptureUpvalue:
+			upvalueIndex := vm.readOperand(instr, 1, wide)
 
 			currentClosure := vm.currentFrame().cl
-			err := vm.push(currentClosure.FreeVars[freeVarIndex])
+			err := vm.push(currentClosure.Upvalues[upvalueIndex])
+			if err != nil {
+				return err
+			}
+		case bytecode.OpCaptureCurrentClosure:
+			currentClosure := vm.currentFrame().cl
+			err := vm.push(object.NewClosedUpvalue(currentClosure))
 			if err != nil {
 				return err
 			}
+		case bytecode.OpCloseUpvalues:
+			localIndex := vm.readOperand(instr, 1, wide)
+
+			vm.closeUpvalues(vm.currentFrame().basePointer + localIndex)
 		case bytecode.OpCurrentClosure:
 			currentClosure := vm.currentFrame().cl
 			err := vm.push(currentClosure)
 			if err != nil {
 				return err
 			}
+		case bytecode.OpAssertFail:
+			descriptionIndex := vm.readOperand(instr, 2, wide)
+			numReferenced := vm.readOperand(instr, 1, wide)
+
+			return vm.assertionFailure(descriptionIndex, numReferenced)
+
+		case bytecode.OpCheckDefined:
+			messageIndex := vm.readOperand(instr, 2, wide)
+
+			// The message already starts with the location of the variable, so the error's position is left out
+			if vm.stack[vm.sp-1] == nil {
+				return &object.RuntimeError{
+					Message:  vm.constants[messageIndex].(*object.String).Value,
+					Filename: vm.filename,
+					Trace:    vm.stackTrace(),
+				}
+			}
+
+		case bytecode.OpDefer:
+			numArgs := vm.readOperand(instr, 1, wide)
+
+			args := make([]object.Object, numArgs)
+			copy(args, vm.stack[vm.sp-numArgs:vm.sp])
+			fn := vm.stack[vm.sp-numArgs-1]
+			vm.sp = vm.sp - numArgs - 1
+
+			frame := vm.currentFrame()
+			frame.deferred = append(frame.deferred, &object.DeferredCall{Fn: fn, Args: args})
+
+		case bytecode.OpGetLocal0, bytecode.OpGetLocal1, bytecode.OpGetLocal2, bytecode.OpGetLocal3:
+			frame := vm.currentFrame()
+			err := vm.push(vm.stack[frame.basePointer+int(op-bytecode.OpGetLocal0)])
+			if err != nil {
+				return err
+			}
+		case bytecode.OpAddConst, bytecode.OpSubConst:
+			constIndex := vm.readOperand(instr, 2, wide)
+
+			left := vm.pop()
+			result, ok := integerArithmetic(op, left, vm.constants[constIndex])
+			if !ok {
+				var err error
+				result, err = object.BinaryOperation(vm, binaryOperators[op], left, vm.constants[constIndex])
+				if err != nil {
+					return err
+				}
+			}
+
+			err := vm.push(result)
+			if err != nil {
+				return err
+			}
+		case bytecode.OpIncLocal:
+			localIndex := vm.readOperand(instr, 1, wide)
+			constIndex := vm.readOperand(instr, 2, wide)
+
+			slot := vm.currentFrame().basePointer + localIndex
+			result, ok := integerArithmetic(bytecode.OpAdd, vm.stack[slot], vm.constants[constIndex])
+			if !ok {
+				var err error
+				result, err = object.BinaryOperation(vm, "+", vm.stack[slot], vm.constants[constIndex])
+				if err != nil {
+					return err
+				}
+			}
+			vm.stack[slot] = result
+		case bytecode.OpLessThanJump, bytecode.OpEqualJump:
+			jumpToPos := vm.readOperand(instr, 2, wide)
+
+			right := vm.pop()
+			left := vm.pop()
+			result, ok := integerComparison(op, left, right)
+			if !ok {
+				var err error
+				result, err = object.Comparison(vm, binaryOperators[op], left, right)
+				if err != nil {
+					return err
+				}
+			}
+
+			if !object.IsTruthy(result) {
+				vm.currentFrame().ip = jumpToPos - 1 // Set to `pos - 1` since this loop increments ip on each iteration
+			}
+		case bytecode.OpCallGlobal:
+			globalIndex := vm.readOperand(instr, 2, wide)
+			numArgs := vm.readOperand(instr, 1, wide)
+
+			// The arguments are moved up a slot, so that the function sits below them as it would for an `OpCall`
+			if vm.sp >= StackSize {
+				return fmt.Errorf("stack overflow - stack of size %d is already full", StackSize)
+			}
+			copy(vm.stack[vm.sp-numArgs+1:vm.sp+1], vm.stack[vm.sp-numArgs:vm.sp])
+			vm.stack[vm.sp-numArgs] = vm.globals[globalIndex]
+			vm.sp += 1
+
+			// Functions stored in globals are almost always closures, which are called without dispatching on the callee
+			var err error
+			if closure, ok := vm.globals[globalIndex].(*object.Closure); ok {
+				err = vm.callClosure(closure, numArgs)
+			} else {
+				err = vm.executeCall(numArgs)
+			}
+			if err != nil {
+				return err
+			}
 
 		default:
 			return fmt.Errorf("invalid opcode received: %d", op)
@@ -274,6 +537,24 @@ func (vm *VM) StackTop() object.Object {
 	return vm.stack[vm.sp-1]
 }
 
+// Reads the next operand of the current instruction, advancing the instruction pointer past it. The operand is of the
+// given width, unless the instruction is prefixed by `OpWide`.
+func (vm *VM) readOperand(instr bytecode.Instructions, width int, wide bool) int {
+	frame := vm.currentFrame()
+	offset := frame.ip + 1
+
+	if wide {
+		frame.ip += bytecode.WideOperandWidth
+		return int(bytecode.ReadUint32(instr[offset:]))
+	}
+
+	frame.ip += width
+	if width == 1 {
+		return int(bytecode.ReadUint8(instr[offset:]))
+	}
+	return int(bytecode.ReadUint16(instr[offset:]))
+}
+
 func (vm *VM) LastPoppedStackElem() object.Object {
 	return vm.stack[vm.sp]
 }
@@ -289,23 +570,55 @@ func (vm *VM) push(obj object.Object) error {
 	return nil
 }
 
-func (vm *VM) pushClosure(constIndex int, numFreeVars int) error {
+func (vm *VM) pushClosure(constIndex int, numUpvalues int) error {
 	constant := vm.constants[constIndex]
 	function, ok := constant.(*object.CompiledFunction)
 	if !ok {
 		return fmt.Errorf("not a function: %+v", function)
 	}
 
-	freeVars := make([]object.Object, numFreeVars)
-	for i := 0; i < numFreeVars; i++ {
-		freeVars[i] = vm.stack[vm.sp-numFreeVars+i]
+	upvalues := make([]*object.Upvalue, numUpvalues)
+	for i := 0; i < numUpvalues; i++ {
+		upvalues[i] = vm.stack[vm.sp-numUpvalues+i].(*object.Upvalue)
 	}
-	vm.sp = vm.sp - numFreeVars
+	vm.sp = vm.sp - numUpvalues
 
-	closure := &object.Closure{Fn: function, FreeVars: freeVars}
+	closure := &object.Closure{Fn: function, Upvalues: upvalues}
 	return vm.push(closure)
 }
 
+// Returns an open upvalue for the variable in the given stack slot. Closures capturing the same variable share a
+// single upvalue, so that they all observe each other's updates.
+func (vm *VM) captureUpvalue(slot int) *object.Upvalue {
+	for _, upvalue := range vm.openUpvalues {
+		if upvalue.Slot == slot {
+			return upvalue
+		}
+	}
+
+	upvalue := object.NewOpenUpvalue(&vm.stack[slot], slot)
+	vm.openUpvalues = append(vm.openUpvalues, upvalue)
+	return upvalue
+}
+
+// Closes all open upvalues for variables in stack slots at or above the given slot, since those slots are about to
+// be released (e.g. when a function returns or a block ends).
+func (vm *VM) closeUpvalues(fromSlot int) {
+	if len(vm.openUpvalues) == 0 {
+		return
+	}
+
+	stillOpen := vm.openUpvalues[:0]
+	for _, upvalue := range vm.openUpvalues {
+		if upvalue.Slot >= fromSlot {
+			upvalue.Close()
+		} else {
+			stillOpen = append(stillOpen, upvalue)
+		}
+	}
+	vm.openUpvalues = stillOpen
+}
+
 func (vm *VM) pop() object.Object {
 	obj := vm.stack[vm.sp-1]
 	vm.sp -= 1
@@ -326,111 +639,92 @@ func (vm *VM) popFrame() *Frame {
 	return vm.frames[vm.framesIndex]
 }
 
-func nativeBoolToBooleanObject(input bool) *object.Boolean {
-	if input {
-		return True
-	} else {
-		return False
-	}
-}
-
-func isTruthy(obj object.Object) bool {
-	switch obj := obj.(type) {
-	case *object.Boolean:
-		return obj.Value
-	case *object.Null:
-		return false
-	default:
-		return true
-	}
+// The operator symbols corresponding to the opcodes of the binary operators, whose semantics are shared with the
+// evaluator. The symbols are indexed by opcode, which is quicker to look up than a map.
+var binaryOperators = [...]string{
+	bytecode.OpAdd:                  "+",
+	bytecode.OpSub:                  "-",
+	bytecode.OpMul:                  "*",
+	bytecode.OpDiv:                  "/",
+	bytecode.OpIntegerDiv:           "//",
+	bytecode.OpExp:                  "**",
+	bytecode.OpMod:                  "%",
+	bytecode.OpUnion:                "|",
+	bytecode.OpIntersection:         "&",
+	bytecode.OpAnd:                  "&&",
+	bytecode.OpOr:                   "||",
+	bytecode.OpEqual:                "==",
+	bytecode.OpNotEqual:             "!=",
+	bytecode.OpLessThan:             "<",
+	bytecode.OpGreaterThan:          ">",
+	bytecode.OpLessThanOrEqualTo:    "<=",
+	bytecode.OpGreaterThanOrEqualTo: ">=",
+
+	bytecode.OpAddConst:     "+",
+	bytecode.OpSubConst:     "-",
+	bytecode.OpLessThanJump: "<",
+	bytecode.OpEqualJump:    "==",
 }
 
 func (vm *VM) executeBinaryOperation(op bytecode.Opcode) error {
 	right := vm.pop()
 	left := vm.pop()
 
-	leftType := left.Type()
-	rightType := right.Type()
+	if result, ok := integerArithmetic(op, left, right); ok {
+		return vm.push(result)
+	}
 
-	switch {
-	case object.IsNumerical(leftType) && object.IsNumerical(rightType):
-		return vm.executeBinaryNumericalOperation(op, left, right)
-	case leftType == object.STRING_OBJ && rightType == object.STRING_OBJ:
-		return vm.executeBinaryStringOperation(op, left, right)
-	case leftType == object.ARRAY_OBJ && rightType == object.ARRAY_OBJ:
-		return vm.executeBinaryArrayOperation(op, left, right)
-	default:
-		return fmt.Errorf("unsupported types for binary operation: %s %s", leftType, rightType)
+	result, err := object.BinaryOperation(vm, binaryOperators[op], left, right)
+	if err != nil {
+		return err
 	}
+	return vm.push(result)
 }
 
-func (vm *VM) executeBinaryNumericalOperation(op bytecode.Opcode, left object.Object, right object.Object) error {
-	var result interface{}
-
-	leftValue, leftIsFloat, _ := object.GetNumericalValue(left)
-	rightValue, rightIsFloat, _ := object.GetNumericalValue(right)
-
-	isFloatOperation := leftIsFloat || rightIsFloat
-
-	switch op {
-	case bytecode.OpAdd:
-		result = leftValue + rightValue
-	case bytecode.OpSub:
-		result = leftValue - rightValue
-	case bytecode.OpMul:
-		result = leftValue * rightValue
-	case bytecode.OpDiv:
-		if rightValue == 0 {
-			return fmt.Errorf("division by zero")
-		}
-		result = leftValue / rightValue
-		if !isFloatOperation && int64(leftValue)%int64(rightValue) != 0 {
-			isFloatOperation = true
-		}
-	case bytecode.OpIntegerDiv:
-		if rightValue == 0 {
-			return fmt.Errorf("division by zero")
-		}
-		return vm.push(&object.Integer{Value: int64(leftValue / rightValue)})
-	case bytecode.OpExp:
-		result = math.Pow(leftValue, rightValue)
-	case bytecode.OpMod:
-		if isFloatOperation {
-			return fmt.Errorf("modulus operation not supported for float values")
-		}
-		return vm.push(&object.Integer{Value: int64(leftValue) % int64(rightValue)})
-	default:
-		return fmt.Errorf("unknown binary numerical operator: %d", op)
+// Applies an addition or subtraction (including those of superinstructions) to two integers without going through
+// object.BinaryOperation, reporting whether the fast path applied. Like object.BinaryOperation, the operation is
+// carried out on float64 values, so that the result is identical to the evaluator's.
+func integerArithmetic(op bytecode.Opcode, left object.Object, right object.Object) (object.Object, bool) {
+	leftInteger, ok := left.(*object.Integer)
+	if !ok {
+		return nil, false
 	}
-
-	if isFloatOperation {
-		return vm.push(&object.Float{Value: result.(float64)})
-	} else {
-		return vm.push(&object.Integer{Value: int64(result.(float64))})
+	rightInteger, ok := right.(*object.Integer)
+	if !ok {
+		return nil, false
 	}
-}
-
-func (vm *VM) executeBinaryStringOperation(op bytecode.Opcode, left object.Object, right object.Object) error {
-	leftValue := left.(*object.String).Value
-	rightValue := right.(*object.String).Value
 
 	switch op {
-	case bytecode.OpAdd:
-		return vm.push(&object.String{Value: leftValue + rightValue})
+	case bytecode.OpAdd, bytecode.OpAddConst:
+		return &object.Integer{Value: int64(float64(leftInteger.Value) + float64(rightInteger.Value))}, true
+	case bytecode.OpSub, bytecode.OpSubConst:
+		return &object.Integer{Value: int64(float64(leftInteger.Value) - float64(rightInteger.Value))}, true
 	default:
-		return fmt.Errorf("unknown binary string operator: %d", op)
+		return nil, false
 	}
 }
 
-func (vm *VM) executeBinaryArrayOperation(op bytecode.Opcode, left object.Object, right object.Object) error {
-	leftElements := left.(*object.Array).Elements
-	rightElements := right.(*object.Array).Elements
+// Applies the comparison of a compare-and-jump superinstruction to two integers without going through
+// object.Comparison, reporting whether the fast path applied. Distinct integers are never within the threshold under
+// which floats are considered equal, so they're equal exactly when their float64 values are.
+func integerComparison(op bytecode.Opcode, left object.Object, right object.Object) (object.Object, bool) {
+	leftInteger, ok := left.(*object.Integer)
+	if !ok {
+		return nil, false
+	}
+	rightInteger, ok := right.(*object.Integer)
+	if !ok {
+		return nil, false
+	}
 
+	leftValue, rightValue := float64(leftInteger.Value), float64(rightInteger.Value)
 	switch op {
-	case bytecode.OpAdd:
-		return vm.push(&object.Array{Elements: append(leftElements, rightElements...)})
+	case bytecode.OpLessThanJump:
+		return object.NativeBoolToBooleanObject(leftValue < rightValue), true
+	case bytecode.OpEqualJump:
+		return object.NativeBoolToBooleanObject(leftValue == rightValue), true
 	default:
-		return fmt.Errorf("unknown binary array operator: %d", op)
+		return nil, false
 	}
 }
 
@@ -438,121 +732,49 @@ func (vm *VM) executeLogicalOperation(op bytecode.Opcode) error {
 	right := vm.pop()
 	left := vm.pop()
 
-	leftType := left.Type()
-	rightType := right.Type()
-
-	if leftType == object.BOOLEAN_OBJ && rightType == object.BOOLEAN_OBJ {
-		return vm.executeLogicalBooleanOperation(op, left, right)
-	}
-
-	return fmt.Errorf("unsupported types for logical operation: %s %s", leftType, rightType)
-}
-
-func (vm *VM) executeLogicalBooleanOperation(op bytecode.Opcode, left object.Object, right object.Object) error {
-	leftValue := left.(*object.Boolean).Value
-	rightValue := right.(*object.Boolean).Value
-
-	switch op {
-	case bytecode.OpAnd:
-		return vm.push(nativeBoolToBooleanObject(leftValue && rightValue))
-	case bytecode.OpOr:
-		return vm.push(nativeBoolToBooleanObject(leftValue || rightValue))
-	default:
-		return fmt.Errorf("unknown logical boolean operator: %d", op)
+	result, err := object.LogicalOperation(binaryOperators[op], left, right)
+	if err != nil {
+		return err
 	}
+	return vm.push(result)
 }
 
 func (vm *VM) executeComparison(op bytecode.Opcode) error {
 	right := vm.pop()
 	left := vm.pop()
 
-	leftType := left.Type()
-	rightType := right.Type()
-
-	if object.IsNumerical(leftType) && object.IsNumerical(rightType) {
-		return vm.executeNumericalComparison(op, left, right)
-	} else if leftType == object.BOOLEAN_OBJ && rightType == object.BOOLEAN_OBJ {
-		return vm.executeBooleanComparison(op, left, right)
-	} else if leftType == object.STRING_OBJ && rightType == object.STRING_OBJ {
-		return vm.executeStringComparison(op, left, right)
+	result, err := object.Comparison(vm, binaryOperators[op], left, right)
+	if err != nil {
+		return err
 	}
-
-	return fmt.Errorf("unsupported types for binary comparison: %s %s", leftType, rightType)
+	return vm.push(result)
 }
 
-func (vm *VM) executeNumericalComparison(op bytecode.Opcode, left object.Object, right object.Object) error {
-	leftValue, _, _ := object.GetNumericalValue(left)
-	rightValue, _, _ := object.GetNumericalValue(right)
+func (vm *VM) executeMembership() error {
+	container := vm.pop()
+	element := vm.pop()
 
-	switch op {
-	case bytecode.OpEqual:
-		return vm.push(nativeBoolToBooleanObject(floatEquality(leftValue, rightValue)))
-	case bytecode.OpNotEqual:
-		return vm.push(nativeBoolToBooleanObject(!floatEquality(leftValue, rightValue)))
-	case bytecode.OpLessThan:
-		return vm.push(nativeBoolToBooleanObject(leftValue < rightValue))
-	case bytecode.OpGreaterThan:
-		return vm.push(nativeBoolToBooleanObject(leftValue > rightValue))
-	case bytecode.OpLessThanOrEqualTo:
-		return vm.push(nativeBoolToBooleanObject(leftValue < rightValue || floatEquality(leftValue, rightValue)))
-	case bytecode.OpGreaterThanOrEqualTo:
-		return vm.push(nativeBoolToBooleanObject(leftValue > rightValue || floatEquality(leftValue, rightValue)))
-	default:
-		return fmt.Errorf("unknown binary numerical comparison operator: %d", op)
-	}
-}
-
-func (vm *VM) executeBooleanComparison(op bytecode.Opcode, left object.Object, right object.Object) error {
-	leftValue := left.(*object.Boolean).Value
-	rightValue := right.(*object.Boolean).Value
-	switch op {
-	case bytecode.OpEqual:
-		return vm.push(nativeBoolToBooleanObject(leftValue == rightValue))
-	case bytecode.OpNotEqual:
-		return vm.push(nativeBoolToBooleanObject(leftValue != rightValue))
-	default:
-		return fmt.Errorf("unknown binary boolean comparison operator: %d", op)
-	}
-}
-
-func (vm *VM) executeStringComparison(op bytecode.Opcode, left object.Object, right object.Object) error {
-	leftValue := left.(*object.String).Value
-	rightValue := right.(*object.String).Value
-	switch op {
-	case bytecode.OpEqual:
-		return vm.push(nativeBoolToBooleanObject(leftValue == rightValue))
-	case bytecode.OpNotEqual:
-		return vm.push(nativeBoolToBooleanObject(leftValue != rightValue))
-	default:
-		return fmt.Errorf("unknown binary string comparison operator: %d", op)
+	result, err := object.Membership(vm, element, container)
+	if err != nil {
+		return err
 	}
+	return vm.push(result)
 }
 
 func (vm *VM) executeMinusOperator() error {
 	operand := vm.pop()
 
-	if operand.Type() == object.INTEGER_OBJ {
-		return vm.push(&object.Integer{Value: -operand.(*object.Integer).Value})
-	} else if operand.Type() == object.FLOAT_OBJ {
-		return vm.push(&object.Float{Value: -operand.(*object.Float).Value})
+	result, err := object.Negation(operand)
+	if err != nil {
+		return err
 	}
-
-	return fmt.Errorf("unsupported type for negation: %s", operand.Type())
+	return vm.push(result)
 }
 
 func (vm *VM) executeBangOperator() error {
 	operand := vm.pop()
 
-	switch operand {
-	case True:
-		return vm.push(False)
-	case False:
-		return vm.push(True)
-	case Null:
-		return vm.push(True)
-	default:
-		return vm.push(False)
-	}
+	return vm.push(object.Not(operand))
 }
 
 func (vm *VM) buildArray(startIndex int, endIndex int) object.Object {
@@ -566,61 +788,30 @@ func (vm *VM) buildArray(startIndex int, endIndex int) object.Object {
 }
 
 func (vm *VM) buildHashMap(startIndex int, endIndex int) (object.Object, error) {
-	kvPairs := make(map[object.HashKey]object.HashMapPair)
+	keys := []object.Object{}
+	values := []object.Object{}
 
 	for i := startIndex; i < endIndex; i += 2 {
-		key := vm.stack[i]
-		value := vm.stack[i+1]
-
-		hashKey, ok := key.(object.Hashable)
-		if !ok {
-			return nil, fmt.Errorf("unusable as hash key: %s", key.Type())
-		}
-
-		pair := object.HashMapPair{Key: key, Value: value}
-		kvPairs[hashKey.HashKey()] = pair
+		keys = append(keys, vm.stack[i])
+		values = append(values, vm.stack[i+1])
 	}
 
-	return &object.HashMap{KVPairs: kvPairs}, nil
+	return object.NewHashMap(vm, keys, values)
 }
 
-func (vm *VM) executeIndexExpression(left object.Object, index object.Object) error {
-	switch {
-	case left.Type() == object.ARRAY_OBJ && index.Type() == object.INTEGER_OBJ:
-		return vm.executeArrayIndex(left, index)
-	case left.Type() == object.HASHMAP_OBJ:
-		return vm.executeHashMapIndex(left, index)
-	default:
-		return fmt.Errorf("index operator not supported: %s", left.Type())
-	}
-}
-
-func (vm *VM) executeArrayIndex(array object.Object, index object.Object) error {
-	arrayObject := array.(*object.Array)
-	i := index.(*object.Integer).Value
-	max := int64(len(arrayObject.Elements) - 1)
-
-	if i < 0 || i > max {
-		return vm.push(Null)
-	}
+func (vm *VM) buildSet(startIndex int, endIndex int) (object.Object, error) {
+	elements := make([]object.Object, endIndex-startIndex)
+	copy(elements, vm.stack[startIndex:endIndex])
 
-	return vm.push(arrayObject.Elements[i])
+	return object.NewSetOf(vm, elements)
 }
 
-func (vm *VM) executeHashMapIndex(hashmap object.Object, index object.Object) error {
-	hashmapObject := hashmap.(*object.HashMap)
-
-	key, ok := index.(object.Hashable)
-	if !ok {
-		return fmt.Errorf("unusable as hash key: %s", index.Type())
-	}
-
-	pair, ok := hashmapObject.KVPairs[key.HashKey()]
-	if !ok {
-		return vm.push(Null)
+func (vm *VM) executeIndexExpression(left object.Object, index object.Object) error {
+	result, err := object.Index(vm, left, index)
+	if err != nil {
+		return err
 	}
-
-	return vm.push(pair.Value)
+	return vm.push(result)
 }
 
 func (vm *VM) executeCall(numArgs int) error {
@@ -647,10 +838,128 @@ func (vm *VM) callClosure(cl *object.Closure, numArgs int) error {
 	return nil
 }
 
+// Calls the function implementing a hook of a user type with the provided arguments, running it to completion on
+// top of the current stack, and returns its result.
+func (vm *VM) CallHook(hook object.Object, args ...object.Object) (object.Object, error) {
+	returnDepth := vm.framesIndex
+
+	err := vm.push(hook)
+	if err != nil {
+		return nil, err
+	}
+	for _, arg := range args {
+		err = vm.push(arg)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = vm.executeCall(len(args))
+	if err != nil {
+		return nil, err
+	}
+
+	// Built-in functions complete immediately, whereas closures run until their frame returns
+	if vm.framesIndex > returnDepth {
+		err = vm.run(returnDepth)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return vm.pop(), nil
+}
+
+// Returns the error reporting a failed assertion, built from its description and the message and referenced
+// identifiers' (name, value) pairs on the stack.
+func (vm *VM) assertionFailure(descriptionIndex int, numReferenced int) error {
+	names := make([]string, numReferenced)
+	values := make([]object.Object, numReferenced)
+	for i := numReferenced - 1; i >= 0; i-- {
+		values[i] = vm.pop()
+		names[i] = vm.pop().(*object.String).Value
+	}
+
+	var message object.Object
+	if obj := vm.pop(); obj != Null {
+		message = obj
+	}
+
+	// The description of the assertion already starts with its location, so the error's position is left out
+	description := vm.constants[descriptionIndex].(*object.String).Value
+	return &object.RuntimeError{
+		Message:  object.FormatAssertionFailure(vm, description, message, names, values),
+		Filename: vm.filename,
+		Trace:    vm.stackTrace(),
+	}
+}
+
+// Converts an error which occurred while running the current instruction into a runtime error carrying the stack trace
+// of the active frames, unless it's already one (e.g. from a hook that failed while running on top of the current
+// frame).
+func (vm *VM) runtimeError(err error) *object.RuntimeError {
+	var runtimeErr *object.RuntimeError
+	if errors.As(err, &runtimeErr) {
+		return runtimeErr
+	}
+
+	trace := vm.stackTrace()
+	return &object.RuntimeError{Message: err.Error(), Position: trace[0].Position, Filename: vm.filename, Trace: trace}
+}
+
+// Returns the stack trace of the active frames (innermost first), along with the position of the instruction that each
+// of them is running.
+func (vm *VM) stackTrace() []object.StackFrame {
+	trace := make([]object.StackFrame, 0, vm.framesIndex)
+	for i := vm.framesIndex - 1; i >= 0; i-- {
+		frame := vm.frames[i]
+		position, _ := frame.cl.Fn.Positions.Lookup(frame.ip)
+		trace = append(trace, object.StackFrame{Function: frame.cl.Fn.Name, Position: position})
+	}
+	return trace
+}
+
+// Runs the calls deferred by the given frame (which must be the current frame) in the reverse of the order in which
+// they were deferred. All of the deferred calls run even if some of them fail, in which case the first error is
+// returned.
+func (vm *VM) runDeferredCalls(frame *Frame) error {
+	var firstErr error
+
+	for len(frame.deferred) > 0 {
+		call := frame.deferred[len(frame.deferred)-1]
+		frame.deferred = frame.deferred[:len(frame.deferred)-1]
+
+		depth := vm.framesIndex
+		_, err := vm.CallHook(call.Fn, call.Args...)
+		if err != nil {
+			vm.unwindTo(depth)
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+
+	return firstErr
+}
+
+// Unwinds the frames above the given depth after a runtime error, running the calls deferred by each of them (innermost
+// first). Errors in the deferred calls are ignored, since the original error is the one reported.
+func (vm *VM) unwindTo(depth int) {
+	for vm.framesIndex > depth {
+		frame := vm.currentFrame()
+		vm.sp = frame.basePointer + frame.cl.Fn.NumLocals
+
+		vm.runDeferredCalls(frame)
+
+		vm.popFrame()
+		vm.closeUpvalues(frame.basePointer)
+	}
+}
+
 func (vm *VM) callBuiltIn(builtin *object.BuiltIn, numArgs int) error {
 	args := vm.stack[vm.sp-numArgs : vm.sp]
 
-	result := builtin.Fn(args...)
+	result := builtin.Call(vm, args...)
 	vm.sp = vm.sp - numArgs - 1
 
 	if result != nil {
@@ -4,10 +4,13 @@ import (
 	"fmt"
 	"math"
 	"monkey/ast"
+	"monkey/bytecode"
 	"monkey/compiler"
+	"monkey/evaluator"
 	"monkey/lexer"
 	"monkey/object"
 	"monkey/parser"
+	"strings"
 	"testing"
 )
 
@@ -16,6 +19,9 @@ type vmTestCase struct {
 	expected interface{}
 }
 
+// The expected `Inspect()` output of a set, which lists elements in a deterministic order.
+type inspectedSet string
+
 func TestArithmetic(t *testing.T) {
 	tests := []vmTestCase{
 		{"1", 1},
@@ -270,6 +276,38 @@ func TestSwitchStatements(t *testing.T) {
 	runVMTests(t, tests)
 }
 
+func TestReturnsNestedInExpressions(t *testing.T) {
+	// A return statement within an expression returns from the enclosing function, like in the evaluator
+	tests := []vmTestCase{
+		{"let f = fn() { -(if (true) { return 1; }); 5 }; f()", 1},
+		{"let f = fn() { (if (true) { return 1; }) + 2; 5 }; f()", 1},
+		{"let f = fn() { 2 + (if (true) { return 1; }); 5 }; f()", 1},
+		{"let f = fn() { (if (true) { return 1; })[0]; 5 }; f()", 1},
+		{"let f = fn() { [5][if (true) { return 1; }]; 5 }; f()", 1},
+		{"let f = fn() { [2, if (true) { return 1; }]; 5 }; f()", 1},
+		{"let f = fn() { #{2, if (true) { return 1; }}; 5 }; f()", 1},
+		{"let f = fn() { {(if (true) { return 1; }): 2}; 5 }; f()", 1},
+		{"let f = fn() { {2: if (true) { return 1; }}; 5 }; f()", 1},
+		{"let f = fn() { (if (true) { return 1; })(); 5 }; f()", 1},
+		{"let f = fn() { len(if (true) { return 1; }); 5 }; f()", 1},
+		{"let f = fn() { let x = if (true) { return 1; }; 5 }; f()", 1},
+		{"let f = fn() { let x = 0; x = if (true) { return 1; }; 5 }; f()", 1},
+		{"let f = fn() { if (if (true) { return 1; }) { 2 }; 5 }; f()", 1},
+		{"let f = fn() { switch (if (true) { return 1; }) { case 1: 2; }; 5 }; f()", 1},
+		{"let f = fn() { switch (3) { case if (true) { return 1; }: 2; }; 5 }; f()", 1},
+		{"let f = fn() { while (if (true) { return 1; }) { return 2; }; 5 }; f()", 1},
+		{"let f = fn() { for (let i = if (true) { return 1; }; i < 2; i++) { 2 }; 5 }; f()", 1},
+		{"let f = fn() { for (let i = 0; if (true) { return 1; }; i++) { return 2; }; 5 }; f()", 1},
+		{"let f = fn() { for (let i = 0; i < 2; i = if (true) { return 1; }) { 2 }; 5 }; f()", 1},
+		{"let f = fn() { defer (if (true) { return 1; })(); 5 }; f()", 1},
+		{"let f = fn() { defer len(if (true) { return 1; }); 5 }; f()", 1},
+		{"let f = fn() { assert if (true) { return 1; }; 5 }; f()", 1},
+		{"let f = fn() { assert false, if (true) { return 1; }; 5 }; f()", 1},
+	}
+
+	runVMTests(t, tests)
+}
+
 func TestWhileLoops(t *testing.T) {
 	tests := []vmTestCase{
 		{"let x = 0; while (false) { x = x + 1; }; x;", 0},
@@ -286,6 +324,7 @@ func TestWhileLoops(t *testing.T) {
 		{"let arr = [1, 2, 3]; let i = 0; while (i < len(arr)) { puts(arr[i]); i++ }; i;", 3},
 		{"let arr = [1, 2, 3]; let i = len(arr) - 1; while (i >= 0) { puts(arr[i]); i--; }; i;", -1},
 		{"let arr = [1, 2, 3, 4, 5]; let l = 0; let r = len(arr) - 1; while (l < r) { puts(arr[l], arr[r]); l = l + 1; r = r - 1; }; l + r;", 4},
+		{"let x = 0; 2 * if (true) { while (x < 3) { x++; x; }; 5 };", 10},
 	}
 
 	runVMTests(t, tests)
@@ -293,12 +332,116 @@ func TestWhileLoops(t *testing.T) {
 
 func TestForLoops(t *testing.T) {
 	tests := []vmTestCase{
-		{"for (let i = 0; i < 10; i = i + 1) { i = i; }; i;", 10},
-		{"for (let i = 0; i < 10; i++) { i = i; }; i;", 10},
-		{"for (let i = 0; i < 10; i++;) { i = i; }; i;", 10},
+		{"let x = 0; for (let i = 0; i < 10; i = i + 1) { x = i; }; x;", 9},
+		{"let x = 0; for (let i = 0; i < 10; i++) { x = i; }; x;", 9},
+		{"let x = 0; for (let i = 0; i < 10; i++;) { x = i; }; x;", 9},
 		{"let arr = [1, 2, 3]; let sum = 0; for (let i = 0; i < len(arr); i = i + 1) { sum = sum + arr[i]; }; sum;", 6},
 		{"let i = 0; let arr = []; for (let j = 0; j < len(arr); j = j + 1) { i = i + 1; }; i;", 0},
 		{"let i = 0; let arr = [10, 15, 20, 25, 30]; for (let j = 0; j < len(arr); j = j + 1) { i = i + 1; }; i;", 5},
+		{"2 * if (true) { for (let i = 0; i < 3; i++) { i; }; 5 };", 10},
+		{"2 * if (true) { for (let i = 0; i < 3; i++) { for (let j = 0; j < 2; j++) {} }; 5 };", 10},
+	}
+
+	runVMTests(t, tests)
+}
+
+func TestLoopBodiesDiscardValues(t *testing.T) {
+	// Each iteration's body leaves a value, which must be popped rather than accumulating on the stack (and overflowing
+	// it, since there are more iterations than stack slots)
+	tests := []vmTestCase{
+		{"let x = 0; while (x < 5000) { x++; x; }; x", 5000},
+		{"let total = 0; for (let i = 0; i < 5000; i++) { total += i; i }; total", 12497500},
+		{"let f = fn() { let n = 0; while (n < 5000) { n = n + 1; [n]; }; n }; f()", 5000},
+		{"let x = 0; [x, if (true) { while (x < 3000) { x++; x }; x }]", []int{0, 3000}},
+	}
+
+	runVMTests(t, tests)
+
+	for _, test := range tests {
+		program := parse(test.input)
+		comp := compiler.NewCompiler()
+		if err := comp.Compile(program); err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		compiled := comp.Bytecode()
+		vm := NewVM(compiled)
+		if err := vm.Run(); err != nil {
+			t.Fatalf("VM error: %s", err)
+		}
+		// Only the slots reserved for the main frame's locals remain
+		if vm.sp != compiled.NumLocals {
+			t.Errorf("stack not empty after running %q. expected sp=%d, got=%d", test.input, compiled.NumLocals, vm.sp)
+		}
+	}
+}
+
+func TestBlockScopes(t *testing.T) {
+	tests := []vmTestCase{
+		{"if (true) { let x = 1; }", Null},
+		{"let x = 1; if (true) { let x = 2; x }", 2},
+		{"let x = 1; if (true) { let x = 2; }; x", 1},
+		{"let x = 1; if (true) { x = 2; }; x", 2},
+		{"let x = 1; if (false) { 0 } else { let x = 3; x = x + 1; x }", 4},
+		{"let sum = 0; for (let i = 0; i < 3; i++) { sum += i; }; for (let i = 0; i < 3; i++) { sum += i; }; sum", 6},
+		{"let n = 0; while (n < 3) { let step = 1; n += step; }; n", 3},
+		{
+			input: `
+			let f = fn(a) {
+				if (a > 0) {
+					let b = a * 2;
+					b
+				} else {
+					let c = a * 3;
+					c
+				}
+			};
+			[f(1), f(-1)]
+			`,
+			expected: []int{2, -3},
+		},
+		{
+			input: `
+			let f = fn() {
+				let total = 0;
+				for (let i = 0; i < 3; i++) {
+					let j = i + 1;
+					total += j;
+				}
+				for (let k = 0; k < 2; k++) {
+					let m = 10;
+					total += m;
+				}
+				total
+			};
+			f()
+			`,
+			expected: 26,
+		},
+		{
+			input: `
+			let makers = [];
+			for (let i = 0; i < 3; i++) {
+				let captured = i * 10;
+				makers = append(makers, fn() { captured });
+			};
+			[makers[0](), makers[1](), makers[2]()]
+			`,
+			expected: []int{0, 10, 20},
+		},
+	}
+
+	runVMTests(t, tests)
+}
+
+func TestShadowingDeclarations(t *testing.T) {
+	tests := []vmTestCase{
+		// The value of a declaration refers to the variable being shadowed, not to the one being declared
+		{"let x = 1; if (true) { let x = x + 1; x }", 2},
+		{"let x = 1; let f = fn() { let x = x * 10; x }; f() + x", 11},
+		{"const c = 2; let f = fn() { const c = c + 1; c }; f() + c", 5},
+		{"let x = 3; let f = fn() { let g = fn() { let x = x - 1; x }; g() }; f()", 2},
+		{"let n = 1; for (let i = 0; i < 2; i++) { let n = n + i; n }; n", 1},
 	}
 
 	runVMTests(t, tests)
@@ -510,6 +653,52 @@ func TestHashMapLiterals(t *testing.T) {
 	runVMTests(t, tests)
 }
 
+func TestHashMapLiteralOrder(t *testing.T) {
+	tests := []vmTestCase{
+		// Keys & values are evaluated in the order in which they appear in the source code
+		{
+			`let order = []; let f = fn(x) { order = append(order, x); x };
+			{f(3): f(4), f(1): f(2), f(5): f(6)}; order`,
+			[]int{3, 4, 1, 2, 5, 6},
+		},
+		// The last of several equal keys wins
+		{`let h = {"a": 1, "b": 2, "a": 3}; h["a"]`, 3},
+		{`let h = {1: "x", 2: "y", 1: 5}; h[1]`, 5},
+	}
+
+	runVMTests(t, tests)
+}
+
+func TestSetLiterals(t *testing.T) {
+	tests := []vmTestCase{
+		{"#{}", inspectedSet("#{}")},
+		{"#{3, 1, 2}", inspectedSet("#{1, 2, 3}")},
+		{"#{1, 1, 1 + 1}", inspectedSet("#{1, 2}")},
+		{`#{"b", true, 2, "a", false, 1}`, inspectedSet(`#{false, true, 1, 2, a, b}`)},
+		{"#{1, 2} | #{2, 3}", inspectedSet("#{1, 2, 3}")},
+		{"#{1, 2} & #{2, 3}", inspectedSet("#{2}")},
+		{"#{1, 2} - #{2, 3}", inspectedSet("#{1}")},
+		{"#{1, 2, 3} - #{1} | #{4} & #{4, 5}", inspectedSet("#{2, 3, 4}")},
+	}
+
+	runVMTests(t, tests)
+}
+
+func TestMembership(t *testing.T) {
+	tests := []vmTestCase{
+		{"1 in #{1, 2}", true},
+		{"3 in #{1, 2}", false},
+		{`"a" in #{"a"}`, true},
+		{"1 + 1 in #{1, 2}", true},
+		{"1 in #{}", false},
+		{`"k" in {"k": 1}`, true},
+		{`"v" in {"k": "v"}`, false},
+		{"let s = #{1, 2}; 2 in s | #{3}", true},
+	}
+
+	runVMTests(t, tests)
+}
+
 func TestIndexExpressions(t *testing.T) {
 	tests := []vmTestCase{
 		{"[1, 2, 3][1]", 2},
@@ -522,6 +711,7 @@ func TestIndexExpressions(t *testing.T) {
 		{"{1: 1, 2: 2}[2]", 2},
 		{"{1: 1}[0]", Null},
 		{"{}[0]", Null},
+		{"{\"a\": 1, \"b\": 2, \"a\": 3}[\"a\"]", 3},
 	}
 
 	runVMTests(t, tests)
@@ -583,6 +773,14 @@ func TestCallingFunctionsWithoutArguments(t *testing.T) {
 			`,
 			expected: 99,
 		},
+		{
+			input: `
+			let x = 1;
+			if (x > 0) { return 5; };
+			10;
+			`,
+			expected: 5,
+		},
 	}
 
 	runVMTests(t, tests)
@@ -613,6 +811,41 @@ func TestFirstClassFunctions(t *testing.T) {
 	runVMTests(t, tests)
 }
 
+func TestPipelinesAndArrowFunctions(t *testing.T) {
+	tests := []vmTestCase{
+		{
+			input:    `let double = (x) => x * 2; double(21);`,
+			expected: 42,
+		},
+		{
+			input:    `let add = (x, y) => { x + y }; add(1, 2);`,
+			expected: 3,
+		},
+		{
+			input:    `(() => 7)()`,
+			expected: 7,
+		},
+		{
+			input:    `let inc = (x) => x + 1; 5 |> inc |> inc;`,
+			expected: 7,
+		},
+		{
+			input:    `let sub = (x, y) => x - y; 10 |> sub(3);`,
+			expected: 7,
+		},
+		{
+			input:    `[1, 2, 3] |> append(4) |> sum`,
+			expected: 10,
+		},
+		{
+			input:    `let adder = (x) => (y) => x + y; 2 |> adder(3)()`,
+			expected: 5,
+		},
+	}
+
+	runVMTests(t, tests)
+}
+
 func TestCallingFunctionsWithBindings(t *testing.T) {
 	tests := []vmTestCase{
 		{
@@ -743,19 +976,19 @@ func TestCallingFunctionsWithWrongArguments(t *testing.T) {
 			let identity = fn(a) { a; };
 			identity(42, 5);
 			`,
-			expected: `wrong number of arguments: expected=1, got=2`,
+			expected: `line 3, column 3: wrong number of arguments: expected=1, got=2`,
 		},
 		{
 			input:    `fn() { 1; }(1)`,
-			expected: `wrong number of arguments: expected=0, got=1`,
+			expected: `line 1, column 0: wrong number of arguments: expected=0, got=1`,
 		},
 		{
 			input:    `fn(a) { a; }()`,
-			expected: `wrong number of arguments: expected=1, got=0`,
+			expected: `line 1, column 0: wrong number of arguments: expected=1, got=0`,
 		},
 		{
 			input:    `fn(a, b) { a + b; }(1)`,
-			expected: `wrong number of arguments: expected=2, got=1`,
+			expected: `line 1, column 0: wrong number of arguments: expected=2, got=1`,
 		},
 	}
 
@@ -859,6 +1092,678 @@ func TestClosures(t *testing.T) {
 	runVMTests(t, tests)
 }
 
+func TestUpvalues(t *testing.T) {
+	tests := []vmTestCase{
+		{
+			input: `
+			let newCounter = fn() {
+				let counter = 0;
+				fn() { counter = counter + 1; counter }
+			};
+			let counter = newCounter();
+			counter();
+			counter();
+			counter();
+			`,
+			expected: 3,
+		},
+		{
+			input: `
+			let count = 0;
+			let increment = fn() { count += 1; };
+			increment();
+			increment();
+			count;
+			`,
+			expected: 2,
+		},
+		{
+			input: `
+			let f = fn() {
+				let x = 1;
+				let get = fn() { x };
+				x = 2;
+				get()
+			};
+			f();
+			`,
+			expected: 2,
+		},
+		{
+			input: `
+			let f = fn() {
+				let x = 0;
+				let inc = fn() { x++; };
+				let get = fn() { x };
+				inc();
+				inc();
+				[x, get()]
+			};
+			f();
+			`,
+			expected: []int{2, 2},
+		},
+		{
+			input: `
+			let outer = fn() {
+				let x = 0;
+				let middle = fn() {
+					fn() { x = x + 10; x }
+				};
+				let inner = middle();
+				inner();
+				inner();
+				x
+			};
+			outer();
+			`,
+			expected: 20,
+		},
+		{
+			input: `
+			let makePair = fn() {
+				let value = 1;
+				[fn() { value }, fn(v) { value = v; }]
+			};
+			let pair = makePair();
+			pair[1](42);
+			pair[0]();
+			`,
+			expected: 42,
+		},
+		{
+			input: `
+			let fns = [];
+			let i = 0;
+			while (i < 3) {
+				let j = i;
+				fns = append(fns, fn() { j = j * 2; j });
+				i++;
+			};
+			[fns[0](), fns[1](), fns[2](), fns[2]()]
+			`,
+			expected: []int{0, 2, 4, 8},
+		},
+		{
+			input: `
+			let f = fn() {
+				let getters = [];
+				for (let i = 0; i < 3; i++) {
+					let captured = i;
+					getters = append(getters, fn() { captured });
+				}
+				getters
+			};
+			let getters = f();
+			[getters[0](), getters[1](), getters[2]()]
+			`,
+			expected: []int{0, 1, 2},
+		},
+		{
+			input: `
+			let wrapper = fn() {
+				let countDown = fn(x) {
+					let next = fn() { countDown(x - 1) };
+					if (x == 0) { return "done"; }
+					next()
+				};
+				countDown(3)
+			};
+			wrapper();
+			`,
+			expected: "done",
+		},
+	}
+
+	runVMTests(t, tests)
+}
+
+func TestFunctionDeclarations(t *testing.T) {
+	tests := []vmTestCase{
+		{"fn add(a, b) { a + b } add(1, 2)", 3},
+		{"let result = double(21); fn double(x) { x * 2 } result", 42},
+		{"fn fact(n) { if (n <= 1) { return 1; } n * fact(n - 1) } fact(5)", 120},
+		{
+			input: `
+			fn isEven(n) { if (n == 0) { return true; } isOdd(n - 1) }
+			fn isOdd(n) { if (n == 0) { return false; } isEven(n - 1) }
+			isEven(10) && isOdd(7) && !isEven(3)
+			`,
+			expected: true,
+		},
+		{
+			input: `
+			let parity = fn(n) {
+				let result = isEven(n);
+				fn isEven(n) { if (n == 0) { return "even"; } isOdd(n - 1) }
+				fn isOdd(n) { if (n == 0) { return "odd"; } isEven(n - 1) }
+				result
+			};
+			parity(5);
+			`,
+			expected: "odd",
+		},
+		{
+			input: `
+			let x = 0;
+			if (true) {
+				x = triple(3);
+				fn triple(n) { n * 3 }
+			};
+			x;
+			`,
+			expected: 9,
+		},
+		{"if (true) { 1; fn f() { 2 } }", 1},
+	}
+
+	runVMTests(t, tests)
+}
+
+func TestFunctionDeclarationsReferringToVariables(t *testing.T) {
+	tests := []vmTestCase{
+		{"let x = 5; fn f() { x + 1 } f()", 6},
+		{"let g = fn() { let y = 10; fn h() { y * 2 } h() }; g()", 20},
+		{"if (true) { const z = 3; fn k() { z * 3 } k() }", 9},
+		{"let g = fn() { if (true) { let y = 4; fn h() { y + 1 } h() } }; g()", 5},
+		{"let g = fn() { fn next() { count += 1; count } let count = 0; [next(), next()] }; g()", []int{1, 2}},
+		{"let r = []; for (let i = 0; i < 3; i++) { fn f() { v * 2 } let v = i; r = append(r, f()); }; r", []int{0, 2, 4}},
+		{"let x = 1; let g = fn() { let a = x; fn f() { x } let x = 2; [a, f()] }; g()", []int{1, 2}},
+	}
+
+	runVMTests(t, tests)
+}
+
+func TestFunctionDeclarationsReadingUndeclaredVariables(t *testing.T) {
+	tests := []struct {
+		input         string
+		expectedError string
+	}{
+		{"fn f() { x } f(); let x = 1;", "line 1, column 9: undefined variable: x"},
+		{"let g = fn() { fn f() { y + 1 } let z = f(); let y = 1; z }; g()", "line 1, column 24: undefined variable: y"},
+		{
+			// The slot of the variable still holds its value from the previous iteration
+			"for (let i = 0; i < 2; i++) { fn f() { v } if (i == 1) { f() } let v = i; }",
+			"line 1, column 39: undefined variable: v",
+		},
+	}
+
+	for _, test := range tests {
+		program := parse(test.input)
+
+		compiler := compiler.NewCompiler()
+		err := compiler.Compile(program)
+		if err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		vm := NewVM(compiler.Bytecode())
+		err = vm.Run()
+		if err == nil {
+			t.Fatalf("expected VM error for input %q, got none", test.input)
+		}
+
+		if err.Error() != test.expectedError {
+			t.Errorf("wrong VM error. expected=%q, got=%q", test.expectedError, err.Error())
+		}
+	}
+}
+
+func TestDeferStatements(t *testing.T) {
+	record := `let log = []; let record = fn(x) { log = append(log, x); };`
+
+	tests := []vmTestCase{
+		{
+			record + `
+			let f = fn() { defer record(1); defer record(2); record(0); 10 };
+			let result = f();
+			[result] + log
+			`,
+			[]int{10, 0, 2, 1},
+		},
+		{
+			record + `
+			let f = fn(n) {
+				defer record(n);
+				if (n > 0) { return n * 10; }
+				record(0);
+				0
+			};
+			[f(5), f(0)] + log
+			`,
+			[]int{50, 0, 5, 0, 0},
+		},
+		{
+			record + `
+			let f = fn() { let x = 1; defer record(x); x = 2; record(x); };
+			f();
+			log
+			`,
+			[]int{2, 1},
+		},
+		{
+			record + `
+			let f = fn() { let x = 1; defer fn() { record(x) }(); x = 2; };
+			f();
+			log
+			`,
+			[]int{2},
+		},
+		{
+			record + `
+			let f = fn() { for (let i = 0; i < 3; i++) { defer record(i); } record(3); };
+			f();
+			log
+			`,
+			[]int{3, 2, 1, 0},
+		},
+		{
+			record + `
+			let inner = fn() { defer record(1); 1 };
+			let outer = fn() { defer record(2); inner() + 1 };
+			[outer()] + log
+			`,
+			[]int{2, 1, 2},
+		},
+		{
+			record + `
+			let t = {"__len__": fn(t) { defer record(1); 7 }};
+			[len(t)] + log
+			`,
+			[]int{7, 1},
+		},
+		{`let f = fn() { defer puts("done"); 5 }; f()`, 5},
+	}
+
+	runVMTests(t, tests)
+}
+
+func TestDeferStatementErrors(t *testing.T) {
+	tests := []struct {
+		input         string
+		expectedError string
+		expectedLog   []int
+	}{
+		{
+			`let f = fn() { defer record(1); defer record(2); 1 + true }; f()`,
+			"line 1, column 110: unsupported types for binary operation: INTEGER BOOLEAN",
+			[]int{2, 1},
+		},
+		{
+			`
+			let inner = fn() { defer record(1); -true };
+			let outer = fn() { defer record(2); inner() };
+			defer record(3);
+			outer();
+			`,
+			"line 2, column 39: unsupported type for negation: BOOLEAN",
+			[]int{1, 2, 3},
+		},
+		{
+			`let f = fn() { defer record(1); defer fn() { 1 + true }(); defer record(2); 5 }; f()`,
+			"line 1, column 106: unsupported types for binary operation: INTEGER BOOLEAN",
+			[]int{2, 1},
+		},
+		{
+			`let f = fn() { defer fn() { -true }(); 1 + true }; f()`,
+			"line 1, column 100: unsupported types for binary operation: INTEGER BOOLEAN",
+			[]int{},
+		},
+		{
+			`defer record(1); defer 5(); record(0);`,
+			"attempted to call non-closure and non-builtin",
+			[]int{0, 1},
+		},
+	}
+
+	for _, test := range tests {
+		program := parse(`let log = []; let record = fn(x) { log = append(log, x); };` + test.input)
+
+		compiler := compiler.NewCompiler()
+		err := compiler.Compile(program)
+		if err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		vm := NewVM(compiler.Bytecode())
+		err = vm.Run()
+		if err == nil {
+			t.Fatalf("expected VM error for input %q, got none", test.input)
+		}
+
+		if err.Error() != test.expectedError {
+			t.Errorf("wrong VM error. expected=%q, got=%q", test.expectedError, err.Error())
+		}
+
+		testExpectedObject(t, test.expectedLog, vm.globals[0])
+	}
+}
+
+func TestAssertStatements(t *testing.T) {
+	tests := []vmTestCase{
+		{`let x = 5; assert x > 0; x`, 5},
+		{`let f = fn(x) { assert x > 0, "x must be positive"; x * 2 }; f(3)`, 6},
+		{`let f = fn() { assert true }; f()`, Null},
+		{`if (true) { assert 1 }`, Null},
+	}
+
+	runVMTests(t, tests)
+}
+
+func TestAssertStatementErrors(t *testing.T) {
+	tests := []struct {
+		input         string
+		expectedError string
+	}{
+		{`assert false`, "main.mo:1:0: assertion failed: false"},
+		{
+			`let x = -1; assert x > 0, "x must be positive";`,
+			"main.mo:1:12: assertion failed: (x > 0): x must be positive (where x = -1)",
+		},
+		{
+			`let xs = [1, 2]; let check = fn(limit) {
+				assert len(xs) < limit && limit > 0, "limit " + "exceeded";
+			}; check(2)`,
+			"main.mo:2:4: assertion failed: ((len(xs) < limit) && (limit > 0)): limit exceeded (where xs = [1, 2], limit = 2)",
+		},
+		{
+			`let t = {"__str__": fn(t) { "T" }}; assert len([t]) == 2, t`,
+			"main.mo:1:36: assertion failed: (len([t]) == 2): T (where t = T)",
+		},
+		{`fn f() { assert 1 > 2 } f()`, "main.mo:1:9: assertion failed: (1 > 2)"},
+	}
+
+	for _, test := range tests {
+		program := parse(test.input)
+
+		comp := compiler.NewCompiler()
+		comp.SetOptions(compiler.Options{Filename: "main.mo"})
+		err := comp.Compile(program)
+		if err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		vm := NewVM(comp.Bytecode())
+		err = vm.Run()
+		if err == nil {
+			t.Fatalf("expected VM error for input %q, got none", test.input)
+		}
+
+		if err.Error() != test.expectedError {
+			t.Errorf("wrong VM error. expected=%q, got=%q", test.expectedError, err.Error())
+		}
+	}
+}
+
+func TestRuntimeErrorLocations(t *testing.T) {
+	tests := []struct {
+		input         string
+		expectedError string
+	}{
+		{"let x = 5;\nlet y = x / 0;", "main.mo:2:10: division by zero"},
+		{"let f = fn(n) {\n\tn + true\n};\nf(1)", "main.mo:2:3: unsupported types for binary operation: INTEGER BOOLEAN"},
+		{`fn f(s) { s - 1 } f("a")`, "main.mo:1:12: unsupported types for binary operation: STRING INTEGER"},
+		{`fn f(s) { let i = s; while (i < 3) { i++ } } f("a")`, "main.mo:1:30: unsupported types for binary comparison: STRING INTEGER"},
+		{"let t = {\"__add__\": fn(a, b) { -a }};\nt + t", "main.mo:1:31: unsupported type for negation: HASHMAP"},
+	}
+
+	for _, test := range tests {
+		for _, noOptimizations := range []bool{false, true} {
+			program := parse(test.input)
+
+			comp := compiler.NewCompiler()
+			comp.SetOptions(compiler.Options{Filename: "main.mo", NoOptimizations: noOptimizations})
+			err := comp.Compile(program)
+			if err != nil {
+				t.Fatalf("compiler error: %s", err)
+			}
+
+			vm := NewVM(comp.Bytecode())
+			err = vm.Run()
+			if err == nil {
+				t.Fatalf("expected VM error for input %q, got none", test.input)
+			}
+
+			if err.Error() != test.expectedError {
+				t.Errorf("wrong VM error (NoOptimizations=%t). expected=%q, got=%q", noOptimizations, test.expectedError, err.Error())
+			}
+		}
+	}
+
+	// Without a filename, errors are located in the same format as those reported by the compiler
+	program := parse("let x = 1;\nx / 0")
+	comp := compiler.NewCompiler()
+	err := comp.Compile(program)
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	err = NewVM(comp.Bytecode()).Run()
+	if err == nil || err.Error() != "line 2, column 2: division by zero" {
+		t.Errorf("wrong VM error. expected=%q, got=%v", "line 2, column 2: division by zero", err)
+	}
+}
+
+func TestStackTraces(t *testing.T) {
+	frame := func(function string, line, column int) object.StackFrame {
+		return object.StackFrame{Function: function, Position: bytecode.Position{Line: line, Column: column}}
+	}
+
+	tests := []struct {
+		input    string
+		expected []object.StackFrame
+	}{
+		{"1 / 0", []object.StackFrame{frame(object.MainFunctionName, 1, 2)}},
+		{
+			"let f = fn(x) {\n  x / 0\n};\nlet g = fn(y) {\n  1 + f(y)\n};\ng(3);",
+			[]object.StackFrame{frame("f", 2, 4), frame("g", 5, 6), frame(object.MainFunctionName, 7, 0)},
+		},
+		{
+			"fn r(n) { if (n == 0) { -true } else { r(n - 1) } }\nr(2)",
+			[]object.StackFrame{frame("r", 1, 24), frame("r", 1, 39), frame("r", 1, 39), frame(object.MainFunctionName, 2, 0)},
+		},
+		{
+			"let t = {\"__add__\": fn(a, b) { -a }};\nlet h = fn() { t + t };\nh()",
+			[]object.StackFrame{frame("", 1, 31), frame("h", 2, 17), frame(object.MainFunctionName, 3, 0)},
+		},
+		{"fn f(a) { a }\nf(1, 2)", []object.StackFrame{frame(object.MainFunctionName, 2, 0)}},
+		{"let x = 1;\nassert x > 1", []object.StackFrame{frame(object.MainFunctionName, 2, 0)}},
+	}
+
+	for _, test := range tests {
+		program := parse(test.input)
+
+		comp := compiler.NewCompiler()
+		comp.SetOptions(compiler.Options{Filename: "main.mo"})
+		err := comp.Compile(program)
+		if err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		vm := NewVM(comp.Bytecode())
+		err = vm.Run()
+
+		runtimeErr, ok := err.(*object.RuntimeError)
+		if !ok {
+			t.Fatalf("expected a runtime error for input %q, got=%T (%v)", test.input, err, err)
+		}
+		if runtimeErr.Filename != "main.mo" {
+			t.Errorf("wrong filename. expected=%q, got=%q", "main.mo", runtimeErr.Filename)
+		}
+
+		if len(runtimeErr.Trace) != len(test.expected) {
+			t.Fatalf("wrong stack trace for input %q.\nexpected=%v\ngot=%v", test.input, test.expected, runtimeErr.Trace)
+		}
+		for i, frame := range test.expected {
+			if runtimeErr.Trace[i] != frame {
+				t.Errorf("wrong frame %d for input %q. expected=%v, got=%v", i, test.input, frame, runtimeErr.Trace[i])
+			}
+		}
+	}
+}
+
+func TestSerializedBytecode(t *testing.T) {
+	input := `
+	let point = fn(x, y) { {"x": x, "y": y, "__add__": fn(a, b) { point(a["x"] + b["x"], a["y"] + b["y"]) }} };
+	fn sum(n) { let total = 0; for (let i = 0; i < n; i++) { total += i }; total }
+	let p = point(1.5, 2) + point(2, 3);
+	let s = "mon" + "key";
+	if (s == "monkey") { sum(10) + p["x"] + p["y"] }
+	`
+
+	program := parse(input)
+	comp := compiler.NewCompiler()
+	comp.SetOptions(compiler.Options{Filename: "main.mo"})
+	err := comp.Compile(program)
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	data, err := comp.Bytecode().Serialize()
+	if err != nil {
+		t.Fatalf("serialization error: %s", err)
+	}
+	loaded, err := compiler.DeserializeBytecode(data)
+	if err != nil {
+		t.Fatalf("deserialization error: %s", err)
+	}
+
+	vm := NewVM(loaded)
+	err = vm.Run()
+	if err != nil {
+		t.Fatalf("vm error: %s", err)
+	}
+	testExpectedObject(t, 53.5, vm.LastPoppedStackElem())
+
+	// Errors in a loaded program are still located in the original source
+	comp = compiler.NewCompiler()
+	comp.SetOptions(compiler.Options{Filename: "main.mo"})
+	err = comp.Compile(parse("let f = fn(x) {\n\tx / 0\n};\nf(1)"))
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	data, err = comp.Bytecode().Serialize()
+	if err != nil {
+		t.Fatalf("serialization error: %s", err)
+	}
+	loaded, err = compiler.DeserializeBytecode(data)
+	if err != nil {
+		t.Fatalf("deserialization error: %s", err)
+	}
+
+	err = NewVM(loaded).Run()
+	runtimeErr, ok := err.(*object.RuntimeError)
+	if !ok {
+		t.Fatalf("expected a runtime error. got=%T (%v)", err, err)
+	}
+	if runtimeErr.Error() != "main.mo:2:3: division by zero" || runtimeErr.Trace[0].Function != "f" {
+		t.Errorf("wrong runtime error. got=%q in %v", runtimeErr.Error(), runtimeErr.Trace)
+	}
+}
+
+func TestUserTypeHooks(t *testing.T) {
+	vector := `
+	let vector = fn(x, y) {
+		{
+			"x": x,
+			"y": y,
+			"__add__": fn(a, b) { vector(a["x"] + b["x"], a["y"] + b["y"]) },
+			"__mul__": fn(v, k) { vector(v["x"] * k, v["y"] * k) },
+			"__eq__": fn(a, b) { (a["x"] == b["x"]) && (a["y"] == b["y"]) },
+			"__lt__": fn(a, b) { a["x"] * a["x"] + a["y"] * a["y"] < b["x"] * b["x"] + b["y"] * b["y"] },
+			"__len__": fn(v) { 2 },
+			"__index__": fn(v, i) { if (i == 0) { v["x"] } else { v["y"] } },
+			"__hash__": fn(v) { v["x"] * 1000 + v["y"] },
+		}
+	};
+	`
+
+	tests := []vmTestCase{
+		{vector + `(vector(1, 2) + vector(3, 4))["x"]`, 4},
+		{vector + `(vector(1, 2) * 3)["y"]`, 6},
+		{vector + `vector(1, 2) + vector(3, 4) == vector(4, 6)`, true},
+		{vector + `vector(1, 2) != vector(1, 2)`, false},
+		{vector + `vector(1, 1) < vector(2, 2)`, true},
+		{vector + `vector(1, 1) > vector(2, 2)`, false},
+		{vector + `vector(1, 1) <= vector(1, 1)`, true},
+		{vector + `vector(1, 1) >= vector(2, 2)`, false},
+		{vector + `len(vector(5, 6))`, 2},
+		{vector + `[vector(5, 6)[0], vector(5, 6)[1]]`, []int{5, 6}},
+		{vector + `let lookup = {vector(1, 2): "a", vector(3, 4): "b"}; lookup[vector(3, 4)]`, "b"},
+		{vector + `len(#{vector(1, 2), vector(1, 2), vector(2, 1)})`, 2},
+		{vector + `vector(1, 2) in #{vector(1, 2)}`, true},
+		{vector + `let total = vector(0, 0); for (let i = 1; i <= 3; i++) { total = total + vector(i, i); }; total["x"]`, 6},
+	}
+
+	runVMTests(t, tests)
+}
+
+func TestUserTypeHookErrors(t *testing.T) {
+	tests := []struct {
+		input         string
+		expectedError string
+	}{
+		{`{"a": 1} + {"b": 2}`, "line 1, column 9: unsupported types for binary operation: HASHMAP HASHMAP"},
+		{`let t = {"__add__": fn(a) { a }}; t + t`, "line 1, column 36: wrong number of arguments: expected=1, got=2"},
+		{`let t = {"__hash__": fn(t) { [] }}; {t: 1}`, "line 1, column 36: __hash__ must return a hashable value, got ARRAY"},
+		{`let t = {"__eq__": 5}; t == t`, "line 1, column 25: attempted to call non-closure and non-builtin"},
+	}
+
+	for _, test := range tests {
+		program := parse(test.input)
+
+		compiler := compiler.NewCompiler()
+		err := compiler.Compile(program)
+		if err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		vm := NewVM(compiler.Bytecode())
+		err = vm.Run()
+		if err == nil {
+			t.Fatalf("expected VM error for input %q, got none", test.input)
+		}
+
+		if err.Error() != test.expectedError {
+			t.Errorf("wrong VM error. expected=%q, got=%q", test.expectedError, err.Error())
+		}
+	}
+}
+
+func TestUserTypeInspect(t *testing.T) {
+	input := `
+	let point = fn(x, name) {
+		{"x": x, "__hash__": fn(p) { p["x"] }, "__str__": fn(p) { "Point(" + name + ")" }}
+	};
+	[point(1, "a"), #{point(2, "b")}]
+	`
+
+	program := parse(input)
+
+	compiler := compiler.NewCompiler()
+	err := compiler.Compile(program)
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	vm := NewVM(compiler.Bytecode())
+	err = vm.Run()
+	if err != nil {
+		t.Fatalf("VM error: %s", err)
+	}
+
+	inspected, err := object.InspectWithHooks(vm, vm.LastPoppedStackElem())
+	if err != nil {
+		t.Fatalf("error inspecting result: %s", err)
+	}
+
+	expected := "[Point(a), #{Point(b)}]"
+	if inspected != expected {
+		t.Errorf("wrong inspected result. expected=%q, got=%q", expected, inspected)
+	}
+}
+
 func TestRecursiveFunctions(t *testing.T) {
 	tests := []vmTestCase{
 		{
@@ -935,6 +1840,164 @@ func TestRecursiveFibonacci(t *testing.T) {
 	runVMTests(t, tests)
 }
 
+// Runs programs which exceed the limits of the regular operand widths, so that their instructions need to be wide.
+func TestSuperinstructions(t *testing.T) {
+	tests := []vmTestCase{
+		{"fn() { let i = 0; i++; i += 2; i }()", 3},
+		{"fn() { let x = 1.5; x++; x }()", 2.5},
+		{`fn() { let s = "a"; s += "b"; s }()`, "ab"},
+		{"fn(a, b, c, d, e) { a + b + c + d + e }(1, 2, 3, 4, 5)", 15},
+		{"fn(x) { x - 1 }(10)", 9},
+		{"fn(x) { x + 0.5 }(1)", 1.5},
+		{"fn(n) { let total = 0; for (let i = 0; i < n; i++) { total += i; }; total }(5)", 10},
+		{"fn(x) { if (x < 1.5) { 1 } else { 2 } }(1)", 1},
+		{`fn(s) { if (s == "a") { 1 } else { 2 } }("b")`, 2},
+		{`let v = fn(n) { {"n": n, "__lt__": fn(a, b) { a["n"] < b["n"] }} }; fn(a, b) { if (a < b) { 1 } else { 2 } }(v(1), v(2))`, 1},
+		{"let add = fn(a, b) { a + b }; add(1, add(2, 3))", 6},
+		{"const add = fn(a, b) { a + b }; add(add(1, 2), 3)", 6},
+		// A reassigned function is read before its arguments are evaluated
+		{"let f = fn(x) { x }; let g = fn() { f = fn(x) { 0 }; 1 }; f(g())", 1},
+		// The integer fast paths compute on float64 values, like the general operations (and the evaluator)
+		{"fn(x) { x + 1 }(9007199254740993)", 9007199254740992},
+		{"fn(x) { let y = x; y++; y }(9007199254740993)", 9007199254740992},
+		{"fn(x) { if (x == 9007199254740992) { 1 } else { 2 } }(9007199254740993)", 1},
+		{"let size = len; size([1, 2])", 2},
+	}
+
+	runVMTests(t, tests)
+}
+
+func TestWideOperands(t *testing.T) {
+	increments := strings.Repeat("a = a + 1; ", 10000)
+
+	globals := []string{}
+	for i := 0; i < 70000; i++ {
+		globals = append(globals, fmt.Sprintf("let %s = %d;", wideTestIdentifier("g", i), i))
+	}
+
+	params := []string{}
+	args := []string{}
+	locals := []string{}
+	for i := 0; i < 300; i++ {
+		params = append(params, wideTestIdentifier("p", i))
+		args = append(args, fmt.Sprint(i))
+		locals = append(locals, fmt.Sprintf("let %s = %d;", wideTestIdentifier("l", i), i))
+	}
+
+	tests := []vmTestCase{
+		// Jumps to positions beyond 2 bytes
+		{fmt.Sprintf("let x = 1; if (x > 0) { let a = 0; %s a } else { 0 }", increments), 10000},
+		{fmt.Sprintf("let x = 0; if (x > 0) { let a = 0; %s a } else { 5 }", increments), 5},
+		// More constants and globals than fit in 2 bytes (and than the VM has room for by default)
+		{strings.Join(globals, "\n") + wideTestIdentifier("g", 69999) + " + " + wideTestIdentifier("g", 1), 70000},
+		// More locals, arguments and upvalues than fit in 1 byte
+		{fmt.Sprintf("fn() { %s %s }()", strings.Join(locals, " "), wideTestIdentifier("l", 299)), 299},
+		{fmt.Sprintf("fn(%s) { %s }(%s)", strings.Join(params, ", "), params[299], strings.Join(args, ", ")), 299},
+		{fmt.Sprintf("fn(%s) { fn() { %s } }(%s)()", strings.Join(params, ", "), strings.Join(params, " + "), strings.Join(args, ", ")), 44850},
+	}
+
+	runVMTests(t, tests)
+}
+
+// Returns a distinct identifier for each index, since identifiers can't contain digits.
+func wideTestIdentifier(prefix string, i int) string {
+	name := ""
+	for {
+		name = string(rune('a'+i%26)) + name
+		i /= 26
+		if i == 0 {
+			return prefix + "_" + name
+		}
+	}
+}
+
+func TestMacros(t *testing.T) {
+	unless := `
+	let unless = macro(condition, consequence, alternative) {
+		quote(if (!(unquote(condition))) { unquote(consequence); } else { unquote(alternative); });
+	};
+	`
+
+	tests := []vmTestCase{
+		{unless + `unless(10 > 5, 1, 2)`, 2},
+		{unless + `unless(10 < 5, 1, 2)`, 1},
+		{unless + `let x = unless(true, 1, 2); let y = unless(false, 1, 2); [x, y]`, []int{2, 1}},
+		{unless + `let x = 0; for (let i = 0; i < 3; i++) { x = unless(i == 1, x + 10, x) }; x`, 20},
+		{unless + `let xs = []; while (len(xs) < 3) { xs = append(xs, unless(len(xs) == 0, 5, 6)) }; xs`, []int{6, 5, 5}},
+		{`let add_one = macro(x) { quote(fn() { let tmp = 1; tmp + unquote(x) }()) }; let tmp = 10; add_one(tmp)`, 11},
+		{`let total = macro(xs) { quote(sum([unquote_splice(xs)])) }; let a = 1; total([a, a + 1, a + 2])`, 6},
+		{`let double = macro(x) { quote(unquote(x) * 2) }; let f = fn(n) { double(n + 1) }; f(4)`, 10},
+		{`let eval_at_compile_time = macro() { let n = 2 + 3; quote(unquote(n) * 10) }; eval_at_compile_time()`, 50},
+	}
+
+	for _, test := range tests {
+		program := parse(test.input)
+		macroEnv := object.NewEnvironment()
+		evaluator.DefineMacros(program, macroEnv)
+		expanded, err := evaluator.ExpandMacros(program, macroEnv)
+		if err != nil {
+			t.Fatalf("macro expansion error: %s", err)
+		}
+
+		compiler := compiler.NewCompiler()
+		err = compiler.Compile(expanded)
+		if err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		vm := NewVM(compiler.Bytecode())
+		err = vm.Run()
+		if err != nil {
+			t.Fatalf("VM error: %s", err)
+		}
+
+		testExpectedObject(t, test.expected, vm.LastPoppedStackElem())
+	}
+}
+
+func TestMacrosPersistAcrossPrograms(t *testing.T) {
+	inputs := []string{
+		`let square = macro(x) { quote(unquote(x) * unquote(x)) };`,
+		`let n = square(3);`,
+		`square(n)`,
+	}
+
+	macroEnv := object.NewEnvironment()
+	symbolTable := compiler.NewSymbolTable()
+	for i, builtin := range object.BuiltIns {
+		symbolTable.DefineBuiltIn(i, builtin.Name)
+	}
+	constants := []object.Object{}
+	globals := make([]object.Object, GlobalsSize)
+
+	var result object.Object
+	for _, input := range inputs {
+		program := parse(input)
+		evaluator.DefineMacros(program, macroEnv)
+		expanded, err := evaluator.ExpandMacros(program, macroEnv)
+		if err != nil {
+			t.Fatalf("macro expansion error: %s", err)
+		}
+
+		compiler := compiler.NewCompilerWithState(symbolTable, constants)
+		err = compiler.Compile(expanded)
+		if err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+		bytecode := compiler.Bytecode()
+		constants = bytecode.Constants
+
+		vm := NewVMWithGlobalsStore(bytecode, globals)
+		err = vm.Run()
+		if err != nil {
+			t.Fatalf("VM error: %s", err)
+		}
+		result = vm.LastPoppedStackElem()
+	}
+
+	testExpectedObject(t, 81, result)
+}
+
 func runVMTests(t *testing.T, tests []vmTestCase) {
 	t.Helper()
 
@@ -1047,6 +2110,16 @@ func testExpectedObject(t *testing.T, expected interface{}, actual object.Object
 				t.Errorf("testIntegerObject failed: %s", err)
 			}
 		}
+	case inspectedSet:
+		set, ok := actual.(*object.Set)
+		if !ok {
+			t.Errorf("object is not a Set. got=%T (%+v)", actual, actual)
+			return
+		}
+
+		if set.Inspect() != string(expected) {
+			t.Errorf("set has wrong elements. expected=%s, got=%s", expected, set.Inspect())
+		}
 	case *object.Error:
 		errObj, ok := actual.(*object.Error)
 		if !ok {